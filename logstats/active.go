@@ -0,0 +1,280 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// getActiveLogFileName returns the name of the current log file, once
+// compressed - refer WithActiveCompression.
+func getActiveLogFileName(fileName string) string {
+	return fileName + CompressionGzip.Suffix()
+}
+
+// compressedLogFile is the current log file, gzip compressed as it gets
+// written. The compressor buffers the stats until flushed, as flushing
+// each write would defeat the compression of the short stat lines. The
+// gzip trailer is written once the file gets closed or rotated.
+type compressedLogFile struct {
+	f  *os.File
+	cw *countingWriter
+	zw *gzip.Writer
+	n  int // uncompressed bytes written
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+func newCompressedLogFile(f *os.File, level int) (*compressedLogFile, error) {
+	cw := &countingWriter{w: f}
+	zw, err := gzip.NewWriterLevel(cw, level)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressedLogFile{f: f, cw: cw, zw: zw}, nil
+}
+
+func (cf *compressedLogFile) Write(p []byte) (int, error) {
+	n, err := cf.zw.Write(p)
+	cf.n += n
+	return n, err
+}
+
+// Flush writes the buffered stats to the log file.
+func (cf *compressedLogFile) Flush() error {
+	return cf.zw.Flush()
+}
+
+// size returns the compressed size of the log file, short of the stats
+// buffered by the compressor.
+func (cf *compressedLogFile) size() int {
+	return cf.cw.n
+}
+
+// Close completes the gzip stream, leaving the log file open.
+func (cf *compressedLogFile) Close() error {
+	return cf.zw.Close()
+}
+
+// truncatedGzipReader reads a gzip stream which may be cut short, e.g. a
+// compressed current log file yet to be completed by its trailer. The
+// data up to the cut is returned, followed by io.EOF.
+type truncatedGzipReader struct {
+	io.ReadCloser
+}
+
+func (r truncatedGzipReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// openCompressedLogFile opens the compressed current log file of fileName
+// for writing. As a gzip stream cannot be appended to once cut short -
+// e.g. by a crash - the existing log file, if any, is recompressed into a
+// new one, along with the uncompressed current log file left behind by a
+// logger without WithActiveCompression.
+func openCompressedLogFile(fileName string, cfg config) (*compressedLogFile, error) {
+	var cf *compressedLogFile
+	err := rewriteCurrentLogFile(fileName, getActiveLogFileName(fileName), cfg,
+		func(f *os.File) (flushWriter, error) {
+			var err error
+			cf, err = newCompressedLogFile(f, cfg.compressionLevel)
+			if err != nil {
+				return nil, err
+			}
+
+			return cf, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return cf, nil
+}
+
+// openCurrentLogFile opens the current log file of fileName for writing,
+// compressed if cfg.compressActive is set. Returns the compressed log
+// file, if any, and the size of the log file.
+func openCurrentLogFile(fileName string, cfg config, repair bool) (*os.File, *compressedLogFile, int, error) {
+	if !cfg.compressActive {
+		f, sz, err := openLogFile(fileName, cfg.fileMode, cfg.dirMode, repair)
+		return f, nil, sz, err
+	}
+
+	cfg.repairOnOpen = repair
+	cf, err := openCompressedLogFile(fileName, cfg)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return cf.f, cf, cf.size(), nil
+}
+
+// decompressCurrentLogFile decompresses the compressed current log file of
+// fileName left behind by a logger with WithActiveCompression, if any, for
+// the logger without it to append to.
+func decompressCurrentLogFile(fileName string, cfg config) error {
+	_, err := os.Stat(getActiveLogFileName(fileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var f *os.File
+	err = rewriteCurrentLogFile(fileName, fileName, cfg,
+		func(file *os.File) (flushWriter, error) {
+			f = file
+			return bufio.NewWriter(file), nil
+		})
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// flushWriter is a writer buffering the data until flushed.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// rewriteCurrentLogFile writes the contents of the current log files of
+// fileName - the compressed one, followed by the uncompressed one - to
+// target, through the writer returned by newWriter, replacing them. The
+// target file is left open. The gzip header gets written by the flush, so
+// that an empty compressed log file is a valid gzip stream for the readers.
+func rewriteCurrentLogFile(fileName string, target string, cfg config,
+	newWriter func(*os.File) (flushWriter, error)) error {
+
+	err := os.MkdirAll(filepath.Dir(fileName), cfg.dirMode)
+	if err != nil {
+		return err
+	}
+
+	tmpName := target + ".tmp"
+	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	f, err := os.OpenFile(tmpName, flags, cfg.fileMode)
+	if err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	w, err := newWriter(f)
+	if err != nil {
+		return fail(err)
+	}
+
+	sources := []string{getActiveLogFileName(fileName), fileName}
+	for _, source := range sources {
+		err = copyLogFileLines(w, source, cfg.repairOnOpen)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return fail(err)
+	}
+
+	// The sources get removed once replaced, so the target must be on the
+	// disk by then.
+	err = f.Sync()
+	if err != nil {
+		return fail(err)
+	}
+
+	err = os.Rename(tmpName, target)
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, source := range sources {
+		if source == target {
+			continue
+		}
+
+		err = os.Remove(source)
+		if err != nil && !os.IsNotExist(err) {
+			f.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyLogFileLines writes the lines of the log file fname, if it exists,
+// to w. A compressed log file cut short is read up to the cut. If repair
+// is set, a trailing partial line is left out.
+func copyLogFileLines(w io.Writer, fname string, repair bool) error {
+	rc, err := openLogFileReader(fname, nil)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err == io.EOF {
+		// An empty compressed log file.
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	reader := bufio.NewReader(truncatedGzipReader{rc})
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && (err == nil || !repair) {
+			_, writeErr := w.Write(line)
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
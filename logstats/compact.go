@@ -0,0 +1,160 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// CompactPolicy configures the deduplication of the reconstructed stats by
+// CompactReconstruct, i.e. when the full stats of a type get written.
+type CompactPolicy struct {
+	// SnapshotEvery writes the full stats of a type once every
+	// SnapshotEvery stats of that type, as WithSnapshotEvery does. Zero
+	// means only the first stats of a type are written in full.
+	SnapshotEvery int
+
+	// FloatEpsilon deduplicates the float stats differing from their
+	// previous value by at most FloatEpsilon, as WithFloatEpsilon does.
+	FloatEpsilon float64
+}
+
+// CompactReconstruct reconstructs the deduplicated stats read from source
+// and deduplicates them again following policy, writing the result to
+// output, e.g. to change the deduplication granularity of a log file. It
+// is ReconstructStatFileWithOptions with ReconstructOptions.Compact set.
+func CompactReconstruct(source io.Reader, output io.Writer, policy CompactPolicy) error {
+	return ReconstructStatFileWithOptions(source, output, ReconstructOptions{Compact: &policy})
+}
+
+// statCompactor deduplicates the reconstructed stat lines. As with the
+// reconstruction, all the lines of a stat type must go to the same
+// compactor.
+type statCompactor struct {
+	policy       CompactPolicy
+	prevStatsMap map[string]map[string]interface{}
+	writeCounts  map[string]int
+}
+
+func newStatCompactor(policy CompactPolicy) *statCompactor {
+	return &statCompactor{
+		policy:       policy,
+		prevStatsMap: make(map[string]map[string]interface{}),
+		writeCounts:  make(map[string]int),
+	}
+}
+
+// compact deduplicates the reconstructed stat line against the previous
+// stats of its type. The stats are encoded with enc, or as JSON if enc is
+// nil, following the timestamp, the prefixFields fields and the stat type.
+// The lines without a stat map are returned as they are.
+func (c *statCompactor) compact(line []byte, enc Encoding, prefixFields int) ([]byte, error) {
+	var jl jsonLine
+	var statType string
+	var data, prefix []byte
+
+	switch {
+	case isJSONLine(line):
+		var err error
+		jl, err = parseJSONLine(line)
+		if err != nil {
+			return line, err
+		}
+		statType, data = jl.Type, jl.Stat
+
+	case !isValidStatLine(line):
+		return line, nil
+
+	case enc != nil:
+		var err error
+		_, statType, data, err = splitStatLine(line, prefixFields)
+		if err != nil {
+			return line, fmt.Errorf("messed up stat map")
+		}
+		prefix = line[:len(line)-len(data)]
+
+	default:
+		statStart, err := extractStatsFromLine(line)
+		if err != nil {
+			return line, err
+		}
+		statType, data = getStatNameFromSource(statStart-2, line), line[statStart:]
+		prefix = line[:statStart]
+	}
+
+	if bytes.HasPrefix(data, []byte("[")) {
+		// An array written by WriteValue, not a stat map.
+		return line, nil
+	}
+
+	if enc == nil {
+		enc = JSONEncoding{}
+	}
+
+	statMap, err := enc.Decode(data)
+	if err != nil {
+		return line, fmt.Errorf("failed to decode stats into map with err - %v", err)
+	}
+
+	prevMap, ok := c.prevStatsMap[statType]
+	if ok && c.policy.SnapshotEvery > 0 && c.writeCounts[statType] >= c.policy.SnapshotEvery {
+		// Time for a full snapshot, which records the keys removed since
+		// the previous stats, as the reconstruction merges it into them.
+		c.prevStatsMap[statType] = statMap
+		c.writeCounts[statType] = 1
+
+		fullMap, removed := withRemovedKeys(prevMap, statMap)
+		if !removed {
+			return line, nil
+		}
+
+		return c.formatLine(line, jl, prefix, statType, fullMap, enc)
+	}
+
+	if !ok {
+		c.prevStatsMap[statType] = statMap
+		c.writeCounts[statType] = 1
+		return line, nil
+	}
+	c.writeCounts[statType]++
+
+	// The stats deduplicated within the epsilon keep their logged values.
+	c.prevStatsMap[statType] = statMap
+	if c.policy.FloatEpsilon > 0 {
+		c.prevStatsMap[statType] = nextBaseline(prevMap, statMap, c.policy.FloatEpsilon)
+	}
+
+	filteredMap := make(map[string]interface{})
+	populateFilteredMap(prevMap, statMap, filteredMap, c.policy.FloatEpsilon)
+	return c.formatLine(line, jl, prefix, statType, filteredMap, enc)
+}
+
+// formatLine returns the stat line line with its stats replaced by
+// statMap, encoded with enc. The JSON Lines have a nil prefix.
+func (c *statCompactor) formatLine(line []byte, jl jsonLine, prefix []byte, statType string,
+	statMap map[string]interface{}, enc Encoding) ([]byte, error) {
+
+	encoded, err := enc.Encode(statMap)
+	if err != nil {
+		return line, fmt.Errorf("failed to compact %v with err - %v", statType, err)
+	}
+
+	if prefix == nil {
+		return formatJSONLine(jl.TS, jl.Seq, statType, encoded), nil
+	}
+
+	var ans = make([]byte, len(prefix), len(prefix)+len(encoded)+1)
+	copy(ans, prefix)
+	ans = append(ans, encoded...)
+	return ans, nil
+}
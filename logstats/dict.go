@@ -0,0 +1,187 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+)
+
+// ErrCompressionDict is returned when reading a log file compressed with a
+// preset dictionary - refer WithCompressionDict - without the dictionary,
+// or with another one.
+var ErrCompressionDict = errors.New("log file compressed with another dictionary")
+
+// The gzip extra field subfield ID flagging the deflate stream compressed
+// with a preset dictionary. The subfield data is the Adler-32 checksum of
+// the dictionary, as in the zlib header.
+const (
+	dictSubfieldID1 = 'L'
+	dictSubfieldID2 = 'D'
+)
+
+// dictID returns the ID of the dictionary, the Adler-32 checksum of dict.
+func dictID(dict []byte) uint32 {
+	return adler32.Checksum(dict)
+}
+
+// dictGzipWriter writes a gzip stream whose deflate stream is compressed
+// with a preset dictionary, flagged in the extra field of the header. As
+// the gzip format has no notion of dictionaries, the stream is read back
+// by newGzipReader only, given the dictionary.
+type dictGzipWriter struct {
+	w    io.Writer
+	fw   *flate.Writer
+	crc  hash.Hash32
+	size uint32
+}
+
+func newDictGzipWriter(w io.Writer, level int, dict []byte) (io.WriteCloser, error) {
+	fw, err := flate.NewWriterDict(w, level, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	// ID1, ID2, CM (deflate), FLG (FEXTRA), MTIME, XFL, OS (unknown),
+	// followed by the extra field with the single subfield.
+	header := []byte{0x1f, 0x8b, 8, 1 << 2, 0, 0, 0, 0, 0, 255}
+	header = binary.LittleEndian.AppendUint16(header, 8)
+	header = append(header, dictSubfieldID1, dictSubfieldID2)
+	header = binary.LittleEndian.AppendUint16(header, 4)
+	header = binary.LittleEndian.AppendUint32(header, dictID(dict))
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dictGzipWriter{w: w, fw: fw, crc: crc32.NewIEEE()}, nil
+}
+
+func (zw *dictGzipWriter) Write(p []byte) (int, error) {
+	n, err := zw.fw.Write(p)
+	zw.crc.Write(p[:n])
+	zw.size += uint32(n)
+	return n, err
+}
+
+// Close completes the gzip stream, leaving the underlying writer open.
+func (zw *dictGzipWriter) Close() error {
+	err := zw.fw.Close()
+	if err != nil {
+		return err
+	}
+
+	trailer := binary.LittleEndian.AppendUint32(nil, zw.crc.Sum32())
+	trailer = binary.LittleEndian.AppendUint32(trailer, zw.size)
+	_, err = zw.w.Write(trailer)
+	return err
+}
+
+// newGzipReader returns a reader of the gzip stream read from r, compressed
+// with the preset dictionary dict or without any. A stream compressed with
+// a dictionary other than dict - nil included - fails with
+// ErrCompressionDict.
+func newGzipReader(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	// Consumes only the header, for the deflate stream to follow.
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := getDictID(zr.Header.Extra)
+	if !ok {
+		return zr, nil
+	}
+
+	if dict == nil || dictID(dict) != id {
+		return nil, fmt.Errorf("%w: dictionary ID %08x", ErrCompressionDict, id)
+	}
+
+	return &dictGzipReader{br: br, fr: flate.NewReaderDict(br, dict), crc: crc32.NewIEEE()}, nil
+}
+
+// getDictID returns the dictionary ID of the gzip extra field extra, and
+// whether it has one.
+func getDictID(extra []byte) (uint32, bool) {
+	for len(extra) >= 4 {
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			return 0, false
+		}
+
+		if extra[0] == dictSubfieldID1 && extra[1] == dictSubfieldID2 && size == 4 {
+			return binary.LittleEndian.Uint32(extra[4:8]), true
+		}
+
+		extra = extra[4+size:]
+	}
+
+	return 0, false
+}
+
+// dictGzipReader reads the deflate stream written by dictGzipWriter,
+// verifying the trailer.
+type dictGzipReader struct {
+	br   *bufio.Reader
+	fr   io.ReadCloser
+	crc  hash.Hash32
+	size uint32
+	done bool // the trailer is verified
+}
+
+func (zr *dictGzipReader) Read(p []byte) (int, error) {
+	if zr.done {
+		return 0, io.EOF
+	}
+
+	n, err := zr.fr.Read(p)
+	zr.crc.Write(p[:n])
+	zr.size += uint32(n)
+	if err != io.EOF {
+		return n, err
+	}
+
+	trailer := make([]byte, 8)
+	_, err = io.ReadFull(zr.br, trailer)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return n, err
+	}
+
+	if binary.LittleEndian.Uint32(trailer) != zr.crc.Sum32() ||
+		binary.LittleEndian.Uint32(trailer[4:]) != zr.size {
+		return n, gzip.ErrChecksum
+	}
+
+	zr.done = true
+	return n, io.EOF
+}
+
+func (zr *dictGzipReader) Close() error {
+	return zr.fr.Close()
+}
@@ -0,0 +1,36 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+// Diff returns the stats of curr which changed since prev, as deduplicated
+// by NewDedupeLogStats, e.g. to alert on what changed between two stat
+// snapshots without writing them. Neither map is modified.
+//
+//   - The keys new in curr, or whose values changed, are included with
+//     their values in curr. The values compare equal when of the same
+//     type, or when numbers - int64, uint64 or float64 - equal to the
+//     json.Number of prev, e.g. as decoded from a log file. The values of
+//     unsupported types, e.g. int, are always changed: the supported ones
+//     are those above, bool, string, Timestamp, the arrays and the maps.
+//   - The nested maps are diffed recursively, and included only if some of
+//     their stats changed, with those stats only.
+//   - The arrays ([]interface{}) are included in full if any of their
+//     elements changed, compared as the stats are.
+//   - The keys of prev missing in curr are listed, sorted, as a []string
+//     under REMOVED_KEYS, at the level of nesting they were removed from.
+//
+// An empty map means no change. The values are shared with curr, so the
+// diff must be copied before mutating curr.
+func Diff(prev, curr map[string]interface{}) map[string]interface{} {
+	diff := make(map[string]interface{})
+	populateFilteredMap(prev, curr, diff, 0)
+	return diff
+}
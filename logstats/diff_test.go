@@ -0,0 +1,76 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	prev := map[string]interface{}{
+		"k1": int64(1),
+		"k2": "v2",
+		"k3": map[string]interface{}{"k31": int64(31), "k32": true, "k33": 3.3},
+		"k4": []interface{}{int64(1), int64(2)},
+		"k5": map[string]interface{}{"k51": "v51"},
+		"k6": json.Number("6"),
+		"k7": int(7),
+	}
+
+	curr := map[string]interface{}{
+		"k1": int64(1),
+		"k2": "v20",
+		"k3": map[string]interface{}{"k31": int64(31), "k32": false},
+		"k4": []interface{}{int64(1), int64(3)},
+		"k5": map[string]interface{}{"k51": "v51"},
+		"k6": int64(6),
+		"k7": int(7),
+		"k8": uint64(8),
+	}
+
+	exp := map[string]interface{}{
+		"k2": "v20",
+		"k3": map[string]interface{}{"k32": false, REMOVED_KEYS: []string{"k33"}},
+		"k4": []interface{}{int64(1), int64(3)},
+		"k7": int(7),
+		"k8": uint64(8),
+	}
+
+	diff := Diff(prev, curr)
+	if !reflect.DeepEqual(diff, exp) {
+		t.Fatalf("TestDiff failed: diff %v, expected %v", diff, exp)
+	}
+
+	// The removed keys, at the top level.
+	diff = Diff(curr, map[string]interface{}{"k1": int64(1)})
+	exp = map[string]interface{}{
+		REMOVED_KEYS: []string{"k2", "k3", "k4", "k5", "k6", "k7", "k8"},
+	}
+	if !reflect.DeepEqual(diff, exp) {
+		t.Fatalf("TestDiff failed: diff %v, expected %v", diff, exp)
+	}
+
+	// No change, but for the unsupported int.
+	diff = Diff(prev, prev)
+	exp = map[string]interface{}{"k7": int(7)}
+	if !reflect.DeepEqual(diff, exp) {
+		t.Fatalf("TestDiff failed: diff %v, expected %v", diff, exp)
+	}
+
+	// All new.
+
+	diff = Diff(nil, curr)
+	if !reflect.DeepEqual(diff, curr) {
+		t.Fatalf("TestDiff failed: diff %v, expected %v", diff, curr)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Encoder encodes the stat maps written to the log files. The log message
+// prefix - the timestamp and the stat type - stays text, followed by the
+// encoded stats. As the log messages are separated by new lines, the
+// encoded stats must not contain a new line byte ('\n'); binary encodings
+// need to be escaped, e.g. with base64.
+type Encoder interface {
+	Encode(statMap map[string]interface{}) ([]byte, error)
+}
+
+// Decoder decodes the stat maps encoded by the matching Encoder.
+type Decoder interface {
+	Decode(data []byte) (map[string]interface{}, error)
+}
+
+// Encoding is an Encoder along with the matching Decoder, as needed for
+// the reconstruction of the deduplicated stats.
+type Encoding interface {
+	Encoder
+	Decoder
+}
+
+// JSONEncoding encodes the stats as JSON objects. It is the default. The
+// numbers are decoded as json.Number, so that the integers - e.g. the
+// int64 counters beyond 2^53 - survive the round trip exactly. The encoding
+// is canonical: the keys are sorted at every level of nesting, including
+// the deduplicated and the reconstructed stats, so that the same stats are
+// always written as the same bytes, e.g. for the diffs of the log files.
+type JSONEncoding struct{}
+
+func (JSONEncoding) Encode(statMap map[string]interface{}) ([]byte, error) {
+	return json.Marshal(statMap)
+}
+
+func (JSONEncoding) Decode(data []byte) (map[string]interface{}, error) {
+	statMap := make(map[string]interface{})
+	err := decodeJSON(data, &statMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return statMap, nil
+}
+
+// JSONMarshalEncoding encodes the stats as JSON objects, as JSONEncoding
+// does, with the given functions in place of those of encoding/json - e.g.
+// the faster ones of github.com/json-iterator/go. The stats written are
+// read back with either of the encodings. A nil Marshal or Unmarshal falls
+// back to encoding/json. Unmarshal should decode the numbers as
+// json.Number, for the integers to survive the round trip exactly.
+//
+// Unlike encoding/json, Marshal may not sort the keys of the maps. Set
+// Canonical to rewrite its output with the keys sorted, as JSONEncoding
+// writes them, at the cost of decoding and encoding the stats again.
+type JSONMarshalEncoding struct {
+	Marshal   func(v interface{}) ([]byte, error)
+	Unmarshal func(data []byte, v interface{}) error
+	Canonical bool
+}
+
+func (e JSONMarshalEncoding) Encode(statMap map[string]interface{}) ([]byte, error) {
+	return e.marshal(statMap)
+}
+
+func (e JSONMarshalEncoding) Decode(data []byte) (map[string]interface{}, error) {
+	if e.Unmarshal == nil {
+		return JSONEncoding{}.Decode(data)
+	}
+
+	statMap := make(map[string]interface{})
+	err := e.Unmarshal(data, &statMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return statMap, nil
+}
+
+func (e JSONMarshalEncoding) marshal(v interface{}) ([]byte, error) {
+	if e.Marshal == nil {
+		return json.Marshal(v)
+	}
+
+	data, err := e.Marshal(v)
+	if err != nil || !e.Canonical {
+		return data, err
+	}
+
+	return canonicalJSON(data)
+}
+
+// canonicalJSON rewrites the JSON value data with the keys of its objects
+// sorted, as encoding/json writes them. The numbers are kept as written.
+func canonicalJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := decodeJSON(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// maxExactInt is the largest magnitude up to which the integers are held
+// exactly by a float64, 2^53.
+const maxExactInt = 1 << 53
+
+// stringifyLargeNumbers returns a copy of statMap with the integers beyond
+// maxExactInt in magnitude as strings, refer WithNumbersAsStrings. The
+// nested maps and arrays are copied as well, leaving statMap unchanged.
+func stringifyLargeNumbers(statMap map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(statMap))
+	for k, v := range statMap {
+		out[k] = stringifyLargeNumber(v)
+	}
+	return out
+}
+
+func stringifyLargeNumber(v interface{}) interface{} {
+	switch val := v.(type) {
+	case int64:
+		if val > maxExactInt || val < -maxExactInt {
+			return strconv.FormatInt(val, 10)
+		}
+	case uint64:
+		if val > maxExactInt {
+			return strconv.FormatUint(val, 10)
+		}
+	case json.Number:
+		// The integers beyond the int64 range are beyond maxExactInt.
+		i, err := val.Int64()
+		_, errUint := strconv.ParseUint(string(val), 10, 64)
+		if (err == nil && (i > maxExactInt || i < -maxExactInt)) || (err != nil && errUint == nil) {
+			return string(val)
+		}
+	case map[string]interface{}:
+		return stringifyLargeNumbers(val)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, elem := range val {
+			out[i] = stringifyLargeNumber(elem)
+		}
+		return out
+	}
+
+	return v
+}
+
+// decodeJSON is json.Unmarshal, decoding the numbers as json.Number
+// instead of float64.
+func decodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	err := dec.Decode(v)
+	if err != nil {
+		return err
+	}
+
+	// As with json.Unmarshal, nothing but white space may follow.
+	_, err = dec.Token()
+	if err != io.EOF {
+		return fmt.Errorf("unexpected data after the JSON value at offset %v", dec.InputOffset())
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// EstimateDedupeSavings reads the full stat lines - e.g. a log file written
+// without deduplication, compressed or not - from r, and returns their
+// size along with the size the deduplication would have reduced them to,
+// in bytes, without writing anything. The lines which are not stat lines,
+// e.g. the malformed ones, are counted as-is in both the sizes. The
+// estimate assumes no rotation, which would reset the deduplication, so it
+// is an upper bound of the savings.
+func EstimateDedupeSavings(r io.Reader) (rawBytes, dedupedBytes int64, err error) {
+	var reader = bufio.NewReader(r)
+	if compression := detectCompression(reader); compression != CompressionNone {
+		decompressor, err := newDecompressReader(reader, compression, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer decompressor.Close()
+
+		if compression == CompressionGzip {
+			// The compressed current log file is yet to be completed.
+			decompressor = truncatedGzipReader{decompressor}
+		}
+
+		reader = bufio.NewReader(decompressor)
+	}
+
+	prevStatsMap := make(map[string]map[string]interface{})
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return rawBytes, dedupedBytes, readErr
+		}
+
+		if len(line) > 0 {
+			size := int64(len(line))
+			rawBytes += size
+			dedupedBytes += size - estimateLineSavings(prevStatsMap, line)
+		}
+
+		if readErr == io.EOF {
+			return rawBytes, dedupedBytes, nil
+		}
+	}
+}
+
+// estimateLineSavings returns the number of bytes the deduplication saves
+// on a full stat line, and records its stats as the previous stats of its
+// type.
+func estimateLineSavings(prevStatsMap map[string]map[string]interface{}, line []byte) int64 {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	_, _, data, err := splitStatLine(line, 0)
+	if err != nil {
+		return 0
+	}
+
+	statType, stat, err := parseFullStatLine(line)
+	if err != nil {
+		return 0
+	}
+
+	prevMap, ok := prevStatsMap[statType]
+	prevStatsMap[statType] = stat
+	if !ok {
+		return 0
+	}
+
+	filteredMap := make(map[string]interface{})
+	populateFilteredMap(prevMap, stat, filteredMap, 0)
+
+	var encoded []byte
+	encoded, err = json.Marshal(filteredMap)
+	if err != nil {
+		return 0
+	}
+
+	// The timestamp and the stat type stay as they are.
+	return int64(len(data) - len(encoded))
+}
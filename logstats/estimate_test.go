@@ -0,0 +1,91 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEstimateDedupeSavings(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "logstats_estimate")
+	if err != nil {
+		t.Fatalf("TestEstimateDedupeSavings failed with error %v", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	// The same stats, written with and without deduplication.
+	rawFile := filepath.Join(tmpDir, "raw.log")
+	dedupedFile := filepath.Join(tmpDir, "deduped.log")
+
+	var rawLogger, dedupeLogger LogStats
+	rawLogger, err = New(rawFile)
+	if err != nil {
+		t.Fatalf("TestEstimateDedupeSavings failed with error %v", err)
+	}
+
+	dedupeLogger, err = New(dedupedFile, WithDedupe(true))
+	if err != nil {
+		t.Fatalf("TestEstimateDedupeSavings failed with error %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		stat := getSimpleStat(i % 3)
+		if i%5 == 0 {
+			delete(stat, "k3")
+		}
+
+		for _, lst := range []LogStats{rawLogger, dedupeLogger} {
+			err = lst.Write("kStats", stat)
+			if err == nil {
+				err = lst.Write("lStats", getSimpleStat(0))
+			}
+			if err != nil {
+				t.Fatalf("TestEstimateDedupeSavings failed with error %v", err)
+			}
+		}
+	}
+
+	rawLogger.Close()
+	dedupeLogger.Close()
+
+	var raw, deduped []byte
+	raw, err = os.ReadFile(rawFile)
+	if err == nil {
+		deduped, err = os.ReadFile(dedupedFile)
+	}
+	if err != nil {
+		t.Fatalf("TestEstimateDedupeSavings failed with error %v", err)
+	}
+
+	// The rotated log files are compressed.
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	gzw.Write(raw)
+	gzw.Close()
+
+	for _, source := range [][]byte{raw, compressed.Bytes()} {
+		var rawBytes, dedupedBytes int64
+		rawBytes, dedupedBytes, err = EstimateDedupeSavings(bytes.NewReader(source))
+		if err != nil {
+			t.Fatalf("TestEstimateDedupeSavings failed with error %v", err)
+		}
+
+		if rawBytes != int64(len(raw)) || dedupedBytes != int64(len(deduped)) {
+			t.Fatalf("TestEstimateDedupeSavings failed: exp %v, %v bytes actual %v, %v bytes",
+				len(raw), len(deduped), rawBytes, dedupedBytes)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// followInterval is how often Follow polls the log file for new stats.
+var followInterval = 100 * time.Millisecond
+
+// StatRecord is a stat read by Follow.
+type StatRecord struct {
+	Time  time.Time
+	Type  string
+	Stats map[string]interface{}
+
+	// Sequence number of the stats, if read with SetSequence, refer
+	// WithSequence.
+	Seq uint64
+
+	// Set for the malformed lines - e.g. with a timestamp failing to parse
+	// in the format of the reader, refer SetTSFormat - and for the values
+	// other than the maps, written by WriteValue, and for the failures to
+	// read the log file. The records with an error carry no stats, nor
+	// time, and are followed by the records of the next lines.
+	Err error
+}
+
+// follower tails the current log file for Follow.
+type follower struct {
+	r       *LogStatsReader
+	f       *os.File
+	offset  int64
+	pending []byte // partial line, not yet terminated by a newline
+}
+
+// Follow streams the stats written to the current log file from now on,
+// until ctx is done - at which point the returned channel gets closed. The
+// log file is polled for the new stats, and is reopened once rotated. The
+// stats written to a log file rotated more than once between two polls can
+// be missed.
+//
+// When reconstructing, the stats already in the current log file are read
+// - though not streamed - as the base for reconstructing the new ones, so
+// that each stat streamed contains the full stats of its type.
+//
+// The compressed current log file - refer WithActiveCompression - is not
+// supported. Follow takes over the reader, which must not be used otherwise
+// afterwards. The reconstructed maps must not be modified.
+func (r *LogStatsReader) Follow(ctx context.Context) (<-chan StatRecord, error) {
+	_, err := os.Stat(getActiveLogFileName(r.fileName))
+	if err == nil {
+		return nil, fmt.Errorf("Follow: Unsupported compressed current log file %v", getActiveLogFileName(r.fileName))
+	}
+
+	fl := &follower{r: r}
+	r.keyToStatsMap = make(map[string]interface{})
+
+	f, err := os.Open(r.fileName)
+	if err == nil {
+		fl.f = f
+
+		// Catch up with the stats written so far, without streaming them.
+		err = fl.readLines(func(StatRecord) bool { return true })
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		// A missing log file is followed once created.
+		return nil, err
+	}
+
+	ch := make(chan StatRecord)
+	go fl.run(ctx, ch)
+	return ch, nil
+}
+
+func (fl *follower) run(ctx context.Context, ch chan<- StatRecord) {
+	defer close(ch)
+	defer func() {
+		if fl.f != nil {
+			fl.f.Close()
+		}
+	}()
+
+	send := func(rec StatRecord) bool {
+		select {
+		case ch <- rec:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+
+	for {
+		err := fl.poll(send)
+		if err != nil && !send(StatRecord{Err: err}) {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll streams the new stats, and switches to the new log file once the
+// current one is rotated.
+func (fl *follower) poll(send func(StatRecord) bool) error {
+	if fl.f == nil {
+		// The new log file was not created yet on the last poll.
+		f, err := os.Open(fl.r.fileName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		fl.f = f
+	}
+
+	err := fl.readLines(send)
+	if err != nil {
+		return err
+	}
+
+	rotated, err := fl.rotated()
+	if err != nil || !rotated {
+		return err
+	}
+
+	// The stats written to the old log file before its rotation.
+	err = fl.readLines(send)
+	if err != nil {
+		return err
+	}
+
+	if len(fl.pending) > 0 {
+		err = fmt.Errorf("Unterminated line at the end of the rotated log file: %s", fl.pending)
+	}
+
+	fl.f.Close()
+	fl.f = nil
+	fl.offset = 0
+	fl.pending = nil
+
+	// Deduplication resets on log rotation, so does the reconstruction.
+	fl.r.keyToStatsMap = make(map[string]interface{})
+
+	pollErr := fl.poll(send)
+	if err == nil {
+		err = pollErr
+	}
+	return err
+}
+
+// rotated checks whether the log file being read is no longer the current
+// log file, or got truncated.
+func (fl *follower) rotated() (bool, error) {
+	finfo, err := os.Stat(fl.r.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	var curr os.FileInfo
+	curr, err = fl.f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	return !os.SameFile(finfo, curr) || finfo.Size() < fl.offset, nil
+}
+
+// readLines reads the log file till its end, passing the complete lines to
+// send. It stops early, without error, if send returns false.
+func (fl *follower) readLines(send func(StatRecord) bool) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := fl.f.Read(buf)
+		fl.offset += int64(n)
+		fl.pending = append(fl.pending, buf[:n]...)
+
+		for {
+			idx := bytes.IndexByte(fl.pending, '\n')
+			if idx < 0 {
+				break
+			}
+
+			line := fl.pending[:idx]
+			fl.pending = fl.pending[idx+1:]
+			if len(line) == 0 {
+				continue
+			}
+
+			rec := StatRecord{}
+			rec.Time, rec.Type, rec.Stats, rec.Err = fl.r.parseLine(line)
+			rec.Seq = fl.r.seq
+			if !send(rec) {
+				return nil
+			}
+		}
+
+		// Do not hold on to the consumed lines.
+		fl.pending = append([]byte(nil), fl.pending...)
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
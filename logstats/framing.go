@@ -0,0 +1,90 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// frameRecord returns the log message msg, without its new line, prefixed
+// by its length as an unsigned varint, refer WithoutTrailingNewline.
+func frameRecord(msg []byte) []byte {
+	framed := make([]byte, 0, binary.MaxVarintLen64+len(msg))
+	framed = binary.AppendUvarint(framed, uint64(len(msg)))
+	return append(framed, msg...)
+}
+
+// readRecord reads the next log message from reader, without its framing:
+// the new line or, if framed is set, the length prefix. A trailing partial
+// line is returned along with io.EOF, while a trailing partial framed log
+// message is reported by io.ErrUnexpectedEOF.
+func readRecord(reader *bufio.Reader, framed bool) ([]byte, error) {
+	if !framed {
+		line, err := reader.ReadBytes('\n')
+		return bytes.TrimSuffix(line, []byte{'\n'}), err
+	}
+
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > math.MaxInt64 {
+		return nil, fmt.Errorf("Malformed log message length %v", size)
+	}
+
+	// Grows with the data read, rather than trusting a corrupt length.
+	var buf bytes.Buffer
+	_, err = io.CopyN(&buf, reader, int64(size))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ScanFramedRecords is a bufio.SplitFunc splitting the log messages written
+// WithoutTrailingNewline, e.g. when embedding them into another protocol.
+// Each token is a log message without its length prefix. A trailing partial
+// log message is reported by io.ErrUnexpectedEOF. The log messages larger
+// than the buffer of the bufio.Scanner - refer bufio.Scanner.Buffer - fail
+// with bufio.ErrTooLong.
+func ScanFramedRecords(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	size, n := binary.Uvarint(data)
+	if n < 0 {
+		return 0, nil, fmt.Errorf("Malformed log message length")
+	}
+
+	if n == 0 || uint64(len(data)-n) < size {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+
+		// Request more data.
+		return 0, nil, nil
+	}
+
+	end := n + int(size)
+	return end, data[n:end], nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// jsonLine is a log message in the JSON Lines format, refer WithJSONLines.
+// The stats are kept encoded, as they may be deduplicated.
+type jsonLine struct {
+	TS   string          `json:"ts"`
+	Seq  uint64          `json:"seq,omitempty"`
+	Type string          `json:"type"`
+	Stat json.RawMessage `json:"stat"`
+}
+
+// isJSONLine reports whether the log message line is in the JSON Lines
+// format, rather than the "<timestamp> <type> <stats>" one - which never
+// starts with a brace.
+func isJSONLine(line []byte) bool {
+	return len(line) > 0 && line[0] == '{'
+}
+
+// formatJSONLine returns the log message in the JSON Lines format, without
+// the trailing new line, for the timestamp ts, the sequence number seq -
+// left out if zero, refer WithSequence - the stat type and the JSON encoded
+// stats.
+func formatJSONLine(ts string, seq uint64, statType string, stat []byte) []byte {
+	// Marshalling a string never fails.
+	tsBytes, _ := json.Marshal(ts)
+	typeBytes, _ := json.Marshal(statType)
+
+	line := make([]byte, 0, len(tsBytes)+len(typeBytes)+len(stat)+48)
+	line = append(line, `{"ts":`...)
+	line = append(line, tsBytes...)
+	if seq > 0 {
+		line = append(line, `,"seq":`...)
+		line = strconv.AppendUint(line, seq, 10)
+	}
+	line = append(line, `,"type":`...)
+	line = append(line, typeBytes...)
+	line = append(line, `,"stat":`...)
+	line = append(line, stat...)
+	line = append(line, '}')
+	return line
+}
+
+// ParseStatLine splits the log message line, without its new line, into
+// the prefixTokens space separated tokens preceding the encoded stats and
+// the encoded stats, e.g. the JSON. The tokens are split on single spaces,
+// as written, so an empty token stands for a double space, e.g. of a
+// timestamp format padding with a space. For example, a log message
+// "<timestamp> <type> <stats>" has 2 prefix tokens, and one written
+// WithSequence and WithLinePrefix of 2 fields has 5:
+// "<timestamp> <seq> <field1> <field2> <type> <stats>". The timestamp
+// formats containing spaces add a token per space. The stats may contain
+// spaces. A line with fewer tokens, or without stats, fails. The log
+// messages in the JSON Lines format - refer WithJSONLines - have no prefix
+// tokens to split, and are read by LogStatsReader instead.
+func ParseStatLine(line []byte, prefixTokens int) (prefix []string, jsonPart []byte, err error) {
+	if prefixTokens < 0 {
+		return nil, nil, fmt.Errorf("ParseStatLine: Unsupported prefix token count %v", prefixTokens)
+	}
+
+	prefix = make([]string, 0, prefixTokens)
+	rest := line
+	for len(prefix) < prefixTokens {
+		idx := bytes.IndexByte(rest, ' ')
+		if idx < 0 {
+			return nil, nil, fmt.Errorf("Unrecognised stat format for line: %s", line)
+		}
+
+		prefix = append(prefix, string(rest[:idx]))
+		rest = rest[idx+1:]
+	}
+
+	if len(rest) == 0 {
+		return nil, nil, fmt.Errorf("Unrecognised stat format for line: %s", line)
+	}
+
+	return prefix, rest, nil
+}
+
+// splitStatLine returns the timestamp, the stat type and the encoded stats
+// of the log message line, in either format. The prefixFields fields
+// following the timestamp - refer WithLinePrefix - are skipped.
+func splitStatLine(line []byte, prefixFields int) (string, string, []byte, error) {
+	if isJSONLine(line) {
+		jl, err := parseJSONLine(line)
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		return jl.TS, jl.Type, jl.Stat, nil
+	}
+
+	prefix, data, err := ParseStatLine(line, prefixFields+2)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return prefix[0], prefix[prefixFields+1], data, nil
+}
+
+// parseJSONLine parses the log message line in the JSON Lines format.
+func parseJSONLine(line []byte) (jsonLine, error) {
+	var jl jsonLine
+	err := json.Unmarshal(line, &jl)
+	if err != nil {
+		return jl, fmt.Errorf("Unrecognised stat format for line: %s: %v", line, err)
+	}
+
+	if jl.Stat == nil {
+		return jl, fmt.Errorf("Unrecognised stat format for line: %s: missing stat", line)
+	}
+
+	return jl, nil
+}
+
+// getStatSeq returns the sequence number of the log message line, in
+// either format, written WithSequence: the field following the timestamp,
+// or the "seq" of the JSON Lines.
+func getStatSeq(line []byte) (uint64, error) {
+	if isJSONLine(line) {
+		jl, err := parseJSONLine(line)
+		if err != nil {
+			return 0, err
+		}
+
+		if jl.Seq == 0 {
+			return 0, fmt.Errorf("Missing sequence number in line: %s", line)
+		}
+
+		return jl.Seq, nil
+	}
+
+	comps := bytes.SplitN(line, []byte(" "), 3)
+	if len(comps) != 3 {
+		return 0, fmt.Errorf("Unrecognised stat format for line: %s", line)
+	}
+
+	seq, err := strconv.ParseUint(string(comps[1]), 10, 64)
+	if err != nil || seq == 0 {
+		return 0, fmt.Errorf("Invalid sequence number %q in line: %s", comps[1], line)
+	}
+
+	return seq, nil
+}
@@ -11,47 +11,354 @@ licenses/APL2.txt.
 package logstats
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
+	// Default max number of log files, refer WithMaxNumFiles.
 	MAX_NUM_FILES = 99
+
+	// Defaults used by New.
+	DEFAULT_SIZE_LIMIT = 10 * 1024 * 1024
+	DEFAULT_NUM_FILES  = 10
+	DEFAULT_TS_FORMAT  = "2006-01-02T15:04:05.000-07:00"
+
+	// Key, under which the deduplicated stats list the keys removed since
+	// the previous stats of the same type. It is reserved, and must not
+	// be used as a stat name.
+	REMOVED_KEYS = "__removed__"
+
+	// Marker, written as ["__truncated__",<size>] in place of the stats
+	// whose log message exceeds the limit set by WithMaxRecordBytes.
+	TRUNCATED_MARKER = "__truncated__"
 )
 
 var DEBUG int = 0
 
+// ErrLogFileInUse is returned when creating a LogStats object for a log
+// file already written by another LogStats object, in the same or in
+// another process.
+var ErrLogFileInUse = errors.New("log file already in use")
+
+// ErrRecordTooLarge is returned when writing the stats whose log message
+// exceeds the limit set by WithMaxRecordBytes.
+var ErrRecordTooLarge = errors.New("record too large")
+
+// ErrClosed is returned when using a LogStats object - or a FileSnapshot -
+// once closed, e.g. by the writes racing with a graceful shutdown.
+var ErrClosed = errors.New("use of closed object")
+
+// ErrRotation is returned, wrapping the cause, when the log file fails to
+// rotate. The logger remains usable, and the rotation is retried by the
+// next write.
+var ErrRotation = errors.New("log file rotation failed")
+
+// ErrMarshal is returned, wrapping the cause, when the stats fail to
+// encode, e.g. a value the Encoder does not support.
+var ErrMarshal = errors.New("failed to encode stats")
+
+// closedError reports the use of the closed object of the named type. It
+// matches ErrClosed.
+type closedError string
+
+func (e closedError) Error() string {
+	return fmt.Sprintf("Use of closed %v object", string(e))
+}
+
+func (e closedError) Is(target error) bool {
+	return target == ErrClosed
+}
+
 // LogStats interface
 type LogStats interface {
 
 	// Write stats to the file.
 	Write(statType string, statMap map[string]interface{}) error
 
+	// Write stats to the file, as Write does, and return the absolute path
+	// of the file written to, e.g. to correlate the stats with a log file
+	// in the tests. The stats stay in that file until the next rotation,
+	// which may happen right after the write.
+	WritePath(statType string, statMap map[string]interface{}) (string, error)
+
+	// Write stats to the file, unless ctx is done. ctx is checked before
+	// acquiring the lock and, for durable loggers, before syncing the
+	// file. If ctx is done while syncing, ctx.Err() is returned without
+	// waiting for the sync to complete.
+	WriteContext(ctx context.Context, statType string, statMap map[string]interface{}) error
+
+	// Write stats to the file, with the given timestamp instead of the
+	// current time. The time based rotation, if enabled, still follows
+	// the current time.
+	WriteAt(ts time.Time, statType string, statMap map[string]interface{}) error
+
+	// Write multiple stats to the file at once, under a single lock
+	// acquisition. The rotation, if needed, happens only before writing
+	// the first stat, so all the stats land in the same file.
+	WriteBatch(stats []StatEntry) error
+
+	// Write any JSON serializable value - e.g. an array, a scalar or a
+	// struct - to the file, instead of a stat map. Maps of type
+	// map[string]interface{} are written as by Write. The other values
+	// are not deduplicated, and are not supported with an Encoder other
+	// than JSONEncoding and JSONMarshalEncoding. With deduplication, the
+	// values should not share their stat type with the stat maps, so that
+	// the reconstruction does not mistake a value for the stats.
+	WriteValue(statType string, v interface{}) error
+
+	// Write a struct - or any value encoded as a JSON object - as stats,
+	// e.g. instead of building the stat map by hand. The value is
+	// encoded as JSON and decoded back into the stat map, with the
+	// numbers as json.Number, so that the stats are deduplicated by
+	// their JSON encoding rather than by their Go types. The keys are
+	// named by the json tags, which also omit fields, as with
+	// encoding/json; the nested structs become nested maps. The Encoder
+	// must support json.Number values, as the JSON encoders do.
+	WriteStruct(statType string, v interface{}) error
+
+	// Write stats already encoded as a JSON object - e.g. received from
+	// an upstream system - to the file as-is, without decoding and
+	// encoding them again. The surrounding white space is trimmed, and
+	// the rest must not contain a new line. Not supported with an
+	// Encoder other than JSONEncoding and JSONMarshalEncoding. The
+	// deduplicating loggers write the raw stats in full, unless
+	// WithRawDedupe is set.
+	WriteRaw(statType string, jsonBytes []byte) error
+
+	// Returns an io.Writer writing each message - e.g. the output of a
+	// log.Logger or a slog handler - as a log message of type statType,
+	// for it to get the rotation and the compression of the log files.
+	// The JSON objects are written as by WriteRaw, and the other
+	// messages as JSON strings by WriteValue, so the same Encoder
+	// restrictions apply.
+	AsWriter(statType string) io.Writer
+
 	// Set flag for durability - when set to true, each call to Write will
 	// also call os.File.Sync()
 	SetDurable(durable bool)
 
-	// Closes the log file if open.
-	Close()
+	// Enable or disable compression of the rotated log files. The files
+	// are compressed using the CompressionType set by WithCompression,
+	// gzip by default. Changing it affects only the future rotations, the
+	// files which are already rotated are left as they are.
+	SetCompression(enable bool)
+
+	// Sync the log file to the disk once. Unlike SetDurable, it does not
+	// force a sync on each subsequent call to Write.
+	Flush() error
+
+	// Reset the deduplication, so that the next stats of each type are
+	// written in full. This trades space for recoverability - e.g. a
+	// consumer starting to read the log file after the reset does not
+	// need the earlier stats to reconstruct the current stats. No-op for
+	// the loggers without deduplication.
+	DedupeReset()
+
+	// Returns the current state of the log files.
+	Info() LogStatsInfo
+
+	// Rotate the log file now, irrespective of its size, e.g. before
+	// collecting the log files. The deduplication resets, as on any other
+	// rotation.
+	Rotate() error
+
+	// Returns the absolute paths of the log files - the rotated ones,
+	// oldest first, followed by the current one - e.g. for collecting
+	// them in a support bundle. Nil if the log files cannot be listed.
+	Files() []string
+
+	// Returns a consistent view of the log files, for reading them while
+	// the logger keeps writing and rotating them. The view is taken under
+	// the lock, after flushing the buffered stats, refer FileSnapshot for
+	// the coordination contract. The snapshot must be closed once read.
+	Snapshot() (*FileSnapshot, error)
+
+	// Returns the time of the last write of the stats of statType, and
+	// whether they were written at all, e.g. to tell when a subsystem
+	// stopped reporting its stats. The snapshots written by the logger
+	// itself, e.g. on rotation, do not count.
+	LastWrite(statType string) (time.Time, bool)
+
+	// Returns the stat types last written more than threshold ago, in
+	// sorted order, e.g. to alert on the missing stats.
+	StaleTypes(threshold time.Duration) []string
+
+	// Closes the log file if open. Returns the error flushing the buffered
+	// stats, syncing the log file - for durable loggers - or closing it.
+	Close() error
+}
+
+// StatEntry is a single stat of a batch written by WriteBatch.
+type StatEntry struct {
+	Type string
+	Map  map[string]interface{}
+}
+
+// LogStatsInfo describes the current state of the log files of a LogStats
+// object.
+type LogStatsInfo struct {
+	// Size of the current log file, in bytes.
+	CurrentFileSize int
+
+	// Number of rotated log files on the disk.
+	RotatedFiles int
+
+	// Total size of the current and the rotated log files, in bytes.
+	TotalBytes int64
+
+	// Number of rotations since the creation of the LogStats object.
+	Rotations uint64
+
+	// Largest size reached by a log file since the creation of the
+	// LogStats object, in bytes. As the size limit is soft, a log file
+	// may exceed it by up to a log message - or a WriteBatch - which,
+	// along with MaxRecordSize, bounds the disk usage. Tracked per
+	// LogStats object, and not persisted: a new object starts from the
+	// size of the current log file.
+	MaxObservedFileSize int
+
+	// Largest log message written since the creation of the LogStats
+	// object, in bytes. Not persisted either.
+	MaxRecordSize int
+
+	// Number of log messages written since the creation of the LogStats
+	// object, including those written by the logger itself, e.g. the
+	// snapshots on rotation. Not persisted either.
+	Records int64
+
+	// Number of log messages written per stat type, adding up to Records,
+	// e.g. to tell which stat type dominates the log files. The map is a
+	// copy, owned by the caller.
+	TypeRecords map[string]int64
+
+	// Set if the rotated log files failed to be listed, e.g. on the
+	// permissions of their directory, in which case RotatedFiles and
+	// TotalBytes count the current log file only.
+	ScanErr error
+}
+
+// RotationInfo is the state of the current log file, passed to the
+// rotation predicate set by WithRotationPredicate.
+type RotationInfo struct {
+	// Name of the current log file.
+	FileName string
+
+	// Size of the current log file, in bytes.
+	Size int
+
+	// Number of stat lines in the current log file.
+	Lines int
+
+	// Time elapsed since LastRotate.
+	Age time.Duration
+
+	// Time of the last rotation, or of the creation of the LogStats
+	// object if it has not rotated the log file yet.
+	LastRotate time.Time
+}
+
+// Observer gets notified of the activity of a LogStats object, e.g. to
+// export it as metrics. The callbacks are invoked synchronously, with the
+// LogStats object locked. So, they must be cheap, must not block and must
+// not call the LogStats object.
+type Observer interface {
+	// Called for each stat written, with the size of its log message in
+	// bytes. The deduplicated stats report the size of the deduplicated
+	// log message.
+	OnWrite(statType string, bytes int)
+
+	// Called after the log file fileName is rotated.
+	OnRotate(fileName string)
+
+	// Called when writing, rotating or flushing the log file fails. The
+	// errors caused by the caller, e.g. the use of a closed object or a
+	// done context, are not reported.
+	OnError(err error)
+}
+
+// writerLock is the lock of a LogStats object: a sync.Mutex, or no lock at
+// all for the single writer, refer WithSingleWriter.
+type writerLock struct {
+	mu     sync.Mutex
+	single bool
+	busy   bool // held by the single writer
+}
+
+func (l *writerLock) Lock() {
+	if !l.single {
+		l.mu.Lock()
+		return
+	}
+
+	// A best effort check without synchronization, so that the race
+	// detector reports the concurrent use as the data race it is.
+	if l.busy {
+		panic("logstats: concurrent use of a LogStats object WithSingleWriter")
+	}
+	l.busy = true
+}
+
+func (l *writerLock) Unlock() {
+	if !l.single {
+		l.mu.Unlock()
+		return
+	}
+
+	l.busy = false
 }
 
 // logStats. Supports regular log rotation.
 type logStats struct {
-	fileName  string
-	sizeLimit int
-	numFiles  int
-	tsFormat  string
+	config
+
+	fileName string
+	lockFile *os.File // held until Close
+
+	lock       writerLock
+	sz         int
+	empty      bool // the current log file holds no stats
+	lines      int  // stat lines in the current log file, if tracksLines
+	f          *os.File
+	w          *bufio.Writer      // nil, if writes are unbuffered
+	cf         *compressedLogFile // nil, unless WithActiveCompression
+	compress   bool
+	closed     bool
+	lastRotate time.Time
+	rotations  uint64
+	maxSz      int           // largest size of a log file, refer MaxObservedFileSize
+	maxRecord  int           // largest log message, refer MaxRecordSize
+	stopSync   chan struct{} // nil, unless WithSyncInterval
+	truncated  bool          // the last log message got truncated, refer WithMaxRecordBytes
+	unsynced   int           // bytes written since the last sync, refer WithSyncEveryBytes
+	syncs      int           // syncs of the log files, for the tests
+
+	// The sequence number of the last log message, refer WithSequence.
+	seq uint64
 
-	lock     sync.Mutex
-	sz       int
-	f        *os.File
-	durable  bool
-	compress bool
-	closed   bool
+	// The number of log messages formatted since the last write, numbered
+	// following seq. The numbers are taken by the write, if it succeeds.
+	unwritten uint64
+
+	// The time of the last write of each stat type, refer LastWrite.
+	lastWrites map[string]time.Time
+
+	// The log messages written, in all and per stat type, refer
+	// LogStatsInfo.Records.
+	records     int64
+	typeRecords map[string]int64
 }
 
 // Create new LogStats object.
@@ -71,258 +378,1533 @@ type logStats struct {
 // numFiles:  Number of log files to be maintained.
 // tsFormat:  Format in which the timestamps in the log messages are
 //
-//	to be logged.
-func NewLogStats(fileName string, sizeLimit int, numFiles int, tsFormat string) (*logStats, error) {
-	var err error
-	fileName, err = validateInput(fileName, numFiles)
+//	to be logged. Must be a valid time layout, e.g. time.RFC3339.
+//
+// opts:      Optional settings, see Option.
+func NewLogStats(fileName string, sizeLimit int, numFiles int, tsFormat string, opts ...Option) (*logStats, error) {
+	return newLogStats(fileName, positionalOptions(sizeLimit, numFiles, tsFormat, opts))
+}
+
+// New creates a new LogStats object, writing to the log file fileName - or
+// fileName with the ".log" extension added, if it does not have one. The
+// rest of the settings are optional, e.g. WithSizeLimit, WithNumFiles,
+// WithTSFormat or WithDedupe.
+func New(fileName string, opts ...Option) (LogStats, error) {
+	cfg, err := applyOptions(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	f, sz, err := openLogFile(fileName)
+	if cfg.perTypeFiles {
+		pt, err := newPerTypeLogStats(fileName, opts, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return pt, nil
+	}
+
+	return newLogger(fileName, opts)
+}
+
+// newLogger creates a logStats object, or a dedupeLogStats object if the
+// deduplication is enabled.
+func newLogger(fileName string, opts []Option) (LogStats, error) {
+	lst, err := newLogStats(fileName, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	lst := &logStats{
-		fileName:  fileName,
-		sizeLimit: sizeLimit,
-		numFiles:  numFiles,
-		tsFormat:  tsFormat,
-		f:         f,
-		sz:        sz,
-		compress:  true,
+	if lst.dedupe {
+		return newDedupeLogStats(lst), nil
 	}
 	return lst, nil
 }
 
-func (lst *logStats) SetDurable(durable bool) {
-	lst.lock.Lock()
-	defer lst.lock.Unlock()
-
-	lst.durable = durable
+// positionalOptions prepends the positional parameters of the legacy
+// constructors to opts.
+func positionalOptions(sizeLimit int, numFiles int, tsFormat string, opts []Option) []Option {
+	return append([]Option{
+		WithSizeLimit(sizeLimit),
+		WithNumFiles(numFiles),
+		WithTSFormat(tsFormat),
+	}, opts...)
 }
 
-func (lst *logStats) rotateIfNeeded() error {
-	// Rotate the logs only if current size of log file is more than
-	// specified sizeLimit. This can lead to files larger than
-	// sizeLimit.
-	if lst.needsRotation() {
-		if DEBUG != 0 {
-			fmt.Println("Log file", lst.fileName, "needs rotation")
+func newLogStats(fileName string, opts []Option) (*logStats, error) {
+	cfg, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(fileName, ".log") {
+		fileName = fileName + ".log"
+	}
+
+	lockFile, err := lockLogFile(fileName, cfg.fileMode, cfg.dirMode)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.compressExisting {
+		// Ahead of the renumbering, which would tell apart a compressed
+		// file left behind by an interruption from its source.
+		err = compressRotatedLogFiles(fileName, cfg)
+		if err != nil {
+			lockFile.Close()
+			return nil, err
 		}
+	}
+
+	// Rotation expects the rotated files to be numbered contiguously.
+	err = renumberLogFiles(fileName, cfg.fileNamer)
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
 
-		err := lst.f.Close()
+	if !cfg.compressActive {
+		err = decompressCurrentLogFile(fileName, cfg)
 		if err != nil {
-			return err
+			lockFile.Close()
+			return nil, err
 		}
+	}
+
+	f, cf, sz, err := openCurrentLogFile(fileName, cfg, cfg.repairOnOpen)
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
 
-		f, sz, err := rotate(lst.fileName, lst.numFiles, lst.compress)
+	var lines int
+	if cfg.tracksLines() && sz > 0 {
+		fname := fileName
+		if cf != nil {
+			fname = getActiveLogFileName(fileName)
+		}
+		lines, err = countLogFileLines(fname)
 		if err != nil {
-			return err
+			f.Close()
+			lockFile.Close()
+			return nil, err
 		}
-		lst.f = f
-		lst.sz = sz
 	}
 
-	return nil
+	var w *bufio.Writer
+	if cfg.bufferSize > 0 && cf == nil {
+		w = bufio.NewWriterSize(f, cfg.bufferSize)
+	}
+
+	lst := &logStats{
+		config:     cfg,
+		fileName:   fileName,
+		lockFile:   lockFile,
+		f:          f,
+		w:          w,
+		cf:         cf,
+		sz:         sz,
+		empty:      (cf == nil && sz == 0) || (cf != nil && cf.n == 0),
+		lines:      lines,
+		compress:   cfg.compression != CompressionNone,
+		lastRotate: cfg.now(),
+		maxSz:      sz,
+		lastWrites: make(map[string]time.Time),
+	}
+	lst.typeRecords = make(map[string]int64)
+	lst.lock.single = cfg.singleWriter
+
+	if cfg.syncInterval > 0 {
+		lst.stopSync = make(chan struct{})
+		go lst.syncLoop(cfg.syncInterval, lst.stopSync)
+	}
+
+	return lst, nil
 }
 
-func (lst *logStats) writeAndCommit(bytes []byte) error {
-	f := lst.f
+// syncLoop syncs the log file every interval, until stop is closed - by
+// Close.
+func (lst *logStats) syncLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	err := writeToFile(f, bytes)
-	if err != nil {
-		return err
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		lst.lock.Lock()
+		if lst.closed {
+			lst.lock.Unlock()
+			return
+		}
+
+		lst.observeError(lst.sync())
+		lst.lock.Unlock()
 	}
-	lst.sz += len(bytes)
+}
+
+func (lst *logStats) SetDurable(durable bool) {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	lst.durable = durable
+}
 
-	if lst.durable {
-		err = f.Sync()
+// rotateIfNeeded rotates the log file if needed and reports whether
+// the rotation happened.
+func (lst *logStats) rotateIfNeeded() (bool, error) {
+	// Rotate the logs only if current size of log file is more than
+	// specified sizeLimit (or the rotate interval has elapsed, or it holds
+	// maxLines lines). This can
+	// lead to files larger than sizeLimit.
+	if !lst.needsRotation() {
+		return false, nil
 	}
 
-	return err
+	if DEBUG != 0 {
+		fmt.Println("Log file", lst.fileName, "needs rotation")
+	}
+
+	return true, lst.rotate()
 }
 
-func (lst *logStats) Write(statType string, statMap map[string]interface{}) error {
+// rotate rotates the log file, and notifies the observer.
+func (lst *logStats) rotate() error {
+	err := lst.rotateLogFile()
+	if err != nil {
+		return lst.observeError(fmt.Errorf("%w: %w", ErrRotation, err))
+	}
+
+	if lst.observer != nil {
+		lst.observer.OnRotate(lst.fileName)
+	}
+	return nil
+}
+
+func (lst *logStats) Rotate() error {
 	lst.lock.Lock()
 	defer lst.lock.Unlock()
 
 	if lst.closed {
-		return fmt.Errorf("Use of closed logStats object")
+		return closedError("logStats")
 	}
 
-	err := lst.rotateIfNeeded()
+	return lst.rotate()
+}
+
+func (lst *logStats) rotateLogFile() error {
+	// The file being rotated out is synced irrespective of durability, so
+	// that a crash during the rotation does not leave it truncated.
+	err := lst.sync()
 	if err != nil {
 		return err
 	}
 
-	bytes, err := lst.getBytesToWrite(statType, statMap)
+	if lst.cf != nil {
+		// Completes the gzip stream.
+		err = lst.cf.Close()
+		if err != nil {
+			lst.f.Close()
+			return lst.reopenLogFile(err)
+		}
+	}
+
+	err = lst.f.Close()
 	if err != nil {
-		return err
+		return lst.reopenLogFile(err)
 	}
 
-	return lst.writeAndCommit(bytes)
-}
+	err = rotate(lst.fileName, lst.numFiles, lst.compressionType(), lst.config)
+	if err != nil {
+		return lst.reopenLogFile(err)
+	}
 
-func (lst *logStats) getBytesToWrite(statType string, statMap map[string]interface{}) ([]byte, error) {
-	bytes, err := json.Marshal(statMap)
+	f, cf, sz, err := openCurrentLogFile(lst.fileName, lst.config, false)
 	if err != nil {
-		return nil, err
+		return lst.reopenLogFile(err)
+	}
+	lst.f = f
+	lst.cf = cf
+	lst.sz = sz
+	lst.empty = true
+	lst.lines = 0
+	lst.lastRotate = lst.now()
+	lst.rotations++
+	if lst.w != nil {
+		lst.w.Reset(f)
 	}
 
-	return lst.formatBytes(statType, bytes), nil
+	return nil
 }
 
-func (lst *logStats) formatBytes(statType string, bytes []byte) []byte {
-	bytes = append(bytes, byte(10))
+// reopenLogFile reopens the current log file once closed by a failed
+// rotation, so that the logger remains usable - appending to the log file
+// if it was not rotated out, or to a new one otherwise. The rotation is
+// retried by the next write. Returns err, the cause of the failure.
+func (lst *logStats) reopenLogFile(err error) error {
+	f, cf, sz, openErr := openCurrentLogFile(lst.fileName, lst.config, false)
+	if openErr != nil {
+		return fmt.Errorf("%v, and failed to reopen the log file: %v", err, openErr)
+	}
 
-	prefix := []byte(strings.Join([]string{time.Now().Format(lst.tsFormat), statType, ""}, " "))
-	bytes = append(prefix, bytes...)
-	return bytes
-}
+	lines := 0
+	if lst.tracksLines() && sz > 0 {
+		fname := lst.fileName
+		if cf != nil {
+			fname = getActiveLogFileName(lst.fileName)
+		}
+		// Rotates early rather than failing.
+		lines, _ = countLogFileLines(fname)
+	}
 
-func (lst *logStats) needsRotation() bool {
-	return lst.sz >= lst.sizeLimit
+	lst.f = f
+	lst.cf = cf
+	lst.sz = sz
+	lst.empty = (cf == nil && sz == 0) || (cf != nil && cf.n == 0)
+	lst.lines = lines
+	if lst.w != nil {
+		lst.w.Reset(f)
+	}
+
+	return err
 }
 
-func (lst *logStats) disableCompression() {
-	lst.lock.Lock()
-	defer lst.lock.Unlock()
+func (lst *logStats) writeAndCommit(ctx context.Context, bytes []byte) error {
+	var err error
+	if lst.w != nil {
+		err = writeToFile(lst.w, bytes)
+	} else if lst.cf != nil {
+		err = writeToFile(lst.cf, bytes)
+	} else {
+		err = lst.writeWithRetry(ctx, bytes)
+	}
 
-	lst.compress = false
-}
+	if err == nil {
+		lst.seq += lst.unwritten
+	}
+	lst.unwritten = 0
 
-func (lst *logStats) Close() {
-	lst.lock.Lock()
-	defer lst.lock.Unlock()
+	if err != nil {
+		return lst.observeError(err)
+	}
 
-	if lst.closed {
-		return
+	if lst.cf != nil {
+		lst.setSize(lst.cf.size())
+	} else {
+		lst.setSize(lst.sz + len(bytes))
+	}
+	lst.empty = lst.empty && len(bytes) == 0
+	if lst.tracksLines() {
+		lst.lines += countLines(bytes)
 	}
 
-	if lst.f != nil {
-		lst.f.Close()
+	lst.unsynced += len(bytes)
+	if lst.durable || (lst.syncEveryBytes > 0 && lst.unsynced >= lst.syncEveryBytes) {
+		err = lst.syncContext(ctx)
+		if err != nil && ctx.Err() == nil {
+			lst.observeError(err)
+		}
 	}
 
-	lst.f = nil
-	lst.closed = true
+	return err
 }
 
-// dedupeLogStats. Supports log rotation. Stats get deduplicated across
-// consecutive log messages of same type. This can save a lot of space
-// but it comes with a cost that the individual log message cannot be
-// consumed as-is. Deduplication resets on log rotation.
-type dedupeLogStats struct {
-	*logStats
+// writeWithRetry writes bytes to the log file, retrying the transient
+// failures as per WithWriteRetry.
+func (lst *logStats) writeWithRetry(ctx context.Context, bytes []byte) error {
+	backoff := lst.retryBackoff
+	for attempt := 1; ; attempt++ {
+		n, err := writeFile(lst.f, bytes)
+		if DEBUG != 0 {
+			fmt.Println(n, "bytes written to the file")
+		}
 
-	fileName  string
-	sizeLimit int
-	numFiles  int
-	tsFormat  string
+		if err == nil {
+			return nil
+		}
 
-	lock     sync.Mutex
-	sz       int
-	f        *os.File
-	durable  bool
-	compress bool
+		if attempt >= lst.writeAttempts || !isTransientWriteError(err) {
+			return err
+		}
 
-	prevStatsMap map[string]map[string]interface{}
-}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
 
-// Create new LogStats object.
-// Paramters:
-// fileName:  Name of the log file. If the file name does not have ".log"
-//
-//	extension, it will be added internally - and the final log
-//	file will have the ".log" extension.
-//
-// sizeLimit: Size limit for one file. It is not a hard limit. A single
-//
-//	log message cannot cross the log file boundary. So, as long
-//	as the current file has not reached its size limit, the
-//	incoming log message will be written to the current file.
-//	This can lead to log files larger than sizeLimit.
-//
-// numFiles:  Number of log files to be maintained.
-// tsFormat:  Format in which the timestamps in the log messages are
-//
-//	to be logged.
-func NewDedupeLogStats(fileName string, sizeLimit int, numFiles int, tsFormat string) (*dedupeLogStats, error) {
+		if n > 0 {
+			// Resumed where it stopped, in the same log file.
+			bytes = bytes[n:]
+			continue
+		}
 
-	var err error
-	fileName, err = validateInput(fileName, numFiles)
-	if err != nil {
-		return nil, err
+		if !lst.dedupe {
+			_, rotateErr := lst.rotateIfNeeded()
+			if rotateErr != nil {
+				return rotateErr
+			}
+		}
 	}
+}
 
-	f, sz, err := openLogFile(fileName)
-	if err != nil {
-		return nil, err
+// observeError reports err, if any, to the observer and returns it.
+func (lst *logStats) observeError(err error) error {
+	if err != nil && lst.observer != nil {
+		lst.observer.OnError(err)
 	}
 
-	lStats := &logStats{
-		fileName:  fileName,
-		sizeLimit: sizeLimit,
-		numFiles:  numFiles,
-		tsFormat:  tsFormat,
-		f:         f,
-		sz:        sz,
-		compress:  true,
+	return err
+}
+
+// observeWrite reports the stat written by the caller, as observeRecord,
+// and records the time of the write.
+func (lst *logStats) observeWrite(statType string, bytes int) {
+	lst.observeRecord(statType, bytes)
+	lst.lastWrites[statType] = lst.now()
+}
+
+// observeRecord reports the stat written to the observer, and tracks the
+// largest log message.
+func (lst *logStats) observeRecord(statType string, bytes int) {
+	if bytes > lst.maxRecord {
+		lst.maxRecord = bytes
 	}
 
-	lst := &dedupeLogStats{
-		logStats:     lStats,
-		fileName:     fileName,
-		sizeLimit:    sizeLimit,
-		numFiles:     numFiles,
-		tsFormat:     tsFormat,
-		f:            f,
-		sz:           sz,
-		compress:     true,
-		prevStatsMap: make(map[string]map[string]interface{}),
+	lst.records++
+	lst.typeRecords[statType]++
+
+	if lst.observer != nil {
+		lst.observer.OnWrite(statType, bytes)
 	}
-	return lst, nil
 }
 
-func (dlst *dedupeLogStats) Write(statType string, statMap map[string]interface{}) error {
-	dlst.lock.Lock()
-	defer dlst.lock.Unlock()
-
-	if dlst.closed {
-		return fmt.Errorf("Use of closed dedupeLogStats object")
+// setSize sets the size of the current log file, tracking the largest.
+func (lst *logStats) setSize(sz int) {
+	lst.sz = sz
+	if sz > lst.maxSz {
+		lst.maxSz = sz
 	}
+}
 
-	var bytes []byte
-	var err error
-	if dlst.needsRotation() {
-		dlst.resetPrevStatsMap()
-		bytes, err = dlst.logStats.getBytesToWrite(statType, statMap)
+// flushBuffer writes the buffered data, if any, to the log file.
+func (lst *logStats) flushBuffer() error {
+	if lst.cf != nil {
+		err := lst.cf.Flush()
+		lst.setSize(lst.cf.size())
+		return err
+	}
 
-	} else {
-		prevMap, ok := dlst.prevStatsMap[statType]
-		if !ok {
-			bytes, err = dlst.logStats.getBytesToWrite(statType, statMap)
-		} else {
-			filteredMap := make(map[string]interface{})
-			populateFilteredMap(prevMap, statMap, filteredMap)
-			bytes, err = dlst.logStats.getBytesToWrite(statType, filteredMap)
-		}
+	if lst.w == nil {
+		return nil
 	}
 
-	dlst.prevStatsMap[statType] = statMap
+	return lst.w.Flush()
+}
 
-	err = dlst.rotateIfNeeded()
+// sync flushes the buffered data and syncs the log file to the disk.
+func (lst *logStats) sync() error {
+	err := lst.flushBuffer()
 	if err != nil {
 		return err
 	}
 
-	return dlst.writeAndCommit(bytes)
+	err = lst.f.Sync()
+	if err == nil {
+		lst.synced()
+	}
+
+	return err
+}
+
+// synced records the sync of the log file.
+func (lst *logStats) synced() {
+	lst.unsynced = 0
+	lst.syncs++
+}
+
+// syncContext is same as sync, except that it returns ctx.Err() as soon
+// as ctx is done, even if the sync is still in progress.
+func (lst *logStats) syncContext(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	if ctx.Done() == nil {
+		return lst.sync()
+	}
+
+	err = lst.flushBuffer()
+	if err != nil {
+		return err
+	}
+
+	f := lst.f
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- f.Sync()
+	}()
+
+	select {
+	case err = <-errCh:
+		if err == nil {
+			lst.synced()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (lst *logStats) Write(statType string, statMap map[string]interface{}) error {
+	return lst.WriteContext(context.Background(), statType, statMap)
+}
+
+func (lst *logStats) WritePath(statType string, statMap map[string]interface{}) (string, error) {
+	err := lst.Write(statType, statMap)
+	if err != nil {
+		return "", err
+	}
+
+	return lst.currentFilePath(), nil
+}
+
+// currentFilePath returns the absolute path of the current log file - the
+// compressed one with WithActiveCompression. The path does not change with
+// the rotation.
+func (lst *logStats) currentFilePath() string {
+	fname := lst.fileName
+	if lst.compressActive {
+		fname = getActiveLogFileName(fname)
+	}
+
+	abs, err := filepath.Abs(fname)
+	if err != nil {
+		return fname
+	}
+
+	return abs
+}
+
+func (lst *logStats) WriteContext(ctx context.Context, statType string, statMap map[string]interface{}) error {
+	return lst.write(ctx, time.Time{}, statType, statMap)
+}
+
+func (lst *logStats) WriteAt(ts time.Time, statType string, statMap map[string]interface{}) error {
+	return lst.write(context.Background(), ts, statType, statMap)
+}
+
+// write writes the stats with timestamp ts - or, if ts is zero, the time
+// of the write.
+func (lst *logStats) write(ctx context.Context, ts time.Time, statType string, statMap map[string]interface{}) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	if lst.closed {
+		return closedError("logStats")
+	}
+
+	// ctx may be done while waiting for the lock.
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	_, err = lst.rotateIfNeeded()
+	if err != nil {
+		return err
+	}
+
+	bytes, err := lst.getBytesToWrite(ts, statType, statMap)
+	if err != nil {
+		return err
+	}
+
+	err = lst.writeAndCommit(ctx, bytes)
+	if err != nil {
+		return err
+	}
+
+	lst.observeWrite(statType, len(bytes))
+	return nil
+}
+
+func (lst *logStats) WriteBatch(stats []StatEntry) error {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	if lst.closed {
+		return closedError("logStats")
+	}
+
+	_, err := lst.rotateIfNeeded()
+	if err != nil {
+		return err
+	}
+
+	var batch []byte
+	var sizes = make([]int, 0, len(stats))
+	for _, entry := range stats {
+		bytes, err := lst.getBytesToWrite(time.Time{}, entry.Type, entry.Map)
+		if err != nil {
+			// The stats formatted so far are not written.
+			lst.unwritten = 0
+			return err
+		}
+
+		batch = append(batch, bytes...)
+		sizes = append(sizes, len(bytes))
+	}
+
+	err = lst.writeAndCommit(context.Background(), batch)
+	if err != nil {
+		return err
+	}
+
+	lst.observeBatch(stats, sizes)
+	return nil
+}
+
+func (lst *logStats) WriteStruct(statType string, v interface{}) error {
+	statMap, err := lst.structToStatMap(statType, v)
+	if err != nil {
+		return err
+	}
+
+	return lst.Write(statType, statMap)
+}
+
+// structToStatMap returns the stat map of the value v, encoded as JSON -
+// by the Marshal of JSONMarshalEncoding, if set - and decoded with the
+// numbers as json.Number, refer WriteStruct.
+func (lst *logStats) structToStatMap(statType string, v interface{}) (map[string]interface{}, error) {
+	marshal := json.Marshal
+	if enc, ok := lst.encoder.(JSONMarshalEncoding); ok {
+		marshal = enc.marshal
+	}
+
+	data, err := marshal(v)
+	if err != nil {
+		return nil, lst.observeError(fmt.Errorf("%w of type %v: %w", ErrMarshal, statType, err))
+	}
+
+	var statMap map[string]interface{}
+	err = decodeJSON(data, &statMap)
+	if err != nil || statMap == nil {
+		return nil, fmt.Errorf("WriteStruct: Unsupported value of type %T, not encoded as a JSON object", v)
+	}
+
+	return statMap, nil
+}
+
+func (lst *logStats) WriteValue(statType string, v interface{}) error {
+	if statMap, ok := v.(map[string]interface{}); ok {
+		return lst.Write(statType, statMap)
+	}
+
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	if lst.closed {
+		return closedError("logStats")
+	}
+
+	_, err := lst.rotateIfNeeded()
+	if err != nil {
+		return err
+	}
+
+	bytes, err := lst.getValueBytesToWrite(statType, v)
+	if err != nil {
+		return err
+	}
+
+	err = lst.writeAndCommit(context.Background(), bytes)
+	if err != nil {
+		return err
+	}
+
+	lst.observeWrite(statType, len(bytes))
+	return nil
+}
+
+func (lst *logStats) WriteRaw(statType string, jsonBytes []byte) error {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	if lst.closed {
+		return closedError("logStats")
+	}
+
+	_, err := lst.rotateIfNeeded()
+	if err != nil {
+		return err
+	}
+
+	bytes, err := lst.getRawBytesToWrite(statType, jsonBytes)
+	if err != nil {
+		return err
+	}
+
+	err = lst.writeAndCommit(context.Background(), bytes)
+	if err != nil {
+		return err
+	}
+
+	lst.observeWrite(statType, len(bytes))
+	return nil
+}
+
+func (lst *logStats) AsWriter(statType string) io.Writer {
+	return &statWriter{ls: lst, statType: statType}
+}
+
+// observeBatch reports the stats written by WriteBatch, with their sizes,
+// to the observer.
+func (lst *logStats) observeBatch(stats []StatEntry, sizes []int) {
+	for i, entry := range stats {
+		lst.observeWrite(entry.Type, sizes[i])
+	}
+}
+
+// getBytesToWrite returns the log message for the stats, with timestamp
+// ts - or, if ts is zero, the current time. As the log messages are
+// separated by new lines, the stat type and the encoded stats must not
+// contain one. The JSON encoded stats never do, as JSON escapes the new
+// lines in the strings.
+func (lst *logStats) getBytesToWrite(ts time.Time, statType string, statMap map[string]interface{}) ([]byte, error) {
+	if lst.numbersAsStrings {
+		statMap = stringifyLargeNumbers(statMap)
+	}
+
+	encoded, err := lst.encoder.Encode(statMap)
+	if err != nil {
+		return nil, lst.observeError(fmt.Errorf("%w of type %v: %w", ErrMarshal, statType, err))
+	}
+
+	return lst.formatEncoded(ts, statType, encoded)
+}
+
+// getValueBytesToWrite returns the log message for the JSON encoded value
+// v, with the current time.
+func (lst *logStats) getValueBytesToWrite(statType string, v interface{}) ([]byte, error) {
+	var encoded []byte
+	var err error
+	switch enc := lst.encoder.(type) {
+	case JSONEncoding:
+		encoded, err = json.Marshal(v)
+	case JSONMarshalEncoding:
+		encoded, err = enc.marshal(v)
+	default:
+		return nil, fmt.Errorf("WriteValue: Unsupported value of type %T with a custom encoder", v)
+	}
+
+	if err != nil {
+		return nil, lst.observeError(fmt.Errorf("%w of type %v: %w", ErrMarshal, statType, err))
+	}
+
+	return lst.formatEncoded(time.Time{}, statType, encoded)
+}
+
+// getRawBytesToWrite returns the log message for the JSON encoded stats
+// jsonBytes, with the current time.
+func (lst *logStats) getRawBytesToWrite(statType string, jsonBytes []byte) ([]byte, error) {
+	switch lst.encoder.(type) {
+	case JSONEncoding, JSONMarshalEncoding:
+	default:
+		return nil, fmt.Errorf("WriteRaw: Unsupported raw stats with a custom encoder")
+	}
+
+	// The capacity is capped, for the log message not to be appended to
+	// the caller's bytes.
+	jsonBytes = bytes.TrimSpace(jsonBytes)
+	return lst.formatEncoded(time.Time{}, statType, jsonBytes[:len(jsonBytes):len(jsonBytes)])
+}
+
+// formatEncoded returns the log message for the encoded stats, unless the
+// log message would span multiple lines.
+func (lst *logStats) formatEncoded(ts time.Time, statType string, encoded []byte) ([]byte, error) {
+	if strings.Contains(statType, "\n") {
+		return nil, lst.observeError(fmt.Errorf("Unsupported stat type %q, contains a new line", statType))
+	}
+
+	if bytes.IndexByte(encoded, '\n') >= 0 {
+		return nil, lst.observeError(fmt.Errorf("Encoded stats of type %v contain a new line", statType))
+	}
+
+	msg := lst.formatBytes(ts, statType, encoded)
+	lst.truncated = false
+	if lst.maxRecordBytes == 0 || len(msg) <= lst.maxRecordBytes {
+		lst.unwritten++
+		return msg, nil
+	}
+
+	err := fmt.Errorf("%w: log message of %v bytes for stat type %v, limit %v bytes",
+		ErrRecordTooLarge, len(msg), statType, lst.maxRecordBytes)
+	if !lst.truncateRecords {
+		return nil, lst.observeError(err)
+	}
+
+	marker := lst.formatBytes(ts, statType, []byte(fmt.Sprintf(`["%v",%v]`, TRUNCATED_MARKER, len(msg))))
+	if len(marker) > lst.maxRecordBytes {
+		return nil, lst.observeError(err)
+	}
+
+	lst.truncated = true
+	lst.unwritten++
+	return marker, nil
+}
+
+func (lst *logStats) formatBytes(ts time.Time, statType string, bytes []byte) []byte {
+	if ts.IsZero() {
+		ts = lst.now()
+	}
+
+	if lst.utc {
+		ts = ts.UTC()
+	}
+
+	tsFormat := lst.tsFormat
+	if typeTSFormat, ok := lst.typeTSFormats[statType]; ok {
+		tsFormat = typeTSFormat
+	}
+
+	var seq uint64
+	if lst.sequence {
+		seq = lst.seq + lst.unwritten + 1
+	}
+
+	if lst.jsonLines {
+		bytes = append(formatJSONLine(ts.Format(tsFormat), seq, statType, bytes), byte(10))
+	} else {
+		bytes = append(bytes, byte(10))
+
+		fields := make([]string, 0, len(lst.linePrefix)+4)
+		fields = append(fields, ts.Format(tsFormat))
+		if seq > 0 {
+			fields = append(fields, strconv.FormatUint(seq, 10))
+		}
+		fields = append(fields, lst.linePrefix...)
+		fields = append(fields, statType, "")
+		prefix := []byte(strings.Join(fields, " "))
+		bytes = append(prefix, bytes...)
+	}
+
+	if lst.framed {
+		return frameRecord(bytes[:len(bytes)-1])
+	}
+
+	return bytes
+}
+
+func (lst *logStats) needsRotation() bool {
+	if lst.noRotation {
+		return false
+	}
+
+	// An empty log file is never rotated, so that a size limit smaller
+	// than a log message - e.g. zero - leaves one log message per file,
+	// rather than rotating on every write and piling up empty files.
+	if lst.empty {
+		return false
+	}
+
+	if lst.sz >= lst.sizeLimit {
+		return true
+	}
+
+	if lst.maxLines > 0 && lst.lines >= lst.maxLines {
+		return true
+	}
+
+	if lst.rotateInterval > 0 && lst.now().Sub(lst.lastRotate) >= lst.rotateInterval {
+		return true
+	}
+
+	return lst.rotatePredicate != nil && lst.rotatePredicate(lst.rotationInfo())
+}
+
+// rotationInfo returns the state of the current log file, for the
+// rotation predicate.
+func (lst *logStats) rotationInfo() RotationInfo {
+	now := lst.now()
+	return RotationInfo{
+		FileName:   lst.fileName,
+		Size:       lst.sz,
+		Lines:      lst.lines,
+		Age:        now.Sub(lst.lastRotate),
+		LastRotate: lst.lastRotate,
+	}
+}
+
+// compressionType returns the compression to be used for the next rotation.
+func (lst *logStats) compressionType() CompressionType {
+	if !lst.compress {
+		return CompressionNone
+	}
+
+	if lst.compression == CompressionNone {
+		return CompressionGzip
+	}
+
+	return lst.compression
+}
+
+func (lst *logStats) SetCompression(enable bool) {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	lst.compress = enable
+}
+
+func (lst *logStats) Flush() error {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	if lst.closed {
+		return closedError("logStats")
+	}
+
+	return lst.observeError(lst.sync())
+}
+
+func (lst *logStats) DedupeReset() {
+}
+
+func (lst *logStats) Info() LogStatsInfo {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	info := LogStatsInfo{
+		CurrentFileSize:     lst.sz,
+		TotalBytes:          int64(lst.sz),
+		Rotations:           lst.rotations,
+		MaxObservedFileSize: lst.maxSz,
+		MaxRecordSize:       lst.maxRecord,
+		Records:             lst.records,
+		TypeRecords:         make(map[string]int64, len(lst.typeRecords)),
+	}
+
+	for statType, n := range lst.typeRecords {
+		info.TypeRecords[statType] = n
+	}
+
+	files, err := getRotatedLogFiles(lst.fileName, lst.fileNamer)
+	if err != nil {
+		info.ScanErr = err
+		return info
+	}
+
+	var rotatedBytes int64
+	for _, file := range files {
+		finfo, err := os.Stat(file.name)
+		if err != nil {
+			info.ScanErr = err
+			return info
+		}
+
+		rotatedBytes += finfo.Size()
+	}
+
+	info.RotatedFiles = len(files)
+	info.TotalBytes += rotatedBytes
+	return info
+}
+
+func (lst *logStats) LastWrite(statType string) (time.Time, bool) {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	ts, ok := lst.lastWrites[statType]
+	return ts, ok
+}
+
+func (lst *logStats) StaleTypes(threshold time.Duration) []string {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	now := lst.now()
+	stale := make([]string, 0)
+	for statType, ts := range lst.lastWrites {
+		if now.Sub(ts) > threshold {
+			stale = append(stale, statType)
+		}
+	}
+	sort.Strings(stale)
+
+	return stale
+}
+
+func (lst *logStats) Files() []string {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	files, err := listLogFiles(lst.fileName, lst.fileNamer)
+	if err != nil {
+		return nil
+	}
+
+	for i, file := range files {
+		abs, err := filepath.Abs(file)
+		if err == nil {
+			files[i] = abs
+		}
+	}
+
+	return files
+}
+
+func (lst *logStats) Snapshot() (*FileSnapshot, error) {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	if lst.closed {
+		return nil, closedError("logStats")
+	}
+
+	// The buffered stats are part of the snapshot.
+	err := lst.observeError(lst.flushBuffer())
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := listLogFiles(lst.fileName, lst.fileNamer)
+	if err != nil {
+		return nil, err
+	}
+
+	return openFileSnapshot(lst.fileName, files, lst.compressionDict)
+}
+
+func (lst *logStats) Close() error {
+	lst.lock.Lock()
+	defer lst.lock.Unlock()
+
+	return lst.close()
+}
+
+func (lst *logStats) close() error {
+	if lst.closed {
+		return nil
+	}
+
+	var err error
+	if lst.f != nil {
+		err = lst.flushBuffer()
+		if err == nil && lst.cf != nil {
+			// Completes the gzip stream.
+			err = lst.cf.Close()
+		}
+		if err == nil && (lst.durable || lst.syncInterval > 0 || lst.syncEveryBytes > 0) {
+			err = lst.f.Sync()
+		}
+
+		closeErr := lst.f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	// Released only once the log file is closed.
+	lst.lockFile.Close()
+
+	lst.f = nil
+	lst.w = nil
+	lst.cf = nil
+	if lst.stopSync != nil {
+		close(lst.stopSync)
+	}
+
+	lst.closed = true
+	return lst.observeError(err)
+}
+
+// dedupeLogStats. Supports log rotation. Stats get deduplicated across
+// consecutive log messages of same type. This can save a lot of space
+// but it comes with a cost that the individual log message cannot be
+// consumed as-is. Deduplication resets on log rotation.
+type dedupeLogStats struct {
+	*logStats
+
+	prevStatsMap map[string]map[string]interface{}
+
+	// Timestamps of the previous stats, for WithRotationSnapshot.
+	prevTimes map[string]time.Time
+
+	// Number of stats written per type, since the last full stats.
+	writeCounts map[string]int
+
+	// The previous stats of the types reset by DedupeReset, yet to be
+	// written in full, for them to list the keys removed since.
+	resetStatsMap map[string]map[string]interface{}
+}
+
+// Create new LogStats object.
+// Paramters:
+// fileName:  Name of the log file. If the file name does not have ".log"
+//
+//	extension, it will be added internally - and the final log
+//	file will have the ".log" extension.
+//
+// sizeLimit: Size limit for one file. It is not a hard limit. A single
+//
+//	log message cannot cross the log file boundary. So, as long
+//	as the current file has not reached its size limit, the
+//	incoming log message will be written to the current file.
+//	This can lead to log files larger than sizeLimit.
+//
+// numFiles:  Number of log files to be maintained.
+// tsFormat:  Format in which the timestamps in the log messages are
+//
+//	to be logged. Must be a valid time layout, e.g. time.RFC3339.
+//
+// opts:      Optional settings, see Option.
+func NewDedupeLogStats(fileName string, sizeLimit int, numFiles int, tsFormat string, opts ...Option) (*dedupeLogStats, error) {
+	opts = positionalOptions(sizeLimit, numFiles, tsFormat, opts)
+	lStats, err := newLogStats(fileName, append(opts, WithDedupe(true)))
+	if err != nil {
+		return nil, err
+	}
+
+	return newDedupeLogStats(lStats), nil
+}
+
+func newDedupeLogStats(lStats *logStats) *dedupeLogStats {
+	return &dedupeLogStats{
+		logStats:      lStats,
+		prevStatsMap:  make(map[string]map[string]interface{}),
+		prevTimes:     make(map[string]time.Time),
+		writeCounts:   make(map[string]int),
+		resetStatsMap: make(map[string]map[string]interface{}),
+	}
+}
+
+func (dlst *dedupeLogStats) Write(statType string, statMap map[string]interface{}) error {
+	return dlst.WriteContext(context.Background(), statType, statMap)
+}
+
+func (dlst *dedupeLogStats) WritePath(statType string, statMap map[string]interface{}) (string, error) {
+	err := dlst.Write(statType, statMap)
+	if err != nil {
+		return "", err
+	}
+
+	return dlst.currentFilePath(), nil
+}
+
+func (dlst *dedupeLogStats) WriteContext(ctx context.Context, statType string, statMap map[string]interface{}) error {
+	return dlst.write(ctx, time.Time{}, statType, statMap)
+}
+
+func (dlst *dedupeLogStats) WriteAt(ts time.Time, statType string, statMap map[string]interface{}) error {
+	return dlst.write(context.Background(), ts, statType, statMap)
+}
+
+// write writes the deduplicated stats with timestamp ts - or, if ts is
+// zero, the time of the write.
+func (dlst *dedupeLogStats) write(ctx context.Context, ts time.Time, statType string, statMap map[string]interface{}) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	dlst.lock.Lock()
+	defer dlst.lock.Unlock()
+
+	if dlst.closed {
+		return closedError("dedupeLogStats")
+	}
+
+	// ctx may be done while waiting for the lock.
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	// Deduplication resets on rotation, irrespective of whether the
+	// rotation was triggered by size or by time.
+	rotated, err := dlst.rotateIfNeeded()
+	if rotated {
+		// Reset even if the rotation fails, as the previous stats may
+		// have been rotated out.
+		err = dlst.afterRotation(err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var bytes []byte
+	bytes, err = dlst.getDedupedBytesToWrite(ts, statType, statMap)
+	if err != nil {
+		return err
+	}
+
+	err = dlst.commit(ctx, bytes)
+	if err != nil {
+		return err
+	}
+
+	dlst.observeWrite(statType, len(bytes))
+	return nil
+}
+
+func (dlst *dedupeLogStats) WriteBatch(stats []StatEntry) error {
+	dlst.lock.Lock()
+	defer dlst.lock.Unlock()
+
+	if dlst.closed {
+		return closedError("dedupeLogStats")
+	}
+
+	rotated, err := dlst.rotateIfNeeded()
+	if rotated {
+		err = dlst.afterRotation(err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var batch []byte
+	var sizes = make([]int, 0, len(stats))
+	for _, entry := range stats {
+		bytes, err := dlst.getDedupedBytesToWrite(time.Time{}, entry.Type, entry.Map)
+		if err != nil {
+			// The stats deduplicated so far are not written.
+			dlst.resetPrevStatsMap()
+			dlst.unwritten = 0
+			return err
+		}
+
+		batch = append(batch, bytes...)
+		sizes = append(sizes, len(bytes))
+	}
+
+	err = dlst.commit(context.Background(), batch)
+	if err != nil {
+		return err
+	}
+
+	dlst.observeBatch(stats, sizes)
+	return nil
+}
+
+func (dlst *dedupeLogStats) WriteStruct(statType string, v interface{}) error {
+	statMap, err := dlst.structToStatMap(statType, v)
+	if err != nil {
+		return err
+	}
+
+	return dlst.Write(statType, statMap)
+}
+
+func (dlst *dedupeLogStats) WriteValue(statType string, v interface{}) error {
+	if statMap, ok := v.(map[string]interface{}); ok {
+		return dlst.Write(statType, statMap)
+	}
+
+	dlst.lock.Lock()
+	defer dlst.lock.Unlock()
+
+	if dlst.closed {
+		return closedError("dedupeLogStats")
+	}
+
+	rotated, err := dlst.rotateIfNeeded()
+	if rotated {
+		err = dlst.afterRotation(err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	bytes, err := dlst.getValueBytesToWrite(statType, v)
+	if err != nil {
+		return err
+	}
+
+	// The values are not deduplicated, nor do they affect the
+	// deduplication of the stat maps.
+	err = dlst.commit(context.Background(), bytes)
+	if err != nil {
+		return err
+	}
+
+	dlst.observeWrite(statType, len(bytes))
+	return nil
+}
+
+// WriteRaw writes the raw stats in full, unless rawDedupe is set - in which
+// case they are decoded and deduplicated as by Write.
+func (dlst *dedupeLogStats) WriteRaw(statType string, jsonBytes []byte) error {
+	if dlst.rawDedupe {
+		statMap := make(map[string]interface{})
+		err := decodeJSON(jsonBytes, &statMap)
+		if err != nil {
+			return fmt.Errorf("WriteRaw: Malformed stats of type %v: %v", statType, err)
+		}
+
+		return dlst.Write(statType, statMap)
+	}
+
+	dlst.lock.Lock()
+	defer dlst.lock.Unlock()
+
+	if dlst.closed {
+		return closedError("dedupeLogStats")
+	}
+
+	rotated, err := dlst.rotateIfNeeded()
+	if rotated {
+		err = dlst.afterRotation(err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	bytes, err := dlst.getRawBytesToWrite(statType, jsonBytes)
+	if err != nil {
+		return err
+	}
+
+	// The next stats of the type are deduplicated against the raw stats
+	// by the reconstruction, so they must be written in full.
+	dlst.forgetStats(statType)
+
+	err = dlst.commit(context.Background(), bytes)
+	if err != nil {
+		return err
+	}
+
+	dlst.observeWrite(statType, len(bytes))
+	return nil
+}
+
+// getDedupedBytesToWrite deduplicates statMap against the previous stats
+// of the same type, and records a deep copy of statMap as the previous
+// stats, for the caller to reuse and mutate statMap once written. The
+// stats deduplicated within the float epsilon keep their logged values
+// instead, refer nextBaseline.
+func (dlst *dedupeLogStats) getDedupedBytesToWrite(ts time.Time, statType string, statMap map[string]interface{}) ([]byte, error) {
+	var bytes []byte
+	var err error
+
+	if ts.IsZero() {
+		ts = dlst.now()
+	}
+
+	prevMap, ok := dlst.prevStatsMap[statType]
+	if ok && dlst.snapshotEvery > 0 && dlst.writeCounts[statType] >= dlst.snapshotEvery {
+		// Time for a full snapshot, which records the keys removed since
+		// the previous stats, as the reconstruction merges it into them.
+		fullMap, removed := withRemovedKeys(prevMap, statMap)
+		if removed {
+			bytes, err = dlst.logStats.getBytesToWrite(ts, statType, fullMap)
+		} else {
+			bytes, err = dlst.logStats.getBytesToWrite(ts, statType, statMap)
+		}
+		dlst.writeCounts[statType] = 0
+		ok = false
+	} else if !ok {
+		// The full stats following a DedupeReset record the keys removed
+		// since the previous stats, as the snapshots do.
+		fullMap, removed := statMap, false
+		if resetMap, reset := dlst.resetStatsMap[statType]; reset {
+			fullMap, removed = withRemovedKeys(resetMap, statMap)
+		}
+
+		if removed {
+			bytes, err = dlst.logStats.getBytesToWrite(ts, statType, fullMap)
+		} else {
+			bytes, err = dlst.logStats.getBytesToWrite(ts, statType, statMap)
+		}
+		dlst.writeCounts[statType] = 0
+	} else {
+		filteredMap := make(map[string]interface{})
+		populateFilteredMap(prevMap, statMap, filteredMap, dlst.floatEpsilon)
+		bytes, err = dlst.logStats.getBytesToWrite(ts, statType, filteredMap)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	delete(dlst.resetStatsMap, statType)
+	if dlst.truncated {
+		dlst.forgetStats(statType)
+		return bytes, nil
+	}
+
+	if ok && dlst.floatEpsilon > 0 {
+		dlst.prevStatsMap[statType] = nextBaseline(prevMap, statMap, dlst.floatEpsilon)
+	} else {
+		dlst.prevStatsMap[statType] = copyStatMap(statMap)
+	}
+	dlst.prevTimes[statType] = ts
+	dlst.writeCounts[statType]++
+	return bytes, nil
+}
+
+// afterRotation resets the deduplication once the log file is rotated -
+// rotateErr being the rotation failure, if any. With WithRotationSnapshot,
+// the previous stats are carried over instead, and written in full at the
+// top of the new log file, with their original timestamps.
+func (dlst *dedupeLogStats) afterRotation(rotateErr error) error {
+	if rotateErr != nil || !dlst.rotationSnapshot {
+		dlst.resetPrevStatsMap()
+		return rotateErr
+	}
+
+	statTypes := make([]string, 0, len(dlst.prevStatsMap))
+	for statType := range dlst.prevStatsMap {
+		statTypes = append(statTypes, statType)
+	}
+
+	return dlst.writeSnapshots(statTypes)
+}
+
+// writeSnapshots writes the previous stats of statTypes in full, in the
+// order of their types, with their original timestamps. If a write fails,
+// the deduplication is reset.
+func (dlst *dedupeLogStats) writeSnapshots(statTypes []string) error {
+	sort.Strings(statTypes)
+	for _, statType := range statTypes {
+		bytes, err := dlst.logStats.getBytesToWrite(dlst.prevTimes[statType], statType, dlst.prevStatsMap[statType])
+		truncated := dlst.truncated
+		if err == nil {
+			err = dlst.writeAndCommit(context.Background(), bytes)
+		}
+
+		if err != nil {
+			dlst.resetPrevStatsMap()
+			return err
+		}
+
+		dlst.writeCounts[statType] = 1
+		if truncated {
+			dlst.forgetStats(statType)
+		}
+		dlst.observeRecord(statType, len(bytes))
+	}
+
+	return nil
+}
+
+// commit writes the deduplicated bytes. If the write fails, the
+// deduplication is reset as the previous stats may not have been written.
+func (dlst *dedupeLogStats) commit(ctx context.Context, bytes []byte) error {
+	err := dlst.writeAndCommit(ctx, bytes)
+	if err != nil {
+		dlst.resetPrevStatsMap()
+	}
+
+	return err
+}
+
+func (dlst *dedupeLogStats) Rotate() error {
+	dlst.lock.Lock()
+	defer dlst.lock.Unlock()
+
+	if dlst.closed {
+		return closedError("dedupeLogStats")
+	}
+
+	// Reset even if the rotation fails, as the previous stats may have
+	// been rotated out.
+	return dlst.afterRotation(dlst.rotate())
+}
+
+// Close writes the full stats of each type whose last stats were
+// deduplicated, with WithCloseSnapshot, before closing the log file.
+func (dlst *dedupeLogStats) Close() error {
+	dlst.lock.Lock()
+	defer dlst.lock.Unlock()
+
+	if dlst.closed || !dlst.closeSnapshot {
+		return dlst.close()
+	}
+
+	statTypes := make([]string, 0, len(dlst.prevStatsMap))
+	for statType := range dlst.prevStatsMap {
+		// Written in full already.
+		if dlst.writeCounts[statType] != 1 {
+			statTypes = append(statTypes, statType)
+		}
+	}
+
+	err := dlst.writeSnapshots(statTypes)
+	closeErr := dlst.close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (dlst *dedupeLogStats) AsWriter(statType string) io.Writer {
+	return &statWriter{ls: dlst, statType: statType}
+}
+
+// DedupeReset resets the deduplication. As the reconstruction merges the
+// full stats written next into the previous stats, the full stats list the
+// keys removed since the previous stats, which a consumer starting to read
+// the log file after the reset ignores.
+func (dlst *dedupeLogStats) DedupeReset() {
+	dlst.lock.Lock()
+	defer dlst.lock.Unlock()
+
+	// The types reset earlier, yet to be written, keep their stats.
+	resetStatsMap := dlst.resetStatsMap
+	for statType, prevMap := range dlst.prevStatsMap {
+		resetStatsMap[statType] = prevMap
+	}
+
+	dlst.resetPrevStatsMap()
+	dlst.resetStatsMap = resetStatsMap
+}
+
+// CurrentBaseline returns the stats of statType the next stats of the type
+// would be deduplicated against, i.e. the full stats last written, and
+// whether there are any, e.g. for debugging. The stats are a deep copy -
+// of the nested maps and arrays - owned by the caller. None after the
+// deduplication resets, e.g. on rotation.
+func (dlst *dedupeLogStats) CurrentBaseline(statType string) (map[string]interface{}, bool) {
+	dlst.lock.Lock()
+	defer dlst.lock.Unlock()
+
+	prevMap, ok := dlst.prevStatsMap[statType]
+	if !ok {
+		return nil, false
+	}
+
+	return copyStatMap(prevMap), true
+}
 
+// forgetStats forgets the previous stats of statType, for its next stats
+// to be written in full, e.g. as the stats written were truncated.
+func (dlst *dedupeLogStats) forgetStats(statType string) {
+	delete(dlst.prevStatsMap, statType)
+	delete(dlst.prevTimes, statType)
+	delete(dlst.writeCounts, statType)
 }
 
 func (dlst *dedupeLogStats) resetPrevStatsMap() {
 	dlst.prevStatsMap = make(map[string]map[string]interface{})
+	dlst.prevTimes = make(map[string]time.Time)
+	dlst.writeCounts = make(map[string]int)
+	dlst.resetStatsMap = make(map[string]map[string]interface{})
 }
 
 var gStatLogger LogStats
@@ -11,16 +11,25 @@ licenses/APL2.txt.
 package logstats
 
 import (
+	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestLogStatsBasics(t *testing.T) {
@@ -41,7 +50,7 @@ func TestLogStatsBasics(t *testing.T) {
 
 	defer statLogger.Close()
 
-	statLogger.(*logStats).disableCompression()
+	statLogger.(*logStats).SetCompression(false)
 
 	// Write a stat
 	stat := getSimpleStat(0)
@@ -58,7 +67,7 @@ func TestLogStatsBasics(t *testing.T) {
 	exp = append(exp, vstat)
 
 	// Verify stats
-	err = verifyStats(exp, fileName, false)
+	err = verifyStats(exp, fileName, CompressionNone)
 	if err != nil {
 		t.Fatalf("TestLogStatsBasics failed with error %v", err)
 	}
@@ -82,7 +91,7 @@ func TestLogStatsRotation(t *testing.T) {
 
 	defer statLogger.Close()
 
-	statLogger.(*logStats).disableCompression()
+	statLogger.(*logStats).SetCompression(false)
 
 	// Write a stat
 	exp := make([]map[string]interface{}, 0)
@@ -100,7 +109,7 @@ func TestLogStatsRotation(t *testing.T) {
 	}
 
 	// Verify stats
-	err = verifyStats(exp, fileName, false)
+	err = verifyStats(exp, fileName, CompressionNone)
 	if err != nil {
 		t.Fatalf("TestLogStatsRotation failed with error %v", err)
 	}
@@ -124,7 +133,7 @@ func TestDedupeLogStatsBasics(t *testing.T) {
 
 	defer statLogger.Close()
 
-	statLogger.(*dedupeLogStats).disableCompression()
+	statLogger.(*dedupeLogStats).SetCompression(false)
 
 	// Write dedupe stats
 	stat := getSimpleStat(0)
@@ -172,7 +181,7 @@ func TestDedupeLogStatsBasics(t *testing.T) {
 	exp = append(exp, vstat)
 
 	// Verify stats
-	err = verifyStats(exp, fileName, false)
+	err = verifyStats(exp, fileName, CompressionNone)
 	if err != nil {
 		t.Fatalf("TestDedupeLogStatsBasics failed with error %v", err)
 	}
@@ -196,7 +205,7 @@ func TestDedupeLogStatsRotate(t *testing.T) {
 
 	defer statLogger.Close()
 
-	statLogger.(*dedupeLogStats).disableCompression()
+	statLogger.(*dedupeLogStats).SetCompression(false)
 
 	// Write dedupe stats
 	stat := getSimpleStat(0)
@@ -258,7 +267,7 @@ func TestDedupeLogStatsRotate(t *testing.T) {
 	exp = append(exp, vstat)
 
 	// Verify stats
-	err = verifyStats(exp, fileName, false)
+	err = verifyStats(exp, fileName, CompressionNone)
 	if err != nil {
 		t.Fatalf("TestDedupeLogStatsRotate failed with error %v", err)
 	}
@@ -342,7 +351,7 @@ func TestCompressionWithRotation(t *testing.T) {
 	exp = append(exp, vstat)
 
 	// Verify stats
-	err = verifyStats(exp, fileName, true)
+	err = verifyStats(exp, fileName, CompressionGzip)
 	if err != nil {
 		t.Fatalf("TestCompressionWithRotation failed with error %v", err)
 	}
@@ -385,12 +394,5572 @@ func TestNumFiles(t *testing.T) {
 	exp = exp[2:]
 
 	// Verify stats
-	err = verifyStats(exp, fileName, true)
+	err = verifyStats(exp, fileName, CompressionGzip)
 	if err != nil {
 		t.Fatalf("TestNumFiles failed with error %v", err)
 	}
 }
 
+func TestNew(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "new.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestNew failed with error %v", err)
+	}
+
+	// Defaults
+	var statLogger LogStats
+	statLogger, err = New(fileName)
+	if err != nil {
+		t.Fatalf("TestNew failed with error %v", err)
+	}
+
+	lst := statLogger.(*logStats)
+	if lst.sizeLimit != DEFAULT_SIZE_LIMIT || lst.numFiles != DEFAULT_NUM_FILES ||
+		lst.tsFormat != DEFAULT_TS_FORMAT || lst.durable {
+		t.Fatalf("TestNew failed: unexpected defaults %+v", lst.config)
+	}
+
+	statLogger.Close()
+
+	err = cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestNew failed with error %v", err)
+	}
+
+	// Deduplicating logger, rotating on each write
+	statLogger, err = New(fileName, WithDedupe(true), WithSizeLimit(0), WithNumFiles(3),
+		WithTSFormat(time.RFC3339), WithCompression(CompressionNone), WithDurable(true))
+	if err != nil {
+		t.Fatalf("TestNew failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	if !statLogger.(*dedupeLogStats).durable {
+		t.Fatalf("TestNew failed: the logger is not durable")
+	}
+
+	stat := getSimpleStat(0)
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 3; i++ {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestNew failed with error %v", err)
+		}
+
+		// The deduplicated stats are reset on rotation.
+		exp = append(exp, map[string]interface{}{"type": "kStats", "stat": stat})
+	}
+
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestNew failed with error %v", err)
+	}
+
+	// Invalid options
+	for _, opt := range []Option{WithSizeLimit(-1), WithNumFiles(0),
+		WithNumFiles(MAX_NUM_FILES + 1), WithTSFormat("")} {
+
+		_, err = New(fileName, opt)
+		if err == nil {
+			t.Fatalf("TestNew failed: invalid option accepted")
+		}
+	}
+}
+
+// hexEncoding encodes the stats as hex encoded JSON.
+type hexEncoding struct{}
+
+func (hexEncoding) Encode(statMap map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(statMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(hex.EncodeToString(data)), nil
+}
+
+func (hexEncoding) Decode(data []byte) (map[string]interface{}, error) {
+	decoded, err := hex.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return JSONEncoding{}.Decode(decoded)
+}
+
+func TestEncoder(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "encoder.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestEncoder failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		WithEncoder(hexEncoding{}))
+	if err != nil {
+		t.Fatalf("TestEncoder failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	full := make([]map[string]interface{}, 0)
+	for i := 0; i < 3; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i)
+		full = append(full, stat)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestEncoder failed with error %v", err)
+		}
+	}
+
+	// The payload is encoded, the prefix is not.
+	lines, err := getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestEncoder failed with error %v", err)
+	}
+
+	comps := strings.SplitN(lines[1], " ", 3)
+	if comps[1] != "kStats" || comps[2] != hex.EncodeToString([]byte(`{"k1":1}`)) {
+		t.Fatalf("TestEncoder failed: unexpected line %v", lines[1])
+	}
+
+	// Reading back with the matching decoder
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestEncoder failed with error %v", err)
+	}
+
+	defer reader.Close()
+
+	reader.SetDecoder(hexEncoding{})
+	for i := range full {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestEncoder failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(full[i], stat) {
+			t.Fatalf("TestEncoder failed: exp %v actual %v", full[i], stat)
+		}
+	}
+
+	// Reconstructing with the matching encoding
+	source, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestEncoder failed with error %v", err)
+	}
+
+	var output bytes.Buffer
+	err = ReconstructStatFileWithOptions(bytes.NewReader(source), &output,
+		ReconstructOptions{Workers: 2, Encoding: hexEncoding{}})
+	if err != nil {
+		t.Fatalf("TestEncoder failed with error %v", err)
+	}
+
+	for i, line := range strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n") {
+		comps := strings.SplitN(line, " ", 3)
+		stat, err := hexEncoding{}.Decode([]byte(comps[2]))
+		if err != nil {
+			t.Fatalf("TestEncoder failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(full[i], stat) {
+			t.Fatalf("TestEncoder failed: exp %v actual %v", full[i], stat)
+		}
+	}
+}
+
+func TestJSONMarshaller(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "json_marshaller.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestJSONMarshaller failed with error %v", err)
+	}
+
+	var marshalled, unmarshalled int
+	marshal := func(v interface{}) ([]byte, error) {
+		marshalled++
+		return json.Marshal(v)
+	}
+	unmarshal := func(data []byte, v interface{}) error {
+		unmarshalled++
+		return decodeJSON(data, v)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		WithJSONMarshaller(marshal))
+	if err != nil {
+		t.Fatalf("TestJSONMarshaller failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	full := make([]map[string]interface{}, 0)
+	for i := 0; i < 3; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i)
+		full = append(full, stat)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestJSONMarshaller failed with error %v", err)
+		}
+	}
+
+	err = statLogger.WriteValue("kValues", []int{1, 2})
+	if err != nil {
+		t.Fatalf("TestJSONMarshaller failed with error %v", err)
+	}
+
+	if marshalled != 4 {
+		t.Fatalf("TestJSONMarshaller failed: exp 4 marshals actual %v", marshalled)
+	}
+
+	// The stats are plain JSON, as written by json.Marshal.
+	lines, err := getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestJSONMarshaller failed with error %v", err)
+	}
+
+	comps := strings.SplitN(lines[1], " ", 3)
+	if comps[1] != "kStats" || comps[2] != `{"k1":1}` {
+		t.Fatalf("TestJSONMarshaller failed: unexpected line %v", lines[1])
+	}
+
+	// Reading back with the matching unmarshaller
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestJSONMarshaller failed with error %v", err)
+	}
+
+	defer reader.Close()
+
+	reader.SetDecoder(JSONMarshalEncoding{Unmarshal: unmarshal})
+	for i := range full {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestJSONMarshaller failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(full[i], stat) {
+			t.Fatalf("TestJSONMarshaller failed: exp %v actual %v", full[i], stat)
+		}
+	}
+
+	if unmarshalled != len(full) {
+		t.Fatalf("TestJSONMarshaller failed: exp %v unmarshals actual %v", len(full), unmarshalled)
+	}
+
+	// Reconstructing with the matching encoding
+	source, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestJSONMarshaller failed with error %v", err)
+	}
+
+	var output bytes.Buffer
+	err = ReconstructStatFileWithOptions(bytes.NewReader(source), &output,
+		ReconstructOptions{Encoding: JSONMarshalEncoding{Marshal: marshal, Unmarshal: unmarshal}})
+	if err != nil {
+		t.Fatalf("TestJSONMarshaller failed with error %v", err)
+	}
+
+	outLines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	for i := range full {
+		comps := strings.SplitN(outLines[i], " ", 3)
+		stat, err := JSONEncoding{}.Decode([]byte(comps[2]))
+		if err != nil {
+			t.Fatalf("TestJSONMarshaller failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(full[i], stat) {
+			t.Fatalf("TestJSONMarshaller failed: exp %v actual %v", full[i], stat)
+		}
+	}
+
+	// Invalid option
+	_, err = New(fileName, WithJSONMarshaller(nil))
+	if err == nil {
+		t.Fatalf("TestJSONMarshaller failed: nil marshaller accepted")
+	}
+}
+
+// newLineEncoder encodes the stats with a raw new line.
+type newLineEncoder struct{}
+
+func (newLineEncoder) Encode(statMap map[string]interface{}) ([]byte, error) {
+	return []byte("{\n}"), nil
+}
+
+func TestNewLineInStats(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "new_line.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestNewLineInStats failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestNewLineInStats failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	full := []map[string]interface{}{
+		{"k1": "first line\nsecond line\n", "k2": int64(1)},
+		{"k1": "first line\nsecond line\n", "k2": int64(2)},
+	}
+
+	for _, stat := range full {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestNewLineInStats failed with error %v", err)
+		}
+	}
+
+	// One record per line, as JSON escapes the new lines.
+	lines, err := getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestNewLineInStats failed with error %v", err)
+	}
+
+	if len(lines) != len(full) {
+		t.Fatalf("TestNewLineInStats failed: exp %v lines actual %v", len(full), lines)
+	}
+
+	err = verifyReader(full, fileName, true, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("TestNewLineInStats failed with error %v", err)
+	}
+
+	// The stat types and the encoded stats with new lines are rejected.
+	err = statLogger.Write("k\nStats", full[0])
+	if err == nil {
+		t.Fatalf("TestNewLineInStats failed: stat type with a new line written")
+	}
+
+	rawFileName := filepath.Join(tmpDir, "new_line_raw.log")
+	err = cleanup([]string{rawFileName})
+	if err != nil {
+		t.Fatalf("TestNewLineInStats failed with error %v", err)
+	}
+
+	var rawLogger LogStats
+	rawLogger, err = NewLogStats(rawFileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		WithEncoder(newLineEncoder{}))
+	if err != nil {
+		t.Fatalf("TestNewLineInStats failed with error %v", err)
+	}
+
+	defer rawLogger.Close()
+
+	err = rawLogger.Write("kStats", full[0])
+	if err == nil {
+		t.Fatalf("TestNewLineInStats failed: encoded stats with a new line written")
+	}
+
+	lines, err = getAllLogsFromFiles(rawFileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestNewLineInStats failed with error %v", err)
+	}
+
+	if len(lines) != 0 {
+		t.Fatalf("TestNewLineInStats failed: exp no lines actual %v", lines)
+	}
+}
+
+func TestRotatedFileComplete(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "rotated_complete.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestRotatedFileComplete failed with error %v", err)
+	}
+
+	tsFormat := "2006-01-02T15:04:05.000-07:00"
+
+	// Non-durable and buffered, so that nothing but the rotation gets the
+	// stats to the disk.
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024, 2, tsFormat,
+		WithBufferSize(64*1024), WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatalf("TestRotatedFileComplete failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var exp []byte
+	for i := 0; ; i++ {
+		stat := getSimpleStat(i)
+		err = statLogger.WriteAt(ts, "kStats", stat)
+		if err != nil {
+			t.Fatalf("TestRotatedFileComplete failed with error %v", err)
+		}
+
+		info := statLogger.Info()
+		if info.ScanErr != nil {
+			t.Fatalf("TestRotatedFileComplete failed with error %v", info.ScanErr)
+		}
+
+		if info.Rotations > 0 {
+			break
+		}
+
+		data, err := json.Marshal(stat)
+		if err != nil {
+			t.Fatalf("TestRotatedFileComplete failed with error %v", err)
+		}
+
+		exp = append(exp, ts.Format(tsFormat)+" kStats "...)
+		exp = append(exp, data...)
+		exp = append(exp, '\n')
+	}
+
+	actual, err := os.ReadFile(getLogFileName(fileName, 1, CompressionNone))
+	if err != nil {
+		t.Fatalf("TestRotatedFileComplete failed with error %v", err)
+	}
+
+	if !bytes.Equal(exp, actual) {
+		t.Fatalf("TestRotatedFileComplete failed: exp %s actual %s", exp, actual)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("TestFileMode skipped, no unix permissions on windows")
+	}
+
+	tmpDir := t.TempDir()
+
+	// The permissions are subject to the umask, probe it.
+	probe := filepath.Join(tmpDir, "probe")
+	err := os.WriteFile(probe, nil, 0o777)
+	if err != nil {
+		t.Fatalf("TestFileMode failed with error %v", err)
+	}
+
+	finfo, err := os.Stat(probe)
+	if err != nil {
+		t.Fatalf("TestFileMode failed with error %v", err)
+	}
+	umask := 0o777 &^ finfo.Mode().Perm()
+
+	dir := filepath.Join(tmpDir, "stats")
+	fileName := filepath.Join(dir, "file_mode.log")
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 32, 3, "2006-01-02T15:04:05.000-07:00",
+		WithFileMode(0o640), WithDirMode(0o750))
+	if err != nil {
+		t.Fatalf("TestFileMode failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Rotate, so that a compressed file gets created as well.
+	for i := 0; i < 2; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestFileMode failed with error %v", err)
+		}
+	}
+
+	exp := map[string]os.FileMode{
+		dir:      0o750 &^ umask,
+		fileName: 0o640 &^ umask,
+		getLogFileName(fileName, 1, CompressionGzip): 0o640 &^ umask,
+	}
+
+	for name, mode := range exp {
+		finfo, err = os.Stat(name)
+		if err != nil {
+			t.Fatalf("TestFileMode failed with error %v", err)
+		}
+
+		if finfo.Mode().Perm() != mode {
+			t.Fatalf("TestFileMode failed: exp mode %v for %v actual %v", mode, name, finfo.Mode().Perm())
+		}
+	}
+
+	for _, opt := range []Option{WithFileMode(os.ModeDir | 0o640), WithDirMode(os.ModeSetuid | 0o750)} {
+		_, err = NewLogStats(fileName, 32, 3, "2006-01-02T15:04:05.000-07:00", opt)
+		if err == nil {
+			t.Fatalf("TestFileMode failed: invalid mode accepted")
+		}
+	}
+}
+
+// recordingObserver records the notifications of a LogStats object.
+type recordingObserver struct {
+	writes    map[string]int
+	bytes     int
+	rotations []string
+	errs      []error
+}
+
+func (o *recordingObserver) OnWrite(statType string, bytes int) {
+	o.writes[statType]++
+	o.bytes += bytes
+}
+
+func (o *recordingObserver) OnRotate(fileName string) {
+	o.rotations = append(o.rotations, fileName)
+}
+
+func (o *recordingObserver) OnError(err error) {
+	o.errs = append(o.errs, err)
+}
+
+func TestObserver(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "observer.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestObserver failed with error %v", err)
+	}
+
+	observer := &recordingObserver{writes: make(map[string]int)}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 256, 10, "2006-01-02T15:04:05.000-07:00",
+		WithCompression(CompressionNone), WithObserver(observer))
+	if err != nil {
+		t.Fatalf("TestObserver failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	for i := 0; i < 10; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i%2))
+		if err != nil {
+			t.Fatalf("TestObserver failed with error %v", err)
+		}
+	}
+
+	err = statLogger.WriteBatch([]StatEntry{
+		{Type: "kStats", Map: getSimpleStat(0)},
+		{Type: "iStats", Map: getSimpleStat(1)},
+	})
+	if err != nil {
+		t.Fatalf("TestObserver failed with error %v", err)
+	}
+
+	writeErr := statLogger.Write("k\nStats", getSimpleStat(0))
+	if writeErr == nil {
+		t.Fatalf("TestObserver failed: stat type with a new line written")
+	}
+
+	info := statLogger.Info()
+	if info.ScanErr != nil {
+		t.Fatalf("TestObserver failed with error %v", info.ScanErr)
+	}
+
+	if !reflect.DeepEqual(observer.writes, map[string]int{"kStats": 11, "iStats": 1}) {
+		t.Fatalf("TestObserver failed: unexpected writes %v", observer.writes)
+	}
+
+	// All the log files are retained, uncompressed.
+	if int64(observer.bytes) != info.TotalBytes {
+		t.Fatalf("TestObserver failed: exp %v bytes written actual %v", info.TotalBytes, observer.bytes)
+	}
+
+	if len(observer.rotations) == 0 || uint64(len(observer.rotations)) != info.Rotations {
+		t.Fatalf("TestObserver failed: exp %v rotations actual %v", info.Rotations, observer.rotations)
+	}
+
+	for _, name := range observer.rotations {
+		if name != fileName {
+			t.Fatalf("TestObserver failed: unexpected rotation of %v", name)
+		}
+	}
+
+	if len(observer.errs) != 1 || observer.errs[0] != writeErr {
+		t.Fatalf("TestObserver failed: unexpected errors %v", observer.errs)
+	}
+}
+
+func TestRepairOnOpen(t *testing.T) {
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "repair_on_open.log")
+
+	complete := `2024-01-01T00:00:00.000+00:00 kStats {"k1":1}` + "\n"
+	partial := `2024-01-01T00:00:01.000+00:00 kStats {"k1":`
+
+	tests := []struct {
+		content string
+		exp     string
+	}{
+		{complete + partial, complete},
+		{complete + partial + strings.Repeat("1", 10000), complete},
+		{complete + complete, complete + complete},
+		{partial, ""},
+		{"", ""},
+	}
+
+	for i, tst := range tests {
+		err := cleanup([]string{fileName})
+		if err != nil {
+			t.Fatalf("TestRepairOnOpen failed with error %v", err)
+		}
+
+		// Simulate a crash in the middle of a write
+		err = os.WriteFile(fileName, []byte(tst.content), 0644)
+		if err != nil {
+			t.Fatalf("TestRepairOnOpen failed with error %v", err)
+		}
+
+		var statLogger LogStats
+		statLogger, err = New(fileName, WithRepairOnOpen(true))
+		if err != nil {
+			t.Fatalf("TestRepairOnOpen failed with error %v", err)
+		}
+
+		var content []byte
+		content, err = os.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("TestRepairOnOpen failed with error %v", err)
+		}
+
+		if string(content) != tst.exp {
+			t.Fatalf("TestRepairOnOpen failed for case %v: exp %q actual %q", i, tst.exp, content)
+		}
+
+		// The stats get appended after the last complete line
+		err = statLogger.Write("kStats", map[string]interface{}{"k1": int64(2)})
+		if err != nil {
+			t.Fatalf("TestRepairOnOpen failed with error %v", err)
+		}
+
+		statLogger.Close()
+
+		var exp []map[string]interface{}
+		for j := 0; j < strings.Count(tst.exp, "\n"); j++ {
+			exp = append(exp, map[string]interface{}{"type": "kStats", "stat": map[string]interface{}{"k1": int64(1)}})
+		}
+		exp = append(exp, map[string]interface{}{"type": "kStats", "stat": map[string]interface{}{"k1": int64(2)}})
+
+		err = verifyStats(exp, fileName, CompressionGzip)
+		if err != nil {
+			t.Fatalf("TestRepairOnOpen failed for case %v with error %v", i, err)
+		}
+	}
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestRepairOnOpen failed with error %v", err)
+	}
+}
+
+func TestTimestampFileNamer(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "logstats_file_namer")
+	if err != nil {
+		t.Fatalf("TestTimestampFileNamer failed with error %v", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+
+	now := time.Date(2024, 1, 31, 23, 58, 0, 0, time.UTC)
+	var statLogger LogStats
+	statLogger, err = New(fileName, WithSizeLimit(1), WithNumFiles(3),
+		WithCompression(CompressionNone), WithFileNamer(TimestampFileNamer{}),
+		withClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("TestTimestampFileNamer failed with error %v", err)
+	}
+
+	// Each write rotates the previous one. The second and the third
+	// rotations happen in the same second.
+	times := []time.Time{
+		now,
+		now.Add(time.Minute),
+		now.Add(time.Minute),
+		now.Add(2 * time.Minute),
+	}
+
+	for i, ts := range times {
+		now = ts
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestTimestampFileNamer failed with error %v", err)
+		}
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestTimestampFileNamer failed with error %v", err)
+	}
+
+	// The oldest rotated file is removed, and the name taken by it is
+	// advanced by a second for the next rotation.
+	var files []string
+	files, err = filepath.Glob(filepath.Join(tmpDir, "*.log*"))
+	if err != nil {
+		t.Fatalf("TestTimestampFileNamer failed with error %v", err)
+	}
+
+	expFiles := []string{
+		filepath.Join(tmpDir, "stats-20240131-235901.log"),
+		filepath.Join(tmpDir, "stats-20240201-000000.log"),
+		fileName,
+	}
+	if !reflect.DeepEqual(expFiles, files) {
+		t.Fatalf("TestTimestampFileNamer failed: exp files %v actual %v", expFiles, files)
+	}
+
+	// The reader finds the rotated files by the same namer.
+	var rdr *LogStatsReader
+	rdr, err = NewLogStatsReader(fileName, false)
+	if err != nil {
+		t.Fatalf("TestTimestampFileNamer failed with error %v", err)
+	}
+
+	defer rdr.Close()
+
+	err = rdr.SetFileNamer(TimestampFileNamer{})
+	if err != nil {
+		t.Fatalf("TestTimestampFileNamer failed with error %v", err)
+	}
+
+	for i := 1; i < len(times); i++ {
+		var stat map[string]interface{}
+		_, _, stat, err = rdr.Next()
+		if err != nil {
+			t.Fatalf("TestTimestampFileNamer failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(getSimpleStat(i), stat) {
+			t.Fatalf("TestTimestampFileNamer failed: exp stat %v actual %v", getSimpleStat(i), stat)
+		}
+	}
+
+	_, _, _, err = rdr.Next()
+	if err != io.EOF {
+		t.Fatalf("TestTimestampFileNamer failed: exp error %v actual %v", io.EOF, err)
+	}
+}
+
+func TestCompressibleRotatedFile(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "compressible.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestCompressibleRotatedFile failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024, 3, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestCompressibleRotatedFile failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// The rotated files compress by far more than their read buffers used
+	// to be sized for.
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 2; i++ {
+		stat := getSimpleStat(i)
+		stat["k5"] = strings.Repeat("a", 1024*1024)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestCompressibleRotatedFile failed with error %v", err)
+		}
+
+		exp = append(exp, map[string]interface{}{"type": "kStats", "stat": stat})
+	}
+
+	err = verifyStats(exp, fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestCompressibleRotatedFile failed with error %v", err)
+	}
+
+	var rdr *LogStatsReader
+	rdr, err = NewLogStatsReader(fileName, false)
+	if err != nil {
+		t.Fatalf("TestCompressibleRotatedFile failed with error %v", err)
+	}
+
+	defer rdr.Close()
+
+	for i := range exp {
+		var stat map[string]interface{}
+		_, _, stat, err = rdr.Next()
+		if err != nil {
+			t.Fatalf("TestCompressibleRotatedFile failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(exp[i]["stat"], stat) {
+			t.Fatalf("TestCompressibleRotatedFile failed: stat %v read back differently", i)
+		}
+	}
+}
+
+func TestRenumberOnOpen(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "logstats_renumber")
+	if err != nil {
+		t.Fatalf("TestRenumberOnOpen failed with error %v", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+
+	// Rotated files with gaps in their numbers, and with a duplicate
+	// number - as if the newer one was compressed by a rotation which
+	// crashed before removing the older one.
+	old := time.Now().Add(-time.Hour)
+	files := []struct {
+		num         int
+		compression CompressionType
+		content     string
+		modTime     time.Time
+	}{
+		{1, CompressionNone, "one\n", old.Add(3 * time.Minute)},
+		{3, CompressionNone, "three\n", old.Add(time.Minute)},
+		{3, CompressionGzip, "three_gz\n", old.Add(2 * time.Minute)},
+		{5, CompressionNone, "five\n", old},
+	}
+
+	for _, file := range files {
+		fname := getLogFileName(fileName, file.num, file.compression)
+		if file.compression != CompressionNone {
+			source := filepath.Join(tmpDir, "source")
+			err = os.WriteFile(source, []byte(file.content), 0644)
+			if err != nil {
+				t.Fatalf("TestRenumberOnOpen failed with error %v", err)
+			}
+
+			err = compressFile(source, fname, file.compression, gzip.DefaultCompression, nil, 0644)
+			if err != nil {
+				t.Fatalf("TestRenumberOnOpen failed with error %v", err)
+			}
+
+			err = os.Remove(source)
+		} else {
+			err = os.WriteFile(fname, []byte(file.content), 0644)
+		}
+
+		if err != nil {
+			t.Fatalf("TestRenumberOnOpen failed with error %v", err)
+		}
+
+		err = os.Chtimes(fname, file.modTime, file.modTime)
+		if err != nil {
+			t.Fatalf("TestRenumberOnOpen failed with error %v", err)
+		}
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024*1024, 10, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestRenumberOnOpen failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := map[string]string{
+		getLogFileName(fileName, 1, CompressionNone): "one\n",
+		getLogFileName(fileName, 2, CompressionGzip): "three_gz\n",
+		getLogFileName(fileName, 3, CompressionNone): "three\n",
+		getLogFileName(fileName, 4, CompressionNone): "five\n",
+	}
+
+	var rotated []rotatedLogFile
+	rotated, err = getRotatedLogFiles(fileName, DefaultFileNamer{})
+	if err != nil {
+		t.Fatalf("TestRenumberOnOpen failed with error %v", err)
+	}
+
+	if len(rotated) != len(exp) {
+		t.Fatalf("TestRenumberOnOpen failed: exp %v rotated files actual %v", len(exp), rotated)
+	}
+
+	for fname, content := range exp {
+		var actual []byte
+		actual, err = readLogFile(fname)
+		if err != nil {
+			t.Fatalf("TestRenumberOnOpen failed with error %v", err)
+		}
+
+		if string(actual) != content {
+			t.Fatalf("TestRenumberOnOpen failed: exp %q in %v actual %q", content, fname, actual)
+		}
+	}
+}
+
+func TestPerTypeFiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "logstats_per_type")
+	if err != nil {
+		t.Fatalf("TestPerTypeFiles failed with error %v", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+
+	var statLogger LogStats
+	statLogger, err = New(fileName, WithPerTypeFiles(true), WithDedupe(true),
+		WithSizeLimit(256), WithNumFiles(3), WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatalf("TestPerTypeFiles failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	if lockSupported {
+		_, err = New(fileName, WithPerTypeFiles(true))
+		if !errors.Is(err, ErrLogFileInUse) {
+			t.Fatalf("TestPerTypeFiles failed: exp error %v actual %v", ErrLogFileInUse, err)
+		}
+	}
+
+	// The noisy stats get rotated many times, without resetting the
+	// deduplication of the quiet stats.
+	err = statLogger.Write("qStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestPerTypeFiles failed with error %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		err = statLogger.Write("nStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestPerTypeFiles failed with error %v", err)
+		}
+	}
+
+	err = statLogger.Write("qStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestPerTypeFiles failed with error %v", err)
+	}
+
+	err = statLogger.Write("a/b", getSimpleStat(0))
+	if err == nil {
+		t.Fatalf("TestPerTypeFiles failed: stat type with a path separator accepted")
+	}
+
+	var info LogStatsInfo
+	info = statLogger.Info()
+	if info.ScanErr != nil {
+		t.Fatalf("TestPerTypeFiles failed with error %v", info.ScanErr)
+	}
+
+	if info.Rotations == 0 || info.RotatedFiles != 2 {
+		t.Fatalf("TestPerTypeFiles failed: unexpected info %+v", info)
+	}
+
+	var content []byte
+	content, err = readLogFile(filepath.Join(tmpDir, "stats.qStats.log"))
+	if err != nil {
+		t.Fatalf("TestPerTypeFiles failed with error %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], " qStats {}") {
+		t.Fatalf("TestPerTypeFiles failed: unexpected quiet stats %q", lines)
+	}
+
+	// Only the noisy stats got rotated.
+	for statType, exp := range map[string]int{"nStats": 2, "qStats": 0} {
+		var rotated []rotatedLogFile
+		rotated, err = getRotatedLogFiles(filepath.Join(tmpDir, "stats."+statType+".log"), DefaultFileNamer{})
+		if err != nil {
+			t.Fatalf("TestPerTypeFiles failed with error %v", err)
+		}
+
+		if len(rotated) != exp {
+			t.Fatalf("TestPerTypeFiles failed: exp %v rotated %v files actual %v", exp, statType, len(rotated))
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "rotate_now.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 3, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	stat := getSimpleStat(0)
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	// The size limit is far from reached.
+	err = statLogger.Rotate()
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	_, err = os.Stat(getLogFileName(fileName, 1, CompressionGzip))
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	var finfo os.FileInfo
+	finfo, err = os.Stat(fileName)
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	if finfo.Size() != 0 {
+		t.Fatalf("TestRotate failed: exp empty log file actual size %v", finfo.Size())
+	}
+
+	// The deduplication resets, so the unchanged stats are written in full.
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	exp := []map[string]interface{}{
+		{"type": "kStats", "stat": stat},
+		{"type": "kStats", "stat": stat},
+	}
+
+	err = verifyStats(exp, fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestRotate failed with error %v", err)
+	}
+
+	err = statLogger.Rotate()
+	if err == nil {
+		t.Fatalf("TestRotate failed: closed logger rotated")
+	}
+}
+
+func TestLineBasedRotation(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "line_rotation.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestLineBasedRotation failed with error %v", err)
+	}
+
+	opts := []Option{WithNumFiles(4), WithMaxLines(3), WithCompression(CompressionNone)}
+
+	var statLogger LogStats
+	statLogger, err = New(fileName, opts...)
+	if err != nil {
+		t.Fatalf("TestLineBasedRotation failed with error %v", err)
+	}
+
+	exp := make([]map[string]interface{}, 0)
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			stat := getSimpleStat(len(exp))
+			err := statLogger.Write("kStats", stat)
+			if err != nil {
+				t.Fatalf("TestLineBasedRotation failed with error %v", err)
+			}
+
+			vstat := make(map[string]interface{})
+			vstat["type"] = "kStats"
+			vstat["stat"] = stat
+			exp = append(exp, vstat)
+		}
+	}
+
+	checkLines := func(expLines []int) {
+		for i, n := range expLines {
+			data, err := readLogFile(getLogFileName(fileName, i, CompressionNone))
+			if err != nil {
+				t.Fatalf("TestLineBasedRotation failed with error %v", err)
+			}
+
+			if countLines(data) != n {
+				t.Fatalf("TestLineBasedRotation failed: exp %v lines in file %v actual %v", n, i, countLines(data))
+			}
+		}
+	}
+
+	write(7)
+	checkLines([]int{1, 3, 3})
+
+	// The lines already in the log file count after a restart.
+	statLogger.Close()
+	statLogger, err = New(fileName, opts...)
+	if err != nil {
+		t.Fatalf("TestLineBasedRotation failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	write(2)
+	checkLines([]int{3, 3, 3})
+
+	write(1)
+	checkLines([]int{1, 3, 3, 3})
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestLineBasedRotation failed with error %v", err)
+	}
+
+	// Invalid option
+	_, err = New(fileName, WithMaxLines(-1))
+	if err == nil {
+		t.Fatalf("TestLineBasedRotation failed: invalid option accepted")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	// Create a stats logger
+	tmpDir, err := os.MkdirTemp("", "files")
+	if err != nil {
+		t.Fatalf("TestFiles failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "files.log")
+
+	var statLogger LogStats
+	statLogger, err = New(fileName, WithNumFiles(3))
+	if err != nil {
+		t.Fatalf("TestFiles failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	for i := 0; i < 3; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestFiles failed with error %v", err)
+		}
+
+		err = statLogger.Rotate()
+		if err != nil {
+			t.Fatalf("TestFiles failed with error %v", err)
+		}
+	}
+
+	// Oldest first, the current log file last.
+	exp := []string{
+		getLogFileName(fileName, 2, CompressionGzip),
+		getLogFileName(fileName, 1, CompressionGzip),
+		fileName,
+	}
+
+	files := statLogger.Files()
+	if !reflect.DeepEqual(exp, files) {
+		t.Fatalf("TestFiles failed: exp %v actual %v", exp, files)
+	}
+
+	// The per type loggers list the log files of each stat type.
+	typeFileName := filepath.Join(tmpDir, "types.log")
+
+	var typeLogger LogStats
+	typeLogger, err = New(typeFileName, WithPerTypeFiles(true))
+	if err != nil {
+		t.Fatalf("TestFiles failed with error %v", err)
+	}
+
+	defer typeLogger.Close()
+
+	for _, statType := range []string{"lStats", "kStats"} {
+		err = typeLogger.Write(statType, getSimpleStat(0))
+		if err != nil {
+			t.Fatalf("TestFiles failed with error %v", err)
+		}
+	}
+
+	err = typeLogger.Rotate()
+	if err != nil {
+		t.Fatalf("TestFiles failed with error %v", err)
+	}
+
+	exp = []string{
+		getLogFileName(filepath.Join(tmpDir, "types.kStats.log"), 1, CompressionGzip),
+		filepath.Join(tmpDir, "types.kStats.log"),
+		getLogFileName(filepath.Join(tmpDir, "types.lStats.log"), 1, CompressionGzip),
+		filepath.Join(tmpDir, "types.lStats.log"),
+	}
+
+	files = typeLogger.Files()
+	if !reflect.DeepEqual(exp, files) {
+		t.Fatalf("TestFiles failed: exp %v actual %v", exp, files)
+	}
+}
+
+func TestMaxNumFiles(t *testing.T) {
+	// Create a stats logger
+	tmpDir, err := os.MkdirTemp("", "max_num_files")
+	if err != nil {
+		t.Fatalf("TestMaxNumFiles failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "max_num_files.log")
+
+	// Beyond the default max number of files.
+	_, err = NewLogStats(fileName, 1024*1024, MAX_NUM_FILES+21, "2006-01-02T15:04:05.000-07:00")
+	if err == nil {
+		t.Fatalf("TestMaxNumFiles failed: %v files accepted", MAX_NUM_FILES+21)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024*1024, MAX_NUM_FILES+21, "2006-01-02T15:04:05.000-07:00",
+		WithMaxNumFiles(200), WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatalf("TestMaxNumFiles failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < MAX_NUM_FILES+25; i++ {
+		if i > 0 {
+			err = statLogger.Rotate()
+			if err != nil {
+				t.Fatalf("TestMaxNumFiles failed with error %v", err)
+			}
+		}
+
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestMaxNumFiles failed with error %v", err)
+		}
+
+		exp = append(exp, stat)
+	}
+
+	files := statLogger.Files()
+	if len(files) != MAX_NUM_FILES+21 {
+		t.Fatalf("TestMaxNumFiles failed: exp %v files actual %v", MAX_NUM_FILES+21, len(files))
+	}
+
+	// The retained stats read back in order.
+	reader, err := NewLogStatsReader(fileName, false)
+	if err != nil {
+		t.Fatalf("TestMaxNumFiles failed with error %v", err)
+	}
+
+	defer reader.Close()
+
+	for _, expStat := range exp[len(exp)-len(files):] {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestMaxNumFiles failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(expStat, stat) {
+			t.Fatalf("TestMaxNumFiles failed: exp %v actual %v", expStat, stat)
+		}
+	}
+
+	// Invalid option
+	_, err = New(fileName, WithMaxNumFiles(0))
+	if err == nil {
+		t.Fatalf("TestMaxNumFiles failed: invalid option accepted")
+	}
+}
+
+func TestManyRotatedFiles(t *testing.T) {
+	// Create a stats logger
+	tmpDir, err := os.MkdirTemp("", "many_rotated_files")
+	if err != nil {
+		t.Fatalf("TestManyRotatedFiles failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "many_rotated_files.log")
+	numFiles := 150
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024*1024, numFiles, "2006-01-02T15:04:05.000-07:00",
+		WithMaxNumFiles(numFiles))
+	if err != nil {
+		t.Fatalf("TestManyRotatedFiles failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < numFiles+10; i++ {
+		if i > 0 {
+			err = statLogger.Rotate()
+			if err != nil {
+				t.Fatalf("TestManyRotatedFiles failed with error %v", err)
+			}
+		}
+
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestManyRotatedFiles failed with error %v", err)
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		exp = append(exp, vstat)
+	}
+
+	// The rotated files are numbered 1 to numFiles-1, across the number
+	// of digits, and sorted numerically.
+	files, err := getRotatedLogFiles(fileName, DefaultFileNamer{})
+	if err != nil {
+		t.Fatalf("TestManyRotatedFiles failed with error %v", err)
+	}
+
+	if len(files) != numFiles-1 {
+		t.Fatalf("TestManyRotatedFiles failed: exp %v rotated files actual %v", numFiles-1, len(files))
+	}
+
+	for i, file := range files {
+		if file.index != i+1 || file.name != getLogFileName(fileName, i+1, CompressionGzip) {
+			t.Fatalf("TestManyRotatedFiles failed: exp file %v actual %v", i+1, file.name)
+		}
+	}
+
+	// Verify stats
+	err = verifyStats(exp[len(exp)-numFiles:], fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestManyRotatedFiles failed with error %v", err)
+	}
+}
+
+func TestActiveCompression(t *testing.T) {
+	// Create a stats logger
+	tmpDir, err := os.MkdirTemp("", "active_compression")
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "active_compression.log")
+	activeName := fileName + ".gz"
+
+	var statLogger LogStats
+	statLogger, err = New(fileName, WithDedupe(true), WithActiveCompression(true))
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	exp := make([]map[string]interface{}, 0)
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			stat := getSimpleStat(len(exp))
+			err := statLogger.Write("kStats", stat)
+			if err != nil {
+				t.Fatalf("TestActiveCompression failed with error %v", err)
+			}
+
+			exp = append(exp, stat)
+		}
+	}
+
+	verify := func() {
+		reader, err := NewLogStatsReader(fileName, true)
+		if err != nil {
+			t.Fatalf("TestActiveCompression failed with error %v", err)
+		}
+
+		defer reader.Close()
+
+		for i := range exp {
+			_, _, stat, err := reader.Next()
+			if err != nil {
+				t.Fatalf("TestActiveCompression failed with error %v", err)
+			}
+
+			convertFloatsToInts(stat)
+			if !reflect.DeepEqual(exp[i], stat) {
+				t.Fatalf("TestActiveCompression failed: exp %v actual %v", exp[i], stat)
+			}
+		}
+
+		_, _, _, err = reader.Next()
+		if err != io.EOF {
+			t.Fatalf("TestActiveCompression failed: exp EOF actual %v", err)
+		}
+	}
+
+	// The stats are readable once flushed, from the compressed current log
+	// file yet to be completed.
+	write(5)
+	err = statLogger.Flush()
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	verify()
+
+	_, err = os.Stat(fileName)
+	if !os.IsNotExist(err) {
+		t.Fatalf("TestActiveCompression failed: uncompressed log file exists, error %v", err)
+	}
+
+	finfo, err := os.Stat(activeName)
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	info := statLogger.Info()
+	if info.ScanErr != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", info.ScanErr)
+	}
+
+	if int64(info.CurrentFileSize) != finfo.Size() {
+		t.Fatalf("TestActiveCompression failed: exp compressed size %v actual %v", finfo.Size(), info.CurrentFileSize)
+	}
+
+	var output bytes.Buffer
+	f, err := os.Open(activeName)
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	err = ReconstructStatFile(f, &output)
+	f.Close()
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	if lines := strings.Count(output.String(), "\n"); lines != len(exp) {
+		t.Fatalf("TestActiveCompression failed: exp %v reconstructed lines actual %v", len(exp), lines)
+	}
+
+	// The rotated log file is the completed gzip stream.
+	err = statLogger.Rotate()
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	_, err = readLogFile(getLogFileName(fileName, 1, CompressionGzip))
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	// The durable loggers flush on every write.
+	statLogger.SetDurable(true)
+	write(5)
+	verify()
+
+	// A log file cut short, as by a crash, is recompressed on open.
+	cut, err := os.ReadFile(activeName)
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	statLogger.Close()
+	err = os.WriteFile(activeName, cut, 0o644)
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	statLogger, err = New(fileName, WithDedupe(true), WithActiveCompression(true))
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	write(5)
+	statLogger.Close()
+	verify()
+
+	// The size limit applies to the compressed size, i.e. a fraction of
+	// the size of the stats.
+	statLogger, err = New(fileName, WithActiveCompression(true), WithSizeLimit(4096), WithNumFiles(99))
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	written := len(exp)
+	write(5000)
+	info = statLogger.Info()
+	if info.ScanErr != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", info.ScanErr)
+	}
+
+	uncompressed := (len(exp) - written) * len(`{"k1":10,"k2":"Value2","k3":false,"k4":{"k31":10,"k32":"Value2","k33":true}}`)
+	if info.Rotations == 0 || info.Rotations > uint64(uncompressed/4096/2) {
+		t.Fatalf("TestActiveCompression failed: unexpected rotations %v", info.Rotations)
+	}
+
+	statLogger.Close()
+	verify()
+
+	// The compressed log file is decompressed without active compression.
+	statLogger, err = New(fileName, WithNumFiles(99))
+	if err != nil {
+		t.Fatalf("TestActiveCompression failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	_, err = os.Stat(activeName)
+	if !os.IsNotExist(err) {
+		t.Fatalf("TestActiveCompression failed: compressed log file exists, error %v", err)
+	}
+
+	write(5)
+	statLogger.Flush()
+	verify()
+}
+
+func TestTinySizeLimit(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "tiny_size_limit")
+	if err != nil {
+		t.Fatalf("TestTinySizeLimit failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Size limits far below the size of a log message, down to zero.
+	for _, sizeLimit := range []int{16, 0} {
+		fileName := filepath.Join(tmpDir, fmt.Sprintf("tiny_size_limit_%v.log", sizeLimit))
+
+		var statLogger LogStats
+		statLogger, err = New(fileName, WithSizeLimit(sizeLimit), WithNumFiles(5),
+			WithCompression(CompressionNone))
+		if err != nil {
+			t.Fatalf("TestTinySizeLimit failed with error %v", err)
+		}
+
+		exp := make([]map[string]interface{}, 0)
+		for i := 0; i < 10; i++ {
+			stat := getSimpleStat(i)
+			err = statLogger.Write("kStats", stat)
+			if err != nil {
+				t.Fatalf("TestTinySizeLimit failed with error %v", err)
+			}
+
+			vstat := make(map[string]interface{})
+			vstat["type"] = "kStats"
+			vstat["stat"] = stat
+			exp = append(exp, vstat)
+		}
+
+		info := statLogger.Info()
+		if info.ScanErr != nil {
+			t.Fatalf("TestTinySizeLimit failed with error %v", info.ScanErr)
+		}
+
+		// A rotation per log message after the first, not per write.
+		if info.Rotations != 9 {
+			t.Fatalf("TestTinySizeLimit failed: exp 9 rotations actual %v", info.Rotations)
+		}
+
+		// Each log file holds a single log message, none is empty.
+		files := statLogger.Files()
+		if len(files) != 5 {
+			t.Fatalf("TestTinySizeLimit failed: exp 5 files actual %v", files)
+		}
+
+		for _, file := range files {
+			lines, err := countLogFileLines(file)
+			if err != nil {
+				t.Fatalf("TestTinySizeLimit failed with error %v", err)
+			}
+
+			if lines != 1 {
+				t.Fatalf("TestTinySizeLimit failed: exp 1 line in %v actual %v", file, lines)
+			}
+		}
+
+		// Verify stats
+		err = verifyStats(exp[len(exp)-5:], fileName, CompressionNone)
+		if err != nil {
+			t.Fatalf("TestTinySizeLimit failed with error %v", err)
+		}
+
+		statLogger.Close()
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "json_lines")
+	if err != nil {
+		t.Fatalf("TestJSONLines failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "json_lines.log")
+	statLogger, err := New(fileName, WithDedupe(true), WithJSONLines(true))
+	if err != nil {
+		t.Fatalf("TestJSONLines failed with error %v", err)
+	}
+
+	// The stats are compared as JSON, as the numbers are read back as
+	// json.Number.
+	var exp []string
+	for i := 0; i < 3; i++ {
+		stat := getSimpleStat(i % 2)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestJSONLines failed with error %v", err)
+		}
+		expBytes, _ := json.Marshal(stat)
+		exp = append(exp, string(expBytes))
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestJSONLines failed with error %v", err)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestJSONLines failed with error %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != len(exp) {
+		t.Fatalf("TestJSONLines failed: exp %v lines actual %v", len(exp), lines)
+	}
+
+	for _, line := range lines {
+		var jl map[string]interface{}
+		err = json.Unmarshal([]byte(line), &jl)
+		if err != nil {
+			t.Fatalf("TestJSONLines failed: invalid JSON line %v: %v", line, err)
+		}
+
+		if jl["type"] != "kStats" || jl["ts"] == nil || jl["stat"] == nil {
+			t.Fatalf("TestJSONLines failed: unexpected JSON line %v", line)
+		}
+	}
+
+	// The reader reconstructs the deduplicated stats.
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestJSONLines failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for i := range exp {
+		_, statType, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestJSONLines failed with error %v", err)
+		}
+
+		statBytes, _ := json.Marshal(stat)
+		if statType != "kStats" || string(statBytes) != exp[i] {
+			t.Fatalf("TestJSONLines failed: exp %v actual %v %v", exp[i], statType, stat)
+		}
+	}
+
+	// So does the reconstruction, keeping the JSON Lines.
+	var out bytes.Buffer
+	err = ReconstructStatFile(strings.NewReader(string(data)), &out)
+	if err != nil {
+		t.Fatalf("TestJSONLines failed with error %v", err)
+	}
+
+	lines = strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for i, line := range lines {
+		var jl struct {
+			Stat json.RawMessage `json:"stat"`
+		}
+		err = json.Unmarshal([]byte(line), &jl)
+		if err != nil {
+			t.Fatalf("TestJSONLines failed: invalid JSON line %v: %v", line, err)
+		}
+
+		if string(jl.Stat) != exp[i] {
+			t.Fatalf("TestJSONLines failed: exp %v actual %v", exp[i], line)
+		}
+	}
+
+	// A custom encoder cannot write the JSON Lines.
+	_, err = New(filepath.Join(tmpDir, "binary.log"), WithJSONLines(true), WithEncoder(hexEncoding{}))
+	if err == nil {
+		t.Fatalf("TestJSONLines failed: custom encoder accepted")
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "rotation_failure")
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "rotation_failure.log")
+	statLogger, err := New(fileName, WithSizeLimit(100), WithNumFiles(2), WithDedupe(true))
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	err = statLogger.Write("kStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+
+	// A non-empty directory in place of the oldest rotated file fails its
+	// removal, and so the rotation.
+	blocker := filepath.Join(tmpDir, "rotation_failure.log.1.gz")
+	err = os.MkdirAll(filepath.Join(blocker, "blocker"), 0755)
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+
+	err = statLogger.Write("kStats", getSimpleStat(1))
+	if !errors.Is(err, ErrRotation) {
+		t.Fatalf("TestRotationFailure failed: exp error %v actual %v", ErrRotation, err)
+	}
+
+	// The logger remains usable, and rotates once the cause is removed.
+	err = statLogger.Flush()
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+
+	err = os.RemoveAll(blocker)
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+
+	err = statLogger.Write("kStats", getSimpleStat(1))
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+
+	// A failure to open the new log file, once the current one is rotated
+	// out, fails the rotation too.
+	failOpen := true
+	oldOpenFile := openFile
+	openFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		if failOpen {
+			failOpen = false
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+	defer func() { openFile = oldOpenFile }()
+
+	err = statLogger.Write("kStats", getSimpleStat(2))
+	if !errors.Is(err, ErrRotation) || failOpen {
+		t.Fatalf("TestRotationFailure failed: exp error %v actual %v", ErrRotation, err)
+	}
+
+	// The logger remains usable, writing to the new log file.
+	err = statLogger.Write("kStats", getSimpleStat(2))
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+
+	exp := []map[string]interface{}{getSimpleStat(1), getSimpleStat(2)}
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestRotationFailure failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for i := range exp {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestRotationFailure failed with error %v", err)
+		}
+
+		statBytes, _ := json.Marshal(stat)
+		expBytes, _ := json.Marshal(exp[i])
+		if string(statBytes) != string(expBytes) {
+			t.Fatalf("TestRotationFailure failed: exp %s actual %s", expBytes, statBytes)
+		}
+	}
+
+	_, _, _, err = reader.Next()
+	if err != io.EOF {
+		t.Fatalf("TestRotationFailure failed: exp EOF actual %v", err)
+	}
+}
+
+func TestLinePrefix(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "line_prefix")
+	if err != nil {
+		t.Fatalf("TestLinePrefix failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "line_prefix.log")
+	statLogger, err := New(fileName, WithLinePrefix("node1", "1234", "indexer"))
+	if err != nil {
+		t.Fatalf("TestLinePrefix failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 3; i++ {
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestLinePrefix failed with error %v", err)
+		}
+		exp = append(exp, map[string]interface{}{"type": "kStats", "stat": stat})
+	}
+
+	err = verifyStatsWithPrefix(exp, fileName, CompressionGzip, 3)
+	if err != nil {
+		t.Fatalf("TestLinePrefix failed with error %v", err)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestLinePrefix failed with error %v", err)
+	}
+
+	comps := strings.SplitN(string(data), " ", 5)
+	if comps[1] != "node1" || comps[2] != "1234" || comps[3] != "indexer" {
+		t.Fatalf("TestLinePrefix failed: unexpected prefix %v", comps)
+	}
+
+	reader, err := NewLogStatsReader(fileName, false)
+	if err != nil {
+		t.Fatalf("TestLinePrefix failed with error %v", err)
+	}
+	defer reader.Close()
+
+	reader.SetPrefixFields(3)
+	for i := range exp {
+		_, statType, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestLinePrefix failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if statType != "kStats" || !reflect.DeepEqual(stat, exp[i]["stat"]) {
+			t.Fatalf("TestLinePrefix failed: exp %v actual %v %v", exp[i]["stat"], statType, stat)
+		}
+	}
+
+	// The encoded stats are reconstructed given the number of fields.
+	encodedName := filepath.Join(tmpDir, "encoded.log")
+	statLogger, err = New(encodedName, WithDedupe(true), WithEncoder(hexEncoding{}),
+		WithLinePrefix("node1"))
+	if err != nil {
+		t.Fatalf("TestLinePrefix failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	for i := 0; i < 3; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i%2))
+		if err != nil {
+			t.Fatalf("TestLinePrefix failed with error %v", err)
+		}
+	}
+
+	data, err = os.ReadFile(encodedName)
+	if err != nil {
+		t.Fatalf("TestLinePrefix failed with error %v", err)
+	}
+
+	var output bytes.Buffer
+	err = ReconstructStatFileWithOptions(bytes.NewReader(data), &output,
+		ReconstructOptions{Workers: 2, Encoding: hexEncoding{}, PrefixFields: 1})
+	if err != nil {
+		t.Fatalf("TestLinePrefix failed with error %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	for i, line := range lines {
+		comps := strings.SplitN(line, " ", 4)
+		stat, err := hexEncoding{}.Decode([]byte(comps[3]))
+		if err != nil {
+			t.Fatalf("TestLinePrefix failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if comps[1] != "node1" || !reflect.DeepEqual(stat, getSimpleStat(i%2)) {
+			t.Fatalf("TestLinePrefix failed: exp %v actual %v", getSimpleStat(i%2), line)
+		}
+	}
+
+	for _, field := range []string{"", "node 1", "node\n1"} {
+		_, err = New(filepath.Join(tmpDir, "invalid.log"), WithLinePrefix(field))
+		if err == nil {
+			t.Fatalf("TestLinePrefix failed: field %q accepted", field)
+		}
+	}
+}
+
+func TestAsWriter(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "as_writer")
+	if err != nil {
+		t.Fatalf("TestAsWriter failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "as_writer.log")
+	statLogger, err := New(fileName, WithDedupe(true))
+	if err != nil {
+		t.Fatalf("TestAsWriter failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	logger := log.New(statLogger.AsWriter("log"), "indexer: ", 0)
+	logger.Printf("started with %v workers", 4)
+
+	jsonLogger := slog.New(slog.NewJSONHandler(statLogger.AsWriter("slog"), nil))
+	jsonLogger.Info("scan done", "rows", 10)
+
+	// A multi-line message stays on a single line.
+	logger.Print("line1\nline2")
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestAsWriter failed with error %v", err)
+	}
+
+	if len(lines) != 3 {
+		t.Fatalf("TestAsWriter failed: exp 3 lines actual %v", lines)
+	}
+
+	comps := strings.SplitN(lines[0], " ", 3)
+	if comps[1] != "log" || comps[2] != `"indexer: started with 4 workers"` {
+		t.Fatalf("TestAsWriter failed: unexpected line %v", lines[0])
+	}
+
+	comps = strings.SplitN(lines[1], " ", 3)
+	var record map[string]interface{}
+	err = json.Unmarshal([]byte(comps[2]), &record)
+	if err != nil {
+		t.Fatalf("TestAsWriter failed with error %v", err)
+	}
+
+	if comps[1] != "slog" || record["msg"] != "scan done" || record["rows"] != float64(10) {
+		t.Fatalf("TestAsWriter failed: unexpected line %v", lines[1])
+	}
+
+	comps = strings.SplitN(lines[2], " ", 3)
+	if comps[2] != `"indexer: line1\nline2"` {
+		t.Fatalf("TestAsWriter failed: unexpected line %v", lines[2])
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sync_interval")
+	if err != nil {
+		t.Fatalf("TestSyncInterval failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	goroutines := runtime.NumGoroutine()
+
+	fileName := filepath.Join(tmpDir, "sync_interval.log")
+	interval := 50 * time.Millisecond
+	statLogger, err := New(fileName, WithBufferSize(1024*1024), WithSyncInterval(interval))
+	if err != nil {
+		t.Fatalf("TestSyncInterval failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	start := time.Now()
+	err = statLogger.Write("kStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestSyncInterval failed with error %v", err)
+	}
+
+	// The buffered stats reach the log file within an interval - allowing
+	// for the scheduling delays - without a Flush.
+	for {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("TestSyncInterval failed with error %v", err)
+		}
+
+		if len(data) > 0 {
+			break
+		}
+
+		if time.Since(start) > 10*interval {
+			t.Fatalf("TestSyncInterval failed: stats not synced after %v", time.Since(start))
+		}
+		time.Sleep(interval / 10)
+	}
+
+	err = statLogger.Write("kStats", getSimpleStat(1))
+	if err != nil {
+		t.Fatalf("TestSyncInterval failed with error %v", err)
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestSyncInterval failed with error %v", err)
+	}
+
+	exp := []map[string]interface{}{
+		{"type": "kStats", "stat": getSimpleStat(0)},
+		{"type": "kStats", "stat": getSimpleStat(1)},
+	}
+	err = verifyStats(exp, fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestSyncInterval failed with error %v", err)
+	}
+
+	// The background goroutine stops on Close.
+	for runtime.NumGoroutine() > goroutines {
+		if time.Since(start) > 100*interval {
+			t.Fatalf("TestSyncInterval failed: %v goroutines left, exp %v",
+				runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(interval / 10)
+	}
+
+	_, err = New(filepath.Join(tmpDir, "invalid.log"), WithSyncInterval(-time.Second))
+	if err == nil {
+		t.Fatalf("TestSyncInterval failed: negative interval accepted")
+	}
+}
+
+// unsortedMarshal marshals the maps with their keys in the map iteration
+// order, i.e. not sorted, as some of the faster JSON libraries do.
+func unsortedMarshal(v interface{}) ([]byte, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return json.Marshal(v)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for k, v := range m {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(k)
+		val, err := unsortedMarshal(v)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "canonical_encoding")
+	if err != nil {
+		t.Fatalf("TestCanonicalEncoding failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	getStat := func(i int) map[string]interface{} {
+		stat := make(map[string]interface{})
+		nested := make(map[string]interface{})
+		for k := 0; k < 20; k++ {
+			stat[fmt.Sprintf("k%v", k)] = int64(k * (i%2 + 1))
+			nested[fmt.Sprintf("n%v", k)] = fmt.Sprintf("v%v", k+i%3)
+		}
+		stat["nested"] = nested
+
+		// Some keys come and go, to be listed as removed.
+		for k := 0; k < i%3; k++ {
+			delete(stat, fmt.Sprintf("k%v", k))
+			delete(nested, fmt.Sprintf("n%v", k))
+		}
+		return stat
+	}
+
+	// Writes the same stats, and reconstructs them.
+	run := func(name string, opts ...Option) ([]byte, []byte) {
+		fileName := filepath.Join(tmpDir, name+".log")
+		statLogger, err := New(fileName, append(opts, WithDedupe(true), withClock(clock))...)
+		if err != nil {
+			t.Fatalf("TestCanonicalEncoding failed with error %v", err)
+		}
+
+		for i := 0; i < 10; i++ {
+			err = statLogger.Write("kStats", getStat(i))
+			if err != nil {
+				t.Fatalf("TestCanonicalEncoding failed with error %v", err)
+			}
+		}
+
+		err = statLogger.Close()
+		if err != nil {
+			t.Fatalf("TestCanonicalEncoding failed with error %v", err)
+		}
+
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("TestCanonicalEncoding failed with error %v", err)
+		}
+
+		var output bytes.Buffer
+		err = ReconstructStatFile(bytes.NewReader(data), &output)
+		if err != nil {
+			t.Fatalf("TestCanonicalEncoding failed with error %v", err)
+		}
+
+		return data, output.Bytes()
+	}
+
+	data, reconstructed := run("run0")
+	canonical := JSONMarshalEncoding{Marshal: unsortedMarshal, Canonical: true}
+	for i, opts := range [][]Option{{}, {WithEncoder(canonical)}} {
+		otherData, otherReconstructed := run(fmt.Sprintf("run%v", i+1), opts...)
+		if !bytes.Equal(data, otherData) {
+			t.Fatalf("TestCanonicalEncoding failed: log files differ\n%s\n%s", data, otherData)
+		}
+
+		if !bytes.Equal(reconstructed, otherReconstructed) {
+			t.Fatalf("TestCanonicalEncoding failed: reconstructed stats differ\n%s\n%s",
+				reconstructed, otherReconstructed)
+		}
+	}
+}
+
+func TestRotationSnapshot(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "rotation_snapshot")
+	if err != nil {
+		t.Fatalf("TestRotationSnapshot failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	fileName := filepath.Join(tmpDir, "rotation_snapshot.log")
+	statLogger, err := New(fileName, WithDedupe(true), WithRotationSnapshot(true),
+		WithCompression(CompressionNone), withClock(clock))
+	if err != nil {
+		t.Fatalf("TestRotationSnapshot failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	stat0, stat1 := getSimpleStat(0), getSimpleStat(1)
+	for _, statType := range []string{"kStats", "aStats"} {
+		err = statLogger.Write(statType, stat0)
+		if err != nil {
+			t.Fatalf("TestRotationSnapshot failed with error %v", err)
+		}
+	}
+
+	err = statLogger.Rotate()
+	if err != nil {
+		t.Fatalf("TestRotationSnapshot failed with error %v", err)
+	}
+
+	// The next stats are deduplicated against the snapshots.
+	now = now.Add(time.Minute)
+	stat1["k4"] = stat0["k4"]
+	err = statLogger.Write("kStats", stat1)
+	if err != nil {
+		t.Fatalf("TestRotationSnapshot failed with error %v", err)
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestRotationSnapshot failed with error %v", err)
+	}
+
+	rotated, err := os.ReadFile(fileName + ".1")
+	if err != nil {
+		t.Fatalf("TestRotationSnapshot failed with error %v", err)
+	}
+
+	current, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestRotationSnapshot failed with error %v", err)
+	}
+
+	// The snapshots keep their original timestamps.
+	ts0 := "2024-01-31T23:59:59.000+00:00"
+	ts1 := "2024-02-01T00:00:59.000+00:00"
+	full := `{"k1":10,"k2":"Value2","k3":false,"k4":{"k31":10,"k32":"Value2","k33":true}}`
+	expCurrent := ts0 + " aStats " + full + "\n" +
+		ts0 + " kStats " + full + "\n" +
+		ts1 + ` kStats {"k1":11,"k2":"Value3"}` + "\n"
+	if string(current) != expCurrent {
+		t.Fatalf("TestRotationSnapshot failed: exp %s actual %s", expCurrent, current)
+	}
+
+	// The current log file is reconstructed on its own, and so are both
+	// the log files together.
+	fullStat1 := `{"k1":11,"k2":"Value3","k3":false,"k4":{"k31":10,"k32":"Value2","k33":true}}`
+	for source, exp := range map[string]string{
+		string(current): ts0 + " aStats " + full + "\n" +
+			ts0 + " kStats " + full + "\n" +
+			ts1 + " kStats " + fullStat1 + "\n",
+		string(rotated) + string(current): ts0 + " kStats " + full + "\n" +
+			ts0 + " aStats " + full + "\n" +
+			ts0 + " aStats " + full + "\n" +
+			ts0 + " kStats " + full + "\n" +
+			ts1 + " kStats " + fullStat1 + "\n",
+	} {
+		var output bytes.Buffer
+		err = ReconstructStatFile(strings.NewReader(source), &output)
+		if err != nil {
+			t.Fatalf("TestRotationSnapshot failed with error %v", err)
+		}
+
+		if output.String() != exp {
+			t.Fatalf("TestRotationSnapshot failed: exp %s actual %s", exp, output.String())
+		}
+	}
+}
+
+func TestNumbersAsStrings(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "numbers_as_strings")
+	if err != nil {
+		t.Fatalf("TestNumbersAsStrings failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "numbers_as_strings.log")
+	statLogger, err := New(fileName, WithDedupe(true), WithNumbersAsStrings(true))
+	if err != nil {
+		t.Fatalf("TestNumbersAsStrings failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	getStat := func(big int64) map[string]interface{} {
+		return map[string]interface{}{
+			"big":    big,
+			"exact":  int64(1 << 53),
+			"neg":    int64(-(1 << 53) - 1),
+			"ubig":   uint64(1<<64 - 1),
+			"float":  1.5,
+			"nested": map[string]interface{}{"n": big},
+			"arr":    []interface{}{big, int64(1)},
+		}
+	}
+
+	for _, big := range []int64{1<<53 + 1, 1<<53 + 1, 1<<62 + 1} {
+		stat := getStat(big)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestNumbersAsStrings failed with error %v", err)
+		}
+
+		// The caller's stats are left as they are.
+		if !reflect.DeepEqual(stat, getStat(big)) {
+			t.Fatalf("TestNumbersAsStrings failed: stats modified %v", stat)
+		}
+	}
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestNumbersAsStrings failed with error %v", err)
+	}
+
+	exp := []string{
+		`{"arr":["9007199254740993",1],"big":"9007199254740993","exact":9007199254740992,` +
+			`"float":1.5,"neg":"-9007199254740993","nested":{"n":"9007199254740993"},"ubig":"18446744073709551615"}`,
+		`{}`,
+		`{"arr":["4611686018427387905",1],"big":"4611686018427387905","nested":{"n":"4611686018427387905"}}`,
+	}
+	if len(lines) != len(exp) {
+		t.Fatalf("TestNumbersAsStrings failed: exp %v lines actual %v", len(exp), lines)
+	}
+
+	for i, line := range lines {
+		comps := strings.SplitN(line, " ", 3)
+		if comps[2] != exp[i] {
+			t.Fatalf("TestNumbersAsStrings failed: exp %v actual %v", exp[i], comps[2])
+		}
+	}
+
+	// The reconstruction keeps the strings exactly.
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestNumbersAsStrings failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for i := 0; i < len(exp); i++ {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestNumbersAsStrings failed with error %v", err)
+		}
+
+		big := "9007199254740993"
+		if i == 2 {
+			big = "4611686018427387905"
+		}
+
+		if stat["big"] != big || stat["ubig"] != "18446744073709551615" {
+			t.Fatalf("TestNumbersAsStrings failed: unexpected stats %v", stat)
+		}
+	}
+}
+
+func TestWriteRetry(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "write_retry")
+	if err != nil {
+		t.Fatalf("TestWriteRetry failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = New(filepath.Join(tmpDir, "invalid.log"), WithWriteRetry(0, 0))
+	if err == nil {
+		t.Fatalf("TestWriteRetry failed: zero attempts accepted")
+	}
+
+	_, err = New(filepath.Join(tmpDir, "invalid.log"), WithWriteRetry(2, 0), WithBufferSize(1024))
+	if err == nil {
+		t.Fatalf("TestWriteRetry failed: retry accepted with buffering")
+	}
+
+	// Fails the first failures writes, after writing partial bytes.
+	var calls, failures, partial int
+	var failErr error
+	var onFailure func()
+	oldWriteFile := writeFile
+	writeFile = func(f *os.File, bytes []byte) (int, error) {
+		calls++
+		if calls > failures {
+			return f.Write(bytes)
+		}
+
+		if onFailure != nil {
+			onFailure()
+		}
+
+		n, _ := f.Write(bytes[:partial])
+		return n, &os.PathError{Op: "write", Path: f.Name(), Err: failErr}
+	}
+	defer func() { writeFile = oldWriteFile }()
+
+	now := time.Now()
+	fileName := filepath.Join(tmpDir, "write_retry.log")
+	statLogger, err := New(fileName, WithWriteRetry(3, time.Millisecond), WithCompression(CompressionNone),
+		WithRotateInterval(time.Hour), withClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("TestWriteRetry failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	tests := []struct {
+		name     string
+		failures int
+		partial  int
+		failErr  error
+		expCalls int
+		expErr   bool
+	}{
+		{"transient", 2, 0, syscall.ENOSPC, 3, false},
+		{"partial", 2, 10, syscall.EIO, 3, false},
+		{"exhausted", 3, 0, syscall.ENOSPC, 3, true},
+		{"non-transient", 1, 0, os.ErrClosed, 1, true},
+	}
+
+	var exp []map[string]interface{}
+	for i, test := range tests {
+		calls, failures, partial, failErr = 0, test.failures, test.partial, test.failErr
+
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if (err != nil) != test.expErr || calls != test.expCalls {
+			t.Fatalf("TestWriteRetry failed for %v: err %v after %v writes", test.name, err, calls)
+		}
+
+		if err == nil {
+			exp = append(exp, stat)
+		}
+	}
+
+	// The rotation is re-checked between the attempts.
+	calls, failures, partial, failErr = 0, 1, 0, syscall.ENOSPC
+	onFailure = func() { now = now.Add(2 * time.Hour) }
+	err = statLogger.Write("kStats", getSimpleStat(len(tests)))
+	if err != nil {
+		t.Fatalf("TestWriteRetry failed with error %v", err)
+	}
+
+	_, err = os.Stat(getLogFileName(fileName, 1, CompressionNone))
+	if err != nil {
+		t.Fatalf("TestWriteRetry failed: log file not rotated between the attempts, %v", err)
+	}
+
+	exp = append(exp, getSimpleStat(len(tests)))
+	failures = 0
+
+	reader, err := NewLogStatsReader(fileName, false)
+	if err != nil {
+		t.Fatalf("TestWriteRetry failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for i := 0; ; i++ {
+		_, _, stat, err := reader.Next()
+		if err == io.EOF {
+			if i != len(exp) {
+				t.Fatalf("TestWriteRetry failed: exp %v stats actual %v", len(exp), i)
+			}
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("TestWriteRetry failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if i >= len(exp) || !reflect.DeepEqual(exp[i], stat) {
+			t.Fatalf("TestWriteRetry failed for stat %v: %v", i, stat)
+		}
+	}
+}
+
+func TestTypeTSFormat(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "type_ts_format")
+	if err != nil {
+		t.Fatalf("TestTypeTSFormat failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = New(filepath.Join(tmpDir, "invalid.log"), WithTypeTSFormat(map[string]string{"kStats": "ts"}))
+	if err == nil {
+		t.Fatalf("TestTypeTSFormat failed: invalid format accepted")
+	}
+
+	now := time.Date(2024, 1, 1, 10, 30, 15, 123456789, time.UTC)
+	fileName := filepath.Join(tmpDir, "type_ts_format.log")
+	statLogger, err := New(fileName, WithTypeTSFormat(map[string]string{"slowStats": time.RFC3339}),
+		withClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatalf("TestTypeTSFormat failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	for _, statType := range []string{"kStats", "slowStats"} {
+		err = statLogger.Write(statType, getSimpleStat(0))
+		if err != nil {
+			t.Fatalf("TestTypeTSFormat failed with error %v", err)
+		}
+	}
+
+	content, err := readLogFile(fileName)
+	if err != nil {
+		t.Fatalf("TestTypeTSFormat failed with error %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	exp := []string{"2024-01-01T10:30:15.123+00:00 kStats {", "2024-01-01T10:30:15Z slowStats {"}
+	if len(lines) != len(exp) {
+		t.Fatalf("TestTypeTSFormat failed: exp %v lines actual %v", len(exp), len(lines))
+	}
+
+	for i, line := range lines {
+		if !strings.HasPrefix(line, exp[i]) {
+			t.Fatalf("TestTypeTSFormat failed: exp prefix %v actual %v", exp[i], line)
+		}
+	}
+
+	// Both are read back.
+	reader, err := NewLogStatsReader(fileName, false)
+	if err != nil {
+		t.Fatalf("TestTypeTSFormat failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for _, expTS := range []time.Time{now.Truncate(time.Millisecond), now.Truncate(time.Second)} {
+		ts, _, _, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestTypeTSFormat failed with error %v", err)
+		}
+
+		if !ts.Equal(expTS) {
+			t.Fatalf("TestTypeTSFormat failed: exp timestamp %v actual %v", expTS, ts)
+		}
+	}
+}
+
+func TestCloseSnapshot(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "close_snapshot")
+	if err != nil {
+		t.Fatalf("TestCloseSnapshot failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, enable := range []bool{false, true} {
+		fileName := filepath.Join(tmpDir, fmt.Sprintf("close_snapshot_%v.log", enable))
+		statLogger, err := New(fileName, WithDedupe(true), WithCloseSnapshot(enable))
+		if err != nil {
+			t.Fatalf("TestCloseSnapshot failed with error %v", err)
+		}
+
+		last := getSimpleStat(0)
+		last["k1"] = int64(9876)
+		for _, stat := range []map[string]interface{}{getSimpleStat(0), last} {
+			err = statLogger.Write("kStats", stat)
+			if err != nil {
+				t.Fatalf("TestCloseSnapshot failed with error %v", err)
+			}
+		}
+
+		// Written in full, so not written again.
+		err = statLogger.Write("iStats", getSimpleStat(1))
+		if err != nil {
+			t.Fatalf("TestCloseSnapshot failed with error %v", err)
+		}
+
+		err = statLogger.Close()
+		if err != nil {
+			t.Fatalf("TestCloseSnapshot failed with error %v", err)
+		}
+
+		content, err := readLogFile(fileName)
+		if err != nil {
+			t.Fatalf("TestCloseSnapshot failed with error %v", err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		expLines := 3
+		if enable {
+			expLines = 4
+		}
+
+		if len(lines) != expLines {
+			t.Fatalf("TestCloseSnapshot failed for %v: exp %v lines actual %v", enable, expLines, len(lines))
+		}
+
+		if !enable {
+			continue
+		}
+
+		// The full stats, with the timestamp of the deduplicated ones.
+		ts, statType, data, err := splitStatLine([]byte(lines[3]), 0)
+		if err != nil {
+			t.Fatalf("TestCloseSnapshot failed with error %v", err)
+		}
+
+		if statType != "kStats" || !strings.HasPrefix(lines[1], ts+" kStats ") {
+			t.Fatalf("TestCloseSnapshot failed: unexpected snapshot %v", lines[3])
+		}
+
+		var stat map[string]interface{}
+		err = json.Unmarshal(data, &stat)
+		if err != nil {
+			t.Fatalf("TestCloseSnapshot failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(last, stat) {
+			t.Fatalf("TestCloseSnapshot failed: exp %v actual %v", last, stat)
+		}
+	}
+}
+
+func TestMaxRecordBytes(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "max_record_bytes")
+	if err != nil {
+		t.Fatalf("TestMaxRecordBytes failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	huge := map[string]interface{}{"k1": strings.Repeat("x", 10*1024*1024)}
+
+	// A 10MB record against a 1MB cap is rejected.
+	fileName := filepath.Join(tmpDir, "reject.log")
+	statLogger, err := New(fileName, WithMaxRecordBytes(1024*1024, false))
+	if err != nil {
+		t.Fatalf("TestMaxRecordBytes failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	err = statLogger.Write("kStats", huge)
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("TestMaxRecordBytes failed: unexpected error %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "kStats") || !strings.Contains(err.Error(), "1048576") {
+		t.Fatalf("TestMaxRecordBytes failed: unclear error %v", err)
+	}
+
+	err = statLogger.Write("kStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestMaxRecordBytes failed with error %v", err)
+	}
+
+	content, err := readLogFile(fileName)
+	if err != nil {
+		t.Fatalf("TestMaxRecordBytes failed with error %v", err)
+	}
+
+	if len(content) > 1024 {
+		t.Fatalf("TestMaxRecordBytes failed: record of %v bytes written", len(content))
+	}
+
+	// Truncated, with the deduplication following the marker.
+	fileName = filepath.Join(tmpDir, "truncate.log")
+	statLogger, err = New(fileName, WithMaxRecordBytes(1024*1024, true), WithDedupe(true))
+	if err != nil {
+		t.Fatalf("TestMaxRecordBytes failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	for _, stat := range []map[string]interface{}{getSimpleStat(0), huge, getSimpleStat(0)} {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestMaxRecordBytes failed with error %v", err)
+		}
+	}
+
+	content, err = readLogFile(fileName)
+	if err != nil {
+		t.Fatalf("TestMaxRecordBytes failed with error %v", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("TestMaxRecordBytes failed: exp 3 lines actual %v", len(lines))
+	}
+
+	_, _, data, err := splitStatLine(lines[1], 0)
+	if err != nil || !strings.HasPrefix(string(data), `["__truncated__",1048`) {
+		t.Fatalf("TestMaxRecordBytes failed: unexpected marker %s, error %v", data, err)
+	}
+
+	// Written in full rather than deduplicated against the truncated stats.
+	if !bytes.Equal(lines[0][bytes.IndexByte(lines[0], ' '):], lines[2][bytes.IndexByte(lines[2], ' '):]) {
+		t.Fatalf("TestMaxRecordBytes failed: exp %s actual %s", lines[0], lines[2])
+	}
+}
+
+func TestUTC(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "utc")
+	if err != nil {
+		t.Fatalf("TestUTC failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	zone := time.FixedZone("IST", 5*3600+1800)
+	now := time.Date(2024, 1, 1, 10, 30, 15, 0, zone)
+
+	for _, utc := range []bool{false, true} {
+		fileName := filepath.Join(tmpDir, fmt.Sprintf("utc_%v.log", utc))
+		statLogger, err := New(fileName, WithUTC(utc), withClock(func() time.Time { return now }))
+		if err != nil {
+			t.Fatalf("TestUTC failed with error %v", err)
+		}
+
+		err = statLogger.Write("kStats", getSimpleStat(0))
+		if err == nil {
+			err = statLogger.WriteAt(now.Add(time.Second), "kStats", getSimpleStat(1))
+		}
+		statLogger.Close()
+		if err != nil {
+			t.Fatalf("TestUTC failed with error %v", err)
+		}
+
+		content, err := readLogFile(fileName)
+		if err != nil {
+			t.Fatalf("TestUTC failed with error %v", err)
+		}
+
+		exp := []string{"2024-01-01T10:30:15.000+05:30 ", "2024-01-01T10:30:16.000+05:30 "}
+		if utc {
+			exp = []string{"2024-01-01T05:00:15.000+00:00 ", "2024-01-01T05:00:16.000+00:00 "}
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		if len(lines) != len(exp) {
+			t.Fatalf("TestUTC failed for %v: exp %v lines actual %v", utc, len(exp), len(lines))
+		}
+
+		for i, line := range lines {
+			if !strings.HasPrefix(line, exp[i]) {
+				t.Fatalf("TestUTC failed for %v: exp prefix %v actual %v", utc, exp[i], line)
+			}
+		}
+	}
+}
+
+func TestStaleTypes(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "stale_types")
+	if err != nil {
+		t.Fatalf("TestStaleTypes failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	optSets := map[string][]Option{
+		"dedupe":   {WithDedupe(true), WithRotationSnapshot(true)},
+		"plain":    {},
+		"per_type": {WithPerTypeFiles(true)},
+	}
+
+	for name, opts := range optSets {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		now := start
+		clock := func() time.Time { return now }
+
+		fileName := filepath.Join(tmpDir, name+".log")
+		statLogger, err := New(fileName, append(opts, withClock(clock))...)
+		if err != nil {
+			t.Fatalf("TestStaleTypes failed for %v with error %v", name, err)
+		}
+
+		err = statLogger.Write("kStats", getSimpleStat(0))
+		if err != nil {
+			t.Fatalf("TestStaleTypes failed for %v with error %v", name, err)
+		}
+
+		now = now.Add(time.Minute)
+		err = statLogger.Write("iStats", getSimpleStat(1))
+		if err != nil {
+			t.Fatalf("TestStaleTypes failed for %v with error %v", name, err)
+		}
+
+		// The snapshots written on rotation do not count.
+		err = statLogger.Rotate()
+		if err != nil {
+			t.Fatalf("TestStaleTypes failed for %v with error %v", name, err)
+		}
+
+		now = now.Add(time.Minute)
+		ts, ok := statLogger.LastWrite("kStats")
+		if !ok || !ts.Equal(start) {
+			t.Fatalf("TestStaleTypes failed for %v: unexpected last write %v, %v", name, ts, ok)
+		}
+
+		_, ok = statLogger.LastWrite("missing")
+		if ok {
+			t.Fatalf("TestStaleTypes failed for %v: last write of a type never written", name)
+		}
+
+		stale := statLogger.StaleTypes(90 * time.Second)
+		if !reflect.DeepEqual(stale, []string{"kStats"}) {
+			t.Fatalf("TestStaleTypes failed for %v: unexpected stale types %v", name, stale)
+		}
+
+		stale = statLogger.StaleTypes(30 * time.Second)
+		if !reflect.DeepEqual(stale, []string{"iStats", "kStats"}) {
+			t.Fatalf("TestStaleTypes failed for %v: unexpected stale types %v", name, stale)
+		}
+
+		statLogger.Close()
+	}
+}
+
+func TestRotationPredicate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "rotation_predicate")
+	if err != nil {
+		t.Fatalf("TestRotationPredicate failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	clock := func() time.Time { return now }
+
+	// Rotates once the next benchmark iteration begins.
+	var newIteration bool
+	var infos []RotationInfo
+	predicate := func(info RotationInfo) bool {
+		infos = append(infos, info)
+		return newIteration
+	}
+
+	fileName := filepath.Join(tmpDir, "rotation_predicate.log")
+	statLogger, err := New(fileName, WithRotationPredicate(predicate), withClock(clock))
+	if err != nil {
+		t.Fatalf("TestRotationPredicate failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestRotationPredicate failed with error %v", err)
+		}
+	}
+
+	// Not consulted for the empty log file.
+	if len(infos) != 2 {
+		t.Fatalf("TestRotationPredicate failed: consulted %v times", len(infos))
+	}
+
+	info := infos[1]
+	if info.FileName != fileName || info.Lines != 2 || info.Size == 0 ||
+		info.Age != 3*time.Second || !info.LastRotate.Equal(start) {
+		t.Fatalf("TestRotationPredicate failed: unexpected rotation info %+v", info)
+	}
+
+	lstInfo := statLogger.Info()
+	if lstInfo.ScanErr != nil || lstInfo.Rotations != 0 {
+		t.Fatalf("TestRotationPredicate failed: unexpected rotations %v, error %v", lstInfo.Rotations, lstInfo.ScanErr)
+	}
+
+	newIteration = true
+	err = statLogger.Write("kStats", getSimpleStat(3))
+	if err != nil {
+		t.Fatalf("TestRotationPredicate failed with error %v", err)
+	}
+
+	lstInfo = statLogger.Info()
+	if lstInfo.ScanErr != nil || lstInfo.Rotations != 1 {
+		t.Fatalf("TestRotationPredicate failed: unexpected rotations %v, error %v", lstInfo.Rotations, lstInfo.ScanErr)
+	}
+}
+
+func TestCompressExisting(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "compress_existing")
+	if err != nil {
+		t.Fatalf("TestCompressExisting failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	line := func(n int) string {
+		return fmt.Sprintf("2024-01-01T00:00:0%v.000Z s%v {\"k\":%v}\n", n, n, n)
+	}
+
+	// Rotated while the compression was disabled: a mixed directory, with a
+	// compressed file left behind by an interrupted compression alongside
+	// its source.
+	files := map[string]string{
+		getLogFileName(fileName, 0, CompressionNone): line(4),
+		getLogFileName(fileName, 2, CompressionNone): line(2),
+		getLogFileName(fileName, 3, CompressionNone): line(1),
+		getLogFileName(fileName, 3, CompressionGzip): "partial",
+		filepath.Join(tmpDir, "uncompressed"):        line(3),
+	}
+	for fname, content := range files {
+		err = os.WriteFile(fname, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("TestCompressExisting failed with error %v", err)
+		}
+	}
+
+	err = compressFile(filepath.Join(tmpDir, "uncompressed"), getLogFileName(fileName, 1, CompressionGzip),
+		CompressionGzip, gzip.DefaultCompression, nil, 0644)
+	if err != nil {
+		t.Fatalf("TestCompressExisting failed with error %v", err)
+	}
+	os.Remove(filepath.Join(tmpDir, "uncompressed"))
+
+	var statLogger LogStats
+	statLogger, err = New(fileName, WithCompressExisting(true))
+	if err != nil {
+		t.Fatalf("TestCompressExisting failed with error %v", err)
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestCompressExisting failed with error %v", err)
+	}
+
+	var rotated []rotatedLogFile
+	rotated, err = getRotatedLogFiles(fileName, DefaultFileNamer{})
+	if err != nil {
+		t.Fatalf("TestCompressExisting failed with error %v", err)
+	}
+
+	if len(rotated) != 3 {
+		t.Fatalf("TestCompressExisting failed: unexpected rotated files %+v", rotated)
+	}
+
+	for i, file := range rotated {
+		if file.index != i+1 || file.name != getLogFileName(fileName, i+1, CompressionGzip) {
+			t.Fatalf("TestCompressExisting failed: unexpected rotated files %+v", rotated)
+		}
+	}
+
+	var content []byte
+	for _, fname := range []string{"stats.log.3.gz", "stats.log.2.gz", "stats.log.1.gz", "stats.log"} {
+		var data []byte
+		data, err = readLogFile(filepath.Join(tmpDir, fname))
+		if err != nil {
+			t.Fatalf("TestCompressExisting failed with error %v", err)
+		}
+		content = append(content, data...)
+	}
+
+	if exp := line(1) + line(2) + line(3) + line(4); string(content) != exp {
+		t.Fatalf("TestCompressExisting failed: exp %q actual %q", exp, content)
+	}
+}
+
+func TestWritePath(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "write_path")
+	if err != nil {
+		t.Fatalf("TestWritePath failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		expect func(statType string) string
+	}{
+		{
+			name: "plain",
+			opts: []Option{WithSizeLimit(256), WithNumFiles(3)},
+			expect: func(string) string {
+				return filepath.Join(tmpDir, "plain.log")
+			},
+		},
+		{
+			name: "dedupe",
+			opts: []Option{WithSizeLimit(256), WithNumFiles(3), WithDedupe(true)},
+			expect: func(string) string {
+				return filepath.Join(tmpDir, "dedupe.log")
+			},
+		},
+		{
+			name: "active",
+			opts: []Option{WithSizeLimit(256), WithNumFiles(3), WithActiveCompression(true)},
+			expect: func(string) string {
+				return filepath.Join(tmpDir, "active.log.gz")
+			},
+		},
+		{
+			name: "pertype",
+			opts: []Option{WithSizeLimit(256), WithNumFiles(3), WithPerTypeFiles(true)},
+			expect: func(statType string) string {
+				return filepath.Join(tmpDir, "pertype."+statType+".log")
+			},
+		},
+	} {
+		var statLogger LogStats
+		statLogger, err = New(filepath.Join(tmpDir, tc.name), tc.opts...)
+		if err != nil {
+			t.Fatalf("TestWritePath failed with error %v", err)
+		}
+
+		// Across the rotations, the stats land in the current log file.
+		for i := 0; i < 10; i++ {
+			statType := fmt.Sprintf("stats%v", i%2)
+
+			var path string
+			path, err = statLogger.WritePath(statType, getSimpleStat(i))
+			if err != nil {
+				t.Fatalf("TestWritePath failed with error %v", err)
+			}
+
+			if exp := tc.expect(statType); path != exp || !filepath.IsAbs(path) {
+				t.Fatalf("TestWritePath failed for %v: exp path %v actual %v", tc.name, exp, path)
+			}
+
+			if tc.name == "active" {
+				continue
+			}
+
+			var content []byte
+			content, err = readLogFile(path)
+			if err != nil {
+				t.Fatalf("TestWritePath failed with error %v", err)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+			if !strings.Contains(lines[len(lines)-1], " "+statType+" ") {
+				t.Fatalf("TestWritePath failed for %v: stats %v missing in %q", tc.name, statType, lines)
+			}
+		}
+
+		var info LogStatsInfo
+		info = statLogger.Info()
+		if info.ScanErr != nil {
+			t.Fatalf("TestWritePath failed with error %v", info.ScanErr)
+		}
+
+		// The compressed stats take more writes to fill the log file.
+		if info.Rotations == 0 && tc.name != "active" {
+			t.Fatalf("TestWritePath failed for %v: no rotation", tc.name)
+		}
+
+		statLogger.Close()
+	}
+
+	var statLogger LogStats
+	statLogger, err = New(filepath.Join(tmpDir, "closed"))
+	if err != nil {
+		t.Fatalf("TestWritePath failed with error %v", err)
+	}
+	statLogger.Close()
+
+	path, err := statLogger.WritePath("stats", getSimpleStat(0))
+	if err == nil || path != "" {
+		t.Fatalf("TestWritePath failed: write to closed logger returned %q, %v", path, err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sentinel_errors")
+	if err != nil {
+		t.Fatalf("TestSentinelErrors failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for name, opts := range map[string][]Option{
+		"logStats":        nil,
+		"dedupeLogStats":  {WithDedupe(true)},
+		"perTypeLogStats": {WithPerTypeFiles(true)},
+	} {
+		var statLogger LogStats
+		statLogger, err = New(filepath.Join(tmpDir, name), opts...)
+		if err != nil {
+			t.Fatalf("TestSentinelErrors failed with error %v", err)
+		}
+
+		stat := getSimpleStat(0)
+		stat["k5"] = make(chan int)
+		err = statLogger.Write("kStats", stat)
+		if !errors.Is(err, ErrMarshal) {
+			t.Fatalf("TestSentinelErrors failed for %v: exp error %v actual %v", name, ErrMarshal, err)
+		}
+
+		err = statLogger.WriteValue("kValue", make(chan int))
+		if !errors.Is(err, ErrMarshal) {
+			t.Fatalf("TestSentinelErrors failed for %v: exp error %v actual %v", name, ErrMarshal, err)
+		}
+
+		// The logger remains usable.
+		err = statLogger.Write("kStats", getSimpleStat(0))
+		if err != nil {
+			t.Fatalf("TestSentinelErrors failed with error %v", err)
+		}
+
+		statLogger.Close()
+
+		err = statLogger.Write("kStats", getSimpleStat(0))
+		if !errors.Is(err, ErrClosed) || errors.Is(err, ErrRotation) {
+			t.Fatalf("TestSentinelErrors failed for %v: exp error %v actual %v", name, ErrClosed, err)
+		}
+
+		err = statLogger.Flush()
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("TestSentinelErrors failed for %v: exp error %v actual %v", name, ErrClosed, err)
+		}
+	}
+}
+
+func TestWriteStruct(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "write_struct")
+	if err != nil {
+		t.Fatalf("TestWriteStruct failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	type diskStats struct {
+		Used uint64 `json:"used"`
+		Free uint64 `json:"free"`
+	}
+
+	type nodeStats struct {
+		Ops     int32     `json:"ops"`
+		Latency float32   `json:"latency_ms"`
+		Secret  string    `json:"-"`
+		Note    string    `json:"note,omitempty"`
+		Disk    diskStats `json:"disk"`
+		Uptime  int64
+	}
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	statLogger, err := New(fileName, WithDedupe(true))
+	if err != nil {
+		t.Fatalf("TestWriteStruct failed with error %v", err)
+	}
+
+	stats := []nodeStats{
+		{Ops: 10, Latency: 0.1, Secret: "s", Disk: diskStats{Used: 1 << 60, Free: 5}, Uptime: 7},
+		{Ops: 10, Latency: 0.1, Secret: "t", Disk: diskStats{Used: 1 << 60, Free: 6}, Uptime: 7},
+		{Ops: 10, Latency: 0.1, Note: "n", Disk: diskStats{Used: 1 << 60, Free: 6}, Uptime: 7},
+	}
+	for _, stat := range stats {
+		err = statLogger.WriteStruct("nodeStats", stat)
+		if err != nil {
+			t.Fatalf("TestWriteStruct failed with error %v", err)
+		}
+	}
+
+	err = statLogger.WriteStruct("nodeStats", []int{1})
+	if err == nil {
+		t.Fatalf("TestWriteStruct failed: value not encoded as a JSON object accepted")
+	}
+
+	err = statLogger.WriteStruct("nodeStats", struct{ C chan int }{})
+	if !errors.Is(err, ErrMarshal) {
+		t.Fatalf("TestWriteStruct failed: exp error %v actual %v", ErrMarshal, err)
+	}
+	statLogger.Close()
+
+	content, err := readLogFile(fileName)
+	if err != nil {
+		t.Fatalf("TestWriteStruct failed with error %v", err)
+	}
+
+	// Deduplicated by the json tags, the secret left out; the nested
+	// struct as a nested map.
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	expLines := []string{
+		`{"Uptime":7,"disk":{"free":5,"used":1152921504606846976},"latency_ms":0.1,"ops":10}`,
+		`{"disk":{"free":6}}`,
+		`{"note":"n"}`,
+	}
+	if len(lines) != len(expLines) {
+		t.Fatalf("TestWriteStruct failed: unexpected lines %q", lines)
+	}
+
+	for i, line := range lines {
+		if !strings.HasSuffix(line, " nodeStats "+expLines[i]) {
+			t.Fatalf("TestWriteStruct failed: exp %v actual %v", expLines[i], line)
+		}
+	}
+
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestWriteStruct failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for _, exp := range stats {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestWriteStruct failed with error %v", err)
+		}
+
+		// The keys sorted, as in the stat maps.
+		statBytes, _ := json.Marshal(stat)
+		expBytes, _ := json.Marshal(exp)
+		expBytes, _ = canonicalJSON(expBytes)
+		if string(statBytes) != string(expBytes) {
+			t.Fatalf("TestWriteStruct failed: exp %s actual %s", expBytes, statBytes)
+		}
+	}
+}
+
+func TestSingleWriter(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "single_writer")
+	if err != nil {
+		t.Fatalf("TestSingleWriter failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	_, err = New(fileName, WithSingleWriter(), WithSyncInterval(time.Second))
+	if err == nil {
+		t.Fatalf("TestSingleWriter failed: WithSyncInterval accepted")
+	}
+
+	statLogger, err := NewLogStats(fileName, 256, 3, DEFAULT_TS_FORMAT, WithSingleWriter())
+	if err != nil {
+		t.Fatalf("TestSingleWriter failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 10; i++ {
+		exp = append(exp, getSimpleStat(i))
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestSingleWriter failed with error %v", err)
+		}
+	}
+
+	info := statLogger.Info()
+	if info.ScanErr != nil || info.Rotations == 0 {
+		t.Fatalf("TestSingleWriter failed: info %+v, error %v", info, info.ScanErr)
+	}
+
+	// An overlapping call, as by another goroutine, panics.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("TestSingleWriter failed: overlapping call not detected")
+			}
+		}()
+
+		statLogger.lock.Lock()
+		defer statLogger.lock.Unlock()
+
+		statLogger.Write("kStats", getSimpleStat(0))
+	}()
+
+	// Usable once the overlapping call is over.
+	err = statLogger.Flush()
+	if err != nil {
+		t.Fatalf("TestSingleWriter failed with error %v", err)
+	}
+
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestSingleWriter failed with error %v", err)
+	}
+	defer reader.Close()
+
+	// Reconstructed from the files remaining after the rotations.
+	var last map[string]interface{}
+	for {
+		_, _, stat, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("TestSingleWriter failed with error %v", err)
+		}
+		last = stat
+	}
+
+	statBytes, _ := json.Marshal(last)
+	expBytes, _ := json.Marshal(exp[len(exp)-1])
+	if string(statBytes) != string(expBytes) {
+		t.Fatalf("TestSingleWriter failed: exp %s actual %s", expBytes, statBytes)
+	}
+}
+
+func TestInfoRecords(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "info_records")
+	if err != nil {
+		t.Fatalf("TestInfoRecords failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for name, opts := range map[string][]Option{
+		"plain":   nil,
+		"dedupe":  {WithDedupe(true)},
+		"pertype": {WithPerTypeFiles(true)},
+	} {
+		var statLogger LogStats
+		statLogger, err = New(filepath.Join(tmpDir, name), opts...)
+		if err != nil {
+			t.Fatalf("TestInfoRecords failed with error %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			err = statLogger.Write("kStats", getSimpleStat(i))
+			if err != nil {
+				t.Fatalf("TestInfoRecords failed with error %v", err)
+			}
+		}
+
+		err = statLogger.WriteBatch([]StatEntry{
+			{Type: "vStats", Map: getSimpleStat(0)},
+			{Type: "kStats", Map: getSimpleStat(3)},
+		})
+		if err != nil {
+			t.Fatalf("TestInfoRecords failed with error %v", err)
+		}
+
+		err = statLogger.WriteValue("vStats", []int{1, 2})
+		if err != nil {
+			t.Fatalf("TestInfoRecords failed with error %v", err)
+		}
+
+		// Failed writes do not count.
+		statLogger.Write("kStats", map[string]interface{}{"c": make(chan int)})
+
+		var info LogStatsInfo
+		info = statLogger.Info()
+		if info.ScanErr != nil {
+			t.Fatalf("TestInfoRecords failed with error %v", info.ScanErr)
+		}
+
+		exp := map[string]int64{"kStats": 4, "vStats": 2}
+		if info.Records != 6 || !reflect.DeepEqual(info.TypeRecords, exp) {
+			t.Fatalf("TestInfoRecords failed for %v: exp 6 records %v actual %v records %v",
+				name, exp, info.Records, info.TypeRecords)
+		}
+
+		// A copy, owned by the caller.
+		info.TypeRecords["kStats"] = 0
+		info = statLogger.Info()
+		if info.TypeRecords["kStats"] != 4 {
+			t.Fatalf("TestInfoRecords failed for %v: records modified by the caller", name)
+		}
+
+		statLogger.Close()
+	}
+}
+
+func TestCurrentBaseline(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "current_baseline.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestCurrentBaseline failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestCurrentBaseline failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	dlst := statLogger.(*dedupeLogStats)
+	_, ok := dlst.CurrentBaseline("kStats")
+	if ok {
+		t.Fatalf("TestCurrentBaseline failed: baseline before the first write")
+	}
+
+	newStat := func() map[string]interface{} {
+		return map[string]interface{}{
+			"k1": int64(1),
+			"k2": map[string]interface{}{"k3": "v3"},
+			"k4": []interface{}{int64(5), map[string]interface{}{"k6": int64(6)}},
+		}
+	}
+
+	err = statLogger.Write("kStats", newStat())
+	if err != nil {
+		t.Fatalf("TestCurrentBaseline failed with error %v", err)
+	}
+
+	baseline, ok := dlst.CurrentBaseline("kStats")
+	if !ok || !reflect.DeepEqual(baseline, newStat()) {
+		t.Fatalf("TestCurrentBaseline failed: baseline %v, expected %v", baseline, newStat())
+	}
+
+	// Mutating the baseline, at every level, does not affect the
+	// deduplication of the next stats.
+	baseline["k1"] = int64(10)
+	baseline["k2"].(map[string]interface{})["k3"] = "v30"
+	baseline["k4"].([]interface{})[0] = int64(50)
+	baseline["k4"].([]interface{})[1].(map[string]interface{})["k6"] = int64(60)
+	delete(baseline, "k2")
+
+	err = statLogger.Write("kStats", newStat())
+	if err != nil {
+		t.Fatalf("TestCurrentBaseline failed with error %v", err)
+	}
+
+	// The same stats are deduplicated in full.
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestCurrentBaseline failed with error %v", err)
+	}
+
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], " kStats {}") {
+		t.Fatalf("TestCurrentBaseline failed: unexpected log messages %q", lines)
+	}
+
+	// No baseline once the deduplication resets.
+	statLogger.DedupeReset()
+	_, ok = dlst.CurrentBaseline("kStats")
+	if ok {
+		t.Fatalf("TestCurrentBaseline failed: baseline after DedupeReset")
+	}
+}
+
+func TestDedupeReusedStatMap(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "dedupe_reused_stat_map.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestDedupeReusedStatMap failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestDedupeReusedStatMap failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// The same stat map, nested maps included, is mutated in place and
+	// written once per tick.
+	nested := map[string]interface{}{"k3": int64(3)}
+	stat := map[string]interface{}{"k1": int64(1), "k2": nested}
+	for i := 0; i < 3; i++ {
+		if i == 1 {
+			stat["k1"] = int64(10)
+			nested["k3"] = int64(30)
+		}
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestDedupeReusedStatMap failed with error %v", err)
+		}
+	}
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestDedupeReusedStatMap failed with error %v", err)
+	}
+
+	exp := []string{
+		`{"k1":1,"k2":{"k3":3}}`,
+		`{"k1":10,"k2":{"k3":30}}`,
+		`{}`,
+	}
+
+	if len(lines) != len(exp) {
+		t.Fatalf("TestDedupeReusedStatMap failed: unexpected log messages %q", lines)
+	}
+
+	for i, line := range lines {
+		if !strings.HasSuffix(line, " kStats "+exp[i]) {
+			t.Fatalf("TestDedupeReusedStatMap failed: log message %q, expected stats %v", line, exp[i])
+		}
+	}
+}
+
+func TestWithoutRotation(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "without_rotation")
+	if err != nil {
+		t.Fatalf("TestWithoutRotation failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	for _, opt := range []Option{
+		WithRotateInterval(time.Hour),
+		WithMaxLines(10),
+		WithRotationPredicate(func(info RotationInfo) bool { return true }),
+	} {
+		_, err = New(fileName, WithoutRotation(), opt)
+		if err == nil {
+			t.Fatalf("TestWithoutRotation failed: conflicting rotation option accepted")
+		}
+	}
+
+	// Way past the size limit and the number of files.
+	statLogger, err := NewDedupeLogStats(fileName, 256, 1, DEFAULT_TS_FORMAT, WithoutRotation())
+	if err != nil {
+		t.Fatalf("TestWithoutRotation failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	for i := 0; i < 50; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestWithoutRotation failed with error %v", err)
+		}
+	}
+
+	info := statLogger.Info()
+	if info.ScanErr != nil || info.Rotations != 0 || info.CurrentFileSize <= 256 {
+		t.Fatalf("TestWithoutRotation failed: info %+v, error %v", info, info.ScanErr)
+	}
+
+	files := statLogger.Files()
+	if len(files) != 1 {
+		t.Fatalf("TestWithoutRotation failed: unexpected log files %v", files)
+	}
+
+	// All the stats in the one log file.
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil || len(lines) != 50 {
+		t.Fatalf("TestWithoutRotation failed: %v log messages, error %v", len(lines), err)
+	}
+
+	// An explicit Rotate still rotates.
+	err = statLogger.Rotate()
+	if err != nil {
+		t.Fatalf("TestWithoutRotation failed with error %v", err)
+	}
+
+	info = statLogger.Info()
+	if info.ScanErr != nil || info.Rotations != 1 {
+		t.Fatalf("TestWithoutRotation failed: info %+v, error %v", info, info.ScanErr)
+	}
+}
+
+func TestSyncEveryBytes(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sync_every_bytes")
+	if err != nil {
+		t.Fatalf("TestSyncEveryBytes failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	_, err = New(fileName, WithSyncEveryBytes(-1))
+	if err == nil {
+		t.Fatalf("TestSyncEveryBytes failed: negative byte count accepted")
+	}
+
+	k := 1000
+	statLogger, err := NewLogStats(fileName, 1024*1024, 2, DEFAULT_TS_FORMAT,
+		WithBufferSize(64*1024), WithSyncEveryBytes(k))
+	if err != nil {
+		t.Fatalf("TestSyncEveryBytes failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	// A sync once k bytes are written since the last one.
+	written, unsynced, expSyncs := 0, 0, 0
+	for i := 0; i < 100; i++ {
+		sz := statLogger.sz
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestSyncEveryBytes failed with error %v", err)
+		}
+
+		written += statLogger.sz - sz
+		unsynced += statLogger.sz - sz
+		if unsynced >= k {
+			expSyncs++
+			unsynced = 0
+		}
+	}
+
+	if expSyncs < 2 || statLogger.syncs != expSyncs {
+		t.Fatalf("TestSyncEveryBytes failed: %v syncs over %v bytes, expected %v",
+			statLogger.syncs, written, expSyncs)
+	}
+
+	// The synced stats are in the log file, despite the buffering.
+	data, err := os.ReadFile(fileName)
+	if err != nil || len(data) != written-unsynced {
+		t.Fatalf("TestSyncEveryBytes failed: %v bytes in the log file, expected %v, error %v",
+			len(data), written-unsynced, err)
+	}
+
+	// Durable wins, syncing on every Write.
+	statLogger.SetDurable(true)
+	syncs := statLogger.syncs
+	for i := 0; i < 3; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestSyncEveryBytes failed with error %v", err)
+		}
+	}
+
+	if statLogger.syncs != syncs+3 {
+		t.Fatalf("TestSyncEveryBytes failed: %v syncs of the durable writes, expected 3",
+			statLogger.syncs-syncs)
+	}
+}
+
+func TestTimeBasedRotation(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "time_rotation.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestTimeBasedRotation failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024*1024, 3, "2006-01-02T15:04:05.000-07:00",
+		WithRotateInterval(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestTimeBasedRotation failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	statLogger.(*logStats).SetCompression(false)
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(150 * time.Millisecond)
+		}
+
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestTimeBasedRotation failed with error %v", err)
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		exp = append(exp, vstat)
+	}
+
+	// The size limit is not reached, so the first stat can be in the
+	// rotated file only due to time based rotation.
+	_, err = os.Stat(getLogFileName(fileName, 1, CompressionNone))
+	if err != nil {
+		t.Fatalf("TestTimeBasedRotation failed with error %v", err)
+	}
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestTimeBasedRotation failed with error %v", err)
+	}
+}
+
+func TestDedupeTimeBasedRotation(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "dedupe_time_rotation.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestDedupeTimeBasedRotation failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 3, "2006-01-02T15:04:05.000-07:00",
+		WithRotateInterval(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestDedupeTimeBasedRotation failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	statLogger.(*dedupeLogStats).SetCompression(false)
+
+	// Write dedupe stats
+	stat := getSimpleStat(0)
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestDedupeTimeBasedRotation failed with error %v", err)
+	}
+
+	exp := make([]map[string]interface{}, 0)
+	vstat := make(map[string]interface{})
+	vstat["type"] = "kStats"
+	vstat["stat"] = stat
+	exp = append(exp, vstat)
+
+	// Dedupe stat 1
+	stat = getSimpleStat(0)
+	stat["k1"] = int64(9876)
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestDedupeTimeBasedRotation failed with error %v", err)
+	}
+
+	estat := make(map[string]interface{})
+	estat["k1"] = int64(9876)
+	vstat = make(map[string]interface{})
+	vstat["type"] = "kStats"
+	vstat["stat"] = estat
+	exp = append(exp, vstat)
+
+	// Time based rotation resets deduplication.
+	time.Sleep(150 * time.Millisecond)
+
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestDedupeTimeBasedRotation failed with error %v", err)
+	}
+
+	vstat = make(map[string]interface{})
+	vstat["type"] = "kStats"
+	vstat["stat"] = stat
+	exp = append(exp, vstat)
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestDedupeTimeBasedRotation failed with error %v", err)
+	}
+}
+
+func TestSetCompression(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "set_compression.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestSetCompression failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 32, 3, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestSetCompression failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 2; i++ {
+		// Compression is enabled by default, disable it before the
+		// first rotation.
+		if i > 0 {
+			statLogger.SetCompression(false)
+		}
+
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestSetCompression failed with error %v", err)
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		exp = append(exp, vstat)
+	}
+
+	_, err = os.Stat(getLogFileName(fileName, 1, CompressionNone))
+	if err != nil {
+		t.Fatalf("TestSetCompression failed with error %v", err)
+	}
+
+	_, err = os.Stat(getLogFileName(fileName, 1, CompressionGzip))
+	if !os.IsNotExist(err) {
+		t.Fatalf("TestSetCompression failed: unexpected compressed file, error %v", err)
+	}
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestSetCompression failed with error %v", err)
+	}
+}
+
+func TestZstdCompressionWithRotation(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "zstd_rotate.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestZstdCompressionWithRotation failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 32, 3, "2006-01-02T15:04:05.000-07:00",
+		WithCompression(CompressionZstd))
+	if err != nil {
+		t.Fatalf("TestZstdCompressionWithRotation failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 5; i++ {
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestZstdCompressionWithRotation failed with error %v", err)
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		exp = append(exp, vstat)
+	}
+
+	// First two stats will get rotate out of retention due to numFiles.
+	exp = exp[2:]
+
+	_, err = os.Stat(getLogFileName(fileName, 2, CompressionZstd))
+	if err != nil {
+		t.Fatalf("TestZstdCompressionWithRotation failed with error %v", err)
+	}
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionZstd)
+	if err != nil {
+		t.Fatalf("TestZstdCompressionWithRotation failed with error %v", err)
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "compression_level.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestCompressionLevel failed with error %v", err)
+	}
+
+	for _, level := range []int{gzip.HuffmanOnly - 1, gzip.BestCompression + 1} {
+		_, err = NewLogStats(fileName, 32, 3, "2006-01-02T15:04:05.000-07:00",
+			WithCompressionLevel(level))
+		if err == nil {
+			t.Fatalf("TestCompressionLevel failed: expected error for level %v", level)
+		}
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 32, 3, "2006-01-02T15:04:05.000-07:00",
+		WithCompressionLevel(gzip.BestCompression))
+	if err != nil {
+		t.Fatalf("TestCompressionLevel failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 3; i++ {
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestCompressionLevel failed with error %v", err)
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		exp = append(exp, vstat)
+	}
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestCompressionLevel failed with error %v", err)
+	}
+}
+
+func TestCompressLargeFile(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "compress_large.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestCompressLargeFile failed with error %v", err)
+	}
+
+	// Pre-populate a multi-megabyte log file, which gets rotated by the
+	// first Write.
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 8*1024*1024; i++ {
+		fmt.Fprintf(&buf, "2006-01-02T15:04:05.000-07:00 kStats {\"k1\":%v}\n", i)
+	}
+
+	orig := buf.Bytes()
+	err = os.WriteFile(fileName, orig, 0o644)
+	if err != nil {
+		t.Fatalf("TestCompressLargeFile failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024*1024, 3, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestCompressLargeFile failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	err = statLogger.Write("kStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestCompressLargeFile failed with error %v", err)
+	}
+
+	f, err := os.Open(getLogFileName(fileName, 1, CompressionGzip))
+	if err != nil {
+		t.Fatalf("TestCompressLargeFile failed with error %v", err)
+	}
+	defer f.Close()
+
+	var reader io.ReadCloser
+	reader, err = newDecompressReader(f, CompressionGzip, nil)
+	if err != nil {
+		t.Fatalf("TestCompressLargeFile failed with error %v", err)
+	}
+	defer reader.Close()
+
+	var got []byte
+	got, err = io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("TestCompressLargeFile failed with error %v", err)
+	}
+
+	if !bytes.Equal(orig, got) {
+		t.Fatalf("TestCompressLargeFile failed: decompressed content mismatch, exp %v bytes actual %v bytes",
+			len(orig), len(got))
+	}
+}
+
+func TestFlush(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "flush.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestFlush failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestFlush failed with error %v", err)
+	}
+
+	stat := getSimpleStat(0)
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestFlush failed with error %v", err)
+	}
+
+	err = statLogger.Flush()
+	if err != nil {
+		t.Fatalf("TestFlush failed with error %v", err)
+	}
+
+	exp := make([]map[string]interface{}, 0)
+	vstat := make(map[string]interface{})
+	vstat["type"] = "kStats"
+	vstat["stat"] = stat
+	exp = append(exp, vstat)
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestFlush failed with error %v", err)
+	}
+
+	statLogger.Close()
+
+	err = statLogger.Flush()
+	if err == nil {
+		t.Fatalf("TestFlush failed: expected error on Flush after Close")
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "close_error.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestCloseError failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		WithBufferSize(64*1024))
+	if err != nil {
+		t.Fatalf("TestCloseError failed with error %v", err)
+	}
+
+	statLogger.SetDurable(true)
+	err = statLogger.Write("kStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestCloseError failed with error %v", err)
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestCloseError failed with error %v", err)
+	}
+
+	// Closing again is a no-op.
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestCloseError failed with error %v", err)
+	}
+
+	// The buffered stats cannot be flushed to a file closed underneath.
+	statLogger, err = NewLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		WithBufferSize(64*1024))
+	if err != nil {
+		t.Fatalf("TestCloseError failed with error %v", err)
+	}
+
+	err = statLogger.Write("kStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestCloseError failed with error %v", err)
+	}
+
+	statLogger.(*logStats).f.Close()
+
+	err = statLogger.Close()
+	if !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("TestCloseError failed: exp error %v actual %v", os.ErrClosed, err)
+	}
+}
+
+func TestLogFileInUse(t *testing.T) {
+	if !lockSupported {
+		t.Skip("TestLogFileInUse skipped, no file locking on this platform")
+	}
+
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "in_use.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestLogFileInUse failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestLogFileInUse failed with error %v", err)
+	}
+
+	// The log file cannot be shared, deduplicating or not.
+	_, err = NewLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if !errors.Is(err, ErrLogFileInUse) {
+		t.Fatalf("TestLogFileInUse failed: exp error %v actual %v", ErrLogFileInUse, err)
+	}
+
+	_, err = NewDedupeLogStats(strings.TrimSuffix(fileName, ".log"), 1024*1024, 2,
+		"2006-01-02T15:04:05.000-07:00")
+	if !errors.Is(err, ErrLogFileInUse) {
+		t.Fatalf("TestLogFileInUse failed: exp error %v actual %v", ErrLogFileInUse, err)
+	}
+
+	// The lock is released on Close.
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestLogFileInUse failed with error %v", err)
+	}
+
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestLogFileInUse failed with error %v", err)
+	}
+
+	statLogger.Close()
+}
+
+func TestBufferedWrites(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "buffered.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestBufferedWrites failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 256, 4, "2006-01-02T15:04:05.000-07:00",
+		WithBufferSize(4096))
+	if err != nil {
+		t.Fatalf("TestBufferedWrites failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	statLogger.SetCompression(false)
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 5; i++ {
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestBufferedWrites failed with error %v", err)
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		exp = append(exp, vstat)
+	}
+
+	// The last stat is buffered until Flush.
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err == nil {
+		t.Fatalf("TestBufferedWrites failed: expected the last stat to be buffered")
+	}
+
+	err = statLogger.Flush()
+	if err != nil {
+		t.Fatalf("TestBufferedWrites failed with error %v", err)
+	}
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestBufferedWrites failed with error %v", err)
+	}
+}
+
+func benchmarkWrite(b *testing.B, name string, opts ...Option) {
+	fileName := filepath.Join(b.TempDir(), name)
+
+	statLogger, err := NewLogStats(fileName, 1024*1024*1024, 2, "2006-01-02T15:04:05.000-07:00", opts...)
+	if err != nil {
+		b.Fatalf("%v failed with error %v", b.Name(), err)
+	}
+
+	defer statLogger.Close()
+
+	stat := getSimpleStat(0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			b.Fatalf("%v failed with error %v", b.Name(), err)
+		}
+	}
+}
+
+func BenchmarkWriteUnbuffered(b *testing.B) {
+	benchmarkWrite(b, "unbuffered.log")
+}
+
+func BenchmarkWriteBuffered(b *testing.B) {
+	benchmarkWrite(b, "buffered.log", WithBufferSize(64*1024))
+}
+
+// The cost of the lock, against BenchmarkWriteBuffered.
+func BenchmarkWriteBufferedSingleWriter(b *testing.B) {
+	benchmarkWrite(b, "single_writer.log", WithBufferSize(64*1024), WithSingleWriter())
+}
+
+func TestWriteBatch(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "write_batch.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestWriteBatch failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestWriteBatch failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Dedupe is applied per entry, in order.
+	stat := getSimpleStat(0)
+	stat1 := getSimpleStat(0)
+	stat1["k1"] = int64(9876)
+	other := getSimpleStat(1)
+
+	batch := []StatEntry{
+		{Type: "kStats", Map: stat},
+		{Type: "kOtherStats", Map: other},
+		{Type: "kStats", Map: stat1},
+	}
+
+	err = statLogger.WriteBatch(batch)
+	if err != nil {
+		t.Fatalf("TestWriteBatch failed with error %v", err)
+	}
+
+	exp := make([]map[string]interface{}, 0)
+	exp = append(exp, map[string]interface{}{"type": "kStats", "stat": stat})
+	exp = append(exp, map[string]interface{}{"type": "kOtherStats", "stat": other})
+	exp = append(exp, map[string]interface{}{
+		"type": "kStats",
+		"stat": map[string]interface{}{"k1": int64(9876)},
+	})
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestWriteBatch failed with error %v", err)
+	}
+}
+
+func TestWriteValue(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "write_value.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestWriteValue failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestWriteValue failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	type subStat struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	stat := getSimpleStat(0)
+	changed := getSimpleStat(0)
+	changed["k1"] = int64(9876)
+
+	values := []struct {
+		statType string
+		value    interface{}
+		exp      string
+	}{
+		{"kStats", stat, `{"k1":10,"k2":"Value2","k3":false,"k4":{"k31":10,"k32":"Value2","k33":true}}`},
+		{"lStats", []subStat{{"a", 1}, {"b", 2}}, `[{"name":"a","count":1},{"name":"b","count":2}]`},
+		{"lStats", []subStat{{"a", 1}, {"b", 2}}, `[{"name":"a","count":1},{"name":"b","count":2}]`},
+		{"sStats", "a string", `"a string"`},
+		{"nStats", 42, `42`},
+		{"kStats", changed, `{"k1":9876}`},
+	}
+
+	for _, v := range values {
+		err = statLogger.WriteValue(v.statType, v.value)
+		if err != nil {
+			t.Fatalf("TestWriteValue failed with error %v", err)
+		}
+	}
+
+	// The values are written as-is, and do not affect the deduplication
+	// of the stat maps.
+	lines, err := getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestWriteValue failed with error %v", err)
+	}
+
+	if len(lines) != len(values) {
+		t.Fatalf("TestWriteValue failed: exp %v lines actual %v", len(values), lines)
+	}
+
+	for i, line := range lines {
+		comps := strings.SplitN(line, " ", 3)
+		if comps[1] != values[i].statType || comps[2] != values[i].exp {
+			t.Fatalf("TestWriteValue failed: exp %v %v actual %v", values[i].statType, values[i].exp, line)
+		}
+	}
+
+	// The arrays pass through the reconstruction.
+	source, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestWriteValue failed with error %v", err)
+	}
+
+	reconstructed, err := ReconstructStatLines(bytes.Split(bytes.TrimSuffix(source, []byte("\n")), []byte("\n")))
+
+	var reconstructErr *ReconstructError
+	if !errors.As(err, &reconstructErr) || len(reconstructErr.Errors) != 2 {
+		t.Fatalf("TestWriteValue failed: exp errors for the scalars, actual %v", err)
+	}
+
+	if string(reconstructed[2]) != lines[2] {
+		t.Fatalf("TestWriteValue failed: exp %v actual %s", lines[2], reconstructed[2])
+	}
+
+	exp, err := json.Marshal(changed)
+	if err != nil {
+		t.Fatalf("TestWriteValue failed with error %v", err)
+	}
+
+	comps := bytes.SplitN(reconstructed[5], []byte(" "), 3)
+	if !bytes.Equal(comps[2], exp) {
+		t.Fatalf("TestWriteValue failed: exp %s actual %s", exp, comps[2])
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "write_raw.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	stat := getSimpleStat(0)
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	// The raw stats are written as-is, without touching the bytes beyond
+	// their length.
+	raw := []byte(`{"k1":12345678901234567890,"k2":"Value2"}` + "\n" + "sentinel")
+	err = statLogger.WriteRaw("kStats", raw[:len(raw)-len("sentinel")])
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	if !strings.HasSuffix(string(raw), "\nsentinel") {
+		t.Fatalf("TestWriteRaw failed: caller's bytes modified %s", raw)
+	}
+
+	// The stats following the raw stats are written in full.
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	err = statLogger.WriteRaw("kStats", []byte("{\"k1\":\n1}"))
+	if err == nil {
+		t.Fatalf("TestWriteRaw failed: raw stats with a new line accepted")
+	}
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	full := `{"k1":10,"k2":"Value2","k3":false,"k4":{"k31":10,"k32":"Value2","k33":true}}`
+	exp := []string{full, `{"k1":12345678901234567890,"k2":"Value2"}`, full}
+	if len(lines) != len(exp) {
+		t.Fatalf("TestWriteRaw failed: exp %v lines actual %v", len(exp), lines)
+	}
+
+	for i, line := range lines {
+		comps := strings.SplitN(line, " ", 3)
+		if comps[1] != "kStats" || comps[2] != exp[i] {
+			t.Fatalf("TestWriteRaw failed: exp %v actual %v", exp[i], line)
+		}
+	}
+
+	// With WithRawDedupe, the raw stats are deduplicated.
+	statLogger.Close()
+	err = cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	statLogger, err = New(fileName, WithDedupe(true), WithRawDedupe(true))
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	err = statLogger.WriteRaw("kStats", []byte(`{"k1":12345678901234567890,"k2":"Value2","k3":false}`))
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	err = statLogger.WriteRaw("kStats", []byte(`{"k1":`))
+	if err == nil {
+		t.Fatalf("TestWriteRaw failed: malformed raw stats accepted")
+	}
+
+	lines, err = getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	exp = []string{full, `{"__removed__":["k4"],"k1":12345678901234567890}`}
+	if len(lines) != len(exp) {
+		t.Fatalf("TestWriteRaw failed: exp %v lines actual %v", len(exp), lines)
+	}
+
+	for i, line := range lines {
+		comps := strings.SplitN(line, " ", 3)
+		if comps[1] != "kStats" || comps[2] != exp[i] {
+			t.Fatalf("TestWriteRaw failed: exp %v actual %v", exp[i], line)
+		}
+	}
+
+	// Not supported with a custom encoder.
+	statLogger.Close()
+	err = cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	statLogger, err = New(fileName, WithEncoder(hexEncoding{}))
+	if err != nil {
+		t.Fatalf("TestWriteRaw failed with error %v", err)
+	}
+
+	err = statLogger.WriteRaw("kStats", []byte(`{"k1":1}`))
+	if err == nil {
+		t.Fatalf("TestWriteRaw failed: raw stats accepted with a custom encoder")
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "write_context.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestWriteContext failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestWriteContext failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	statLogger.SetDurable(true)
+
+	// Cancelled context, nothing gets written.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = statLogger.WriteContext(ctx, "kStats", getSimpleStat(1))
+	if err != context.Canceled {
+		t.Fatalf("TestWriteContext failed: expected %v, actual %v", context.Canceled, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	stat := getSimpleStat(0)
+	err = statLogger.WriteContext(ctx, "kStats", stat)
+	if err != nil {
+		t.Fatalf("TestWriteContext failed with error %v", err)
+	}
+
+	exp := make([]map[string]interface{}, 0)
+	vstat := make(map[string]interface{})
+	vstat["type"] = "kStats"
+	vstat["stat"] = stat
+	exp = append(exp, vstat)
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestWriteContext failed with error %v", err)
+	}
+}
+
+func TestDedupeLogStatsConsistency(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "dedupe_consistency.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestDedupeLogStatsConsistency failed with error %v", err)
+	}
+
+	statLogger, err := NewDedupeLogStats(fileName, 256, 3, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestDedupeLogStatsConsistency failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	for i := 0; i < 100; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i%3))
+		if err != nil {
+			t.Fatalf("TestDedupeLogStatsConsistency failed with error %v", err)
+		}
+
+		// The size tracked for rotation must match the current log file.
+		var finfo os.FileInfo
+		finfo, err = os.Stat(fileName)
+		if err != nil {
+			t.Fatalf("TestDedupeLogStatsConsistency failed with error %v", err)
+		}
+
+		if int64(statLogger.sz) != finfo.Size() {
+			t.Fatalf("TestDedupeLogStatsConsistency failed: size mismatch after %v writes, exp %v actual %v",
+				i+1, finfo.Size(), statLogger.sz)
+		}
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "max_age.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestMaxAge failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 32, 5, "2006-01-02T15:04:05.000-07:00",
+		WithCompression(CompressionNone), WithMaxAge(time.Hour))
+	if err != nil {
+		t.Fatalf("TestMaxAge failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 4; i++ {
+		if i == 3 {
+			// Expire the file with the second stat.
+			old := time.Now().Add(-2 * time.Hour)
+			err = os.Chtimes(getLogFileName(fileName, 1, CompressionNone), old, old)
+			if err != nil {
+				t.Fatalf("TestMaxAge failed with error %v", err)
+			}
+		}
+
+		stat := getSimpleStat(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestMaxAge failed with error %v", err)
+		}
+
+		if i == 1 {
+			continue
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		exp = append(exp, vstat)
+	}
+
+	// The remaining rotated files are renumbered without gaps.
+	for num := 1; num <= 2; num++ {
+		_, err = os.Stat(getLogFileName(fileName, num, CompressionNone))
+		if err != nil {
+			t.Fatalf("TestMaxAge failed with error %v", err)
+		}
+	}
+
+	_, err = os.Stat(getLogFileName(fileName, 3, CompressionNone))
+	if !os.IsNotExist(err) {
+		t.Fatalf("TestMaxAge failed: unexpected rotated file, error %v", err)
+	}
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestMaxAge failed with error %v", err)
+	}
+}
+
+func TestMaxTotalBytes(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "max_total_bytes.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestMaxTotalBytes failed with error %v", err)
+	}
+
+	maxTotalBytes := int64(400)
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 128, 50, "2006-01-02T15:04:05.000-07:00",
+		WithCompression(CompressionNone), WithMaxTotalBytes(maxTotalBytes))
+	if err != nil {
+		t.Fatalf("TestMaxTotalBytes failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	for i := 0; i < 100; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestMaxTotalBytes failed with error %v", err)
+		}
+
+		var files []rotatedLogFile
+		files, err = getRotatedLogFiles(fileName, DefaultFileNamer{})
+		if err != nil {
+			t.Fatalf("TestMaxTotalBytes failed with error %v", err)
+		}
+
+		var total int64
+		for _, file := range files {
+			var finfo os.FileInfo
+			finfo, err = os.Stat(file.name)
+			if err != nil {
+				t.Fatalf("TestMaxTotalBytes failed with error %v", err)
+			}
+			total += finfo.Size()
+		}
+
+		if total > maxTotalBytes {
+			t.Fatalf("TestMaxTotalBytes failed: total size of rotated files %v exceeds %v after %v writes",
+				total, maxTotalBytes, i+1)
+		}
+
+		if i > 10 && len(files) == 0 {
+			t.Fatalf("TestMaxTotalBytes failed: no rotated files retained")
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "info.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestInfo failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 32, 3, "2006-01-02T15:04:05.000-07:00",
+		WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatalf("TestInfo failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Each write, except the first one, rotates the log file.
+	numWrites := 5
+	for i := 0; i < numWrites; i++ {
+		err = statLogger.Write("kStats", getSimpleStat(i))
+		if err != nil {
+			t.Fatalf("TestInfo failed with error %v", err)
+		}
+	}
+
+	info := statLogger.Info()
+	if info.ScanErr != nil {
+		t.Fatalf("TestInfo failed with error %v", info.ScanErr)
+	}
+
+	if info.Rotations != uint64(numWrites-1) {
+		t.Fatalf("TestInfo failed: rotations exp %v actual %v", numWrites-1, info.Rotations)
+	}
+
+	if info.RotatedFiles != 2 {
+		t.Fatalf("TestInfo failed: rotated files exp %v actual %v", 2, info.RotatedFiles)
+	}
+
+	var total int64
+	for num := 0; num <= 2; num++ {
+		var finfo os.FileInfo
+		finfo, err = os.Stat(getLogFileName(fileName, num, CompressionNone))
+		if err != nil {
+			t.Fatalf("TestInfo failed with error %v", err)
+		}
+
+		if num == 0 && int64(info.CurrentFileSize) != finfo.Size() {
+			t.Fatalf("TestInfo failed: current file size exp %v actual %v",
+				finfo.Size(), info.CurrentFileSize)
+		}
+		total += finfo.Size()
+	}
+
+	if info.TotalBytes != total {
+		t.Fatalf("TestInfo failed: total bytes exp %v actual %v", total, info.TotalBytes)
+	}
+
+	// A rotated log file failing to be listed is reported, along with the
+	// current log file.
+	dangling := getLogFileName(fileName, 3, CompressionNone)
+	err = os.Symlink(filepath.Join(tmpDir, "info_missing.log"), dangling)
+	if err != nil {
+		t.Fatalf("TestInfo failed with error %v", err)
+	}
+	defer os.Remove(dangling)
+
+	info = statLogger.Info()
+	if info.ScanErr == nil || info.RotatedFiles != 0 || info.TotalBytes != int64(info.CurrentFileSize) {
+		t.Fatalf("TestInfo failed: unexpected info %+v for a rotated file failing to be listed", info)
+	}
+}
+
+func TestMaxObservedFileSize(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "max_observed_file_size")
+	if err != nil {
+		t.Fatalf("TestMaxObservedFileSize failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "max_observed_file_size.log")
+	statLogger, err := New(fileName, WithSizeLimit(150), WithNumFiles(10),
+		WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatalf("TestMaxObservedFileSize failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	// Log messages of different sizes, overshooting the size limit by
+	// different amounts.
+	for i := 0; i < 10; i++ {
+		stat := getSimpleStat(i)
+		stat["pad"] = strings.Repeat("x", (i*37)%100)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestMaxObservedFileSize failed with error %v", err)
+		}
+	}
+
+	info := statLogger.Info()
+	if info.ScanErr != nil {
+		t.Fatalf("TestMaxObservedFileSize failed with error %v", info.ScanErr)
+	}
+
+	var maxFileSize, maxRecordSize int
+	for _, file := range statLogger.Files() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("TestMaxObservedFileSize failed with error %v", err)
+		}
+
+		if len(data) > maxFileSize {
+			maxFileSize = len(data)
+		}
+
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			if len(line) > maxRecordSize {
+				maxRecordSize = len(line)
+			}
+		}
+	}
+
+	if info.MaxObservedFileSize != maxFileSize || info.MaxObservedFileSize <= 150 {
+		t.Fatalf("TestMaxObservedFileSize failed: exp %v actual %v", maxFileSize, info.MaxObservedFileSize)
+	}
+
+	if info.MaxRecordSize != maxRecordSize {
+		t.Fatalf("TestMaxObservedFileSize failed: exp %v actual %v", maxRecordSize, info.MaxRecordSize)
+	}
+
+	// Not persisted: a new logger starts from the current log file.
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestMaxObservedFileSize failed with error %v", err)
+	}
+
+	statLogger, err = New(fileName, WithSizeLimit(150), WithNumFiles(10),
+		WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatalf("TestMaxObservedFileSize failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	info = statLogger.Info()
+	if info.ScanErr != nil {
+		t.Fatalf("TestMaxObservedFileSize failed with error %v", info.ScanErr)
+	}
+
+	if info.MaxObservedFileSize != info.CurrentFileSize || info.MaxRecordSize != 0 {
+		t.Fatalf("TestMaxObservedFileSize failed: unexpected info %+v", info)
+	}
+}
+
+func TestInjectedClock(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "injected_clock.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestInjectedClock failed with error %v", err)
+	}
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		withClock(clock), WithRotateInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("TestInjectedClock failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Timestamp stats are marshalled relative to the injected clock too.
+	oldTimeNow := timeNow
+	timeNow = clock
+	defer func() {
+		timeNow = oldTimeNow
+	}()
+
+	stat := map[string]interface{}{
+		"k1": int64(10),
+		"k2": NewTimestamp(now.Add(-time.Minute)),
+	}
+
+	for i := 0; i < 2; i++ {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestInjectedClock failed with error %v", err)
+		}
+
+		// Time based rotation follows the injected clock.
+		now = now.Add(time.Hour)
+	}
+
+	exp := []string{
+		`2020-01-02T03:04:05.006+00:00 kStats {"k1":10,"k2":"1m0s"}`,
+		`2020-01-02T04:04:05.006+00:00 kStats {"k1":10,"k2":"1h1m0s"}`,
+	}
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestInjectedClock failed with error %v", err)
+	}
+
+	if !reflect.DeepEqual(exp, lines) {
+		t.Fatalf("TestInjectedClock failed: exp %v actual %v", exp, lines)
+	}
+}
+
+func TestAbsoluteTimestamp(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "absolute_timestamp.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestAbsoluteTimestamp failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestAbsoluteTimestamp failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Absolute timestamps do not depend on the time of the write, and are
+	// deduplicated until they change.
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	stats := []map[string]interface{}{
+		{"k1": NewAbsoluteTimestamp(ts, ""), "k2": NewAbsoluteTimestamp(ts, time.RFC3339)},
+		{"k1": NewAbsoluteTimestamp(ts, ""), "k2": NewAbsoluteTimestamp(ts.Add(time.Hour), time.RFC3339)},
+	}
+
+	for _, stat := range stats {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestAbsoluteTimestamp failed with error %v", err)
+		}
+	}
+
+	exp := []map[string]interface{}{
+		{
+			"type": "kStats",
+			"stat": map[string]interface{}{
+				"k1": "2020-01-02T03:04:05.006Z",
+				"k2": "2020-01-02T03:04:05Z",
+			},
+		},
+		{
+			"type": "kStats",
+			"stat": map[string]interface{}{
+				"k2": "2020-01-02T04:04:05Z",
+			},
+		},
+	}
+
+	err = verifyStats(exp, fileName, CompressionGzip)
+	if err != nil {
+		t.Fatalf("TestAbsoluteTimestamp failed with error %v", err)
+	}
+}
+
+func TestInvalidTSFormat(t *testing.T) {
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "invalid_ts_format.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestInvalidTSFormat failed with error %v", err)
+	}
+
+	for _, tsFormat := range []string{"", "YYYY-MM-DD hh:mm:ss", "2006-13-02 15:04:05"} {
+		_, err = NewLogStats(fileName, 1024, 2, tsFormat)
+		if err == nil {
+			t.Fatalf("TestInvalidTSFormat failed: NewLogStats accepted %q", tsFormat)
+		}
+
+		_, err = NewDedupeLogStats(fileName, 1024, 2, tsFormat)
+		if err == nil {
+			t.Fatalf("TestInvalidTSFormat failed: NewDedupeLogStats accepted %q", tsFormat)
+		}
+	}
+
+	for _, tsFormat := range []string{time.RFC3339, "2006-01-02 15:04:05.000", "Jan _2 15:04:05"} {
+		var statLogger LogStats
+		statLogger, err = NewLogStats(fileName, 1024, 2, tsFormat)
+		if err != nil {
+			t.Fatalf("TestInvalidTSFormat failed for %q with error %v", tsFormat, err)
+		}
+		statLogger.Close()
+	}
+}
+
+func TestTimestampComparisons(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	earlier := NewTimestamp(now.Add(-90 * time.Second))
+	later := NewAbsoluteTimestamp(now, "")
+
+	if d := later.Sub(earlier); d != 90*time.Second {
+		t.Fatalf("TestTimestampComparisons failed: exp %v actual %v", 90*time.Second, d)
+	}
+
+	if d := earlier.Sub(later); d != -90*time.Second {
+		t.Fatalf("TestTimestampComparisons failed: exp %v actual %v", -90*time.Second, d)
+	}
+
+	if !earlier.Before(later) || earlier.After(later) {
+		t.Fatalf("TestTimestampComparisons failed: %v is not before %v", earlier, later)
+	}
+
+	if !later.After(earlier) || later.Before(earlier) {
+		t.Fatalf("TestTimestampComparisons failed: %v is not after %v", later, earlier)
+	}
+
+	if later.Before(later) || later.After(later) {
+		t.Fatalf("TestTimestampComparisons failed: %v is not equal to itself", later)
+	}
+
+	if s := earlier.Since(later); s != "1m30s" {
+		t.Fatalf("TestTimestampComparisons failed: exp 1m30s actual %v", s)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "write_at.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestWriteAt failed with error %v", err)
+	}
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		withClock(clock), WithRotateInterval(time.Hour))
+	if err != nil {
+		t.Fatalf("TestWriteAt failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Collection time far behind the current time must not trigger the
+	// time based rotation.
+	collected := now.Add(-24 * time.Hour)
+	err = statLogger.WriteAt(collected, "kStats", map[string]interface{}{"k1": int64(10)})
+	if err != nil {
+		t.Fatalf("TestWriteAt failed with error %v", err)
+	}
+
+	err = statLogger.Write("kStats", map[string]interface{}{"k1": int64(20)})
+	if err != nil {
+		t.Fatalf("TestWriteAt failed with error %v", err)
+	}
+
+	exp := []string{
+		`2020-01-01T03:04:05.000+00:00 kStats {"k1":10}`,
+		`2020-01-02T03:04:05.000+00:00 kStats {"k1":20}`,
+	}
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestWriteAt failed with error %v", err)
+	}
+
+	if !reflect.DeepEqual(exp, lines) {
+		t.Fatalf("TestWriteAt failed: exp %v actual %v", exp, lines)
+	}
+}
+
+func TestDedupeRemovedKeys(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "dedupe_removed_keys.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestDedupeRemovedKeys failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestDedupeRemovedKeys failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	stat := getSimpleStat(0)
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestDedupeRemovedKeys failed with error %v", err)
+	}
+
+	exp := make([]map[string]interface{}, 0)
+	vstat := make(map[string]interface{})
+	vstat["type"] = "kStats"
+	vstat["stat"] = stat
+	exp = append(exp, vstat)
+
+	// Remove a top level and a nested key.
+	stat = getSimpleStat(0)
+	delete(stat, "k2")
+	delete(stat["k4"].(map[string]interface{}), "k31")
+	err = statLogger.Write("kStats", stat)
+	if err != nil {
+		t.Fatalf("TestDedupeRemovedKeys failed with error %v", err)
+	}
+
+	estat := make(map[string]interface{})
+	estat[REMOVED_KEYS] = []interface{}{"k2"}
+	estat["k4"] = map[string]interface{}{REMOVED_KEYS: []interface{}{"k31"}}
+	vstat = make(map[string]interface{})
+	vstat["type"] = "kStats"
+	vstat["stat"] = estat
+	exp = append(exp, vstat)
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestDedupeRemovedKeys failed with error %v", err)
+	}
+}
+
+func TestDedupeFloat64(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "dedupe_float64.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestDedupeFloat64 failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		WithFloatEpsilon(0.001))
+	if err != nil {
+		t.Fatalf("TestDedupeFloat64 failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	stats := []map[string]interface{}{
+		{"k1": 0.5, "k2": 1.25},
+		// Unchanged
+		{"k1": 0.5, "k2": 1.25},
+		// k2 changes within epsilon
+		{"k1": 0.75, "k2": 1.2505},
+	}
+
+	for _, stat := range stats {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestDedupeFloat64 failed with error %v", err)
+		}
+	}
+
+	exp := []map[string]interface{}{
+		{"type": "kStats", "stat": stats[0]},
+		{"type": "kStats", "stat": map[string]interface{}{}},
+		{"type": "kStats", "stat": map[string]interface{}{"k1": 0.75}},
+	}
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestDedupeFloat64 failed with error %v", err)
+	}
+
+	if len(lines) != len(exp) {
+		t.Fatalf("TestDedupeFloat64 failed: exp %v lines actual %v", len(exp), len(lines))
+	}
+
+	for i, line := range lines {
+		comps := strings.SplitN(line, " ", 3)
+
+		m := make(map[string]interface{})
+		err = json.Unmarshal([]byte(comps[2]), &m)
+		if err != nil {
+			t.Fatalf("TestDedupeFloat64 failed with error %v", err)
+		}
+
+		if !reflect.DeepEqual(exp[i]["stat"], m) {
+			t.Fatalf("TestDedupeFloat64 failed: exp %v actual %v", exp[i]["stat"], m)
+		}
+	}
+}
+
+func TestDedupeFloat64Drift(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dedupe_float64_drift")
+	if err != nil {
+		t.Fatalf("TestDedupeFloat64Drift failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	epsilon := 0.1
+	statLogger, err := NewDedupeLogStats(fileName, 1024*1024, 2, DEFAULT_TS_FORMAT,
+		WithFloatEpsilon(epsilon))
+	if err != nil {
+		t.Fatalf("TestDedupeFloat64Drift failed with error %v", err)
+	}
+
+	// A stat drifting by less than epsilon per write, at the top level
+	// and nested, along with a stat which does not change.
+	values := make([]float64, 0)
+	for i := 0; i < 20; i++ {
+		v := 1.0 + 0.03*float64(i)
+		values = append(values, v)
+
+		stat := map[string]interface{}{"f": v, "n": map[string]interface{}{"f": v}, "k": int64(1)}
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestDedupeFloat64Drift failed with error %v", err)
+		}
+	}
+	statLogger.Close()
+
+	// The value is logged again once it differs from the value logged
+	// last by more than epsilon.
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil || len(lines) != len(values) {
+		t.Fatalf("TestDedupeFloat64Drift failed: %v lines, error %v", len(lines), err)
+	}
+
+	logged := values[0]
+	numLogged := 0
+	for i, line := range lines {
+		_, _, data, err := splitStatLine([]byte(line), 0)
+		if err != nil {
+			t.Fatalf("TestDedupeFloat64Drift failed with error %v", err)
+		}
+
+		m := make(map[string]interface{})
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			t.Fatalf("TestDedupeFloat64Drift failed with error %v", err)
+		}
+
+		f, ok := m["f"]
+		if i == 0 || values[i]-logged > epsilon {
+			if !ok || f != values[i] || !reflect.DeepEqual(m["n"], map[string]interface{}{"f": values[i]}) {
+				t.Fatalf("TestDedupeFloat64Drift failed: value %v not logged, line %q", values[i], line)
+			}
+
+			logged = values[i]
+			numLogged++
+		} else if ok {
+			t.Fatalf("TestDedupeFloat64Drift failed: value %v logged within epsilon, line %q", values[i], line)
+		}
+	}
+
+	if numLogged < 4 {
+		t.Fatalf("TestDedupeFloat64Drift failed: value logged %v times", numLogged)
+	}
+
+	// The reconstructed stats stay within epsilon of the values written.
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestDedupeFloat64Drift failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for i := range values {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestDedupeFloat64Drift failed with error %v", err)
+		}
+
+		f, err := stat["f"].(json.Number).Float64()
+		if err != nil || f < values[i]-epsilon || f > values[i]+epsilon {
+			t.Fatalf("TestDedupeFloat64Drift failed: reconstructed %v, written %v, error %v", f, values[i], err)
+		}
+	}
+}
+
+func TestDedupeSlices(t *testing.T) {
+	prev := []interface{}{int64(1), "two", 3.0, []interface{}{true, uint64(4)}}
+
+	tests := []struct {
+		name  string
+		curr  []interface{}
+		dedup bool
+	}{
+		{"equal", []interface{}{int64(1), "two", 3.0, []interface{}{true, uint64(4)}}, true},
+		{"shorter", []interface{}{int64(1), "two", 3.0}, false},
+		{"longer", []interface{}{int64(1), "two", 3.0, []interface{}{true, uint64(4)}, int64(5)}, false},
+		{"element changed", []interface{}{int64(1), "two", 3.0, []interface{}{false, uint64(4)}}, false},
+		{"element type changed", []interface{}{int64(1), "two", int64(3), []interface{}{true, uint64(4)}}, false},
+	}
+
+	for _, test := range tests {
+		prevMap := map[string]interface{}{"k1": prev}
+		currMap := map[string]interface{}{"k1": test.curr}
+		newMap := make(map[string]interface{})
+		populateFilteredMap(prevMap, currMap, newMap, 0)
+
+		if test.dedup {
+			if len(newMap) != 0 {
+				t.Fatalf("TestDedupeSlices failed for %v: expected dedup, actual %v", test.name, newMap)
+			}
+			continue
+		}
+
+		// Changed arrays are written entirely.
+		if !reflect.DeepEqual(currMap, newMap) {
+			t.Fatalf("TestDedupeSlices failed for %v: exp %v actual %v", test.name, currMap, newMap)
+		}
+	}
+}
+
+func TestDedupeJSONNumbers(t *testing.T) {
+	// Stats read back from a log file carry json.Number values.
+	tests := []struct {
+		name  string
+		prev  interface{}
+		curr  interface{}
+		dedup bool
+	}{
+		{"equal numbers", json.Number("10"), json.Number("10"), true},
+		{"changed numbers", json.Number("10"), json.Number("11"), false},
+		{"large integers", json.Number("9007199254740993"), json.Number("9007199254740992"), false},
+		{"large unsigned integers", json.Number("18446744073709551615"), json.Number("18446744073709551614"), false},
+		{"int64 after number", json.Number("10"), int64(10), true},
+		{"number after int64", int64(10), json.Number("10"), true},
+		{"uint64 after number", json.Number("18446744073709551615"), uint64(18446744073709551615), true},
+		{"float64 after number", json.Number("1.5"), 1.5, true},
+		{"integral float", json.Number("1.0"), json.Number("1"), true},
+		{"changed float64", json.Number("1.5"), 1.25, false},
+		{"number after string", "10", json.Number("10"), false},
+		{"nested numbers", []interface{}{json.Number("1")}, []interface{}{int64(1)}, true},
+	}
+
+	for _, test := range tests {
+		prevMap := map[string]interface{}{"k1": test.prev}
+		currMap := map[string]interface{}{"k1": test.curr}
+		newMap := make(map[string]interface{})
+		populateFilteredMap(prevMap, currMap, newMap, 0)
+
+		if test.dedup != (len(newMap) == 0) {
+			t.Fatalf("TestDedupeJSONNumbers failed for %v: dedup exp %v actual %v", test.name, test.dedup, newMap)
+		}
+	}
+
+	// The tolerance applies to the floats.
+	newMap := make(map[string]interface{})
+	populateFilteredMap(map[string]interface{}{"k1": json.Number("1.5")},
+		map[string]interface{}{"k1": json.Number("1.55")}, newMap, 0.1)
+	if len(newMap) != 0 {
+		t.Fatalf("TestDedupeJSONNumbers failed: number within epsilon not deduplicated")
+	}
+}
+
+func TestDedupeReset(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "dedupe_reset.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestDedupeReset failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestDedupeReset failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 3; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i)
+
+		// The stat after the reset is written in full.
+		if i == 2 {
+			statLogger.DedupeReset()
+		}
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestDedupeReset failed with error %v", err)
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		if i == 1 {
+			vstat["stat"] = map[string]interface{}{"k1": int64(i)}
+		}
+		exp = append(exp, vstat)
+	}
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestDedupeReset failed with error %v", err)
+	}
+}
+
+func TestDedupeResetRemovedKeys(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "dedupe_reset_removed_keys")
+	if err != nil {
+		t.Fatalf("TestDedupeResetRemovedKeys failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	statLogger, err := NewDedupeLogStats(fileName, 1024*1024, 2, DEFAULT_TS_FORMAT)
+	if err != nil {
+		t.Fatalf("TestDedupeResetRemovedKeys failed with error %v", err)
+	}
+
+	// The stats after the reset are written in full, with the key b removed.
+	full := []map[string]interface{}{
+		{"a": int64(1), "b": int64(2)},
+		{"a": int64(1)},
+		{"a": int64(3)},
+	}
+
+	for i, stat := range full {
+		if i == 1 {
+			statLogger.DedupeReset()
+		}
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestDedupeResetRemovedKeys failed with error %v", err)
+		}
+	}
+	statLogger.Close()
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil || len(lines) != len(full) {
+		t.Fatalf("TestDedupeResetRemovedKeys failed: %v lines, error %v", len(lines), err)
+	}
+
+	reset := `{"__removed__":["b"],"a":1}`
+	if !strings.HasSuffix(lines[1], " kStats "+reset) {
+		t.Fatalf("TestDedupeResetRemovedKeys failed: stats %q, expected stats %v", lines[1], reset)
+	}
+
+	// The removed keys stay removed in the reconstruction.
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestDedupeResetRemovedKeys failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for i := range full {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestDedupeResetRemovedKeys failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(stat, full[i]) {
+			t.Fatalf("TestDedupeResetRemovedKeys failed for stat %v: exp %v actual %v", i, full[i], stat)
+		}
+	}
+
+	err = verifyReconstruction(full, fileName, filepath.Join(tmpDir, "out.log"))
+	if err != nil {
+		t.Fatalf("TestDedupeResetRemovedKeys failed with error %v", err)
+	}
+
+	// Reading from the reset onwards, the removed keys are dropped.
+	reconstructor := NewReconstructor(ReconstructOptions{})
+	for i := 1; i < len(lines); i++ {
+		line, err := reconstructor.Write([]byte(lines[i]))
+		if err != nil {
+			t.Fatalf("TestDedupeResetRemovedKeys failed with error %v", err)
+		}
+
+		err = verifyReconstructedLines(full[i:i+1], []string{string(line)})
+		if err != nil {
+			t.Fatalf("TestDedupeResetRemovedKeys failed with error %v", err)
+		}
+	}
+}
+
+func TestSnapshotEvery(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "snapshot_every.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestSnapshotEvery failed with error %v", err)
+	}
+
+	snapshotEvery := 3
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00",
+		WithSnapshotEvery(snapshotEvery))
+	if err != nil {
+		t.Fatalf("TestSnapshotEvery failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 10; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestSnapshotEvery failed with error %v", err)
+		}
+
+		// Another stat type does not affect the snapshots of kStats.
+		err = statLogger.Write("kOtherStats", getSimpleStat(1))
+		if err != nil {
+			t.Fatalf("TestSnapshotEvery failed with error %v", err)
+		}
+
+		vstat := make(map[string]interface{})
+		vstat["type"] = "kStats"
+		vstat["stat"] = stat
+		if i%snapshotEvery != 0 {
+			vstat["stat"] = map[string]interface{}{"k1": int64(i)}
+		}
+		exp = append(exp, vstat)
+
+		vstat = make(map[string]interface{})
+		vstat["type"] = "kOtherStats"
+		vstat["stat"] = getSimpleStat(1)
+		if i%snapshotEvery != 0 {
+			vstat["stat"] = map[string]interface{}{}
+		}
+		exp = append(exp, vstat)
+	}
+
+	// Verify stats
+	err = verifyStats(exp, fileName, CompressionNone)
+	if err != nil {
+		t.Fatalf("TestSnapshotEvery failed with error %v", err)
+	}
+}
+
+func TestSnapshotEveryRemovedKeys(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "snapshot_every_removed_keys")
+	if err != nil {
+		t.Fatalf("TestSnapshotEveryRemovedKeys failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	statLogger, err := NewDedupeLogStats(fileName, 1024*1024, 2, DEFAULT_TS_FORMAT,
+		WithSnapshotEvery(2))
+	if err != nil {
+		t.Fatalf("TestSnapshotEveryRemovedKeys failed with error %v", err)
+	}
+
+	// The third stats are a snapshot, with the keys b and n.y removed.
+	full := []map[string]interface{}{
+		{"a": int64(1), "b": int64(2), "n": map[string]interface{}{"x": int64(1), "y": int64(2)}},
+		{"a": int64(1), "b": int64(2), "n": map[string]interface{}{"x": int64(1), "y": int64(2)}},
+		{"a": int64(1), "n": map[string]interface{}{"x": int64(1)}},
+		{"a": int64(3), "n": map[string]interface{}{"x": int64(1)}},
+	}
+
+	for _, stat := range full {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestSnapshotEveryRemovedKeys failed with error %v", err)
+		}
+	}
+	statLogger.Close()
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil || len(lines) != len(full) {
+		t.Fatalf("TestSnapshotEveryRemovedKeys failed: %v lines, error %v", len(lines), err)
+	}
+
+	snapshot := `{"__removed__":["b"],"a":1,"n":{"__removed__":["y"],"x":1}}`
+	if !strings.HasSuffix(lines[2], " kStats "+snapshot) {
+		t.Fatalf("TestSnapshotEveryRemovedKeys failed: snapshot %q, expected stats %v", lines[2], snapshot)
+	}
+
+	// The removed keys stay removed in the reconstruction.
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestSnapshotEveryRemovedKeys failed with error %v", err)
+	}
+	defer reader.Close()
+
+	for i := range full {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestSnapshotEveryRemovedKeys failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(stat, full[i]) {
+			t.Fatalf("TestSnapshotEveryRemovedKeys failed for stat %v: exp %v actual %v", i, full[i], stat)
+		}
+	}
+
+	err = verifyReconstruction(full, fileName, filepath.Join(tmpDir, "out.log"))
+	if err != nil {
+		t.Fatalf("TestSnapshotEveryRemovedKeys failed with error %v", err)
+	}
+
+	// Reading from the snapshot onwards, the removed keys are dropped.
+	reconstructor := NewReconstructor(ReconstructOptions{})
+	for i := 2; i < len(lines); i++ {
+		line, err := reconstructor.Write([]byte(lines[i]))
+		if err != nil {
+			t.Fatalf("TestSnapshotEveryRemovedKeys failed with error %v", err)
+		}
+
+		err = verifyReconstructedLines(full[i:i+1], []string{string(line)})
+		if err != nil {
+			t.Fatalf("TestSnapshotEveryRemovedKeys failed with error %v", err)
+		}
+	}
+}
+
 func getSimpleStat(seed int) map[string]interface{} {
 	stat := make(map[string]interface{})
 	stat["k1"] = int64(seed + 10)
@@ -434,12 +6003,12 @@ func cleanup(paths []string) error {
 	return nil
 }
 
-func getAllLogsFromFiles(fileName string, compress bool) ([]string, error) {
+func getAllLogsFromFiles(fileName string, compression CompressionType) ([]string, error) {
 
 	name := fileName[:len(fileName)-4]
 	var pattern string
-	if compress {
-		pattern = fmt.Sprintf("%s.log.*.gz", name)
+	if compression != CompressionNone {
+		pattern = fmt.Sprintf("%s.log.*%s", name, compression.Suffix())
 	} else {
 		pattern = fmt.Sprintf("%s.log*", name)
 	}
@@ -448,8 +6017,8 @@ func getAllLogsFromFiles(fileName string, compress bool) ([]string, error) {
 		return nil, err
 	}
 
-	if compress {
-		fname := getLogFileName(fileName, 0, true)
+	if compression != CompressionNone {
+		fname := getLogFileName(fileName, 0, compression)
 		f, err := os.Open(fname)
 		if err != nil {
 			// Expecting at least one file to be present.
@@ -464,54 +6033,25 @@ func getAllLogsFromFiles(fileName string, compress bool) ([]string, error) {
 		files = append(files, fname)
 	}
 
-	sort.Strings(files)
-	all := make([]string, 0)
-	for i := len(files) - 1; i >= 0; i-- {
-		all = append(all, files[i])
+	// Oldest - i.e. highest numbered - file first, and the current log
+	// file last. The files are sorted by their number, as the names sort
+	// "stats.log.10" before "stats.log.2".
+	fileNumber := func(fname string) int {
+		num, _, _ := DefaultFileNamer{}.ParseRotatedFileName(fileName, fname)
+		return num
 	}
+	sort.Slice(files, func(i, j int) bool {
+		return fileNumber(files[i]) > fileNumber(files[j])
+	})
 
 	lines := make([]string, 0)
-	for _, fname := range all {
-		f, err := os.Open(fname)
-		if err != nil {
-			return nil, err
-		}
-
-		var num int
-		num, err = getLogFileNumber(fname)
-		if err != nil {
-			return nil, err
-		}
-
-		var finfo os.FileInfo
-		finfo, err = f.Stat()
+	for _, fname := range files {
+		buf, err := readLogFile(fname)
 		if err != nil {
+			fmt.Println("Error in reading file", fname, ":", err)
 			return nil, err
 		}
 
-		buf := make([]byte, finfo.Size())
-
-		if compress && num != 0 {
-			buf = make([]byte, finfo.Size()*3)
-			reader, err := gzip.NewReader(f)
-			if err != nil {
-				return nil, err
-			}
-
-			var n int
-			n, err = reader.Read(buf)
-			if err != nil && err != io.EOF {
-				fmt.Println("Error in reading file", fname, ":", err, n, finfo.Size())
-				return nil, err
-			}
-			buf = buf[:n]
-		} else {
-			_, err = f.Read(buf)
-			if err != nil {
-				return nil, err
-			}
-		}
-
 		s := string(buf)
 		flines := strings.Split(s, "\n")
 		if len(flines[len(flines)-1]) == 0 {
@@ -523,9 +6063,16 @@ func getAllLogsFromFiles(fileName string, compress bool) ([]string, error) {
 	return lines, nil
 }
 
-func verifyStats(exp []map[string]interface{}, fileName string, compress bool) error {
+func verifyStats(exp []map[string]interface{}, fileName string, compression CompressionType) error {
+	return verifyStatsWithPrefix(exp, fileName, compression, 0)
+}
+
+// verifyStatsWithPrefix is verifyStats for the log messages with
+// prefixFields fields between the timestamp and the stat type.
+func verifyStatsWithPrefix(exp []map[string]interface{}, fileName string, compression CompressionType,
+	prefixFields int) error {
 
-	lines, err := getAllLogsFromFiles(fileName, compress)
+	lines, err := getAllLogsFromFiles(fileName, compression)
 	if err != nil {
 		fmt.Println("Error in getAllLogsFromFiles:", err)
 		return err
@@ -552,23 +6099,24 @@ func verifyStats(exp []map[string]interface{}, fileName string, compress bool) e
 	}
 
 	for i, line := range lines {
-		comps := strings.SplitN(line, " ", 3)
-		if len(comps) != 3 {
+		prefix, data, err := ParseStatLine([]byte(line), prefixFields+2)
+		if err != nil {
 			if DEBUG != 0 {
 				printlines()
 			}
 
-			return fmt.Errorf("Unrecognised stat format for line: %v", line)
+			return err
 		}
 
 		ex := exp[i]
-		if comps[1] != ex["type"] {
+		statType := prefix[prefixFields+1]
+		if statType != ex["type"] {
 			return fmt.Errorf("Log type mismatch on line number %v, exp %v actual %v",
-				i, ex["type"], comps[1])
+				i, ex["type"], statType)
 		}
 
 		m := make(map[string]interface{})
-		err = json.Unmarshal([]byte(comps[2]), &m)
+		err = json.Unmarshal(data, &m)
 		if err != nil {
 			return err
 		}
@@ -586,6 +6134,8 @@ func verifyStats(exp []map[string]interface{}, fileName string, compress bool) e
 	return nil
 }
 
+// convertFloatsToInts converts the numbers unmarshalled as float64 - or,
+// by JSONEncoding, as integral json.Number - to int64.
 func convertFloatsToInts(m map[string]interface{}) {
 	for k, v := range m {
 		vf, ok := v.(float64)
@@ -593,6 +6143,14 @@ func convertFloatsToInts(m map[string]interface{}) {
 			m[k] = int64(vf)
 		}
 
+		vn, ok := v.(json.Number)
+		if ok {
+			vi, err := vn.Int64()
+			if err == nil {
+				m[k] = vi
+			}
+		}
+
 		var vm map[string]interface{}
 
 		vm, ok = v.(map[string]interface{})
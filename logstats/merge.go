@@ -0,0 +1,132 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// MergeStatFiles returns the log lines of the log file baseName - or
+// baseName with the ".log" extension added, if it does not have one - and
+// of its rotated log files as a single stream, in the order of LogStatsReader:
+// the rotated files oldest to newest, followed by the current log file. The
+// compressed files are decompressed, so the stream can be piped into
+// ReconstructStatFile. The files are opened one at a time, as the stream is
+// read, and the numbers missing in the rotated files, or the files rotated
+// out meanwhile, are skipped. A file not terminated by a new line, e.g. cut
+// short by a crash, is terminated by one, so that its last line does not
+// run into the first line of the next file.
+func MergeStatFiles(baseName string) (io.ReadCloser, error) {
+	if !strings.HasSuffix(baseName, ".log") {
+		baseName = baseName + ".log"
+	}
+
+	files, err := listLogFiles(baseName, DefaultFileNamer{})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, &os.PathError{Op: "open", Path: baseName, Err: os.ErrNotExist}
+	}
+
+	open := func(fname string) (io.ReadCloser, error) {
+		return openStatFile(baseName, fname, nil)
+	}
+
+	return &mergedReader{files: files, open: open}, nil
+}
+
+// mergedReader reads the log files in order, refer MergeStatFiles.
+type mergedReader struct {
+	files []string
+	open  func(fname string) (io.ReadCloser, error)
+
+	rc          io.ReadCloser
+	last        byte // the last byte read from the current file
+	pendingLine bool // the previous file lacks its trailing new line
+}
+
+func (m *mergedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if m.pendingLine {
+			m.pendingLine = false
+			p[0] = '\n'
+			return 1, nil
+		}
+
+		if m.rc == nil {
+			if len(m.files) == 0 {
+				return 0, io.EOF
+			}
+
+			err := m.openNextFile()
+			if os.IsNotExist(err) {
+				// Rotated out since the files were listed.
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := m.rc.Read(p)
+		if n > 0 {
+			m.last = p[n-1]
+		}
+
+		if err == io.EOF {
+			err = m.closeFile()
+			m.pendingLine = m.last != '\n'
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (m *mergedReader) openNextFile() error {
+	fname := m.files[0]
+	m.files = m.files[1:]
+
+	rc, err := m.open(fname)
+	if err != nil {
+		return err
+	}
+
+	m.rc = rc
+	m.last = '\n'
+	return nil
+}
+
+func (m *mergedReader) closeFile() error {
+	if m.rc == nil {
+		return nil
+	}
+
+	err := m.rc.Close()
+	m.rc = nil
+	return err
+}
+
+// Closes the log file being read, if any.
+func (m *mergedReader) Close() error {
+	m.files = nil
+	m.pendingLine = false
+	return m.closeFile()
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// multiLogStats writes the stats to multiple LogStats objects - each with
+// its own log files, lock and deduplication - routing each stat by its
+// type. Refer WithPerTypeFiles and NewShardedLogStats.
+type multiLogStats struct {
+	name     string   // for the error messages
+	lockFile *os.File // held until Close, if any
+
+	// route returns the key of the LogStats object of statType, and
+	// create creates the LogStats object of a key.
+	route  func(statType string) (string, error)
+	create func(key string) (LogStats, error)
+
+	lock     sync.Mutex
+	loggers  map[string]LogStats
+	durable  bool
+	compress bool
+	closed   bool
+}
+
+// logger returns the logger of statType, creating it if needed.
+func (m *multiLogStats) logger(statType string) (LogStats, error) {
+	key, err := m.route(statType)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil, closedError(m.name)
+	}
+
+	return m.loggerLocked(key)
+}
+
+// loggerLocked returns the logger of key, creating it if needed. Called
+// with the lock held.
+func (m *multiLogStats) loggerLocked(key string) (LogStats, error) {
+	lst, ok := m.loggers[key]
+	if ok {
+		return lst, nil
+	}
+
+	lst, err := m.create(key)
+	if err != nil {
+		return nil, err
+	}
+
+	lst.SetDurable(m.durable)
+	lst.SetCompression(m.compress)
+
+	m.loggers[key] = lst
+	return lst, nil
+}
+
+// forEach calls fn for each logger, returning the first error.
+func (m *multiLogStats) forEach(fn func(LogStats) error) error {
+	var err error
+	for _, lst := range m.loggers {
+		lstErr := fn(lst)
+		if err == nil {
+			err = lstErr
+		}
+	}
+
+	return err
+}
+
+func (m *multiLogStats) Write(statType string, statMap map[string]interface{}) error {
+	return m.WriteContext(context.Background(), statType, statMap)
+}
+
+func (m *multiLogStats) WritePath(statType string, statMap map[string]interface{}) (string, error) {
+	lst, err := m.logger(statType)
+	if err != nil {
+		return "", err
+	}
+
+	return lst.WritePath(statType, statMap)
+}
+
+func (m *multiLogStats) WriteContext(ctx context.Context, statType string, statMap map[string]interface{}) error {
+	lst, err := m.logger(statType)
+	if err != nil {
+		return err
+	}
+
+	return lst.WriteContext(ctx, statType, statMap)
+}
+
+func (m *multiLogStats) WriteAt(ts time.Time, statType string, statMap map[string]interface{}) error {
+	lst, err := m.logger(statType)
+	if err != nil {
+		return err
+	}
+
+	return lst.WriteAt(ts, statType, statMap)
+}
+
+// WriteBatch writes the stats routed to each logger as a batch. As the
+// loggers are written one after the other, the batch is not atomic across
+// them - on failure, the stats of the loggers before the failed one remain
+// written.
+func (m *multiLogStats) WriteBatch(stats []StatEntry) error {
+	loggers := make([]LogStats, 0)
+	batches := make(map[LogStats][]StatEntry)
+	for _, entry := range stats {
+		lst, err := m.logger(entry.Type)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := batches[lst]; !ok {
+			loggers = append(loggers, lst)
+		}
+		batches[lst] = append(batches[lst], entry)
+	}
+
+	for _, lst := range loggers {
+		err := lst.WriteBatch(batches[lst])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *multiLogStats) WriteValue(statType string, v interface{}) error {
+	lst, err := m.logger(statType)
+	if err != nil {
+		return err
+	}
+
+	return lst.WriteValue(statType, v)
+}
+
+func (m *multiLogStats) WriteStruct(statType string, v interface{}) error {
+	lst, err := m.logger(statType)
+	if err != nil {
+		return err
+	}
+
+	return lst.WriteStruct(statType, v)
+}
+
+func (m *multiLogStats) WriteRaw(statType string, jsonBytes []byte) error {
+	lst, err := m.logger(statType)
+	if err != nil {
+		return err
+	}
+
+	return lst.WriteRaw(statType, jsonBytes)
+}
+
+func (m *multiLogStats) SetDurable(durable bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.durable = durable
+	m.forEach(func(lst LogStats) error {
+		lst.SetDurable(durable)
+		return nil
+	})
+}
+
+func (m *multiLogStats) SetCompression(enable bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.compress = enable
+	m.forEach(func(lst LogStats) error {
+		lst.SetCompression(enable)
+		return nil
+	})
+}
+
+func (m *multiLogStats) Flush() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return closedError(m.name)
+	}
+
+	return m.forEach(func(lst LogStats) error {
+		return lst.Flush()
+	})
+}
+
+func (m *multiLogStats) AsWriter(statType string) io.Writer {
+	return &statWriter{ls: m, statType: statType}
+}
+
+func (m *multiLogStats) DedupeReset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.forEach(func(lst LogStats) error {
+		lst.DedupeReset()
+		return nil
+	})
+}
+
+// Rotate rotates the log files of all the loggers.
+func (m *multiLogStats) Rotate() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return closedError(m.name)
+	}
+
+	return m.forEach(func(lst LogStats) error {
+		return lst.Rotate()
+	})
+}
+
+// Info returns the state of the log files of all the loggers, summed up.
+// CurrentFileSize is the total size of their current log files, and
+// ScanErr the first failure to list the rotated log files of a logger.
+func (m *multiLogStats) Info() LogStatsInfo {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	info := LogStatsInfo{TypeRecords: make(map[string]int64)}
+	m.forEach(func(lst LogStats) error {
+		lstInfo := lst.Info()
+		info.Records += lstInfo.Records
+		for statType, n := range lstInfo.TypeRecords {
+			info.TypeRecords[statType] += n
+		}
+		info.CurrentFileSize += lstInfo.CurrentFileSize
+		info.RotatedFiles += lstInfo.RotatedFiles
+		info.TotalBytes += lstInfo.TotalBytes
+		info.Rotations += lstInfo.Rotations
+		if lstInfo.MaxObservedFileSize > info.MaxObservedFileSize {
+			info.MaxObservedFileSize = lstInfo.MaxObservedFileSize
+		}
+		if lstInfo.MaxRecordSize > info.MaxRecordSize {
+			info.MaxRecordSize = lstInfo.MaxRecordSize
+		}
+		if info.ScanErr == nil {
+			info.ScanErr = lstInfo.ScanErr
+		}
+		return nil
+	})
+
+	return info
+}
+
+// LastWrite returns the time of the last write of statType by its logger.
+func (m *multiLogStats) LastWrite(statType string) (time.Time, bool) {
+	key, err := m.route(statType)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	lst, ok := m.loggers[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return lst.LastWrite(statType)
+}
+
+// StaleTypes returns the stale types of all the loggers, in sorted order.
+func (m *multiLogStats) StaleTypes(threshold time.Duration) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stale := make([]string, 0)
+	m.forEach(func(lst LogStats) error {
+		stale = append(stale, lst.StaleTypes(threshold)...)
+		return nil
+	})
+	sort.Strings(stale)
+
+	return stale
+}
+
+// Files returns the log files of all the loggers, one logger after the
+// other, in the order of their log file names.
+func (m *multiLogStats) Files() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := make([]string, 0, len(m.loggers))
+	for key := range m.loggers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	files := make([]string, 0)
+	for _, key := range keys {
+		files = append(files, m.loggers[key].Files()...)
+	}
+
+	return files
+}
+
+// Snapshot takes the snapshots of the loggers one after the other, so the
+// combined snapshot is consistent per logger only. The log files are
+// listed as by Files.
+func (m *multiLogStats) Snapshot() (*FileSnapshot, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil, closedError(m.name)
+	}
+
+	keys := make([]string, 0, len(m.loggers))
+	for key := range m.loggers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	snap := &FileSnapshot{}
+	for _, key := range keys {
+		lstSnap, err := m.loggers[key].Snapshot()
+		if err != nil {
+			snap.Close()
+			return nil, err
+		}
+
+		snap.Files = append(snap.Files, lstSnap.Files...)
+	}
+
+	return snap, nil
+}
+
+func (m *multiLogStats) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	err := m.forEach(func(lst LogStats) error {
+		return lst.Close()
+	})
+
+	if m.lockFile != nil {
+		m.lockFile.Close()
+	}
+
+	m.loggers = nil
+	m.closed = true
+	return err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileNamer names the rotated log files. fileName is always the name of
+// the current log file, with the ".log" extension.
+type FileNamer interface {
+	// RotatedFileName returns the name of a rotated log file. index is the
+	// position of the file among the rotated files, 1 being the newest, and
+	// ts is the time of its rotation. The name must end with the suffix of
+	// the compression, refer CompressionType.Suffix. On rotation, the files
+	// are renamed if their index changes the name.
+	RotatedFileName(fileName string, index int, ts time.Time, compression CompressionType) string
+
+	// ParseRotatedFileName is the inverse of RotatedFileName. It returns
+	// the index and the rotation time of the rotated log file name, as
+	// known from the name. ok is false if name is not a rotated log file of
+	// fileName. The rotated files are ordered by their index, and the files
+	// with the same index by their rotation time, newest first.
+	ParseRotatedFileName(fileName string, name string) (index int, ts time.Time, ok bool)
+
+	// RotatedFilePattern returns a filepath.Match pattern matching the
+	// names of all the rotated log files of fileName. It can match other
+	// files as well, which are then rejected by ParseRotatedFileName.
+	RotatedFilePattern(fileName string) string
+}
+
+// DefaultFileNamer names the rotated log files by their index, as
+// fileName.N, followed by the compression suffix, e.g. "stats.log.1.gz".
+// The files are renamed on each rotation.
+type DefaultFileNamer struct{}
+
+func (DefaultFileNamer) RotatedFileName(fileName string, index int, ts time.Time, compression CompressionType) string {
+	return getLogFileName(fileName, index, compression)
+}
+
+func (DefaultFileNamer) ParseRotatedFileName(fileName string, name string) (int, time.Time, bool) {
+	name = strings.TrimSuffix(name, getLogFileCompression(name).Suffix())
+	if !strings.HasPrefix(name, fileName+".") {
+		return 0, time.Time{}, false
+	}
+
+	index, err := strconv.Atoi(name[len(fileName)+1:])
+	if err != nil || index <= 0 {
+		return 0, time.Time{}, false
+	}
+
+	return index, time.Time{}, true
+}
+
+func (DefaultFileNamer) RotatedFilePattern(fileName string) string {
+	return fileName + ".*"
+}
+
+// TIMESTAMP_FILE_NAME_FORMAT is the time layout of the rotation times in
+// the names given by TimestampFileNamer.
+const TIMESTAMP_FILE_NAME_FORMAT = "20060102-150405"
+
+// TimestampFileNamer names the rotated log files by their rotation time,
+// in UTC, e.g. "stats-20240131-235959.log.gz" for the log file
+// "stats.log". The files are never renamed. If a name is already taken,
+// e.g. by a rotation earlier in the same second, the rotation time in the
+// name is advanced by a second until the name is free.
+type TimestampFileNamer struct{}
+
+func (TimestampFileNamer) RotatedFileName(fileName string, index int, ts time.Time, compression CompressionType) string {
+	name := strings.TrimSuffix(fileName, ".log")
+	return name + "-" + ts.UTC().Format(TIMESTAMP_FILE_NAME_FORMAT) + ".log" + compression.Suffix()
+}
+
+func (TimestampFileNamer) ParseRotatedFileName(fileName string, name string) (int, time.Time, bool) {
+	prefix := strings.TrimSuffix(fileName, ".log") + "-"
+	name = strings.TrimSuffix(name, getLogFileCompression(name).Suffix())
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".log") {
+		return 0, time.Time{}, false
+	}
+
+	tsText := strings.TrimSuffix(name[len(prefix):], ".log")
+	ts, err := time.Parse(TIMESTAMP_FILE_NAME_FORMAT, tsText)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+
+	return 1, ts, true
+}
+
+func (TimestampFileNamer) RotatedFilePattern(fileName string) string {
+	return strings.TrimSuffix(fileName, ".log") + "-*.log*"
+}
@@ -0,0 +1,862 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"compress/gzip"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Option configures optional behaviour of a LogStats object. Options are
+// applied in the given order at construction time, and an invalid option
+// fails the construction.
+type Option func(*config) error
+
+// config holds the optional settings of a LogStats object.
+type config struct {
+	sizeLimit        int
+	numFiles         int
+	maxNumFiles      int
+	tsFormat         string
+	dedupe           bool
+	durable          bool
+	rotateInterval   time.Duration
+	compression      CompressionType
+	compressionLevel int
+	bufferSize       int
+	maxAge           time.Duration
+	maxTotalBytes    int64
+	floatEpsilon     float64
+	snapshotEvery    int
+	encoder          Encoder
+	fileMode         os.FileMode
+	dirMode          os.FileMode
+	observer         Observer
+	repairOnOpen     bool
+	fileNamer        FileNamer
+	perTypeFiles     bool
+	rawDedupe        bool
+	maxLines         int
+	compressActive   bool
+	jsonLines        bool
+	linePrefix       []string
+	syncInterval     time.Duration
+	rotationSnapshot bool
+	numbersAsStrings bool
+	writeAttempts    int
+	retryBackoff     time.Duration
+	typeTSFormats    map[string]string
+	closeSnapshot    bool
+	maxRecordBytes   int
+	truncateRecords  bool
+	utc              bool
+	rotatePredicate  func(info RotationInfo) bool
+	sequence         bool
+	compressExisting bool
+	framed           bool
+	singleWriter     bool
+	compressionDict  []byte
+	noRotation       bool
+	syncEveryBytes   int
+
+	// All the time reads go through now, so that the tests can
+	// control the clock.
+	now func() time.Time
+}
+
+func defaultConfig() config {
+	return config{
+		sizeLimit:        DEFAULT_SIZE_LIMIT,
+		numFiles:         DEFAULT_NUM_FILES,
+		maxNumFiles:      MAX_NUM_FILES,
+		tsFormat:         DEFAULT_TS_FORMAT,
+		compression:      CompressionGzip,
+		compressionLevel: gzip.DefaultCompression,
+		encoder:          JSONEncoding{},
+		fileMode:         0o644,
+		dirMode:          0o755,
+		fileNamer:        DefaultFileNamer{},
+		now:              time.Now,
+	}
+}
+
+// tracksLines reports whether the stat lines of the current log file are
+// counted, for the line count based rotation or the rotation predicate.
+func (cfg config) tracksLines() bool {
+	return cfg.maxLines > 0 || cfg.rotatePredicate != nil
+}
+
+func applyOptions(opts []Option) (config, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		err := opt(&cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	// Validated once all the options are applied, as the max may follow
+	// the number of files.
+	if cfg.numFiles > cfg.maxNumFiles {
+		return cfg, fmt.Errorf("WithNumFiles: More than %v files not supported.", cfg.maxNumFiles)
+	}
+
+	if cfg.jsonLines {
+		switch cfg.encoder.(type) {
+		case JSONEncoding, JSONMarshalEncoding:
+		default:
+			return cfg, fmt.Errorf("WithJSONLines: Unsupported encoder %T", cfg.encoder)
+		}
+
+		if len(cfg.linePrefix) != 0 {
+			return cfg, fmt.Errorf("WithJSONLines: Unsupported with WithLinePrefix")
+		}
+	}
+
+	if cfg.truncateRecords {
+		switch cfg.encoder.(type) {
+		case JSONEncoding, JSONMarshalEncoding:
+		default:
+			return cfg, fmt.Errorf("WithMaxRecordBytes: Unsupported truncation with encoder %T", cfg.encoder)
+		}
+	}
+
+	if cfg.framed {
+		if cfg.repairOnOpen {
+			return cfg, fmt.Errorf("WithoutTrailingNewline: Unsupported with WithRepairOnOpen")
+		}
+
+		if cfg.tracksLines() {
+			return cfg, fmt.Errorf("WithoutTrailingNewline: Unsupported with WithMaxLines or WithRotationPredicate")
+		}
+	}
+
+	if cfg.compressionDict != nil {
+		if cfg.compression == CompressionZstd {
+			return cfg, fmt.Errorf("WithCompressionDict: Unsupported with CompressionZstd")
+		}
+
+		if cfg.compressActive {
+			return cfg, fmt.Errorf("WithCompressionDict: Unsupported with WithActiveCompression")
+		}
+	}
+
+	if cfg.noRotation && (cfg.rotateInterval > 0 || cfg.tracksLines()) {
+		return cfg, fmt.Errorf("WithoutRotation: Unsupported with WithRotateInterval, WithMaxLines or WithRotationPredicate")
+	}
+
+	if cfg.singleWriter && cfg.syncInterval > 0 {
+		return cfg, fmt.Errorf("WithSingleWriter: Unsupported with WithSyncInterval")
+	}
+
+	if cfg.writeAttempts > 1 {
+		if cfg.bufferSize > 0 {
+			return cfg, fmt.Errorf("WithWriteRetry: Unsupported with WithBufferSize")
+		}
+
+		if cfg.compressActive {
+			return cfg, fmt.Errorf("WithWriteRetry: Unsupported with WithActiveCompression")
+		}
+	}
+
+	return cfg, nil
+}
+
+// WithSizeLimit sets the size limit of a log file, in bytes. It is not a
+// hard limit. A single log message cannot cross the log file boundary. So,
+// as long as the current file has not reached its size limit, the incoming
+// log message will be written to the current file. This can lead to log
+// files larger than sizeLimit. The effective minimum is a single log
+// message per file: a size limit smaller than a log message - including
+// zero - gets each log message its own file, as an empty log file is
+// never rotated. The default is DEFAULT_SIZE_LIMIT.
+func WithSizeLimit(sizeLimit int) Option {
+	return func(cfg *config) error {
+		if sizeLimit < 0 {
+			return fmt.Errorf("WithSizeLimit: Unsupported size limit %v", sizeLimit)
+		}
+
+		cfg.sizeLimit = sizeLimit
+		return nil
+	}
+}
+
+// WithNumFiles sets the number of log files to be maintained, including
+// the current one, at most the max number of files - refer
+// WithMaxNumFiles. The default is DEFAULT_NUM_FILES.
+func WithNumFiles(numFiles int) Option {
+	return func(cfg *config) error {
+		if numFiles < 1 {
+			return fmt.Errorf("WithNumFiles: Unsupported file count %v", numFiles)
+		}
+
+		cfg.numFiles = numFiles
+		return nil
+	}
+}
+
+// WithMaxNumFiles sets the max number of log files to be maintained, i.e.
+// the limit of WithNumFiles, e.g. for the long retention audit logs. The
+// rotated log files are sorted by their index numerically, so there is no
+// limit beyond the one of the file system. The default is MAX_NUM_FILES.
+func WithMaxNumFiles(maxNumFiles int) Option {
+	return func(cfg *config) error {
+		if maxNumFiles < 1 {
+			return fmt.Errorf("WithMaxNumFiles: Unsupported max file count %v", maxNumFiles)
+		}
+
+		cfg.maxNumFiles = maxNumFiles
+		return nil
+	}
+}
+
+// WithTSFormat sets the format in which the timestamps in the log messages
+// are to be logged. It must be a valid time layout, e.g. time.RFC3339. The
+// default is DEFAULT_TS_FORMAT.
+func WithTSFormat(tsFormat string) Option {
+	return func(cfg *config) error {
+		err := validateTSFormat(tsFormat)
+		if err != nil {
+			return fmt.Errorf("WithTSFormat: %v", err)
+		}
+
+		cfg.tsFormat = tsFormat
+		return nil
+	}
+}
+
+// WithSequence writes an increasing sequence number with each log message,
+// for a total order of the stats independent of the timestamp resolution,
+// e.g. for the stats written within the same millisecond. It follows the
+// timestamp - "<timestamp> <seq> <type> <stats>", ahead of the WithLinePrefix
+// fields - or is the "seq" of the JSON Lines. The numbers start from 1 with
+// each LogStats object, and follow each other - the log messages rejected,
+// e.g. by WithMaxRecordBytes, and the failed writes take none.
+// LogStatsReader returns them once told with SetSequence; the
+// reconstruction of the stats written with a custom Encoder counts the
+// sequence number as a ReconstructOptions.PrefixFields field. Disabled by
+// default.
+func WithSequence(enable bool) Option {
+	return func(cfg *config) error {
+		cfg.sequence = enable
+		return nil
+	}
+}
+
+// WithUTC writes the timestamps in UTC rather than in the local time, so
+// that the log files of the nodes in different time zones can be merged
+// and sorted. Applies to the timestamps passed to WriteAt as well.
+// Disabled by default.
+func WithUTC(enable bool) Option {
+	return func(cfg *config) error {
+		cfg.utc = enable
+		return nil
+	}
+}
+
+// WithTypeTSFormat sets the format of the timestamps per stat type, e.g.
+// the second precision for the high frequency stats, to shrink their log
+// messages. The types missing in formats follow WithTSFormat. Each format
+// must be a valid time layout. As the readers parse all the timestamps with
+// a single layout, the formats should vary in the precision only, e.g.
+// time.RFC3339 and DEFAULT_TS_FORMAT, both read by LogStatsReader.
+func WithTypeTSFormat(formats map[string]string) Option {
+	return func(cfg *config) error {
+		typeTSFormats := make(map[string]string, len(formats))
+		for statType, tsFormat := range formats {
+			err := validateTSFormat(tsFormat)
+			if err != nil {
+				return fmt.Errorf("WithTypeTSFormat: %v for stat type %v", err, statType)
+			}
+
+			typeTSFormats[statType] = tsFormat
+		}
+
+		cfg.typeTSFormats = typeTSFormats
+		return nil
+	}
+}
+
+// WithDedupe makes New create a deduplicating logger, which writes only the
+// stats changed since the previous stats of the same type. Refer
+// NewDedupeLogStats. Disabled by default.
+func WithDedupe(dedupe bool) Option {
+	return func(cfg *config) error {
+		cfg.dedupe = dedupe
+		return nil
+	}
+}
+
+// WithDurable makes each write sync the log file to the disk. Refer
+// SetDurable. Disabled by default.
+func WithDurable(durable bool) Option {
+	return func(cfg *config) error {
+		cfg.durable = durable
+		return nil
+	}
+}
+
+// WithRotateInterval enables time based log rotation. The log file gets
+// rotated on the first Write after rotateInterval has elapsed since the
+// last rotation (or since the creation of the LogStats object), even if
+// the file has not reached its size limit. Zero disables time based
+// rotation, which is the default.
+func WithRotateInterval(rotateInterval time.Duration) Option {
+	return func(cfg *config) error {
+		if rotateInterval < 0 {
+			return fmt.Errorf("WithRotateInterval: Unsupported rotate interval %v", rotateInterval)
+		}
+
+		cfg.rotateInterval = rotateInterval
+		return nil
+	}
+}
+
+// WithMaxLines enables line count based log rotation. The log file gets
+// rotated on the first Write after it holds maxLines stat lines, or its
+// size limit is reached, whichever comes first. As with the size limit,
+// it is not a hard limit, as a WriteBatch is written to a single log file.
+// Zero disables line count based rotation, which is the default.
+func WithMaxLines(maxLines int) Option {
+	return func(cfg *config) error {
+		if maxLines < 0 {
+			return fmt.Errorf("WithMaxLines: Unsupported max lines %v", maxLines)
+		}
+
+		cfg.maxLines = maxLines
+		return nil
+	}
+}
+
+// WithRotationPredicate rotates the log file on the first Write after
+// predicate returns true, e.g. on an external signal such as the start of
+// a new benchmark iteration, in addition to the size, time and line count
+// based rotations. It is consulted before each Write with the state of the
+// current log file, unless the log file is empty - as an empty log file
+// is never rotated. It is invoked with the LogStats object locked, so it
+// must be cheap and must not call the LogStats object. Nil, the default,
+// disables it.
+func WithRotationPredicate(predicate func(info RotationInfo) bool) Option {
+	return func(cfg *config) error {
+		cfg.rotatePredicate = predicate
+		return nil
+	}
+}
+
+// WithoutRotation disables the automatic log rotation, for the log file to
+// grow unbounded, e.g. when an external system rotates or ships it. The
+// size limit and the number of files do not apply then, and the caller
+// owns the retention of the log file. An explicit Rotate still rotates it.
+// Not supported with WithRotateInterval, WithMaxLines or
+// WithRotationPredicate.
+func WithoutRotation() Option {
+	return func(cfg *config) error {
+		cfg.noRotation = true
+		return nil
+	}
+}
+
+// WithCompression sets the compression used for the rotated log files.
+// The default is CompressionGzip.
+func WithCompression(compression CompressionType) Option {
+	return func(cfg *config) error {
+		switch compression {
+		case CompressionNone, CompressionGzip, CompressionZstd:
+		default:
+			return fmt.Errorf("WithCompression: Unsupported compression type %v", compression)
+		}
+
+		cfg.compression = compression
+		return nil
+	}
+}
+
+// WithCompressExisting compresses the uncompressed rotated log files on
+// open - e.g. the ones rotated before the compression got enabled - with
+// the compression set by WithCompression, keeping their numbers, so that
+// the log files do not stay in mixed formats. Costs a pass over each of
+// those files. No-op with CompressionNone. Disabled by default.
+func WithCompressExisting(enable bool) Option {
+	return func(cfg *config) error {
+		cfg.compressExisting = enable
+		return nil
+	}
+}
+
+// WithActiveCompression makes the current log file gzip compressed too,
+// named as the log file with the ".gz" suffix, e.g. "stats.log.gz". This
+// trades the CPU spent compressing each write for the disk space. The
+// compressor buffers the stats, in place of the bufferSize, so they become
+// visible in the log file as with WithBufferSize - the durable loggers
+// flush the compressor on every Write, at the cost of the compression.
+// The size limit applies to the compressed size written so far. Once
+// rotated, the log files stay gzip compressed, irrespective of the
+// compression, without being compressed again. On open, the existing
+// current log file - compressed or not - gets recompressed, as a gzip
+// stream cut short by a crash cannot be appended to. Likewise, a logger
+// without active compression decompresses the compressed current log file.
+// Disabled by default.
+func WithActiveCompression(enable bool) Option {
+	return func(cfg *config) error {
+		cfg.compressActive = enable
+		return nil
+	}
+}
+
+// WithCompressionLevel sets the gzip compression level used for the rotated
+// log files, e.g. gzip.BestSpeed or gzip.BestCompression. The level must be
+// in the range accepted by gzip.NewWriterLevel. The default is
+// gzip.DefaultCompression. The level is not used by the other compression
+// types.
+func WithCompressionLevel(level int) Option {
+	return func(cfg *config) error {
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return fmt.Errorf("WithCompressionLevel: Unsupported gzip compression level %v", level)
+		}
+
+		cfg.compressionLevel = level
+		return nil
+	}
+}
+
+// WithCompressionDict sets a preset dictionary for the gzip compression of
+// the rotated log files, e.g. the key names shared by the stats of a
+// stable schema, improving the compression of the small log files, the
+// deduplicated ones in particular. Only the last 32KB of dict are used,
+// and the content most likely to match should come last. As the gzip
+// format has no notion of dictionaries, the deflate stream is flagged in
+// the extra field of the gzip header, along with the Adler-32 checksum of
+// the dictionary, and can only be read back with the same dictionary -
+// refer LogStatsReader.SetCompressionDict - not by gunzip or zcat. Not
+// supported with CompressionZstd or WithActiveCompression. The dictionary
+// must not be modified afterwards. None by default.
+func WithCompressionDict(dict []byte) Option {
+	return func(cfg *config) error {
+		if len(dict) == 0 {
+			dict = nil
+		}
+
+		cfg.compressionDict = dict
+		return nil
+	}
+}
+
+// WithBufferSize buffers the writes to the log file in a buffer of
+// bufferSize bytes, reducing the number of write system calls. The buffer
+// gets flushed when it is full, before rotation, on Flush, on Close and -
+// for durable loggers - on each Write. Until then, the buffered stats are
+// not visible in the log file. Zero disables buffering, which is the
+// default.
+func WithBufferSize(bufferSize int) Option {
+	return func(cfg *config) error {
+		if bufferSize < 0 {
+			return fmt.Errorf("WithBufferSize: Unsupported buffer size %v", bufferSize)
+		}
+
+		cfg.bufferSize = bufferSize
+		return nil
+	}
+}
+
+// WithRotationSnapshot carries the deduplication across the rotations:
+// rather than resetting it, the last stats of each type are written in full
+// at the top of the new log file, with their original timestamps, and the
+// next stats are deduplicated against them. So each log file holds the
+// full stats of every type written so far, for it to be reconstructed on
+// its own, even for the types not written since the rotation. As the
+// readers of multiple log files read the repeated stats again, they can
+// be told apart by their type and timestamp. Disabled by default, i.e. the
+// deduplication resets on rotation.
+func WithRotationSnapshot(enable bool) Option {
+	return func(cfg *config) error {
+		cfg.rotationSnapshot = enable
+		return nil
+	}
+}
+
+// WithMaxRecordBytes limits the size of a log message to n bytes, e.g. to
+// guard the line based readers against a stat map gone wrong. A write
+// exceeding it fails with ErrRecordTooLarge - or, if truncate is set,
+// writes the marker ["__truncated__",<size>] in place of the stats, the
+// size being the one of the log message dropped. Following the marker,
+// the deduplicating loggers write the next stats of the type in full. The
+// marker is only supported with the JSON encoders. Zero means no limit, which is the
+// default.
+func WithMaxRecordBytes(n int, truncate bool) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return fmt.Errorf("WithMaxRecordBytes: Unsupported size %v", n)
+		}
+
+		cfg.maxRecordBytes = n
+		cfg.truncateRecords = truncate
+		return nil
+	}
+}
+
+// WithCloseSnapshot makes Close write the full stats of each type whose
+// last stats were deduplicated, with their original timestamps, so that
+// the final state of each type is at the end of the log file, for the
+// consumers of the closed log file to read without reconstructing it.
+// Applies to the deduplicating loggers only. Disabled by default.
+func WithCloseSnapshot(enable bool) Option {
+	return func(cfg *config) error {
+		cfg.closeSnapshot = enable
+		return nil
+	}
+}
+
+// WithNumbersAsStrings writes the integers beyond 2^53 in magnitude - e.g.
+// the nanosecond counters - as JSON strings, e.g. "9007199254740993", as
+// the consumers decoding the JSON numbers as float64, e.g. in JavaScript,
+// would round them. The integers up to 2^53, and the floats, are written
+// as numbers. The deduplication compares the values as written by the
+// caller, and the reconstruction compares the strings as strings, so the
+// counters survive the round trip exactly; the readers return them as
+// strings. Applies to the stat maps, including the nested maps and arrays,
+// but not to the values written by WriteValue or WriteRaw. Disabled by
+// default.
+func WithNumbersAsStrings(enable bool) Option {
+	return func(cfg *config) error {
+		cfg.numbersAsStrings = enable
+		return nil
+	}
+}
+
+// WithSingleWriter skips the locking of the LogStats object, for a single
+// goroutine - e.g. the one of a stat collector - to write without the cost
+// of the lock. It is unsafe for concurrent use: all the methods, not only
+// the writes, must be called from the one goroutine, or otherwise be
+// synchronized by the caller. The overlapping calls are detected on a best
+// effort basis, by a panic, and reported as data races by the race
+// detector. With WithPerTypeFiles, only the loggers of the stat types skip
+// the locking. Not supported with WithSyncInterval, which syncs from a
+// goroutine of its own.
+func WithSingleWriter() Option {
+	return func(cfg *config) error {
+		cfg.singleWriter = true
+		return nil
+	}
+}
+
+// WithSyncInterval flushes the buffered stats and syncs the log file to
+// the disk every d, from a background goroutine, bounding the stats lost
+// on a crash to the last d without the cost of syncing on every Write as
+// the durable loggers do. The goroutine stops on Close, which syncs the
+// log file one last time. Zero disables the periodic sync, which is the
+// default.
+func WithSyncInterval(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return fmt.Errorf("WithSyncInterval: Unsupported interval %v", d)
+		}
+
+		cfg.syncInterval = d
+		return nil
+	}
+}
+
+// WithSyncEveryBytes flushes the buffered stats and syncs the log file to
+// the disk once k bytes of log messages are written since the last sync,
+// bounding the stats lost on a crash by their volume rather than by time,
+// as WithSyncInterval does. The sync is done by the Write crossing k, so
+// the log messages larger than k sync on every Write. The durable loggers
+// sync on every Write regardless. Close syncs the log file one last time.
+// Zero disables it, which is the default.
+func WithSyncEveryBytes(k int) Option {
+	return func(cfg *config) error {
+		if k < 0 {
+			return fmt.Errorf("WithSyncEveryBytes: Unsupported byte count %v", k)
+		}
+
+		cfg.syncEveryBytes = k
+		return nil
+	}
+}
+
+// WithWriteRetry retries the writes to the log file failing with the
+// transient errors - ENOSPC, e.g. until the old log files are cleaned up,
+// EIO, e.g. on network storage, EAGAIN and EINTR - making up to attempts
+// attempts in all, waiting backoff before the first retry and doubling the
+// wait after each. The other errors, e.g. writing to a closed file, fail
+// fast. A partial write is resumed where it stopped. The rotation is
+// re-checked between the attempts, except by the deduplicating loggers
+// whose stats are deduplicated against the current log file. The writes
+// wait holding the lock, so the other writers wait as well. Not supported
+// with WithBufferSize and WithActiveCompression, as their writers do not
+// recover from a failed write. The default is a single attempt.
+func WithWriteRetry(attempts int, backoff time.Duration) Option {
+	return func(cfg *config) error {
+		if attempts < 1 {
+			return fmt.Errorf("WithWriteRetry: Unsupported attempts %v", attempts)
+		}
+
+		if backoff < 0 {
+			return fmt.Errorf("WithWriteRetry: Unsupported backoff %v", backoff)
+		}
+
+		cfg.writeAttempts = attempts
+		cfg.retryBackoff = backoff
+		return nil
+	}
+}
+
+// WithMaxAge removes the rotated log files last modified more than maxAge
+// ago, irrespective of numFiles. The files are removed on rotation, and the
+// remaining rotated files get renumbered contiguously. Zero disables the
+// age based retention, which is the default.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(cfg *config) error {
+		if maxAge < 0 {
+			return fmt.Errorf("WithMaxAge: Unsupported max age %v", maxAge)
+		}
+
+		cfg.maxAge = maxAge
+		return nil
+	}
+}
+
+// WithMaxTotalBytes limits the total size of the log files. On rotation,
+// the oldest rotated log files are removed - even if that leaves fewer
+// than numFiles files - until the total size of the rotated files is at
+// most maxTotalBytes. As the current log file is never removed, the total
+// size can exceed maxTotalBytes by the size of the current log file. Zero
+// disables the limit, which is the default.
+func WithMaxTotalBytes(maxTotalBytes int64) Option {
+	return func(cfg *config) error {
+		if maxTotalBytes < 0 {
+			return fmt.Errorf("WithMaxTotalBytes: Unsupported max total bytes %v", maxTotalBytes)
+		}
+
+		cfg.maxTotalBytes = maxTotalBytes
+		return nil
+	}
+}
+
+// WithFloatEpsilon sets the tolerance for the deduplication of float64
+// stats. A float64 stat differing from its previous value by at most
+// epsilon is considered unchanged, and gets deduplicated. The default is
+// zero, i.e. only the exactly equal values get deduplicated.
+func WithFloatEpsilon(epsilon float64) Option {
+	return func(cfg *config) error {
+		if epsilon < 0 || math.IsNaN(epsilon) {
+			return fmt.Errorf("WithFloatEpsilon: Unsupported epsilon %v", epsilon)
+		}
+
+		cfg.floatEpsilon = epsilon
+		return nil
+	}
+}
+
+// WithSnapshotEvery makes the deduplicating loggers write the full stats of
+// a type - bypassing the deduplication - once every snapshotEvery writes of
+// that type. This bounds the number of log messages needed to reconstruct
+// the current stats, e.g. for a consumer tailing a long-lived log file.
+// The snapshots list the keys removed since the previous stats, as the
+// deduplicated stats do, for the reconstruction to drop them; reading from
+// a snapshot onwards, they are ignored. Zero disables the periodic
+// snapshots, which is the default.
+func WithSnapshotEvery(snapshotEvery int) Option {
+	return func(cfg *config) error {
+		if snapshotEvery < 0 {
+			return fmt.Errorf("WithSnapshotEvery: Unsupported snapshot frequency %v", snapshotEvery)
+		}
+
+		cfg.snapshotEvery = snapshotEvery
+		return nil
+	}
+}
+
+// WithEncoder sets the Encoder of the stats written to the log files. The
+// default is JSONEncoding. Reading or reconstructing the stats encoded
+// otherwise needs the matching Decoder, refer LogStatsReader.SetDecoder
+// and ReconstructOptions.
+func WithEncoder(encoder Encoder) Option {
+	return func(cfg *config) error {
+		if encoder == nil {
+			return fmt.Errorf("WithEncoder: Unsupported nil encoder")
+		}
+
+		cfg.encoder = encoder
+		return nil
+	}
+}
+
+// WithJSONMarshaller sets the function marshalling the stats to JSON, in
+// place of json.Marshal - e.g. the faster one of
+// github.com/json-iterator/go. It is a shorthand for WithEncoder with a
+// JSONMarshalEncoding, so it overrides the Encoder and vice versa. The
+// stats read back with the default Decoder, or with the JSONMarshalEncoding
+// of the matching unmarshaller, refer LogStatsReader.SetDecoder and
+// ReconstructOptions.
+func WithJSONMarshaller(marshal func(v interface{}) ([]byte, error)) Option {
+	return func(cfg *config) error {
+		if marshal == nil {
+			return fmt.Errorf("WithJSONMarshaller: Unsupported nil marshaller")
+		}
+
+		cfg.encoder = JSONMarshalEncoding{Marshal: marshal}
+		return nil
+	}
+}
+
+// WithJSONLines writes each log message as a single JSON object, e.g.
+// {"ts":"2024-01-31T23:59:59.000+00:00","type":"kStats","stat":{"k1":10}},
+// instead of "<timestamp> <type> <stats>", so that the log files are JSON
+// Lines, as expected by the standard tooling. The deduplicated stats hold
+// the changes only, as ever. The readers and the reconstruction take either
+// format. Not supported with an Encoder other than JSONEncoding and
+// JSONMarshalEncoding. Disabled by default.
+func WithJSONLines(enable bool) Option {
+	return func(cfg *config) error {
+		cfg.jsonLines = enable
+		return nil
+	}
+}
+
+// WithLinePrefix inserts the fields - e.g. the hostname, the pid or the
+// component name - between the timestamp and the stat type of each log
+// message, space separated, to tell apart the log files collected from
+// multiple nodes or processes. The fields must be non-empty, and must not
+// contain white space. The readers must be told the number of fields,
+// refer LogStatsReader.SetPrefixFields and ReconstructOptions.PrefixFields.
+// No fields by default.
+func WithLinePrefix(fields ...string) Option {
+	return func(cfg *config) error {
+		for _, field := range fields {
+			if field == "" || strings.IndexFunc(field, unicode.IsSpace) >= 0 {
+				return fmt.Errorf("WithLinePrefix: Unsupported field %q", field)
+			}
+		}
+
+		cfg.linePrefix = append([]string(nil), fields...)
+		return nil
+	}
+}
+
+// WithFileMode sets the permissions of the log files created, including the
+// rotated and the compressed ones. As with os.OpenFile, the permissions are
+// subject to the umask. The existing log files keep their permissions. The
+// default is 0644.
+func WithFileMode(fileMode os.FileMode) Option {
+	return func(cfg *config) error {
+		if fileMode&^os.ModePerm != 0 {
+			return fmt.Errorf("WithFileMode: Unsupported file mode %v", fileMode)
+		}
+
+		cfg.fileMode = fileMode
+		return nil
+	}
+}
+
+// WithDirMode sets the permissions of the directories created for the log
+// files, subject to the umask. The default is 0755.
+func WithDirMode(dirMode os.FileMode) Option {
+	return func(cfg *config) error {
+		if dirMode&^os.ModePerm != 0 {
+			return fmt.Errorf("WithDirMode: Unsupported directory mode %v", dirMode)
+		}
+
+		cfg.dirMode = dirMode
+		return nil
+	}
+}
+
+// WithObserver sets the Observer notified of the writes, the rotations and
+// the errors. There is no observer by default.
+func WithObserver(observer Observer) Option {
+	return func(cfg *config) error {
+		cfg.observer = observer
+		return nil
+	}
+}
+
+// WithoutTrailingNewline frames each log message by its length - an
+// unsigned varint prefix - instead of a trailing new line, for embedding
+// the log messages into a length framed transport, e.g. a binary protocol.
+// The log messages are otherwise unchanged. The log files are then read by
+// LogStatsReader with SetFramed, or split by ScanFramedRecords; the new
+// line based tools - e.g. MergeStatFiles, Follow, ReconstructStatFile and
+// ValidateStatFile - do not support them. Not supported with
+// WithRepairOnOpen, WithMaxLines and WithRotationPredicate, which count on
+// the new lines.
+func WithoutTrailingNewline() Option {
+	return func(cfg *config) error {
+		cfg.framed = true
+		return nil
+	}
+}
+
+// WithRepairOnOpen makes the construction truncate a trailing partial line
+// of the existing log file - e.g. left behind by a crash in the middle of a
+// Write - before appending to it. Otherwise, the partial line gets merged
+// with the next stats written, breaking the readers and the reconstruction
+// of the log file. Disabled by default.
+func WithRepairOnOpen(repair bool) Option {
+	return func(cfg *config) error {
+		cfg.repairOnOpen = repair
+		return nil
+	}
+}
+
+// WithFileNamer sets the FileNamer naming the rotated log files, e.g.
+// TimestampFileNamer. Changing the namer of the existing log files leaves
+// their rotated files behind, unmanaged. The default is DefaultFileNamer.
+func WithFileNamer(namer FileNamer) Option {
+	return func(cfg *config) error {
+		if namer == nil {
+			return fmt.Errorf("WithFileNamer: Unsupported nil file namer")
+		}
+
+		cfg.fileNamer = namer
+		return nil
+	}
+}
+
+// WithPerTypeFiles makes New write each stat type to its own log files,
+// named as the log file with the stat type inserted before the ".log"
+// extension, e.g. "stats.kStats.log". Each stat type gets rotated on its
+// own, and keeps its own deduplication, so that a stat type written often
+// does not force the rotation - and the reset of the deduplication - of
+// the others. The rest of the options apply to each stat type, e.g. each
+// one keeps up to numFiles log files. This costs an open file per stat
+// type. The stat types must be valid file names. Disabled by default.
+func WithPerTypeFiles(perTypeFiles bool) Option {
+	return func(cfg *config) error {
+		cfg.perTypeFiles = perTypeFiles
+		return nil
+	}
+}
+
+// WithRawDedupe makes the deduplicating loggers decode the stats written by
+// WriteRaw, for them to be deduplicated as the stats written by Write.
+// Otherwise, the raw stats are written as-is, and the next stats of their
+// type are written in full. Disabled by default.
+func WithRawDedupe(rawDedupe bool) Option {
+	return func(cfg *config) error {
+		cfg.rawDedupe = rawDedupe
+		return nil
+	}
+}
+
+// withClock replaces the clock used for the timestamps and for the time
+// based rotation and retention. Used by the tests.
+func withClock(now func() time.Time) Option {
+	return func(cfg *config) error {
+		cfg.now = now
+		return nil
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// newPerTypeLogStats creates a LogStats object writing each stat type to
+// its own log files, named as the log file with the stat type inserted
+// before the ".log" extension, e.g. "stats.kStats.log" for the log file
+// "stats.log". Each stat type has its own rotation and, for the
+// deduplicating loggers, its own deduplication. The loggers of the stat
+// types are created on their first write.
+func newPerTypeLogStats(fileName string, opts []Option, cfg config) (*multiLogStats, error) {
+	if !strings.HasSuffix(fileName, ".log") {
+		fileName = fileName + ".log"
+	}
+
+	// The log files of the stat types are locked as they get created,
+	// the log file itself guards against a second per type logger.
+	lockFile, err := lockLogFile(fileName, cfg.fileMode, cfg.dirMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &multiLogStats{
+		name:     "perTypeLogStats",
+		lockFile: lockFile,
+		route: func(statType string) (string, error) {
+			return getTypeLogFileName(fileName, statType)
+		},
+		create: func(typeFileName string) (LogStats, error) {
+			return newLogger(typeFileName, opts)
+		},
+		loggers:  make(map[string]LogStats),
+		durable:  cfg.durable,
+		compress: cfg.compression != CompressionNone,
+	}, nil
+}
+
+// getTypeLogFileName returns the name of the log file of statType.
+func getTypeLogFileName(fileName string, statType string) (string, error) {
+	if statType == "" || statType == "." || statType == ".." ||
+		strings.ContainsAny(statType, "/"+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Unsupported stat type %q for the per type log files", statType)
+	}
+
+	return strings.TrimSuffix(fileName, ".log") + "." + statType + ".log", nil
+}
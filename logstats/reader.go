@@ -0,0 +1,432 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// LogStatsReader reads the stats back from the log files written by a
+// LogStats object. The rotated log files are read first - oldest to
+// newest - followed by the current log file. Compressed log files are
+// decompressed transparently.
+type LogStatsReader struct {
+	fileName    string
+	files       []string
+	tsFormat    string
+	location    *time.Location
+	reconstruct bool
+	decoder     Decoder
+	numPrefix   int
+	sequence    bool
+	seq         uint64
+	open        func(fname string) (io.ReadCloser, error)
+	framed      bool
+	dict        []byte
+
+	rc            io.ReadCloser
+	reader        *bufio.Reader
+	keyToStatsMap map[string]interface{}
+}
+
+// Create new LogStatsReader object.
+// Paramters:
+// fileName:    Name of the log file, as passed to NewLogStats or
+//
+//	NewDedupeLogStats.
+//
+// reconstruct: If set, the stats deduplicated by dedupeLogStats are
+//
+//	reconstructed, i.e. each stat read contains the full stats
+//	of its type.
+func NewLogStatsReader(fileName string, reconstruct bool) (*LogStatsReader, error) {
+	if !strings.HasSuffix(fileName, ".log") {
+		fileName = fileName + ".log"
+	}
+
+	files, err := listLogFiles(fileName, DefaultFileNamer{})
+	if err != nil {
+		return nil, err
+	}
+
+	rdr := newLogStatsReader(fileName, reconstruct)
+	rdr.files = files
+	return rdr, nil
+}
+
+// NewLogStatsReaderWithTSFormat is NewLogStatsReader, for the stats whose
+// timestamps were written in tsFormat - the WithTSFormat of the LogStats
+// object which wrote them - in the location loc if tsFormat has no time
+// zone. Refer SetTSFormat.
+func NewLogStatsReaderWithTSFormat(fileName string, reconstruct bool, tsFormat string,
+	loc *time.Location) (*LogStatsReader, error) {
+
+	rdr, err := NewLogStatsReader(fileName, reconstruct)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rdr.SetTSFormat(tsFormat, loc)
+	if err != nil {
+		return nil, err
+	}
+	return rdr, nil
+}
+
+// newLogStatsReader returns a LogStatsReader of the log file fileName with
+// the default settings, yet to list the log files.
+func newLogStatsReader(fileName string, reconstruct bool) *LogStatsReader {
+	rdr := &LogStatsReader{
+		fileName:    fileName,
+		tsFormat:    time.RFC3339Nano,
+		location:    time.Local,
+		reconstruct: reconstruct,
+		decoder:     JSONEncoding{},
+	}
+
+	rdr.open = func(fname string) (io.ReadCloser, error) {
+		return openStatFile(fileName, fname, rdr.dict)
+	}
+	return rdr
+}
+
+// SetDecoder sets the Decoder of the stats, matching the Encoder of the
+// LogStats object which wrote them. The default is JSONEncoding.
+func (r *LogStatsReader) SetDecoder(decoder Decoder) {
+	r.decoder = decoder
+}
+
+// SetTSFormat sets the format of the timestamps, matching the WithTSFormat
+// of the LogStats object which wrote them, and the location of the
+// timestamps whose format has no time zone: time.UTC for the stats written
+// WithUTC, and time.Local - the default, also meant by nil - otherwise. The
+// timestamps with a time zone keep theirs. The default format is
+// time.RFC3339Nano, which reads DEFAULT_TS_FORMAT as well. The formats
+// containing a space are not supported, as the space separates the fields
+// of the log messages. A timestamp failing to parse is reported by Next as
+// the error of its line, and by Follow as the Err of its StatRecord - the
+// lines following it are read as usual.
+func (r *LogStatsReader) SetTSFormat(tsFormat string, loc *time.Location) error {
+	err := validateTSFormat(tsFormat)
+	if err != nil {
+		return fmt.Errorf("SetTSFormat: %v", err)
+	}
+
+	if strings.Contains(tsFormat, " ") {
+		return fmt.Errorf("SetTSFormat: Unsupported timestamp format %q, contains a space", tsFormat)
+	}
+
+	if loc == nil {
+		loc = time.Local
+	}
+
+	r.tsFormat = tsFormat
+	r.location = loc
+	return nil
+}
+
+// SetPrefixFields sets the number of fields between the timestamp and the
+// stat type of each log message, matching the WithLinePrefix fields of the
+// LogStats object which wrote them. The default is 0.
+func (r *LogStatsReader) SetPrefixFields(n int) {
+	r.numPrefix = n
+}
+
+// SetSequence tells that the stats were written WithSequence, so that the
+// sequence number of each stat is returned by Seq. The default is false.
+func (r *LogStatsReader) SetSequence(enable bool) {
+	r.sequence = enable
+}
+
+// Seq returns the sequence number of the stat last returned by Next, refer
+// SetSequence. Zero if none.
+func (r *LogStatsReader) Seq() uint64 {
+	return r.seq
+}
+
+// SetFramed tells that the log messages are framed by their length, i.e.
+// that the stats were written WithoutTrailingNewline. The default is false.
+func (r *LogStatsReader) SetFramed(enable bool) {
+	r.framed = enable
+}
+
+// SetCompressionDict sets the preset dictionary of the compressed log
+// files, matching the WithCompressionDict of the LogStats object which
+// wrote them. The log files compressed with another dictionary, or
+// without one, fail with ErrCompressionDict. The default is none. No-op
+// for the readers of a FileSnapshot, which uses the dictionary of its
+// logger.
+func (r *LogStatsReader) SetCompressionDict(dict []byte) {
+	r.dict = dict
+}
+
+// SetFileNamer sets the FileNamer of the rotated log files, matching the
+// one of the LogStats object which wrote them. The default is
+// DefaultFileNamer. It must be called before the first Next. No-op for
+// the readers of a FileSnapshot, which lists the log files itself.
+func (r *LogStatsReader) SetFileNamer(namer FileNamer) error {
+	if r.fileName == "" {
+		return nil
+	}
+
+	files, err := listLogFiles(r.fileName, namer)
+	if err != nil {
+		return err
+	}
+
+	r.files = files
+	return nil
+}
+
+// listLogFiles returns the log files of fileName in the order of reading,
+// i.e. the rotated files oldest first, followed by the current log file.
+func listLogFiles(fileName string, namer FileNamer) ([]string, error) {
+	rotated, err := getRotatedLogFiles(fileName, namer)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(rotated)+1)
+	for i := len(rotated) - 1; i >= 0; i-- {
+		files = append(files, rotated[i].name)
+	}
+
+	// The compressed current log file - refer WithActiveCompression -
+	// followed by the uncompressed one.
+	for _, fname := range []string{getActiveLogFileName(fileName), fileName} {
+		_, err = os.Stat(fname)
+		if err == nil {
+			files = append(files, fname)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// openStatFile opens the log file fname of the log file fileName for
+// reading its stat lines, with the preset dictionary dict, if any. The
+// compressed current log file is read up to its last flush.
+func openStatFile(fileName, fname string, dict []byte) (io.ReadCloser, error) {
+	rc, err := openLogFileReader(fname, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	if fname == getActiveLogFileName(fileName) {
+		// The compressed current log file is yet to be completed.
+		rc = truncatedGzipReader{rc}
+	}
+
+	return rc, nil
+}
+
+// Next returns the timestamp, the type and the stats of the next stat
+// read from the log files. It returns io.EOF once all the stats are read.
+// A malformed line is reported by an error other than io.EOF, and the
+// reading can be continued by calling Next again. So are the values other
+// than the maps, written by WriteValue.
+//
+// When reconstructing, the returned map is also used as the base for
+// reconstructing the next stat of the same type, so it must not be
+// modified.
+func (r *LogStatsReader) Next() (time.Time, string, map[string]interface{}, error) {
+	for {
+		if r.reader == nil {
+			if len(r.files) == 0 {
+				return time.Time{}, "", nil, io.EOF
+			}
+
+			err := r.openNextFile()
+			if err != nil {
+				return time.Time{}, "", nil, err
+			}
+		}
+
+		line, err := readRecord(r.reader, r.framed)
+		if err != nil {
+			r.closeFile()
+			if err != io.EOF {
+				return time.Time{}, "", nil, err
+			}
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		return r.parseLine(line)
+	}
+}
+
+func (r *LogStatsReader) openNextFile() error {
+	fname := r.files[0]
+	r.files = r.files[1:]
+
+	rc, err := r.open(fname)
+	if err != nil {
+		return err
+	}
+
+	r.rc = rc
+	r.reader = bufio.NewReader(rc)
+
+	// Deduplication resets on log rotation, so does the reconstruction.
+	r.keyToStatsMap = make(map[string]interface{})
+	return nil
+}
+
+func (r *LogStatsReader) closeFile() error {
+	if r.rc == nil {
+		return nil
+	}
+
+	err := r.rc.Close()
+
+	r.rc = nil
+	r.reader = nil
+	return err
+}
+
+func (r *LogStatsReader) parseLine(line []byte) (time.Time, string, map[string]interface{}, error) {
+	r.seq = 0
+
+	var seq uint64
+	prefixFields := r.numPrefix
+	if r.sequence {
+		var err error
+		seq, err = getStatSeq(line)
+		if err != nil {
+			return time.Time{}, "", nil, err
+		}
+
+		prefixFields++
+	}
+
+	tsStr, statType, data, err := splitStatLine(line, prefixFields)
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	ts, err := time.ParseInLocation(r.tsFormat, tsStr, r.location)
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	stat, err := r.decoder.Decode(data)
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+
+	if r.reconstruct {
+		stat = reconstructStatMap(r.keyToStatsMap, statType, stat)
+	}
+
+	r.seq = seq
+	return ts, statType, stat, nil
+}
+
+// WriteTo writes the stat lines yet to be read from the log files to w, as
+// they are in the log files - or, when reconstructing, with the full stats
+// of their type - e.g. to stream them to an HTTP response without
+// buffering them. It implements io.WriterTo. The malformed lines are
+// written as they are, and the reading goes on; a failure to read the log
+// files or to write to w stops it. Returns the number of bytes written and
+// the first error encountered.
+//
+// The reconstruction needs the Decoder to be an Encoding, to encode the
+// reconstructed stats.
+func (r *LogStatsReader) WriteTo(w io.Writer) (int64, error) {
+	var enc Encoding
+	if r.reconstruct {
+		switch dec := r.decoder.(type) {
+		case JSONEncoding:
+		case Encoding:
+			enc = dec
+		default:
+			return 0, fmt.Errorf("WriteTo: Unsupported decoder %T for reconstruction", r.decoder)
+		}
+	}
+
+	// The sequence number precedes the prefix fields, refer parseLine.
+	prefixFields := r.numPrefix
+	if r.sequence {
+		prefixFields++
+	}
+
+	var n int64
+	var firstErr error
+	for {
+		if r.reader == nil {
+			if len(r.files) == 0 {
+				return n, firstErr
+			}
+
+			err := r.openNextFile()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return n, firstErr
+			}
+		}
+
+		line, err := readRecord(r.reader, r.framed)
+		if err != nil {
+			r.closeFile()
+			if err != io.EOF {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return n, firstErr
+			}
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if r.reconstruct {
+			var lineErr error
+			line, lineErr = reconstructStatLine(r.keyToStatsMap, line, enc, prefixFields)
+			if lineErr != nil && firstErr == nil {
+				firstErr = lineErr
+			}
+		}
+
+		if r.framed {
+			line = frameRecord(line)
+		} else {
+			line = append(line, '\n')
+		}
+
+		written, err := w.Write(line)
+		n += int64(written)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return n, firstErr
+		}
+	}
+}
+
+// Closes the log file being read, if any.
+func (r *LogStatsReader) Close() error {
+	r.files = nil
+	return r.closeFile()
+}
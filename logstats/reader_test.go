@@ -0,0 +1,1242 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestLogStatsReader(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "reader.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestLogStatsReader failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 128, 5, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestLogStatsReader failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Full stats, as written. The second and the fourth ones get
+	// deduplicated, the third one gets rotated into a new file.
+	full := make([]map[string]interface{}, 0)
+	deduped := make([]map[string]interface{}, 0)
+
+	stat := getSimpleStat(0)
+	full = append(full, stat)
+	deduped = append(deduped, stat)
+
+	stat = getSimpleStat(0)
+	stat["k1"] = int64(9876)
+	full = append(full, stat)
+	deduped = append(deduped, map[string]interface{}{"k1": int64(9876)})
+
+	stat = getSimpleStat(0)
+	stat["k1"] = int64(9876)
+	stat["k2"] = "ChangedValue"
+	full = append(full, stat)
+	deduped = append(deduped, stat)
+
+	stat = getSimpleStat(0)
+	stat["k1"] = int64(98)
+	stat["k2"] = "ChangedValue"
+	full = append(full, stat)
+	deduped = append(deduped, map[string]interface{}{"k1": int64(98)})
+
+	start := time.Now().Add(-time.Second)
+	for _, stat := range full {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestLogStatsReader failed with error %v", err)
+		}
+	}
+
+	_, err = os.Stat(getLogFileName(fileName, 1, CompressionGzip))
+	if err != nil {
+		t.Fatalf("TestLogStatsReader failed with error %v", err)
+	}
+
+	for _, reconstruct := range []bool{false, true} {
+		exp := deduped
+		if reconstruct {
+			exp = full
+		}
+
+		err = verifyReader(exp, fileName, reconstruct, start)
+		if err != nil {
+			t.Fatalf("TestLogStatsReader failed for reconstruct %v with error %v", reconstruct, err)
+		}
+	}
+}
+
+func verifyReader(exp []map[string]interface{}, fileName string, reconstruct bool, start time.Time) error {
+	reader, err := NewLogStatsReader(fileName, reconstruct)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	for i := 0; ; i++ {
+		ts, statType, stat, err := reader.Next()
+		if err == io.EOF {
+			if i != len(exp) {
+				return fmt.Errorf("Unexpected number of stats, exp %v actual %v", len(exp), i)
+			}
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if i >= len(exp) {
+			return fmt.Errorf("Unexpected stat %v", stat)
+		}
+
+		if ts.Before(start) || ts.After(time.Now()) {
+			return fmt.Errorf("Unexpected timestamp %v for stat %v", ts, i)
+		}
+
+		if statType != "kStats" {
+			return fmt.Errorf("Stat type mismatch for stat %v, exp kStats actual %v", i, statType)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(exp[i], stat) {
+			return fmt.Errorf("Expected and actual stats are not equal. exp %v, actual %v", exp[i], stat)
+		}
+	}
+}
+
+func TestFollow(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "follow.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestFollow failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 512, 3, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestFollow failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	defer func(interval time.Duration) {
+		followInterval = interval
+	}(followInterval)
+	followInterval = 10 * time.Millisecond
+
+	// Written before following, so not streamed - but needed to
+	// reconstruct the stats written next.
+	err = statLogger.Write("kStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestFollow failed with error %v", err)
+	}
+
+	var reader *LogStatsReader
+	reader, err = NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestFollow failed with error %v", err)
+	}
+
+	defer reader.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var records <-chan StatRecord
+	records, err = reader.Follow(ctx)
+	if err != nil {
+		t.Fatalf("TestFollow failed with error %v", err)
+	}
+
+	// The stats get deduplicated, and the log file gets rotated a few
+	// times along the way.
+	for i := 0; i < 10; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i)
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestFollow failed with error %v", err)
+		}
+
+		var rec StatRecord
+		select {
+		case rec = <-records:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("TestFollow failed: stat %v not streamed", i)
+		}
+
+		if rec.Err != nil {
+			t.Fatalf("TestFollow failed with error %v", rec.Err)
+		}
+
+		convertFloatsToInts(rec.Stats)
+		if rec.Type != "kStats" || !reflect.DeepEqual(stat, rec.Stats) {
+			t.Fatalf("TestFollow failed: exp stat %v actual %v %v", stat, rec.Type, rec.Stats)
+		}
+	}
+
+	var info LogStatsInfo
+	info = statLogger.Info()
+	if info.ScanErr != nil {
+		t.Fatalf("TestFollow failed with error %v", info.ScanErr)
+	}
+
+	if info.Rotations == 0 {
+		t.Fatalf("TestFollow failed: log file not rotated")
+	}
+
+	// The channel gets closed once ctx is done.
+	cancel()
+	select {
+	case _, ok := <-records:
+		if ok {
+			t.Fatalf("TestFollow failed: unexpected stat after cancellation")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("TestFollow failed: channel not closed after cancellation")
+	}
+}
+
+func TestReaderNumberFidelity(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "number_fidelity.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestReaderNumberFidelity failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestReaderNumberFidelity failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Integers beyond 2^53 are not representable as float64.
+	stats := []map[string]interface{}{
+		{"k1": int64(1<<53 + 1), "k2": uint64(1<<64 - 1), "k3": 0.1},
+		{"k1": int64(1<<53 + 1), "k2": uint64(1<<64 - 1), "k3": 0.2},
+		{"k1": int64(1<<53 + 3), "k2": uint64(1<<64 - 1), "k3": 0.2},
+	}
+
+	for _, stat := range stats {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestReaderNumberFidelity failed with error %v", err)
+		}
+	}
+
+	var reader *LogStatsReader
+	reader, err = NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestReaderNumberFidelity failed with error %v", err)
+	}
+
+	defer reader.Close()
+
+	for i, stat := range stats {
+		var actual map[string]interface{}
+		_, _, actual, err = reader.Next()
+		if err != nil {
+			t.Fatalf("TestReaderNumberFidelity failed with error %v", err)
+		}
+
+		exp := map[string]interface{}{
+			"k1": json.Number(fmt.Sprint(stat["k1"])),
+			"k2": json.Number(fmt.Sprint(stat["k2"])),
+			"k3": json.Number(fmt.Sprint(stat["k3"])),
+		}
+		if !reflect.DeepEqual(exp, actual) {
+			t.Fatalf("TestReaderNumberFidelity failed for stat %v: exp %v actual %v", i, exp, actual)
+		}
+	}
+
+	// So does the reconstruction of the log file.
+	var lines [][]byte
+	content, err := readLogFile(fileName)
+	if err != nil {
+		t.Fatalf("TestReaderNumberFidelity failed with error %v", err)
+	}
+
+	lines, err = ReconstructStatLines(bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n")))
+	if err != nil {
+		t.Fatalf("TestReaderNumberFidelity failed with error %v", err)
+	}
+
+	exp := `{"k1":9007199254740993,"k2":18446744073709551615,"k3":0.2}`
+	if !bytes.HasSuffix(lines[1], []byte(exp)) {
+		t.Fatalf("TestReaderNumberFidelity failed: exp %s actual %s", exp, lines[1])
+	}
+}
+
+type failingWriter struct {
+	limit int
+	n     int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.limit {
+		return 0, fmt.Errorf("write limit reached")
+	}
+
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "writeto")
+	if err != nil {
+		t.Fatalf("TestReaderWriteTo failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	statLogger, err := NewDedupeLogStats(fileName, 256, 5, DEFAULT_TS_FORMAT)
+	if err != nil {
+		t.Fatalf("TestReaderWriteTo failed with error %v", err)
+	}
+
+	// Enough stats to rotate the log file.
+	full := make([]map[string]interface{}, 0)
+	for i := 0; i < 6; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i % 3)
+		full = append(full, stat)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestReaderWriteTo failed with error %v", err)
+		}
+	}
+	statLogger.Close()
+
+	_, err = os.Stat(getLogFileName(fileName, 1, CompressionGzip))
+	if err != nil {
+		t.Fatalf("TestReaderWriteTo failed with error %v", err)
+	}
+
+	for _, reconstruct := range []bool{false, true} {
+		var reader *LogStatsReader
+		reader, err = NewLogStatsReader(fileName, reconstruct)
+		if err != nil {
+			t.Fatalf("TestReaderWriteTo failed with error %v", err)
+		}
+
+		var buf bytes.Buffer
+		var n int64
+		n, err = reader.WriteTo(&buf)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("TestReaderWriteTo failed for reconstruct %v with error %v", reconstruct, err)
+		}
+
+		if n != int64(buf.Len()) {
+			t.Fatalf("TestReaderWriteTo failed for reconstruct %v: returned %v bytes, wrote %v",
+				reconstruct, n, buf.Len())
+		}
+
+		lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+		if len(lines) != len(full) {
+			t.Fatalf("TestReaderWriteTo failed for reconstruct %v: exp %v lines actual %v",
+				reconstruct, len(full), len(lines))
+		}
+
+		if !reconstruct {
+			continue
+		}
+
+		for i, line := range lines {
+			_, _, data, err := splitStatLine(line, 0)
+			if err != nil {
+				t.Fatalf("TestReaderWriteTo failed with error %v", err)
+			}
+
+			var stat map[string]interface{}
+			err = json.Unmarshal(data, &stat)
+			if err != nil {
+				t.Fatalf("TestReaderWriteTo failed with error %v", err)
+			}
+
+			convertFloatsToInts(stat)
+			if !reflect.DeepEqual(full[i], stat) {
+				t.Fatalf("TestReaderWriteTo failed for line %v: exp %v actual %v", i, full[i], stat)
+			}
+		}
+	}
+
+	// A failure to write stops the reading, with the bytes written so far.
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestReaderWriteTo failed with error %v", err)
+	}
+	defer reader.Close()
+
+	w := &failingWriter{limit: 200}
+	n, err := reader.WriteTo(w)
+	if err == nil || n != int64(w.n) || n == 0 {
+		t.Fatalf("TestReaderWriteTo failed: unexpected %v bytes written, %v accepted, err %v", n, w.n, err)
+	}
+}
+
+func TestMergeStatFiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merge")
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	statLogger, err := New(fileName, WithSizeLimit(200), WithNumFiles(10), WithDedupe(true))
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+
+	full := make([]map[string]interface{}, 0)
+	for i := 0; i < 12; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i)
+		full = append(full, stat)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestMergeStatFiles failed with error %v", err)
+		}
+	}
+	statLogger.Close()
+
+	// Reconstructed across the files, in order.
+	merged, err := MergeStatFiles(filepath.Join(tmpDir, "stats"))
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = ReconstructStatFile(merged, &buf)
+	merged.Close()
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != len(full) {
+		t.Fatalf("TestMergeStatFiles failed: exp %v lines actual %v", len(full), len(lines))
+	}
+
+	for i, line := range lines {
+		_, _, data, err := splitStatLine(line, 0)
+		if err != nil {
+			t.Fatalf("TestMergeStatFiles failed with error %v", err)
+		}
+
+		var stat map[string]interface{}
+		err = json.Unmarshal(data, &stat)
+		if err != nil {
+			t.Fatalf("TestMergeStatFiles failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(full[i], stat) {
+			t.Fatalf("TestMergeStatFiles failed for line %v: exp %v actual %v", i, full[i], stat)
+		}
+	}
+
+	// A missing number is skipped, and a file cut short gets its new line.
+	err = os.Remove(getLogFileName(fileName, 2, CompressionGzip))
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+
+	oldest := getLogFileName(fileName, 20, CompressionNone)
+	err = os.WriteFile(oldest, []byte("2024-01-01T00:00:00.000+00:00 kStats {\"k1\":"), 0644)
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+
+	files, err := listLogFiles(fileName, DefaultFileNamer{})
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+
+	if files[0] != oldest {
+		t.Fatalf("TestMergeStatFiles failed: unexpected files %v", files)
+	}
+
+	var exp []byte
+	for _, fname := range files {
+		content, err := readLogFile(fname)
+		if err != nil {
+			t.Fatalf("TestMergeStatFiles failed with error %v", err)
+		}
+
+		exp = append(exp, content...)
+		if !bytes.HasSuffix(content, []byte("\n")) {
+			exp = append(exp, '\n')
+		}
+	}
+
+	merged, err = MergeStatFiles(fileName)
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+	defer merged.Close()
+
+	actual, err := io.ReadAll(iotest.OneByteReader(merged))
+	if err != nil {
+		t.Fatalf("TestMergeStatFiles failed with error %v", err)
+	}
+
+	if !bytes.Equal(exp, actual) {
+		t.Fatalf("TestMergeStatFiles failed: exp %s actual %s", exp, actual)
+	}
+
+	_, err = MergeStatFiles(filepath.Join(tmpDir, "missing.log"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("TestMergeStatFiles failed: unexpected error %v for a missing log file", err)
+	}
+}
+
+func TestReaderTSFormat(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "reader_ts_format")
+	if err != nil {
+		t.Fatalf("TestReaderTSFormat failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// No time zone in the format, so the location of the timestamps is
+	// told to the reader.
+	tsFormat := "2006-01-02T15:04:05.000"
+	for _, utc := range []bool{false, true} {
+		now := time.Date(2024, 1, 1, 10, 30, 15, 123000000, time.Local)
+		loc := time.Local
+		if utc {
+			loc = time.UTC
+		}
+
+		fileName := filepath.Join(tmpDir, fmt.Sprintf("utc_%v.log", utc))
+		statLogger, err := New(fileName, WithTSFormat(tsFormat), WithUTC(utc),
+			withClock(func() time.Time { return now }))
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+
+		err = statLogger.Write("kStats", getSimpleStat(0))
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+		statLogger.Close()
+
+		// A line with a malformed timestamp, followed by a valid one.
+		f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+		_, err = f.WriteString("2024-01-01 kStats {}\n" + now.In(loc).Format(tsFormat) + " iStats {}\n")
+		f.Close()
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+
+		_, err = NewLogStatsReaderWithTSFormat(fileName, false, "2006-01-02 15:04:05", nil)
+		if err == nil {
+			t.Fatalf("TestReaderTSFormat failed: format with a space accepted")
+		}
+
+		reader, err := NewLogStatsReaderWithTSFormat(fileName, false, tsFormat, loc)
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+		defer reader.Close()
+
+		err = reader.SetTSFormat("2006-01-02 15:04:05", nil)
+		if err == nil {
+			t.Fatalf("TestReaderTSFormat failed: format with a space accepted")
+		}
+
+		ts, _, _, err := reader.Next()
+		if err != nil || !ts.Equal(now) {
+			t.Fatalf("TestReaderTSFormat failed for utc %v: exp %v actual %v, error %v", utc, now, ts, err)
+		}
+
+		_, _, _, err = reader.Next()
+		if err == nil || err == io.EOF {
+			t.Fatalf("TestReaderTSFormat failed: malformed timestamp not reported, error %v", err)
+		}
+
+		ts, statType, _, err := reader.Next()
+		if err != nil || statType != "iStats" || !ts.Equal(now) {
+			t.Fatalf("TestReaderTSFormat failed for utc %v: unexpected %v %v, error %v", utc, ts, statType, err)
+		}
+
+		// Follow streams the malformed timestamp as the error of its
+		// record, followed by the next line.
+		follower, err := NewLogStatsReaderWithTSFormat(fileName, false, tsFormat, loc)
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+		defer follower.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		records, err := follower.Follow(ctx)
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+
+		f, err = os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+		_, err = f.WriteString("2024-01-01 kStats {}\n" + now.In(loc).Format(tsFormat) + " iStats {}\n")
+		f.Close()
+		if err != nil {
+			t.Fatalf("TestReaderTSFormat failed with error %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			var rec StatRecord
+			select {
+			case rec = <-records:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("TestReaderTSFormat failed: line %v not streamed", i)
+			}
+
+			if i == 0 && (rec.Err == nil || rec.Stats != nil) {
+				t.Fatalf("TestReaderTSFormat failed: malformed timestamp not reported, record %+v", rec)
+			}
+
+			if i == 1 && (rec.Err != nil || rec.Type != "iStats" || !rec.Time.Equal(now)) {
+				t.Fatalf("TestReaderTSFormat failed for utc %v: unexpected record %+v", utc, rec)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestSequence(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sequence")
+	if err != nil {
+		t.Fatalf("TestSequence failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, jsonLines := range []bool{false, true} {
+		fileName := filepath.Join(tmpDir, fmt.Sprintf("json_lines_%v.log", jsonLines))
+		statLogger, err := New(fileName, WithSequence(true), WithJSONLines(jsonLines), WithDedupe(true))
+		if err != nil {
+			t.Fatalf("TestSequence failed with error %v", err)
+		}
+
+		// Written in a tight loop, likely within the same millisecond.
+		for i := 0; i < 2; i++ {
+			stat := getSimpleStat(0)
+			stat["k1"] = int64(i)
+			err = statLogger.Write("kStats", stat)
+			if err != nil {
+				t.Fatalf("TestSequence failed with error %v", err)
+			}
+		}
+		statLogger.Close()
+
+		reader, err := NewLogStatsReader(fileName, true)
+		if err != nil {
+			t.Fatalf("TestSequence failed with error %v", err)
+		}
+		defer reader.Close()
+
+		reader.SetSequence(true)
+		for i := 0; i < 2; i++ {
+			_, _, stat, err := reader.Next()
+			if err != nil {
+				t.Fatalf("TestSequence failed for JSON Lines %v with error %v", jsonLines, err)
+			}
+
+			if reader.Seq() != uint64(i+1) || len(stat) != len(getSimpleStat(0)) {
+				t.Fatalf("TestSequence failed for JSON Lines %v: unexpected seq %v for stat %v",
+					jsonLines, reader.Seq(), stat)
+			}
+		}
+
+		// The reconstruction keeps the sequence numbers.
+		f, err := os.Open(fileName)
+		if err != nil {
+			t.Fatalf("TestSequence failed with error %v", err)
+		}
+
+		var buf bytes.Buffer
+		err = ReconstructStatFile(f, &buf)
+		f.Close()
+		if err != nil {
+			t.Fatalf("TestSequence failed with error %v", err)
+		}
+
+		lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+		for i, line := range lines {
+			seq, err := getStatSeq(line)
+			if err != nil || seq != uint64(i+1) {
+				t.Fatalf("TestSequence failed for JSON Lines %v: seq %v for line %s, error %v",
+					jsonLines, seq, line, err)
+			}
+		}
+	}
+}
+
+func TestSequenceDense(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "sequence_dense")
+	if err != nil {
+		t.Fatalf("TestSequenceDense failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	large := map[string]interface{}{"k": string(bytes.Repeat([]byte("x"), 256))}
+	for _, truncate := range []bool{false, true} {
+		fileName := filepath.Join(tmpDir, fmt.Sprintf("truncate_%v.log", truncate))
+		statLogger, err := New(fileName, WithSequence(true), WithMaxRecordBytes(128, truncate))
+		if err != nil {
+			t.Fatalf("TestSequenceDense failed with error %v", err)
+		}
+
+		// The log message too large is rejected, or truncated, and the
+		// failed batch is not written.
+		records := 4
+		err = statLogger.Write("kStats", map[string]interface{}{"k": int64(1)})
+		if err != nil {
+			t.Fatalf("TestSequenceDense failed with error %v", err)
+		}
+
+		err = statLogger.Write("kStats", large)
+		if truncate {
+			records++
+		}
+		if (err == nil) != truncate {
+			t.Fatalf("TestSequenceDense failed for truncate %v with error %v", truncate, err)
+		}
+
+		err = statLogger.WriteBatch([]StatEntry{
+			{Type: "kStats", Map: map[string]interface{}{"k": int64(2)}},
+			{Type: "kStats", Map: map[string]interface{}{"k": make(chan int)}},
+		})
+		if err == nil {
+			t.Fatalf("TestSequenceDense failed: batch with unsupported stats written")
+		}
+
+		err = statLogger.WriteBatch([]StatEntry{
+			{Type: "kStats", Map: map[string]interface{}{"k": int64(3)}},
+			{Type: "kStats", Map: map[string]interface{}{"k": int64(4)}},
+		})
+		if err != nil {
+			t.Fatalf("TestSequenceDense failed with error %v", err)
+		}
+
+		err = statLogger.Write("kStats", map[string]interface{}{"k": int64(5)})
+		if err != nil {
+			t.Fatalf("TestSequenceDense failed with error %v", err)
+		}
+		statLogger.Close()
+
+		// The truncation marker fails to read as stats, so the sequence
+		// numbers are read from the lines.
+		lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+		if err != nil || len(lines) != records {
+			t.Fatalf("TestSequenceDense failed for truncate %v: %v lines, error %v", truncate, len(lines), err)
+		}
+
+		for i, line := range lines {
+			seq, err := getStatSeq([]byte(line))
+			if err != nil || seq != uint64(i+1) {
+				t.Fatalf("TestSequenceDense failed for truncate %v: seq %v for line %s, error %v",
+					truncate, seq, line, err)
+			}
+		}
+	}
+}
+
+func TestFileSnapshot(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "snapshot")
+	if err != nil {
+		t.Fatalf("TestFileSnapshot failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for name, opts := range map[string][]Option{
+		"buffered": {WithBufferSize(64 * 1024)},
+		"active":   {WithActiveCompression(true)},
+		"pertype":  {WithPerTypeFiles(true)},
+	} {
+		fileName := filepath.Join(tmpDir, name+".log")
+		opts = append(opts, WithSizeLimit(200), WithNumFiles(2), WithDedupe(true))
+		statLogger, err := New(fileName, opts...)
+		if err != nil {
+			t.Fatalf("TestFileSnapshot failed with error %v", err)
+		}
+
+		write := func(i int) {
+			stat := getSimpleStat(0)
+			stat["k1"] = int64(i)
+			err := statLogger.Write("kStats", stat)
+			if err != nil {
+				t.Fatalf("TestFileSnapshot failed with error %v", err)
+			}
+		}
+
+		for i := 0; i < 5; i++ {
+			write(i)
+		}
+
+		snap, err := statLogger.Snapshot()
+		if err != nil {
+			t.Fatalf("TestFileSnapshot failed with error %v", err)
+		}
+
+		for _, file := range snap.Files {
+			if !filepath.IsAbs(file.Path) {
+				t.Fatalf("TestFileSnapshot failed for %v: relative path %v", name, file.Path)
+			}
+		}
+
+		// The rotations since rename, compress and remove the log files
+		// of the snapshot, and the writes since are left out.
+		for i := 5; i < 40; i++ {
+			write(i)
+		}
+
+		rdr := snap.NewReader(true)
+		for i := 0; ; i++ {
+			_, statType, stat, err := rdr.Next()
+			if err == io.EOF {
+				if i != 5 {
+					t.Fatalf("TestFileSnapshot failed for %v: exp 5 stats actual %v", name, i)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("TestFileSnapshot failed for %v with error %v", name, err)
+			}
+
+			if statType != "kStats" || fmt.Sprint(stat["k1"]) != fmt.Sprint(i) || stat["k2"] != "Value2" {
+				t.Fatalf("TestFileSnapshot failed for %v: unexpected stat %v %v %v", name, i, statType, stat)
+			}
+		}
+		rdr.Close()
+
+		merged := snap.Open()
+		content, err := io.ReadAll(merged)
+		merged.Close()
+		if err != nil {
+			t.Fatalf("TestFileSnapshot failed for %v with error %v", name, err)
+		}
+
+		if n := bytes.Count(content, []byte("\n")); n != 5 {
+			t.Fatalf("TestFileSnapshot failed for %v: exp 5 lines actual %v", name, n)
+		}
+
+		err = snap.Close()
+		if err != nil {
+			t.Fatalf("TestFileSnapshot failed with error %v", err)
+		}
+
+		_, _, _, err = snap.NewReader(false).Next()
+		if err == nil || err == io.EOF {
+			t.Fatalf("TestFileSnapshot failed for %v: closed snapshot read with %v", name, err)
+		}
+
+		statLogger.Close()
+		_, err = statLogger.Snapshot()
+		if err == nil {
+			t.Fatalf("TestFileSnapshot failed for %v: snapshot of a closed logger", name)
+		}
+	}
+}
+
+func TestFramedRecords(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "framed")
+	if err != nil {
+		t.Fatalf("TestFramedRecords failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	for _, opt := range []Option{WithRepairOnOpen(true), WithMaxLines(10)} {
+		_, err = New(fileName, WithoutTrailingNewline(), opt)
+		if err == nil {
+			t.Fatalf("TestFramedRecords failed: line based option accepted")
+		}
+	}
+
+	statLogger, err := New(fileName, WithoutTrailingNewline(), WithDedupe(true),
+		WithSizeLimit(300), WithNumFiles(10), WithCompression(CompressionNone))
+	if err != nil {
+		t.Fatalf("TestFramedRecords failed with error %v", err)
+	}
+
+	full := make([]map[string]interface{}, 0)
+	for i := 0; i < 12; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i)
+		full = append(full, stat)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestFramedRecords failed with error %v", err)
+		}
+	}
+	statLogger.Close()
+
+	// Split by the length prefixes, without any new line.
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatalf("TestFramedRecords failed with error %v", err)
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(ScanFramedRecords)
+	records := 0
+	for scanner.Scan() {
+		record := scanner.Bytes()
+		if bytes.IndexByte(record, '\n') >= 0 || !isValidStatLine(record) {
+			t.Fatalf("TestFramedRecords failed: unexpected record %q", record)
+		}
+		records++
+	}
+	f.Close()
+
+	if scanner.Err() != nil || records == 0 {
+		t.Fatalf("TestFramedRecords failed: %v records, error %v", records, scanner.Err())
+	}
+
+	// Reconstructed across the files, in order.
+	rdr, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestFramedRecords failed with error %v", err)
+	}
+	defer rdr.Close()
+
+	rdr.SetFramed(true)
+	for i := 0; ; i++ {
+		_, statType, stat, err := rdr.Next()
+		if err == io.EOF {
+			if i != len(full) {
+				t.Fatalf("TestFramedRecords failed: exp %v stats actual %v", len(full), i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("TestFramedRecords failed with error %v", err)
+		}
+
+		if statType != "kStats" || fmt.Sprint(stat["k1"]) != fmt.Sprint(i) || stat["k2"] != "Value2" {
+			t.Fatalf("TestFramedRecords failed: unexpected stat %v %v %v", i, statType, stat)
+		}
+	}
+
+	// A trailing partial record, e.g. left behind by a crash.
+	_, _, err = ScanFramedRecords(frameRecord([]byte("stats"))[:4], true)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("TestFramedRecords failed: exp error %v actual %v", io.ErrUnexpectedEOF, err)
+	}
+
+	_, err = readRecord(bufio.NewReader(bytes.NewReader(frameRecord([]byte("stats"))[:4])), true)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("TestFramedRecords failed: exp error %v actual %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestCompressionDict(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "compression_dict")
+	if err != nil {
+		t.Fatalf("TestCompressionDict failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = New(filepath.Join(tmpDir, "zstd.log"), WithCompressionDict([]byte("k1")),
+		WithCompression(CompressionZstd))
+	if err == nil {
+		t.Fatalf("TestCompressionDict failed: zstd compression accepted")
+	}
+
+	dict := []byte(`kStats {"k1":,"k2":"Value","k3":false,"k4":{"k31":,"k32":"Value","k33":true}}`)
+	rotatedBytes := func(name string, opts ...Option) int64 {
+		fileName := filepath.Join(tmpDir, name)
+		opts = append(opts, WithSizeLimit(200), WithNumFiles(20), WithDedupe(true))
+		statLogger, err := New(fileName, opts...)
+		if err != nil {
+			t.Fatalf("TestCompressionDict failed with error %v", err)
+		}
+
+		for i := 0; i < 20; i++ {
+			err = statLogger.Write("kStats", getSimpleStat(i))
+			if err != nil {
+				t.Fatalf("TestCompressionDict failed with error %v", err)
+			}
+		}
+		statLogger.Close()
+
+		files, err := getRotatedLogFiles(fileName, DefaultFileNamer{})
+		if err != nil || len(files) == 0 {
+			t.Fatalf("TestCompressionDict failed: rotated files %v, error %v", files, err)
+		}
+
+		var total int64
+		for _, file := range files {
+			finfo, err := os.Stat(file.name)
+			if err != nil {
+				t.Fatalf("TestCompressionDict failed with error %v", err)
+			}
+			total += finfo.Size()
+		}
+		return total
+	}
+
+	plain := rotatedBytes("plain.log")
+	withDict := rotatedBytes("dict.log", WithCompressionDict(dict))
+	if withDict >= plain {
+		t.Fatalf("TestCompressionDict failed: %v bytes with the dictionary, %v without", withDict, plain)
+	}
+
+	fileName := filepath.Join(tmpDir, "dict.log")
+	_, err = readLogFile(getLogFileName(fileName, 1, CompressionGzip))
+	if !errors.Is(err, ErrCompressionDict) {
+		t.Fatalf("TestCompressionDict failed: exp error %v actual %v", ErrCompressionDict, err)
+	}
+
+	for _, d := range [][]byte{nil, []byte("another")} {
+		reader, err := NewLogStatsReader(fileName, true)
+		if err != nil {
+			t.Fatalf("TestCompressionDict failed with error %v", err)
+		}
+
+		reader.SetCompressionDict(d)
+		_, _, _, err = reader.Next()
+		reader.Close()
+		if !errors.Is(err, ErrCompressionDict) {
+			t.Fatalf("TestCompressionDict failed: exp error %v actual %v", ErrCompressionDict, err)
+		}
+	}
+
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestCompressionDict failed with error %v", err)
+	}
+	defer reader.Close()
+
+	reader.SetCompressionDict(dict)
+	for i := 0; i < 20; i++ {
+		_, _, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestCompressionDict failed with error %v", err)
+		}
+
+		statBytes, _ := json.Marshal(stat)
+		expBytes, _ := json.Marshal(getSimpleStat(i))
+		if string(statBytes) != string(expBytes) {
+			t.Fatalf("TestCompressionDict failed: exp %s actual %s", expBytes, statBytes)
+		}
+	}
+
+	_, _, _, err = reader.Next()
+	if err != io.EOF {
+		t.Fatalf("TestCompressionDict failed: exp EOF actual %v", err)
+	}
+}
+
+func TestParseStatLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		tokens int
+		prefix []string
+		stats  string
+	}{
+		{`2024-01-02T15:04:05.000Z kStats {"k1":1}`, 2,
+			[]string{"2024-01-02T15:04:05.000Z", "kStats"}, `{"k1":1}`},
+		// WithSequence and WithLinePrefix.
+		{`2024-01-02T15:04:05.000Z 7 host1 123 kStats {"k1":1}`, 5,
+			[]string{"2024-01-02T15:04:05.000Z", "7", "host1", "123", "kStats"}, `{"k1":1}`},
+		// A timestamp with a space, and a padded one.
+		{`2024-01-02 15:04:05 kStats {"k1":1}`, 3,
+			[]string{"2024-01-02", "15:04:05", "kStats"}, `{"k1":1}`},
+		{`Jan  2 15:04:05 kStats {"k1":1}`, 4,
+			[]string{"Jan", "", "2", "15:04:05"}, `kStats {"k1":1}`},
+		// Spaces within the stats.
+		{`2024-01-02T15:04:05.000Z kStats {"k1": "a b"}`, 2,
+			[]string{"2024-01-02T15:04:05.000Z", "kStats"}, `{"k1": "a b"}`},
+		{`{"k1":1}`, 0, []string{}, `{"k1":1}`},
+	}
+
+	for _, test := range tests {
+		prefix, stats, err := ParseStatLine([]byte(test.line), test.tokens)
+		if err != nil {
+			t.Fatalf("TestParseStatLine failed with error %v", err)
+		}
+
+		if !reflect.DeepEqual(prefix, test.prefix) || string(stats) != test.stats {
+			t.Fatalf("TestParseStatLine failed: line %q parsed into %q %q, expected %q %q",
+				test.line, prefix, stats, test.prefix, test.stats)
+		}
+	}
+
+	// Too few tokens, no stats, or a negative token count.
+	for _, line := range []string{`2024-01-02T15:04:05.000Z`, `2024-01-02T15:04:05.000Z kStats `} {
+		_, _, err := ParseStatLine([]byte(line), 2)
+		if err == nil {
+			t.Fatalf("TestParseStatLine failed: malformed line %q accepted", line)
+		}
+	}
+
+	_, _, err := ParseStatLine([]byte(`{"k1":1}`), -1)
+	if err == nil {
+		t.Fatalf("TestParseStatLine failed: negative token count accepted")
+	}
+
+	// The log messages of a logger WithLinePrefix.
+	tmpDir, err := os.MkdirTemp("", "parse_stat_line")
+	if err != nil {
+		t.Fatalf("TestParseStatLine failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	statLogger, err := New(fileName, WithLinePrefix("host1", "123"))
+	if err != nil {
+		t.Fatalf("TestParseStatLine failed with error %v", err)
+	}
+	defer statLogger.Close()
+
+	err = statLogger.Write("kStats", getSimpleStat(0))
+	if err != nil {
+		t.Fatalf("TestParseStatLine failed with error %v", err)
+	}
+
+	lines, err := getAllLogsFromFiles(fileName, CompressionNone)
+	if err != nil || len(lines) != 1 {
+		t.Fatalf("TestParseStatLine failed: %v log messages, error %v", len(lines), err)
+	}
+
+	prefix, stats, err := ParseStatLine([]byte(lines[0]), 4)
+	if err != nil {
+		t.Fatalf("TestParseStatLine failed with error %v", err)
+	}
+
+	m := make(map[string]interface{})
+	err = json.Unmarshal(stats, &m)
+	if err != nil || prefix[1] != "host1" || prefix[2] != "123" || prefix[3] != "kStats" {
+		t.Fatalf("TestParseStatLine failed: line %q parsed into %q %q, error %v", lines[0], prefix, stats, err)
+	}
+
+	convertFloatsToInts(m)
+	if !reflect.DeepEqual(m, getSimpleStat(0)) {
+		t.Fatalf("TestParseStatLine failed: stats %v, expected %v", m, getSimpleStat(0))
+	}
+}
+
+func TestReaderWriteToSequence(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "writeto_sequence")
+	if err != nil {
+		t.Fatalf("TestReaderWriteToSequence failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileName := filepath.Join(tmpDir, "stats.log")
+	statLogger, err := New(fileName, WithDedupe(true), WithSequence(true),
+		WithEncoder(hexEncoding{}))
+	if err != nil {
+		t.Fatalf("TestReaderWriteToSequence failed with error %v", err)
+	}
+
+	// A changed key, then a removed one.
+	full := make([]map[string]interface{}, 0)
+	for i := 0; i < 3; i++ {
+		stat := getSimpleStat(0)
+		if i > 0 {
+			stat["k1"] = int64(20)
+		}
+		if i > 1 {
+			delete(stat, "k2")
+		}
+		full = append(full, stat)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestReaderWriteToSequence failed with error %v", err)
+		}
+	}
+	statLogger.Close()
+
+	reader, err := NewLogStatsReader(fileName, true)
+	if err != nil {
+		t.Fatalf("TestReaderWriteToSequence failed with error %v", err)
+	}
+	defer reader.Close()
+
+	reader.SetDecoder(hexEncoding{})
+	reader.SetSequence(true)
+
+	var buf bytes.Buffer
+	_, err = reader.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("TestReaderWriteToSequence failed with error %v", err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != len(full) {
+		t.Fatalf("TestReaderWriteToSequence failed: exp %v lines actual %v", len(full), len(lines))
+	}
+
+	for i, line := range lines {
+		prefix, data, err := ParseStatLine(line, 3)
+		if err != nil {
+			t.Fatalf("TestReaderWriteToSequence failed with error %v", err)
+		}
+
+		if prefix[1] != fmt.Sprint(i+1) || prefix[2] != "kStats" {
+			t.Fatalf("TestReaderWriteToSequence failed: unexpected prefix %q of line %v", prefix, i)
+		}
+
+		stat, err := hexEncoding{}.Decode(data)
+		if err != nil {
+			t.Fatalf("TestReaderWriteToSequence failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !reflect.DeepEqual(full[i], stat) {
+			t.Fatalf("TestReaderWriteToSequence failed for line %v: exp %v actual %v", i, full[i], stat)
+		}
+	}
+}
@@ -1,76 +1,97 @@
 package logstats
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 )
 
-// omits new line from input
-func parseBufferTillNewLine(sourceBuffer []byte) (bool, []byte) {
-	var outputBuffer = make([]byte, 0, 1024)
-	for _, c := range sourceBuffer {
-		if c == '\n' {
-			return true, outputBuffer
-		}
-		outputBuffer = append(outputBuffer, c)
-	}
-	return false, outputBuffer
-}
-
-func extractStatsFromLine(source []byte) int {
+// extractStatsFromLine returns the start of the stats at the end of the
+// log message source, found by balancing the brackets backwards from the
+// end of the line. The brackets within the JSON strings, e.g. in a stat
+// value "a]b", are skipped.
+func extractStatsFromLine(source []byte) (int, error) {
 	var end int
 	var stack = make([]byte, 0)
 	var stackTop = -1
+	var inString bool
 	for end = len(source) - 1; end > 0; end-- {
+		if source[end] == '"' && !isEscaped(source, end) {
+			inString = !inString
+			continue
+		}
+
+		if inString {
+			continue
+		}
+
 		switch source[end] {
 		case '}', ']', ')':
 			stack = append(stack, source[end])
 			stackTop++
 		case '{':
+			if stackTop < 0 {
+				return -1, fmt.Errorf("bracket mismatch error - unexpected opening '{'")
+			}
 			if stack[stackTop] != '}' {
-				fmt.Printf(
-					"invalid line: bracket mismatch error - expected closing '}' but got '%v'. Input - %s\n",
+				return -1, fmt.Errorf(
+					"bracket mismatch error - expected closing '}' but got '%v'",
 					string(stack[stackTop]),
-					source,
 				)
-				return -1
 			}
 			stack = stack[:stackTop]
 			stackTop--
 		case '[':
+			if stackTop < 0 {
+				return -1, fmt.Errorf("bracket mismatch error - unexpected opening '['")
+			}
 			// need ')' as well because histogram gets printed as [)
 			if stack[stackTop] != ']' && stack[stackTop] != ')' {
-				fmt.Printf(
-					"invalid line: bracket mismatch error - expected closing ']'/')' but got '%v'. Input - %s\n",
+				return -1, fmt.Errorf(
+					"bracket mismatch error - expected closing ']'/')' but got '%v'",
 					string(stack[stackTop]),
-					source,
 				)
-				return -1
 			}
 			stack = stack[:stackTop]
 			stackTop--
 		case '(':
+			if stackTop < 0 {
+				return -1, fmt.Errorf("bracket mismatch error - unexpected opening '('")
+			}
 			if stack[stackTop] != ')' && stack[stackTop] != ']' {
-				fmt.Printf(
-					"invalid line: bracket mismatch error - expected closing ')'/']' but got '%v'. Input - %s\n",
+				return -1, fmt.Errorf(
+					"bracket mismatch error - expected closing ')'/']' but got '%v'",
 					string(stack[stackTop]),
-					source,
 				)
-				return -1
 			}
 			stack = stack[:stackTop]
 			stackTop--
 		}
 		// only exit with a valid ans
 		if len(stack) == 0 {
-			return end
+			return end, nil
 		}
 	}
-	return -1
+	return -1, fmt.Errorf("failed to extract valid json in stats")
+}
+
+// isEscaped reports whether the character at pos of source is escaped,
+// i.e. preceded by an odd number of backslashes.
+func isEscaped(source []byte, pos int) bool {
+	var n int
+	for i := pos - 1; i >= 0 && source[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
 }
 
 // returns the key in reverse format
@@ -92,73 +113,279 @@ func getStatNameFromSource(end int, source []byte) string {
 	return string(statName.String()[:statName.Len()-lastSpaceIndex])
 }
 
+// LineError describes a stat line which could not be reconstructed. Such
+// lines are passed through as-is.
+type LineError struct {
+	Line   int // 1-based line number in the source
+	Reason string
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %v: %v", e.Line, e.Reason)
+}
+
+// ReconstructError is returned by ReconstructStatFile when some of the
+// stat lines could not be reconstructed. All the other lines are still
+// reconstructed and written to the output.
+type ReconstructError struct {
+	Errors []*LineError
+}
+
+func (e *ReconstructError) Error() string {
+	return fmt.Sprintf("failed to reconstruct %v stat lines, first error - %v",
+		len(e.Errors), e.Errors[0])
+}
+
+// ReconstructStatLine reconstructs the full stats of a deduplicated stat
+// line, based on the previous stats recorded in keyToStatsMap. The lines
+// which cannot be reconstructed are returned as-is.
 func ReconstructStatLine(keyToStatsMap map[string]interface{}, source []byte) []byte {
+	ans, _ := reconstructStatLine(keyToStatsMap, source, nil, 0)
+	return ans
+}
+
+// ReconstructStatLines reconstructs the deduplicated stat lines in order,
+// without the trailing new lines. The lines which cannot be reconstructed
+// are returned as-is, and reported by a *ReconstructError.
+func ReconstructStatLines(lines [][]byte) ([][]byte, error) {
+	var reconstructor = NewReconstructor(ReconstructOptions{})
+	var lineErrs []*LineError
+
+	var reconstructed = make([][]byte, 0, len(lines))
+	for i, line := range lines {
+		ans, err := reconstructor.Write(line)
+		if err != nil {
+			lineErrs = append(lineErrs, &LineError{Line: i + 1, Reason: err.Error()})
+		}
+		reconstructed = append(reconstructed, ans)
+	}
+
+	if len(lineErrs) > 0 {
+		return reconstructed, &ReconstructError{Errors: lineErrs}
+	}
+	return reconstructed, nil
+}
+
+// reconstructStatLine is ReconstructStatLine, also returning the reason
+// when the line cannot be reconstructed. The stats are encoded with enc,
+// or as JSON if enc is nil. The line has prefixFields fields between the
+// timestamp and the stat type, refer WithLinePrefix.
+func reconstructStatLine(keyToStatsMap map[string]interface{}, source []byte, enc Encoding, prefixFields int) ([]byte, error) {
+	if isJSONLine(source) {
+		return reconstructJSONLine(keyToStatsMap, source, enc)
+	}
+
 	if !isValidStatLine(source) {
-		return source
+		return source, fmt.Errorf("not a stat line")
+	}
+
+	if enc != nil {
+		return reconstructEncodedStatLine(keyToStatsMap, source, enc, prefixFields)
 	}
 
 	var defaultAns = source
 	if keyToStatsMap == nil {
-		return defaultAns
+		return defaultAns, nil
 	}
-	var statStart = extractStatsFromLine(source)
-
-	if statStart == -1 {
-		fmt.Printf("failed to extract valid json in stats for line:\n\t%s\n", string(source))
-		return defaultAns
+	var statStart, err = extractStatsFromLine(source)
+	if err != nil {
+		return defaultAns, err
 	}
 
 	if source[statStart-1] != ' ' {
-		fmt.Printf("messed up stat map - %s\n", string(source))
-		return defaultAns
+		return defaultAns, fmt.Errorf("messed up stat map")
 	}
 
 	var statKey = getStatNameFromSource(statStart-2, source)
 
+	if source[statStart] != '{' {
+		// An array written by WriteValue, not a stat map.
+		return defaultAns, nil
+	}
+
 	var statMap = make(map[string]interface{})
-	var err = json.Unmarshal(source[statStart:], &statMap)
+	err = decodeJSON(source[statStart:], &statMap)
 	if err != nil {
-		fmt.Printf("failed to unmarshal stats into map with err - %v\n\tstat source - %v\n",
-			err, source)
-		return defaultAns
+		return defaultAns, fmt.Errorf("failed to unmarshal stats into map with err - %v", err)
 	}
 
-	var prevStatMap map[string]interface{}
-	if prevStatInterface, keyExists := keyToStatsMap[statKey]; !keyExists {
+	if _, keyExists := keyToStatsMap[statKey]; !keyExists && !dropRemovedKeys(statMap) {
 		keyToStatsMap[statKey] = statMap
-		return defaultAns
+		return defaultAns, nil
+	}
+
+	statMap = reconstructStatMap(keyToStatsMap, statKey, statMap)
+
+	var newReconstructedStatBytes []byte
+	newReconstructedStatBytes, err = json.Marshal(statMap)
+	if err != nil {
+		return defaultAns, fmt.Errorf("failed to reconstruct %v with err - %v", statKey, err)
+	}
+
+	var ans = make([]byte, statStart, statStart+len(newReconstructedStatBytes)+1)
+	copy(ans, defaultAns[:statStart])
+	ans = append(ans, newReconstructedStatBytes...)
+	return ans, nil
+}
+
+// reconstructEncodedStatLine reconstructs a stat line, with the stats
+// encoded with enc. Unlike the JSON stats, located by matching the
+// brackets, the encoded stats are the last space separated field, after
+// the timestamp, the prefixFields fields and the stat type.
+func reconstructEncodedStatLine(keyToStatsMap map[string]interface{}, source []byte, enc Encoding,
+	prefixFields int) ([]byte, error) {
+
+	_, statKey, data, err := splitStatLine(source, prefixFields)
+	if err != nil {
+		return source, fmt.Errorf("messed up stat map")
+	}
+
+	if _, ok := enc.(JSONMarshalEncoding); ok && bytes.HasPrefix(data, []byte("[")) {
+		// An array written by WriteValue, not a stat map.
+		return source, nil
+	}
+
+	statMap, err := enc.Decode(data)
+	if err != nil {
+		return source, fmt.Errorf("failed to decode stats into map with err - %v", err)
+	}
+
+	if _, keyExists := keyToStatsMap[statKey]; !keyExists && !dropRemovedKeys(statMap) {
+		keyToStatsMap[statKey] = statMap
+		return source, nil
+	}
+
+	statMap = reconstructStatMap(keyToStatsMap, statKey, statMap)
+
+	var encoded []byte
+	encoded, err = enc.Encode(statMap)
+	if err != nil {
+		return source, fmt.Errorf("failed to reconstruct %v with err - %v", statKey, err)
+	}
+
+	var statStart = len(source) - len(data)
+	var ans = make([]byte, statStart, statStart+len(encoded)+1)
+	copy(ans, source[:statStart])
+	ans = append(ans, encoded...)
+	return ans, nil
+}
+
+// reconstructJSONLine reconstructs a stat line in the JSON Lines format,
+// refer WithJSONLines. The stats are encoded with enc, or as JSON if enc is
+// nil.
+func reconstructJSONLine(keyToStatsMap map[string]interface{}, source []byte, enc Encoding) ([]byte, error) {
+	jl, err := parseJSONLine(source)
+	if err != nil {
+		return source, fmt.Errorf("messed up stat map")
+	}
+	statKey, data := jl.Type, []byte(jl.Stat)
+
+	if keyToStatsMap == nil {
+		return source, nil
+	}
+
+	if bytes.HasPrefix(data, []byte("[")) {
+		// An array written by WriteValue, not a stat map.
+		return source, nil
+	}
+
+	if enc == nil {
+		enc = JSONEncoding{}
+	}
+
+	statMap, err := enc.Decode(data)
+	if err != nil {
+		return source, fmt.Errorf("failed to decode stats into map with err - %v", err)
+	}
+
+	if _, keyExists := keyToStatsMap[statKey]; !keyExists && !dropRemovedKeys(statMap) {
+		keyToStatsMap[statKey] = statMap
+		return source, nil
+	}
+
+	statMap = reconstructStatMap(keyToStatsMap, statKey, statMap)
+
+	var encoded []byte
+	encoded, err = enc.Encode(statMap)
+	if err != nil {
+		return source, fmt.Errorf("failed to reconstruct %v with err - %v", statKey, err)
+	}
+
+	return formatJSONLine(jl.TS, jl.Seq, statKey, encoded), nil
+}
+
+// reconstructStatMap fills in the stats of statMap, deduplicated against
+// the previous stats of type statKey, and records the full stats as the
+// previous stats for the next stat of the same type.
+func reconstructStatMap(keyToStatsMap map[string]interface{}, statKey string,
+	statMap map[string]interface{}) map[string]interface{} {
+
+	if prevStatInterface, keyExists := keyToStatsMap[statKey]; keyExists {
+		prevStatMap := prevStatInterface.(map[string]interface{})
+		mergeStatMaps(prevStatMap, statMap)
 	} else {
-		prevStatMap = prevStatInterface.(map[string]interface{})
+		// The keys removed since the stats preceding the ones read, e.g.
+		// when reading from a snapshot onwards.
+		dropRemovedKeys(statMap)
 	}
 
+	keyToStatsMap[statKey] = statMap
+	return statMap
+}
+
+// mergeStatMaps adds the stats from prevStatMap, which are missing in
+// statMap - except the ones listed as removed. Nested maps (e.g.
+// histograms) are merged recursively.
+func mergeStatMaps(prevStatMap, statMap map[string]interface{}) {
+	removed := make(map[string]bool)
+	if keys, ok := statMap[REMOVED_KEYS].([]interface{}); ok {
+		for _, key := range keys {
+			if k, ok := key.(string); ok {
+				removed[k] = true
+			}
+		}
+	}
+	delete(statMap, REMOVED_KEYS)
+
 	for key, stat := range prevStatMap {
-		if _, keyExists := statMap[key]; !keyExists {
+		if removed[key] {
+			continue
+		}
+
+		newStat, keyExists := statMap[key]
+		if !keyExists {
 			statMap[key] = stat
-		} else if oldHistMap, isMap := stat.(map[string]interface{}); isMap {
-			// oldVal is map aka histogram
-			var newHistmap = statMap[key].(map[string]interface{})
-			for keyRange, val := range oldHistMap {
-				if _, exists2 := newHistmap[keyRange]; !exists2 {
-					newHistmap[keyRange] = val
-				}
+			continue
+		}
+
+		oldNestedMap, isMap := stat.(map[string]interface{})
+		if !isMap {
+			if newNestedMap, isMap := newStat.(map[string]interface{}); isMap {
+				dropRemovedKeys(newNestedMap)
 			}
-			statMap[key] = newHistmap
+			continue
+		}
+
+		if newNestedMap, isMap := newStat.(map[string]interface{}); isMap {
+			mergeStatMaps(oldNestedMap, newNestedMap)
 		}
 	}
+}
 
-	keyToStatsMap[statKey] = statMap
+// dropRemovedKeys drops the keys listed as removed from statMap, at every
+// level of nesting, as there are no previous stats to remove them from.
+// Reports whether there were any.
+func dropRemovedKeys(statMap map[string]interface{}) bool {
+	_, dropped := statMap[REMOVED_KEYS]
+	delete(statMap, REMOVED_KEYS)
 
-	var newReconstructedStatBytes []byte
-	newReconstructedStatBytes, err = json.Marshal(statMap)
-	if err != nil {
-		fmt.Printf("failed to reconstruct %v-%v with err - \n\t%v\n", statKey, statMap, err)
-		return defaultAns
+	for _, stat := range statMap {
+		if nestedMap, isMap := stat.(map[string]interface{}); isMap {
+			dropped = dropRemovedKeys(nestedMap) || dropped
+		}
 	}
 
-	var ans = make([]byte, statStart, statStart+len(newReconstructedStatBytes)+1)
-	copy(ans, defaultAns[:statStart])
-	ans = append(ans, newReconstructedStatBytes...)
-	return ans
+	return dropped
 }
 
 func isValidStatLine(source []byte) bool {
@@ -172,111 +399,439 @@ func isValidStatLine(source []byte) bool {
 	return false
 }
 
-func ReconstructStatFile(sourceFile, outputFile *os.File) error {
-	var fileReadBuffer = make([]byte, 1024)
-	var lineBuffer = make([]byte, 0)
-	var offset = 0
-	var n int
+// ReconstructOptions configures ReconstructStatFileWithOptions.
+type ReconstructOptions struct {
+	// Workers is the number of goroutines reconstructing the stats. The
+	// lines are sharded across the workers by their stat type, as the
+	// stats of different types are reconstructed independently. Zero
+	// means a single worker.
+	Workers int
+
+	// BufferSize is the number of lines buffered between the reader, the
+	// workers and the writer, at each stage. As the lines may be large,
+	// a smaller buffer bounds the memory used, and a larger one smooths
+	// the bursts of slow lines. Zero means 10,000 lines.
+	BufferSize int
+
+	// Encoding of the stats, matching the Encoder of the LogStats object
+	// which wrote them. Nil means JSONEncoding.
+	Encoding Encoding
+
+	// PrefixFields is the number of fields between the timestamp and the
+	// stat type of each line, matching the WithLinePrefix fields of the
+	// LogStats object which wrote them.
+	PrefixFields int
+
+	// Types restricts the reconstruction to the stats of the given types.
+	// As the lines of a type are reconstructed from those of the same
+	// type only, the lines of the other types - and the lines without a
+	// stat map, e.g. the malformed ones - are simply left out of the
+	// output. Nil means all the lines.
+	Types []string
+
+	// Compact deduplicates the reconstructed stats again following the
+	// policy, refer CompactReconstruct. Nil means the full stats are
+	// written.
+	Compact *CompactPolicy
+}
+
+// Reconstructor reconstructs the deduplicated stat lines one at a time, in
+// the order of the source, keeping the previous stats of each type - e.g.
+// to reconstruct the lines of a bufio.Scanner loop, or of an HTTP response
+// being streamed. It is the core of ReconstructStatFileWithOptions, without
+// the workers. A Reconstructor is not safe for concurrent use.
+type Reconstructor struct {
+	enc           Encoding
+	prefixFields  int
+	types         map[string]bool
+	compactor     *statCompactor
+	keyToStatsMap map[string]interface{}
+}
+
+// NewReconstructor returns a Reconstructor configured by opts. The
+// Encoding, PrefixFields, Types and Compact options apply; Workers and
+// BufferSize do not.
+func NewReconstructor(opts ReconstructOptions) *Reconstructor {
+	r := &Reconstructor{
+		enc:           opts.Encoding,
+		prefixFields:  opts.PrefixFields,
+		keyToStatsMap: make(map[string]interface{}),
+	}
+
+	// the JSON stats are reconstructed without relying on the spaces in
+	// the timestamps
+	if _, ok := r.enc.(JSONEncoding); ok {
+		r.enc = nil
+	}
+
+	if opts.Types != nil {
+		r.types = make(map[string]bool, len(opts.Types))
+		for _, statType := range opts.Types {
+			r.types[statType] = true
+		}
+	}
+
+	if opts.Compact != nil {
+		r.compactor = newStatCompactor(*opts.Compact)
+	}
+
+	return r
+}
+
+// Write reconstructs the stat line, without its trailing new line, and
+// returns the line with the full stats of its type. A line which cannot be
+// reconstructed is returned as-is, along with the reason. The lines of the
+// types left out by ReconstructOptions.Types are returned as nil. The
+// returned line may share the memory of line.
+func (r *Reconstructor) Write(line []byte) ([]byte, error) {
+	if r.types != nil && !r.types[string(getStatType(line, r.enc, r.prefixFields))] {
+		return nil, nil
+	}
+
+	ans, err := reconstructStatLine(r.keyToStatsMap, line, r.enc, r.prefixFields)
+	if r.compactor != nil && err == nil {
+		ans, err = r.compactor.compact(ans, r.enc, r.prefixFields)
+	}
+
+	return ans, err
+}
+
+// Reset forgets the previous stats of all the types, e.g. at the start of
+// the next log file, as the deduplication resets on rotation.
+func (r *Reconstructor) Reset() {
+	r.keyToStatsMap = make(map[string]interface{})
+	if r.compactor != nil {
+		r.compactor = newStatCompactor(r.compactor.policy)
+	}
+}
+
+// reconstructedLine is a line passed through the reconstruction pipeline.
+// seq is the 0-based position of the line among the lines reconstructed,
+// used to restore the order of the lines reconstructed by different
+// workers, and num its 1-based line number in the source.
+type reconstructedLine struct {
+	seq  int
+	num  int
+	line []byte
+	err  error
+}
+
+// ReconstructStatFile reconstructs the deduplicated stats read from source
+// and writes the full stats to output, using a single worker. See
+// ReconstructStatFileWithOptions.
+func ReconstructStatFile(source io.Reader, output io.Writer) error {
+	return ReconstructStatFileWithOptions(source, output, ReconstructOptions{})
+}
+
+// ReconstructStatFileWithOptions reconstructs the deduplicated stats read
+// from source and writes the full stats to output, in the order of the
+// source. The lines which cannot be reconstructed are written as-is, and
+// reported by a *ReconstructError once all the lines are processed. A gzip
+// or zstd compressed source is detected from its magic bytes, and
+// decompressed transparently - a gzip source cut short, e.g. the compressed
+// current log file, up to the cut. The CRLF terminated lines are read as
+// well, and written LF terminated. If output has a Sync method, it gets
+// synced periodically.
+func ReconstructStatFileWithOptions(source io.Reader, output io.Writer, opts ReconstructOptions) error {
+	var reader = bufio.NewReader(source)
+	if compression := detectCompression(reader); compression != CompressionNone {
+		decompressor, err := newDecompressReader(reader, compression, nil)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+
+		if compression == CompressionGzip {
+			// The compressed current log file is yet to be completed.
+			decompressor = truncatedGzipReader{decompressor}
+		}
+
+		reader = bufio.NewReader(decompressor)
+	}
+
+	var workers = opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var bufferSize = opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 10_000
+	}
+
+	// the JSON stats are reconstructed without relying on the spaces in
+	// the timestamps
+	var enc = opts.Encoding
+	if _, ok := enc.(JSONEncoding); ok {
+		enc = nil
+	}
+
 	var totalLines = 0
-	var keyToStatsMap = make(map[string]interface{})
 
-	var closeWait sync.WaitGroup
-	var lineCh = make(chan []byte, 10_000)
-	var outCh = make(chan []byte, 10_000)
+	var closeWait, workerWait sync.WaitGroup
+	var lineChs = make([]chan reconstructedLine, workers)
+	var outCh = make(chan reconstructedLine, bufferSize)
 
-	var globalErr error
+	var readErr, writeErr error
+	var lineErrs []*LineError
 
-	// parser
-	closeWait.Add(1)
-	go func() {
-		defer closeWait.Done()
-		for line := range lineCh {
-			var outputBuffer = ReconstructStatLine(keyToStatsMap, line)
+	// parsers, each with the stats of its own stat types
+	for i := range lineChs {
+		lineChs[i] = make(chan reconstructedLine, bufferSize/workers+1)
 
-			if outputBuffer != nil {
-				outputBuffer = append(outputBuffer, '\n')
+		workerWait.Add(1)
+		go func(lineCh chan reconstructedLine) {
+			defer workerWait.Done()
 
-				outCh <- outputBuffer
+			// the lines are filtered by type before the dispatch
+			var workerOpts = opts
+			workerOpts.Types = nil
+			var reconstructor = NewReconstructor(workerOpts)
 
-			} else {
-				fmt.Printf("parsed full line %v\n", string(line))
+			for l := range lineCh {
+				l.line, l.err = reconstructor.Write(l.line)
+				outCh <- l
 			}
-		}
+		}(lineChs[i])
+	}
 
+	go func() {
+		workerWait.Wait()
 		close(outCh)
 	}()
 
 	// writer
 	closeWait.Add(1)
 	go func() {
-		var err error
-
 		defer closeWait.Done()
 
-		for outputBuffer := range outCh {
-			_, err = outputFile.Write(outputBuffer)
-			if err != nil {
-				globalErr = fmt.Errorf(
-					"failed to write to dest file %v with err %v",
-					outputFile.Name(),
-					err,
-				)
-				break
+		syncer, _ := output.(interface{ Sync() error })
 
-			}
+		// the lines reconstructed ahead of their turn
+		var pending = make(map[int]reconstructedLine)
+		var next = 0
+
+		for l := range outCh {
+			pending[l.seq] = l
+
+			for {
+				l, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				next++
 
-			totalLines++
-			if totalLines%10_000 == 0 {
-				_ = outputFile.Sync()
-				if totalLines != 10_000 {
-					// deletes previous line
-					fmt.Printf("\033[1A\033[K")
+				if l.err != nil {
+					lineErrs = append(lineErrs, &LineError{Line: l.num, Reason: l.err.Error()})
+				}
+
+				// keep draining outCh after a failure, so that the
+				// parsers and the reader are not blocked
+				if writeErr != nil {
+					continue
+				}
+
+				_, err := output.Write(append(l.line, '\n'))
+				if err != nil {
+					writeErr = fmt.Errorf("failed to write to dest with err %v", err)
+					continue
+				}
+
+				totalLines++
+				if totalLines%10_000 == 0 && syncer != nil {
+					_ = syncer.Sync()
 				}
-				fmt.Printf("%v stat lines parsed\n", totalLines)
 			}
 		}
-
-		fmt.Printf("total lines parsed - %v\n", totalLines)
 	}()
 
+	var types map[string]bool
+	if opts.Types != nil {
+		types = make(map[string]bool, len(opts.Types))
+		for _, statType := range opts.Types {
+			types[statType] = true
+		}
+	}
+
 	// reader
-	var err error
+	var seq, num = 0, 0
+	var dispatch = func(line []byte) {
+		num++
+		if types != nil && !types[string(getStatType(line, enc, opts.PrefixFields))] {
+			return
+		}
+
+		lineChs[getStatShard(line, workers, enc, opts.PrefixFields)] <- reconstructedLine{seq: seq, num: num, line: line}
+		seq++
+	}
+
 	for {
-		n, err = sourceFile.ReadAt(fileReadBuffer, int64(offset))
-		if err != nil && err != io.EOF {
-			globalErr = err
-			break
+		line, err := reader.ReadBytes('\n')
+		if err == nil {
+			// the CRLF line endings, e.g. of a log file edited on
+			// Windows, are written back as LF
+			line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+			dispatch(line)
+			continue
 		}
-		var parsedBuffer []byte
-		var completeLine bool
 
-		for len(fileReadBuffer) > 0 {
-			completeLine, parsedBuffer = parseBufferTillNewLine(fileReadBuffer)
-			var lenOfCharsParsed = len(parsedBuffer)
+		if len(line) > 0 {
+			// last line, not terminated by a new line
+			dispatch(line)
+		}
+		if err != io.EOF {
+			readErr = err
+		}
+		break
+	}
 
-			lineBuffer = append(lineBuffer, parsedBuffer...)
+	for _, lineCh := range lineChs {
+		close(lineCh)
+	}
+	closeWait.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if len(lineErrs) > 0 {
+		return &ReconstructError{Errors: lineErrs}
+	}
+	return nil
+}
 
-			if completeLine {
-				// len of parsed buffer + 1 because we also read `\n`
-				lenOfCharsParsed++
+// getStatShard returns the worker, out of workers, reconstructing the
+// stat line. All the lines of a stat type go to the same worker. The lines
+// without a stat map go to the first worker.
+func getStatShard(line []byte, workers int, enc Encoding, prefixFields int) int {
+	if workers == 1 {
+		return 0
+	}
 
-				lineCh <- lineBuffer
+	var statType = getStatType(line, enc, prefixFields)
+	if statType == nil {
+		return 0
+	}
 
-				lineBuffer = make([]byte, 0)
-			}
+	var h = fnv.New32a()
+	h.Write(statType)
+	return int(h.Sum32() % uint32(workers))
+}
 
-			fileReadBuffer = fileReadBuffer[lenOfCharsParsed:]
+// getStatType returns the stat type of the stat line, or nil for the lines
+// without a stat map. The stat type is the word preceding the stat map,
+// i.e. the first " {" of the line - or, for the stats encoded with enc,
+// the space separated field after the timestamp and the prefixFields
+// fields, and for the JSON Lines, the "type" field.
+func getStatType(line []byte, enc Encoding, prefixFields int) []byte {
+	if isJSONLine(line) || enc != nil {
+		_, statType, _, err := splitStatLine(line, prefixFields)
+		if err != nil {
+			return nil
 		}
+		return []byte(statType)
+	}
 
-		fileReadBuffer = make([]byte, 1024)
-		offset += n
-		if err == io.EOF {
-			break
+	var end = bytes.Index(line, []byte(" {"))
+	if end < 0 {
+		return nil
+	}
+	return line[bytes.LastIndexByte(line[:end], ' ')+1 : end]
+}
+
+// VerifyReconstruction checks that the stats survive the deduplication
+// followed by the reconstruction unchanged. original holds the full stat
+// lines, in the "<timestamp> <type> <stats>" format, with JSON encoded
+// stats and no spaces in the timestamps. The stats are written by a
+// deduplicating logger to a temporary log file, which is then
+// reconstructed. Returns an error describing the first stat reconstructed
+// differently.
+func VerifyReconstruction(original [][]byte) error {
+	types := make([]string, 0, len(original))
+	stats := make([]map[string]interface{}, 0, len(original))
+	for i, line := range original {
+		statType, stat, err := parseFullStatLine(line)
+		if err != nil {
+			return fmt.Errorf("VerifyReconstruction: Invalid original line %v: %v", i+1, err)
 		}
+
+		types = append(types, statType)
+		stats = append(stats, stat)
 	}
 
-	close(lineCh)
-	closeWait.Wait()
+	dir, err := os.MkdirTemp("", "logstats_verify")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "verify.log")
+	lst, err := New(fileName, WithDedupe(true), WithSizeLimit(math.MaxInt),
+		WithCompression(CompressionNone))
+	if err != nil {
+		return err
+	}
+
+	for i, stat := range stats {
+		err = lst.Write(types[i], stat)
+		if err != nil {
+			lst.Close()
+			return err
+		}
+	}
+
+	err = lst.Close()
+	if err != nil {
+		return err
+	}
+
+	deduped, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer deduped.Close()
+
+	var output bytes.Buffer
+	err = ReconstructStatFile(deduped, &output)
+	if err != nil {
+		return err
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(output.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != len(stats) {
+		return fmt.Errorf("VerifyReconstruction: Reconstructed %v lines out of %v", len(lines), len(stats))
+	}
+
+	for i, line := range lines {
+		statType, stat, err := parseFullStatLine(line)
+		if err != nil {
+			return fmt.Errorf("VerifyReconstruction: Invalid reconstructed line %v: %v", i+1, err)
+		}
+
+		if statType != types[i] || !reflect.DeepEqual(stat, stats[i]) {
+			return fmt.Errorf("VerifyReconstruction: Line %v reconstructed as %v %v instead of %v %v",
+				i+1, statType, stat, types[i], stats[i])
+		}
+	}
+
+	return nil
+}
+
+// parseFullStatLine returns the type and the JSON decoded stats of a stat
+// line, assuming no spaces in the timestamp, in either format.
+func parseFullStatLine(line []byte) (string, map[string]interface{}, error) {
+	_, statType, data, err := splitStatLine(line, 0)
+	if err != nil {
+		return "", nil, err
+	}
+
+	stat, err := JSONEncoding{}.Decode(data)
+	if err != nil {
+		return "", nil, err
+	}
 
-	return globalErr
+	return statType, stat, nil
 }
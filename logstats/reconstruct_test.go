@@ -0,0 +1,900 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReconstructRemovedKeys(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "reconstruct_removed_keys.log")
+	outputName := filepath.Join(tmpDir, "reconstruct_removed_keys_out.log")
+
+	err := cleanup([]string{fileName, outputName})
+	if err != nil {
+		t.Fatalf("TestReconstructRemovedKeys failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestReconstructRemovedKeys failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// The key k2 vanishes in the second stat, and k31 in the third one.
+	exp := make([]map[string]interface{}, 0)
+
+	stat := getSimpleStat(0)
+	exp = append(exp, stat)
+
+	stat = getSimpleStat(0)
+	stat["k1"] = int64(20)
+	delete(stat, "k2")
+	exp = append(exp, stat)
+
+	stat = getSimpleStat(0)
+	stat["k1"] = int64(20)
+	delete(stat, "k2")
+	delete(stat["k4"].(map[string]interface{}), "k31")
+	exp = append(exp, stat)
+
+	for _, stat := range exp {
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestReconstructRemovedKeys failed with error %v", err)
+		}
+	}
+
+	err = verifyReconstruction(exp, fileName, outputName)
+	if err != nil {
+		t.Fatalf("TestReconstructRemovedKeys failed with error %v", err)
+	}
+}
+
+func TestReconstructFromReader(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "reconstruct_from_reader.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestReconstructFromReader failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestReconstructFromReader failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 10; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i % 3)
+		exp = append(exp, stat)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestReconstructFromReader failed with error %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestReconstructFromReader failed with error %v", err)
+	}
+
+	// Reconstruct from memory to memory, reading a byte at a time to
+	// exercise the partial reads.
+	var output bytes.Buffer
+	err = ReconstructStatFile(iotest.OneByteReader(bytes.NewReader(data)), &output)
+	if err != nil {
+		t.Fatalf("TestReconstructFromReader failed with error %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	err = verifyReconstructedLines(exp, lines)
+	if err != nil {
+		t.Fatalf("TestReconstructFromReader failed with error %v", err)
+	}
+}
+
+func TestReconstructCRLF(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "reconstruct_crlf.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestReconstructCRLF failed with error %v", err)
+	}
+
+	var statLogger LogStats
+	statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		t.Fatalf("TestReconstructCRLF failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0)
+	for i := 0; i < 10; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i % 3)
+		exp = append(exp, stat)
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestReconstructCRLF failed with error %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestReconstructCRLF failed with error %v", err)
+	}
+
+	var output bytes.Buffer
+	err = ReconstructStatFile(bytes.NewReader(data), &output)
+	if err != nil {
+		t.Fatalf("TestReconstructCRLF failed with error %v", err)
+	}
+
+	// The log file as edited on Windows, reconstructed into the same
+	// LF terminated lines.
+	var crlfOutput bytes.Buffer
+	crlf := bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	err = ReconstructStatFile(bytes.NewReader(crlf), &crlfOutput)
+	if err != nil {
+		t.Fatalf("TestReconstructCRLF failed with error %v", err)
+	}
+
+	if !bytes.Equal(crlfOutput.Bytes(), output.Bytes()) {
+		t.Fatalf("TestReconstructCRLF failed: reconstructed %q, expected %q",
+			crlfOutput.String(), output.String())
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	err = verifyReconstructedLines(exp, lines)
+	if err != nil {
+		t.Fatalf("TestReconstructCRLF failed with error %v", err)
+	}
+}
+
+func TestReconstructCompressed(t *testing.T) {
+	for _, compression := range []CompressionType{CompressionGzip, CompressionZstd} {
+		// Create a stats logger
+		tmpDir := os.TempDir()
+		fileName := filepath.Join(tmpDir, "reconstruct_compressed.log")
+		compressedName := fileName + compression.Suffix()
+		outputName := filepath.Join(tmpDir, "reconstruct_compressed_out.log")
+
+		err := cleanup([]string{fileName, outputName})
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed with error %v", err)
+		}
+
+		var statLogger LogStats
+		statLogger, err = NewDedupeLogStats(fileName, 1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed with error %v", err)
+		}
+
+		exp := make([]map[string]interface{}, 0)
+		for i := 0; i < 10; i++ {
+			stat := getSimpleStat(0)
+			stat["k1"] = int64(i % 3)
+			exp = append(exp, stat)
+
+			err = statLogger.Write("kStats", stat)
+			if err != nil {
+				t.Fatalf("TestReconstructCompressed failed with error %v", err)
+			}
+		}
+
+		statLogger.Close()
+
+		// Compress the deduplicated stats.
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed with error %v", err)
+		}
+
+		var compressed bytes.Buffer
+		w, err := newCompressWriter(&compressed, compression, gzip.DefaultCompression, nil)
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed with error %v", err)
+		}
+
+		_, err = w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed with error %v", err)
+		}
+
+		err = os.WriteFile(compressedName, compressed.Bytes(), 0644)
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed with error %v", err)
+		}
+
+		// The compression is detected from the content, not the file name.
+		err = verifyReconstruction(exp, compressedName, outputName)
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed for %v with error %v", compression, err)
+		}
+
+		var output bytes.Buffer
+		err = ReconstructStatFile(&compressed, &output)
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed with error %v", err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+		err = verifyReconstructedLines(exp, lines)
+		if err != nil {
+			t.Fatalf("TestReconstructCompressed failed for %v with error %v", compression, err)
+		}
+	}
+}
+
+func TestReconstructStatLines(t *testing.T) {
+	lines := [][]byte{
+		[]byte(`2024-01-01T00:00:00.000+00:00 kStats {"k1":1,"k2":2,"k3":3}`),
+		[]byte(`2024-01-01T00:00:00.000+00:00 iStats {"i1":1}`),
+		[]byte(`2024-01-01T00:00:01.000+00:00 kStats {"k1":2,"__removed__":["k3"]}`),
+		[]byte(`2024-01-01T00:00:01.000+00:00 iStats {"i2":2}`),
+		[]byte(`2024-01-01T00:00:02.000+00:00 kStats {"k2":3`),
+		[]byte(`2024-01-01T00:00:02.000+00:00 kStats {}`),
+	}
+
+	exp := []string{
+		`2024-01-01T00:00:00.000+00:00 kStats {"k1":1,"k2":2,"k3":3}`,
+		`2024-01-01T00:00:00.000+00:00 iStats {"i1":1}`,
+		`2024-01-01T00:00:01.000+00:00 kStats {"k1":2,"k2":2}`,
+		`2024-01-01T00:00:01.000+00:00 iStats {"i1":1,"i2":2}`,
+		`2024-01-01T00:00:02.000+00:00 kStats {"k2":3`,
+		`2024-01-01T00:00:02.000+00:00 kStats {"k1":2,"k2":2}`,
+	}
+
+	reconstructed, err := ReconstructStatLines(lines)
+
+	var reconstructErr *ReconstructError
+	if !errors.As(err, &reconstructErr) || len(reconstructErr.Errors) != 1 ||
+		reconstructErr.Errors[0].Line != 5 {
+		t.Fatalf("TestReconstructStatLines failed with error %v", err)
+	}
+
+	if len(reconstructed) != len(exp) {
+		t.Fatalf("TestReconstructStatLines failed, exp %v lines actual %v",
+			len(exp), len(reconstructed))
+	}
+
+	for i, line := range reconstructed {
+		if string(line) != exp[i] {
+			t.Fatalf("TestReconstructStatLines failed for line %v, exp %v actual %v",
+				i, exp[i], string(line))
+		}
+	}
+}
+
+func TestReconstructBracketsInStrings(t *testing.T) {
+	lines := [][]byte{
+		[]byte(`2024-01-01T00:00:00.000+00:00 kStats {"k1":"a]b","k2":"{[(","k3":{"n":"x\"]"}}`),
+		[]byte(`2024-01-01T00:00:01.000+00:00 kStats {"k1":"c)d\\","k3":{"n":"}"}}`),
+		[]byte(`2024-01-01T00:00:02.000+00:00 kStats {"k2":")]}"}`),
+	}
+
+	exp := []string{
+		`2024-01-01T00:00:00.000+00:00 kStats {"k1":"a]b","k2":"{[(","k3":{"n":"x\"]"}}`,
+		`2024-01-01T00:00:01.000+00:00 kStats {"k1":"c)d\\","k2":"{[(","k3":{"n":"}"}}`,
+		`2024-01-01T00:00:02.000+00:00 kStats {"k1":"c)d\\","k2":")]}","k3":{"n":"}"}}`,
+	}
+
+	reconstructed, err := ReconstructStatLines(lines)
+	if err != nil {
+		t.Fatalf("TestReconstructBracketsInStrings failed with error %v", err)
+	}
+
+	for i, line := range reconstructed {
+		if string(line) != exp[i] {
+			t.Fatalf("TestReconstructBracketsInStrings failed for line %v, exp %v actual %v",
+				i, exp[i], string(line))
+		}
+	}
+
+	// The histograms printed as [) still balance, outside the strings.
+	line := []byte(`2024-01-01T00:00:00.000+00:00 kStats {"h":[0 10),"s":"[)"}`)
+	start, err := extractStatsFromLine(line)
+	if err != nil {
+		t.Fatalf("TestReconstructBracketsInStrings failed with error %v", err)
+	}
+
+	if string(line[start:]) != `{"h":[0 10),"s":"[)"}` {
+		t.Fatalf("TestReconstructBracketsInStrings failed, unexpected stats %s", line[start:])
+	}
+}
+
+func TestReconstructor(t *testing.T) {
+	source := strings.Join([]string{
+		`2024-01-01T00:00:00.000+00:00 kStats {"k1":1,"k2":2,"k3":3}`,
+		`2024-01-01T00:00:00.000+00:00 iStats {"i1":1}`,
+		`2024-01-01T00:00:01.000+00:00 kStats {"k1":2,"__removed__":["k3"]}`,
+		`2024-01-01T00:00:01.000+00:00 kStats {"k2":3`,
+		`2024-01-01T00:00:01.000+00:00 iStats {"i2":2}`,
+		`2024-01-01T00:00:02.000+00:00 kStats {}`,
+	}, "\n")
+
+	exp := []string{
+		`2024-01-01T00:00:00.000+00:00 kStats {"k1":1,"k2":2,"k3":3}`,
+		`2024-01-01T00:00:00.000+00:00 iStats {"i1":1}`,
+		`2024-01-01T00:00:01.000+00:00 kStats {"k1":2,"k2":2}`,
+		`2024-01-01T00:00:01.000+00:00 kStats {"k2":3`,
+		`2024-01-01T00:00:01.000+00:00 iStats {"i1":1,"i2":2}`,
+		`2024-01-01T00:00:02.000+00:00 kStats {"k1":2,"k2":2}`,
+	}
+
+	// Line by line, as the lines are read.
+	reconstructor := NewReconstructor(ReconstructOptions{})
+	scanner := bufio.NewScanner(strings.NewReader(source))
+	for i := 0; scanner.Scan(); i++ {
+		line, err := reconstructor.Write(scanner.Bytes())
+		if (err != nil) != (i == 3) {
+			t.Fatalf("TestReconstructor failed for line %v with error %v", i, err)
+		}
+
+		if string(line) != exp[i] {
+			t.Fatalf("TestReconstructor failed for line %v, exp %v actual %s", i, exp[i], line)
+		}
+	}
+
+	// The previous stats are forgotten on Reset.
+	reconstructor.Reset()
+	line, err := reconstructor.Write([]byte(`2024-01-01T00:00:03.000+00:00 iStats {"i3":3}`))
+	if err != nil || string(line) != `2024-01-01T00:00:03.000+00:00 iStats {"i3":3}` {
+		t.Fatalf("TestReconstructor failed after Reset, line %s error %v", line, err)
+	}
+
+	// The lines of the other types are left out.
+	reconstructor = NewReconstructor(ReconstructOptions{Types: []string{"iStats"}})
+	var filtered []string
+	scanner = bufio.NewScanner(strings.NewReader(source))
+	for scanner.Scan() {
+		line, err := reconstructor.Write(scanner.Bytes())
+		if err != nil {
+			t.Fatalf("TestReconstructor failed with error %v", err)
+		}
+
+		if line != nil {
+			filtered = append(filtered, string(line))
+		}
+	}
+
+	if !reflect.DeepEqual(filtered, []string{exp[1], exp[4]}) {
+		t.Fatalf("TestReconstructor failed, unexpected lines %v", filtered)
+	}
+}
+
+func TestVerifyReconstruction(t *testing.T) {
+	sequences := [][]string{
+		// Changed, removed and added keys
+		{
+			`2024-01-01T00:00:00Z kStats {"k1":1,"k2":"v2","k3":true}`,
+			`2024-01-01T00:00:01Z kStats {"k1":2,"k2":"v2"}`,
+			`2024-01-01T00:00:02Z kStats {"k1":2,"k3":false}`,
+			`2024-01-01T00:00:03Z kStats {}`,
+			`2024-01-01T00:00:04Z kStats {"k1":2}`,
+		},
+		// Floats, arrays and nulls
+		{
+			`2024-01-01T00:00:00Z fStats {"f1":1.5,"a1":[1,2,3],"n1":null}`,
+			`2024-01-01T00:00:01Z fStats {"f1":1.5000001,"a1":[1,2,3],"n1":null}`,
+			`2024-01-01T00:00:02Z fStats {"f1":1.5000001,"a1":[1,2],"n1":1}`,
+			`2024-01-01T00:00:03Z fStats {"f1":-0.25,"a1":[],"n1":null}`,
+		},
+		// Nested maps, replaced by scalars and back, interleaved types
+		{
+			`2024-01-01T00:00:00Z kStats {"k1":{"k11":1,"k12":{"k121":"a"}}}`,
+			`2024-01-01T00:00:00Z iStats {"i1":{"i11":1}}`,
+			`2024-01-01T00:00:01Z kStats {"k1":{"k11":1,"k12":{}}}`,
+			`2024-01-01T00:00:01Z iStats {"i1":7}`,
+			`2024-01-01T00:00:02Z kStats {"k1":{"k12":{"k121":"b"}}}`,
+			`2024-01-01T00:00:02Z iStats {"i1":{"i11":1}}`,
+			`2024-01-01T00:00:03Z kStats {"k1":{"k11":1,"k12":{"k121":"b"}}}`,
+		},
+	}
+
+	// The verification writes nothing to the stdout of the caller.
+	stdout, err := os.CreateTemp("", "verify_reconstruction_stdout")
+	if err != nil {
+		t.Fatalf("TestVerifyReconstruction failed with error %v", err)
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+
+	origStdout := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = origStdout }()
+
+	for i, sequence := range sequences {
+		original := make([][]byte, 0, len(sequence))
+		for _, line := range sequence {
+			original = append(original, []byte(line))
+		}
+
+		err = VerifyReconstruction(original)
+		if err != nil {
+			t.Fatalf("TestVerifyReconstruction failed for sequence %v with error %v", i, err)
+		}
+	}
+
+	os.Stdout = origStdout
+	fi, err := stdout.Stat()
+	if err != nil || fi.Size() != 0 {
+		t.Fatalf("TestVerifyReconstruction failed: output written to stdout, error %v", err)
+	}
+
+	err = VerifyReconstruction([][]byte{[]byte("garbage")})
+	if err == nil {
+		t.Fatalf("TestVerifyReconstruction failed: invalid original line accepted")
+	}
+}
+
+func TestReconstructLineErrors(t *testing.T) {
+	source := strings.Join([]string{
+		`2024-01-01T00:00:00.000+00:00 kStats {"k1":1,"k2":2}`,
+		`2024-01-01T00:00:01.000+00:00 kStats {"k1":2`,
+		`garbage`,
+		`2024-01-01T00:00:02.000+00:00 kStats {"k1":3}`,
+	}, "\n") + "\n"
+
+	var output bytes.Buffer
+	err := ReconstructStatFile(strings.NewReader(source), &output)
+
+	var reconstructErr *ReconstructError
+	if !errors.As(err, &reconstructErr) {
+		t.Fatalf("TestReconstructLineErrors failed, expected a ReconstructError but got %v", err)
+	}
+
+	lines := make([]int, 0)
+	for _, lineErr := range reconstructErr.Errors {
+		lines = append(lines, lineErr.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{2, 3}) {
+		t.Fatalf("TestReconstructLineErrors failed, unexpected line errors %v", reconstructErr.Errors)
+	}
+
+	// The malformed lines are passed through, and the rest reconstructed.
+	exp := strings.Join([]string{
+		`2024-01-01T00:00:00.000+00:00 kStats {"k1":1,"k2":2}`,
+		`2024-01-01T00:00:01.000+00:00 kStats {"k1":2`,
+		`garbage`,
+		`2024-01-01T00:00:02.000+00:00 kStats {"k1":3,"k2":2}`,
+	}, "\n") + "\n"
+	if output.String() != exp {
+		t.Fatalf("TestReconstructLineErrors failed, exp %v actual %v", exp, output.String())
+	}
+}
+
+func TestReconstructMalformedLines(t *testing.T) {
+	lines := []string{
+		"123 type {",
+		"123 type [",
+		"123 type (",
+		"123 type ]}",
+		"123 type [}",
+		"123 type {)}",
+		"123 {",
+	}
+
+	for _, line := range lines {
+		keyToStatsMap := map[string]interface{}{
+			"type": map[string]interface{}{"k1": float64(1)},
+		}
+
+		out, err := reconstructStatLine(keyToStatsMap, []byte(line), nil, 0)
+		if err == nil {
+			t.Fatalf("TestReconstructMalformedLines failed, expected an error for line %v", line)
+		}
+
+		if string(out) != line {
+			t.Fatalf("TestReconstructMalformedLines failed, line %v not passed through, got %v",
+				line, string(out))
+		}
+	}
+
+	// The whole file gets processed, without taking down the parser.
+	var output bytes.Buffer
+	source := strings.Join(lines, "\n") + "\n"
+	err := ReconstructStatFile(strings.NewReader(source), &output)
+
+	var reconstructErr *ReconstructError
+	if !errors.As(err, &reconstructErr) || len(reconstructErr.Errors) != len(lines) {
+		t.Fatalf("TestReconstructMalformedLines failed with error %v", err)
+	}
+
+	if output.String() != source {
+		t.Fatalf("TestReconstructMalformedLines failed, exp %v actual %v", source, output.String())
+	}
+}
+
+func TestReconstructWorkers(t *testing.T) {
+	fileName := filepath.Join(os.TempDir(), "reconstruct_workers.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestReconstructWorkers failed with error %v", err)
+	}
+
+	data, exp, err := getDedupedStats(fileName, 8, 100)
+	if err != nil {
+		t.Fatalf("TestReconstructWorkers failed with error %v", err)
+	}
+
+	for _, workers := range []int{1, 3, 8} {
+		// The buffers as small as a single line still make progress.
+		for _, bufferSize := range []int{0, 1} {
+			var output bytes.Buffer
+			err = ReconstructStatFileWithOptions(bytes.NewReader(data), &output,
+				ReconstructOptions{Workers: workers, BufferSize: bufferSize})
+			if err != nil {
+				t.Fatalf("TestReconstructWorkers failed with error %v", err)
+			}
+
+			// The lines are written in the source order, whatever the
+			// worker reconstructing them.
+			lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+			err = verifyReconstructedLines(exp, lines)
+			if err != nil {
+				t.Fatalf("TestReconstructWorkers failed for %v workers and buffer size %v with error %v",
+					workers, bufferSize, err)
+			}
+		}
+	}
+}
+
+func TestReconstructTypes(t *testing.T) {
+	// Create a stats logger
+	tmpDir := os.TempDir()
+	fileName := filepath.Join(tmpDir, "reconstruct_types.log")
+
+	err := cleanup([]string{fileName})
+	if err != nil {
+		t.Fatalf("TestReconstructTypes failed with error %v", err)
+	}
+
+	numTypes := 3
+	data, all, err := getDedupedStats(fileName, numTypes, 10)
+	if err != nil {
+		t.Fatalf("TestReconstructTypes failed with error %v", err)
+	}
+
+	// The malformed lines are left out along with the other types.
+	data = append([]byte("malformed line\n"), data...)
+
+	for _, workers := range []int{1, 2} {
+		var output bytes.Buffer
+		err = ReconstructStatFileWithOptions(bytes.NewReader(data), &output,
+			ReconstructOptions{Workers: workers, Types: []string{"type1", "type2"}})
+		if err != nil {
+			t.Fatalf("TestReconstructTypes failed with error %v", err)
+		}
+
+		exp := make([]map[string]interface{}, 0)
+		for i, stat := range all {
+			if i%numTypes != 0 {
+				exp = append(exp, stat)
+			}
+		}
+
+		lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+		err = verifyReconstructedLines(exp, lines)
+		if err != nil {
+			t.Fatalf("TestReconstructTypes failed with error %v", err)
+		}
+
+		for _, line := range lines {
+			if strings.Contains(line, " type0 ") {
+				t.Fatalf("TestReconstructTypes failed: unexpected line %v", line)
+			}
+		}
+	}
+
+	// The line numbers of the errors are those of the source.
+	var output bytes.Buffer
+	err = ReconstructStatFileWithOptions(strings.NewReader(string(data)+"2024-01-01T00:00:00Z type1 {\"k1\":\n"),
+		&output, ReconstructOptions{Types: []string{"type1"}})
+
+	var reconstructErr *ReconstructError
+	if !errors.As(err, &reconstructErr) || reconstructErr.Errors[0].Line != 2+numTypes*10 {
+		t.Fatalf("TestReconstructTypes failed: unexpected error %v", err)
+	}
+}
+
+func TestCompactReconstructFloatDrift(t *testing.T) {
+	// The full stats of a stat drifting by less than epsilon per line.
+	epsilon := 0.1
+	var source bytes.Buffer
+	values := make([]float64, 0)
+	for i := 0; i < 20; i++ {
+		v := 1.0 + 0.03*float64(i)
+		values = append(values, v)
+		fmt.Fprintf(&source, "2024-01-01T00:00:%02dZ kStats {\"f\":%v}\n", i, v)
+	}
+
+	var output bytes.Buffer
+	err := CompactReconstruct(&source, &output, CompactPolicy{FloatEpsilon: epsilon})
+	if err != nil {
+		t.Fatalf("TestCompactReconstructFloatDrift failed with error %v", err)
+	}
+
+	// The value is logged again once it differs from the value logged
+	// last by more than epsilon.
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != len(values) {
+		t.Fatalf("TestCompactReconstructFloatDrift failed: %v lines", len(lines))
+	}
+
+	logged := values[0]
+	for i, line := range lines {
+		exp := "{}"
+		if i == 0 || values[i]-logged > epsilon {
+			exp = fmt.Sprintf("{\"f\":%v}", values[i])
+			logged = values[i]
+		}
+
+		if !strings.HasSuffix(line, " kStats "+exp) {
+			t.Fatalf("TestCompactReconstructFloatDrift failed: line %q, expected stats %v", line, exp)
+		}
+	}
+}
+
+func TestCompactReconstructRemovedKeys(t *testing.T) {
+	// The deduplicated stats, compacted with a snapshot of the third
+	// stats, with the key b removed.
+	source := strings.Join([]string{
+		`2024-01-01T00:00:00Z kStats {"a":1,"b":2}`,
+		`2024-01-01T00:00:01Z kStats {}`,
+		`2024-01-01T00:00:02Z kStats {"__removed__":["b"]}`,
+		`2024-01-01T00:00:03Z kStats {"a":3}`,
+	}, "\n") + "\n"
+
+	var compacted bytes.Buffer
+	err := CompactReconstruct(strings.NewReader(source), &compacted, CompactPolicy{SnapshotEvery: 2})
+	if err != nil {
+		t.Fatalf("TestCompactReconstructRemovedKeys failed with error %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(compacted.String(), "\n"), "\n")
+	if len(lines) != 4 || lines[2] != `2024-01-01T00:00:02Z kStats {"__removed__":["b"],"a":1}` {
+		t.Fatalf("TestCompactReconstructRemovedKeys failed: compacted %q", lines)
+	}
+
+	// The removed key stays removed in the reconstruction.
+	var output bytes.Buffer
+	err = ReconstructStatFile(&compacted, &output)
+	if err != nil {
+		t.Fatalf("TestCompactReconstructRemovedKeys failed with error %v", err)
+	}
+
+	exp := []map[string]interface{}{
+		{"a": int64(1), "b": int64(2)},
+		{"a": int64(1), "b": int64(2)},
+		{"a": int64(1)},
+		{"a": int64(3)},
+	}
+
+	lines = strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	err = verifyReconstructedLines(exp, lines)
+	if err != nil {
+		t.Fatalf("TestCompactReconstructRemovedKeys failed with error %v", err)
+	}
+}
+
+func TestCompactReconstruct(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "compact_reconstruct")
+	if err != nil {
+		t.Fatalf("TestCompactReconstruct failed with error %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The same stats, deduplicated with and without periodic snapshots.
+	writeStats := func(fileName string, opts ...Option) []byte {
+		statLogger, err := New(fileName, append(opts, WithDedupe(true))...)
+		if err != nil {
+			t.Fatalf("TestCompactReconstruct failed with error %v", err)
+		}
+		defer statLogger.Close()
+
+		for i := 0; i < 10; i++ {
+			for j := 0; j < 2; j++ {
+				stat := getSimpleStat(j)
+				stat["k1"] = int64(i % 4)
+				err = statLogger.Write(fmt.Sprintf("type%v", j), stat)
+				if err != nil {
+					t.Fatalf("TestCompactReconstruct failed with error %v", err)
+				}
+			}
+		}
+
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatalf("TestCompactReconstruct failed with error %v", err)
+		}
+		return data
+	}
+
+	deduped := writeStats(filepath.Join(tmpDir, "deduped.log"))
+	snapshots := writeStats(filepath.Join(tmpDir, "snapshots.log"), WithSnapshotEvery(3))
+
+	// The timestamps differ between the files.
+	getStats := func(data []byte) []string {
+		var stats []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			stats = append(stats, strings.SplitN(line, " ", 2)[1])
+		}
+		return stats
+	}
+
+	var output bytes.Buffer
+	err = CompactReconstruct(bytes.NewReader(deduped), &output, CompactPolicy{SnapshotEvery: 3})
+	if err != nil {
+		t.Fatalf("TestCompactReconstruct failed with error %v", err)
+	}
+
+	if !reflect.DeepEqual(getStats(output.Bytes()), getStats(snapshots)) {
+		t.Fatalf("TestCompactReconstruct failed: exp %s actual %s", snapshots, output.Bytes())
+	}
+
+	// And back, over multiple workers.
+	output.Reset()
+	err = ReconstructStatFileWithOptions(bytes.NewReader(snapshots), &output,
+		ReconstructOptions{Workers: 2, Compact: &CompactPolicy{}})
+	if err != nil {
+		t.Fatalf("TestCompactReconstruct failed with error %v", err)
+	}
+
+	if !reflect.DeepEqual(getStats(output.Bytes()), getStats(deduped)) {
+		t.Fatalf("TestCompactReconstruct failed: exp %s actual %s", deduped, output.Bytes())
+	}
+}
+
+func benchmarkReconstruct(b *testing.B, workers int) {
+	fileName := filepath.Join(b.TempDir(), "reconstruct.log")
+
+	data, _, err := getDedupedStats(fileName, 16, 1000)
+	if err != nil {
+		b.Fatalf("%v failed with error %v", b.Name(), err)
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = ReconstructStatFileWithOptions(bytes.NewReader(data), io.Discard,
+			ReconstructOptions{Workers: workers})
+		if err != nil {
+			b.Fatalf("%v failed with error %v", b.Name(), err)
+		}
+	}
+}
+
+func BenchmarkReconstruct1Worker(b *testing.B) {
+	benchmarkReconstruct(b, 1)
+}
+
+func BenchmarkReconstruct4Workers(b *testing.B) {
+	benchmarkReconstruct(b, 4)
+}
+
+// getDedupedStats writes numWrites stats of each of numTypes stat types,
+// interleaved, with a deduplicating logger to fileName. Returns the log
+// file contents, and the full stats written.
+func getDedupedStats(fileName string, numTypes, numWrites int) ([]byte, []map[string]interface{}, error) {
+	statLogger, err := NewDedupeLogStats(fileName, 1024*1024*1024, 2, "2006-01-02T15:04:05.000-07:00")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer statLogger.Close()
+
+	exp := make([]map[string]interface{}, 0, numTypes*numWrites)
+	for i := 0; i < numWrites; i++ {
+		for j := 0; j < numTypes; j++ {
+			stat := getSimpleStat(j)
+			stat["k1"] = int64(i % 7)
+			exp = append(exp, stat)
+
+			err = statLogger.Write(fmt.Sprintf("type%v", j), stat)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	data, err := os.ReadFile(fileName)
+	return data, exp, err
+}
+
+// verifyReconstruction reconstructs the stats in fileName to outputName,
+// and verifies the reconstructed stats against exp.
+func verifyReconstruction(exp []map[string]interface{}, fileName, outputName string) error {
+	sourceFile, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	outputFile, err := os.Create(outputName)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	err = ReconstructStatFile(sourceFile, outputFile)
+	if err != nil {
+		return err
+	}
+
+	lines, err := getAllLogsFromFiles(outputName, CompressionNone)
+	if err != nil {
+		return err
+	}
+
+	return verifyReconstructedLines(exp, lines)
+}
+
+// verifyReconstructedLines verifies the reconstructed stat lines against exp.
+func verifyReconstructedLines(exp []map[string]interface{}, lines []string) error {
+	if len(lines) != len(exp) {
+		return fmt.Errorf("Unexpected number of reconstructed lines, exp %v actual %v",
+			len(exp), len(lines))
+	}
+
+	for i, line := range lines {
+		_, data, err := ParseStatLine([]byte(line), 2)
+		if err != nil {
+			return err
+		}
+
+		m := make(map[string]interface{})
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			return err
+		}
+
+		convertFloatsToInts(m)
+		if !reflect.DeepEqual(exp[i], m) {
+			return fmt.Errorf("Expected and actual stats are not equal for line %v. exp %v, actual %v",
+				i, exp[i], m)
+		}
+	}
+
+	return nil
+}
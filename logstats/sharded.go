@@ -0,0 +1,228 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// getShardLogFileName returns the name of the log file of a shard.
+func getShardLogFileName(dir string, shard int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard%d.log", shard))
+}
+
+// getStatTypeShard returns the shard the stats of statType are written to.
+func getStatTypeShard(statType string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(statType))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Create new LogStats object, writing to shards log files in the directory
+// dir - named "shard0.log", "shard1.log" and so on - for the writers not
+// to contend for a single lock and file. Each stat type is written to the
+// shard its name hashes to, so all the stats of a type are in the same
+// shard, which rotates and deduplicates them on its own. The options apply
+// to each shard, e.g. each one keeps up to numFiles log files. The stats
+// are read back, in timestamp order, by ShardedLogStatsReader.
+func NewShardedLogStats(dir string, shards int, opts ...Option) (LogStats, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("NewShardedLogStats: Unsupported shard count %v", shards)
+	}
+
+	cfg, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &multiLogStats{
+		name: "shardedLogStats",
+		route: func(statType string) (string, error) {
+			return getShardLogFileName(dir, getStatTypeShard(statType, shards)), nil
+		},
+		create: func(shardFileName string) (LogStats, error) {
+			return newLogger(shardFileName, opts)
+		},
+		loggers:  make(map[string]LogStats),
+		durable:  cfg.durable,
+		compress: cfg.compression != CompressionNone,
+	}
+
+	// All the shards are opened upfront, so that a shard already in use
+	// fails the construction rather than the writes.
+	for i := 0; i < shards; i++ {
+		_, err = m.loggerLocked(getShardLogFileName(dir, i))
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// ShardedLogStatsReader reads the stats back from the log files of all the
+// shards written by a sharded LogStats object, merged in timestamp order.
+// The stats with the same timestamp are returned in the order of their
+// shards.
+type ShardedLogStatsReader struct {
+	readers []*LogStatsReader
+	heads   []*shardStat // next stat of each shard, nil if not read yet
+	done    []bool
+}
+
+// shardStat is a stat read from a shard, yet to be returned.
+type shardStat struct {
+	ts       time.Time
+	statType string
+	stat     map[string]interface{}
+}
+
+// Create new ShardedLogStatsReader object, reading the shards log files in
+// the directory dir, as passed to NewShardedLogStats. If reconstruct is
+// set, the deduplicated stats are reconstructed.
+func NewShardedLogStatsReader(dir string, shards int, reconstruct bool) (*ShardedLogStatsReader, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("NewShardedLogStatsReader: Unsupported shard count %v", shards)
+	}
+
+	rdr := &ShardedLogStatsReader{
+		readers: make([]*LogStatsReader, 0, shards),
+		heads:   make([]*shardStat, shards),
+		done:    make([]bool, shards),
+	}
+
+	for i := 0; i < shards; i++ {
+		shardReader, err := NewLogStatsReader(getShardLogFileName(dir, i), reconstruct)
+		if err != nil {
+			rdr.Close()
+			return nil, err
+		}
+
+		rdr.readers = append(rdr.readers, shardReader)
+	}
+
+	return rdr, nil
+}
+
+// SetDecoder sets the Decoder of the stats of all the shards. Refer
+// LogStatsReader.SetDecoder.
+func (r *ShardedLogStatsReader) SetDecoder(decoder Decoder) {
+	for _, shardReader := range r.readers {
+		shardReader.SetDecoder(decoder)
+	}
+}
+
+// SetPrefixFields sets the number of line prefix fields of all the shards.
+// Refer LogStatsReader.SetPrefixFields.
+func (r *ShardedLogStatsReader) SetPrefixFields(n int) {
+	for _, shardReader := range r.readers {
+		shardReader.SetPrefixFields(n)
+	}
+}
+
+// SetTSFormat sets the format and the location of the timestamps of all
+// the shards. Refer LogStatsReader.SetTSFormat.
+func (r *ShardedLogStatsReader) SetTSFormat(tsFormat string, loc *time.Location) error {
+	for _, shardReader := range r.readers {
+		err := shardReader.SetTSFormat(tsFormat, loc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetFramed sets the framing of the log messages of all the shards. Refer
+// LogStatsReader.SetFramed.
+func (r *ShardedLogStatsReader) SetFramed(enable bool) {
+	for _, shardReader := range r.readers {
+		shardReader.SetFramed(enable)
+	}
+}
+
+// SetCompressionDict sets the preset dictionary of the compressed log files
+// of all the shards. Refer LogStatsReader.SetCompressionDict.
+func (r *ShardedLogStatsReader) SetCompressionDict(dict []byte) {
+	for _, shardReader := range r.readers {
+		shardReader.SetCompressionDict(dict)
+	}
+}
+
+// SetFileNamer sets the FileNamer of the rotated log files of all the
+// shards. Refer LogStatsReader.SetFileNamer.
+func (r *ShardedLogStatsReader) SetFileNamer(namer FileNamer) error {
+	for _, shardReader := range r.readers {
+		err := shardReader.SetFileNamer(namer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Next returns the timestamp, the type and the stats of the stat with the
+// earliest timestamp among the next stats of the shards. It returns io.EOF
+// once all the stats are read. As with LogStatsReader.Next, the reading
+// can be continued after an error other than io.EOF.
+func (r *ShardedLogStatsReader) Next() (time.Time, string, map[string]interface{}, error) {
+	for i, shardReader := range r.readers {
+		if r.done[i] || r.heads[i] != nil {
+			continue
+		}
+
+		ts, statType, stat, err := shardReader.Next()
+		if err == io.EOF {
+			r.done[i] = true
+			continue
+		}
+
+		if err != nil {
+			return time.Time{}, "", nil, err
+		}
+
+		r.heads[i] = &shardStat{ts: ts, statType: statType, stat: stat}
+	}
+
+	next := -1
+	for i, head := range r.heads {
+		if head != nil && (next < 0 || head.ts.Before(r.heads[next].ts)) {
+			next = i
+		}
+	}
+
+	if next < 0 {
+		return time.Time{}, "", nil, io.EOF
+	}
+
+	head := r.heads[next]
+	r.heads[next] = nil
+	return head.ts, head.statType, head.stat, nil
+}
+
+// Closes the log files being read, if any.
+func (r *ShardedLogStatsReader) Close() error {
+	var err error
+	for _, shardReader := range r.readers {
+		closeErr := shardReader.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedLogStats(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "logstats_sharded")
+	if err != nil {
+		t.Fatalf("TestShardedLogStats failed with error %v", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	shards := 4
+	var statLogger LogStats
+	statLogger, err = NewShardedLogStats(tmpDir, shards, WithDedupe(true), WithSizeLimit(512))
+	if err != nil {
+		t.Fatalf("TestShardedLogStats failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	if lockSupported {
+		_, err = NewShardedLogStats(tmpDir, shards)
+		if err == nil {
+			t.Fatalf("TestShardedLogStats failed: shards shared by two loggers")
+		}
+	}
+
+	// Stats of a few types, interleaved, with increasing timestamps. The
+	// stats of each type get deduplicated within their shard.
+	type written struct {
+		ts       time.Time
+		statType string
+		stat     map[string]interface{}
+	}
+
+	start := time.Now().Truncate(time.Millisecond)
+	all := make([]written, 0)
+	for i := 0; i < 40; i++ {
+		stat := getSimpleStat(0)
+		stat["k1"] = int64(i / 8)
+
+		w := written{
+			ts:       start.Add(time.Duration(i) * time.Millisecond),
+			statType: fmt.Sprintf("stats%d", i%8),
+			stat:     stat,
+		}
+
+		err = statLogger.WriteAt(w.ts, w.statType, w.stat)
+		if err != nil {
+			t.Fatalf("TestShardedLogStats failed with error %v", err)
+		}
+
+		all = append(all, w)
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestShardedLogStats failed with error %v", err)
+	}
+
+	for i := 0; i < shards; i++ {
+		_, err = os.Stat(getShardLogFileName(tmpDir, i))
+		if err != nil {
+			t.Fatalf("TestShardedLogStats failed with error %v", err)
+		}
+	}
+
+	// The shards are merged back in timestamp order.
+	var reader *ShardedLogStatsReader
+	reader, err = NewShardedLogStatsReader(tmpDir, shards, true)
+	if err != nil {
+		t.Fatalf("TestShardedLogStats failed with error %v", err)
+	}
+
+	defer reader.Close()
+
+	for i, w := range all {
+		ts, statType, stat, err := reader.Next()
+		if err != nil {
+			t.Fatalf("TestShardedLogStats failed with error %v", err)
+		}
+
+		convertFloatsToInts(stat)
+		if !ts.Equal(w.ts) || statType != w.statType || !reflect.DeepEqual(w.stat, stat) {
+			t.Fatalf("TestShardedLogStats failed for stat %v: exp %v %v %v actual %v %v %v",
+				i, w.ts, w.statType, w.stat, ts, statType, stat)
+		}
+	}
+
+	_, _, _, err = reader.Next()
+	if err != io.EOF {
+		t.Fatalf("TestShardedLogStats failed: exp error %v actual %v", io.EOF, err)
+	}
+}
+
+func benchmarkShardedWrite(b *testing.B, shards int) {
+	tmpDir, err := os.MkdirTemp("", "logstats_sharded_bench")
+	if err != nil {
+		b.Fatalf("benchmarkShardedWrite failed with error %v", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	var statLogger LogStats
+	statLogger, err = NewShardedLogStats(tmpDir, shards, WithDedupe(true),
+		WithSizeLimit(64*1024*1024), WithNumFiles(2))
+	if err != nil {
+		b.Fatalf("benchmarkShardedWrite failed with error %v", err)
+	}
+
+	defer statLogger.Close()
+
+	// Each goroutine writes stats of its own type.
+	var goroutines int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		statType := fmt.Sprintf("stats%d", atomic.AddInt64(&goroutines, 1))
+		i := 0
+		for pb.Next() {
+			err := statLogger.Write(statType, getSimpleStat(i))
+			if err != nil {
+				b.Errorf("benchmarkShardedWrite failed with error %v", err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkShardedWrite1Shard(b *testing.B) {
+	benchmarkShardedWrite(b, 1)
+}
+
+func BenchmarkShardedWrite4Shards(b *testing.B) {
+	benchmarkShardedWrite(b, 4)
+}
+
+func BenchmarkShardedWrite16Shards(b *testing.B) {
+	benchmarkShardedWrite(b, 16)
+}
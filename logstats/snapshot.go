@@ -0,0 +1,186 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileSnapshot is a consistent view of the log files of a LogStats object,
+// taken by Snapshot, for reading them while the logger keeps writing and
+// rotating them.
+//
+// The coordination contract: the snapshot is taken under the lock of the
+// logger, after flushing the stats it buffers, so no write or rotation is
+// in progress. The log files are opened then and there, and read through
+// the open files up to their sizes at that time. So the rotations since -
+// renaming, compressing or removing the log files - do not affect the
+// snapshot, nor do the writes since, which are left out. The logger does
+// not wait for the readers, which in turn hold the disk space of the
+// removed log files until the snapshot is closed.
+//
+// On the platforms without the file locking, e.g. Windows, the open files
+// may fail the rotations, so the snapshots should be closed promptly.
+type FileSnapshot struct {
+	// Files are the log files, in the order of reading: the rotated files
+	// oldest first, followed by the current log file.
+	Files []SnapshotFile
+}
+
+// SnapshotFile is a log file of a FileSnapshot.
+type SnapshotFile struct {
+	// Path is the absolute path of the log file at the time of the
+	// snapshot. The rotations since may have renamed or removed it.
+	Path string
+
+	// Size of the log file at the time of the snapshot, in bytes -
+	// compressed, for the compressed log files. The reads stop there.
+	Size int64
+
+	f      *os.File
+	active bool   // the compressed current log file, yet to be completed
+	dict   []byte // refer WithCompressionDict
+}
+
+// openFileSnapshot opens the log files fnames of the log file fileName,
+// listed in the order of reading, for a FileSnapshot. The compressed log
+// files are read with the preset dictionary dict, if any.
+func openFileSnapshot(fileName string, fnames []string, dict []byte) (*FileSnapshot, error) {
+	snap := &FileSnapshot{Files: make([]SnapshotFile, 0, len(fnames))}
+	for _, fname := range fnames {
+		file, err := openSnapshotFile(fname)
+		if err != nil {
+			snap.Close()
+			return nil, err
+		}
+
+		file.active = fname == getActiveLogFileName(fileName)
+		file.dict = dict
+		snap.Files = append(snap.Files, file)
+	}
+
+	return snap, nil
+}
+
+func openSnapshotFile(fname string) (SnapshotFile, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return SnapshotFile{}, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return SnapshotFile{}, err
+	}
+
+	path, err := filepath.Abs(fname)
+	if err != nil {
+		path = fname
+	}
+
+	return SnapshotFile{Path: path, Size: fi.Size(), f: f}, nil
+}
+
+// Open returns the stat lines of the log files as a single stream, as
+// MergeStatFiles does. Each call returns a new stream, from the start.
+// The stream fails once the snapshot is closed.
+func (s *FileSnapshot) Open() io.ReadCloser {
+	files := make([]string, 0, len(s.Files))
+	for _, file := range s.Files {
+		files = append(files, file.Path)
+	}
+
+	return &mergedReader{files: files, open: s.open}
+}
+
+// NewReader returns a LogStatsReader reading the stats of the log files,
+// reconstructing them if reconstruct is set, as NewLogStatsReader does. It
+// fails once the snapshot is closed.
+func (s *FileSnapshot) NewReader(reconstruct bool) *LogStatsReader {
+	rdr := newLogStatsReader("", reconstruct)
+	for _, file := range s.Files {
+		rdr.files = append(rdr.files, file.Path)
+	}
+
+	rdr.open = s.open
+	return rdr
+}
+
+// open opens the log file path of the snapshot for reading its stat lines.
+func (s *FileSnapshot) open(path string) (io.ReadCloser, error) {
+	for _, file := range s.Files {
+		if file.Path == path {
+			return file.open()
+		}
+	}
+
+	return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+}
+
+func (file SnapshotFile) open() (io.ReadCloser, error) {
+	if file.f == nil {
+		return nil, closedError("FileSnapshot")
+	}
+
+	if file.Size == 0 {
+		// The compressed current log file may lack even its header.
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	rc, err := newDecompressReader(io.NewSectionReader(file.f, 0, file.Size),
+		getLogFileCompression(file.Path), file.dict)
+	if err != nil {
+		return nil, err
+	}
+
+	rc = snapshotFileReader{rc}
+	if file.active {
+		rc = truncatedGzipReader{rc}
+	}
+
+	return rc, nil
+}
+
+// snapshotFileReader reads a log file of a FileSnapshot.
+type snapshotFileReader struct {
+	io.ReadCloser
+}
+
+// Close closes the decompressor, leaving the log file open for the other
+// readers of the snapshot. The errors of the decompressor, e.g. of the gzip
+// stream yet to be completed, are reported by Read, as applicable.
+func (r snapshotFileReader) Close() error {
+	r.ReadCloser.Close()
+	return nil
+}
+
+// Close closes the log files of the snapshot, releasing the disk space of
+// the ones removed since.
+func (s *FileSnapshot) Close() error {
+	var err error
+	for i := range s.Files {
+		if s.Files[i].f == nil {
+			continue
+		}
+
+		closeErr := s.Files[i].f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		s.Files[i].f = nil
+	}
+
+	return err
+}
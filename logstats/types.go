@@ -2,12 +2,57 @@ package logstats
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
+// CompressionType is the compression used for the rotated log files.
+type CompressionType int
+
+const (
+	CompressionNone CompressionType = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+func (ct CompressionType) String() string {
+	switch ct {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+
+	return fmt.Sprintf("CompressionType(%d)", int(ct))
+}
+
+// Suffix returns the file name suffix of the files compressed with ct, e.g.
+// ".gz". It is empty for CompressionNone.
+func (ct CompressionType) Suffix() string {
+	switch ct {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+
+	return ""
+}
+
+// timeNow is the clock used by NowTimestamp. Replaced by the tests.
+var timeNow = time.Now
+
+// Timestamp is a stat logged when its time changes. By default, it is
+// marshalled relative to the time of marshalling - refer NewTimestamp. For
+// the stats analysed after the fact, NewAbsoluteTimestamp is recommended.
 type Timestamp struct {
 	timestamp        time.Time
 	customMarsheller func(Timestamp) ([]byte, error)
+
+	// layout of the absolute timestamps; empty for the relative ones
+	layout string
 }
 
 func (ts Timestamp) Equal(otherTs Timestamp) bool {
@@ -15,11 +60,28 @@ func (ts Timestamp) Equal(otherTs Timestamp) bool {
 	return timeA.Equal(timeB)
 }
 
+// Since returns the time elapsed from ts to curr, as a string. Prefer Sub
+// for the arithmetic and the comparisons on the elapsed time.
 func (ts Timestamp) Since(curr Timestamp) string {
 	var currTime = time.Time(curr.timestamp)
 	return currTime.Sub(time.Time(ts.timestamp)).String()
 }
 
+// Sub returns the duration ts-other.
+func (ts Timestamp) Sub(other Timestamp) time.Duration {
+	return ts.timestamp.Sub(other.timestamp)
+}
+
+// Before reports whether ts is before other.
+func (ts Timestamp) Before(other Timestamp) bool {
+	return ts.timestamp.Before(other.timestamp)
+}
+
+// After reports whether ts is after other.
+func (ts Timestamp) After(other Timestamp) bool {
+	return ts.timestamp.After(other.timestamp)
+}
+
 func NewTimestampWithCustomMarshaller(ts time.Time, cm func(Timestamp) ([]byte, error)) Timestamp {
 	return Timestamp{
 		timestamp:        ts,
@@ -27,24 +89,48 @@ func NewTimestampWithCustomMarshaller(ts time.Time, cm func(Timestamp) ([]byte,
 	}
 }
 
+// NewTimestamp returns a Timestamp marshalled as the duration since ts, at
+// the time of marshalling (e.g. "1m30s"). As such, the logged value depends
+// on when the stats are written.
 func NewTimestamp(ts time.Time) Timestamp {
 	return NewTimestampWithCustomMarshaller(ts, nil)
 }
 
+// NewAbsoluteTimestamp returns a Timestamp marshalled as ts formatted with
+// layout, e.g. time.RFC3339. An empty layout means time.RFC3339Nano.
+func NewAbsoluteTimestamp(ts time.Time, layout string) Timestamp {
+	if layout == "" {
+		layout = time.RFC3339Nano
+	}
+
+	return Timestamp{
+		timestamp: ts,
+		layout:    layout,
+	}
+}
+
 func NowTimestamp() Timestamp {
-	return NewTimestamp(time.Now())
+	return NewTimestamp(timeNow())
+}
+
+// text returns the Timestamp as logged, in absence of a custom marshaller.
+func (ts Timestamp) text() string {
+	if ts.layout != "" {
+		return ts.timestamp.Format(ts.layout)
+	}
+	return ts.Since(NowTimestamp())
 }
 
 func (ts Timestamp) MarshalText() ([]byte, error) {
 	if ts.customMarsheller != nil {
 		return ts.customMarsheller(ts)
 	}
-	return []byte(ts.Since(NowTimestamp())), nil
+	return []byte(ts.text()), nil
 }
 
 func (ts Timestamp) MarshalJSON() ([]byte, error) {
 	if ts.customMarsheller != nil {
 		return ts.customMarsheller(ts)
 	}
-	return json.Marshal(ts.Since(NowTimestamp()))
+	return json.Marshal(ts.text())
 }
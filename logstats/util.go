@@ -11,17 +11,27 @@ licenses/APL2.txt.
 package logstats
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 // Utility functions for file handling
-func getLogFileName(fileName string, num int, compress bool) string {
+func getLogFileName(fileName string, num int, compression CompressionType) string {
 	// Assumption: fileName always has ".log" extention.
 	name := fileName[:len(fileName)-4]
 
@@ -32,47 +42,144 @@ func getLogFileName(fileName string, num int, compress bool) string {
 		fname = fmt.Sprintf("%s.%s", name, "log")
 	}
 
-	if compress && num > 0 {
-		fname = fname + ".gz"
+	if num > 0 {
+		fname = fname + compression.Suffix()
 	}
 	return fname
 }
 
-func getLogFileNumber(fileName string) (int, error) {
-	names := strings.Split(fileName, ".")
-	if len(names) < 2 || len(names) > 4 {
-		return 0, fmt.Errorf("Unexpected log file name")
+// rotatedLogFile is a rotated log file, as parsed by a FileNamer.
+type rotatedLogFile struct {
+	name  string
+	index int
+	ts    time.Time
+}
+
+// getRotatedLogFiles returns the rotated log files of fileName - compressed
+// or not - named by namer, ordered by their index and rotation time, i.e.
+// newest first.
+func getRotatedLogFiles(fileName string, namer FileNamer) ([]rotatedLogFile, error) {
+	// Assumption: fileName always has ".log" extention.
+
+	all, err := filepath.Glob(namer.RotatedFilePattern(fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]rotatedLogFile, 0, len(all))
+	for _, fname := range all {
+		index, ts, ok := namer.ParseRotatedFileName(fileName, fname)
+		if !ok {
+			// Not a rotated log file.
+			continue
+		}
+
+		files = append(files, rotatedLogFile{name: fname, index: index, ts: ts})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].index != files[j].index {
+			return files[i].index < files[j].index
+		}
+		return files[i].ts.After(files[j].ts)
+	})
+
+	return files, nil
+}
+
+// renumberLogFiles renumbers the rotated log files of fileName
+// contiguously from 1, closing the gaps and resolving the duplicate numbers,
+// e.g. left behind by a crash in the middle of a rotation or by the files
+// removed by hand. Of the files with the same number, the ones modified
+// last are considered newer.
+func renumberLogFiles(fileName string, namer FileNamer) error {
+	all, err := getRotatedLogFiles(fileName, namer)
+	if err != nil {
+		return err
+	}
+
+	modTimes := make(map[string]time.Time, len(all))
+	for _, file := range all {
+		finfo, err := os.Stat(file.name)
+		if err != nil {
+			return err
+		}
+
+		modTimes[file.name] = finfo.ModTime()
 	}
 
-	if len(names) == 2 {
-		return 0, nil
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].index != all[j].index {
+			return all[i].index < all[j].index
+		}
+		if !all[i].ts.Equal(all[j].ts) {
+			return all[i].ts.After(all[j].ts)
+		}
+		return modTimes[all[i].name].After(modTimes[all[j].name])
+	})
+
+	type move struct {
+		from, to string
 	}
 
-	if names[len(names)-1] == "log" {
-		return 0, nil
+	moves := make([]move, 0)
+	for i, file := range all {
+		target := namer.RotatedFileName(fileName, i+1, file.ts, getLogFileCompression(file.name))
+		if target != file.name {
+			moves = append(moves, move{from: file.name, to: target})
+		}
 	}
 
-	idx := len(names) - 1
-	if names[len(names)-1] == "gz" {
-		idx = len(names) - 2
+	// Move the files out of the way first, so that no file gets
+	// overwritten before it is moved.
+	for i := range moves {
+		tmp := moves[i].from + ".renumber"
+		err = os.Rename(moves[i].from, tmp)
+		if err != nil {
+			return err
+		}
+
+		moves[i].from = tmp
 	}
 
-	return strconv.Atoi(names[idx])
+	for _, m := range moves {
+		if DEBUG != 0 {
+			fmt.Println("Renumbering file", strings.TrimSuffix(m.from, ".renumber"), "to", m.to)
+		}
+
+		err = os.Rename(m.from, m.to)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func openLogFile(fileName string) (*os.File, int, error) {
+// openFile opens the log file fname. Replaced by the tests, to fail the
+// opens.
+var openFile = os.OpenFile
+
+func openLogFile(fileName string, fileMode, dirMode os.FileMode, repair bool) (*os.File, int, error) {
 	// Assumption: fileName always has ".log" extention.
 
 	dir := filepath.Dir(fileName)
-	err := os.MkdirAll(dir, 0o755)
+	err := os.MkdirAll(dir, dirMode)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	fname := getLogFileName(fileName, 0, false)
+	fname := getLogFileName(fileName, 0, CompressionNone)
+	if repair {
+		err = repairLogFile(fname)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
 	flag := os.O_CREATE | os.O_APPEND | os.O_WRONLY
 	var f *os.File
-	f, err = os.OpenFile(fname, flag, 0o644)
+	f, err = openFile(fname, flag, fileMode)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -90,8 +197,127 @@ func openLogFile(fileName string) (*os.File, int, error) {
 	return f, int(finfo.Size()), nil
 }
 
-func writeToFile(f *os.File, bytes []byte) error {
-	n, err := f.Write(bytes)
+// countLogFileLines returns the number of lines in the log file fname,
+// decompressed as per its suffix.
+func countLogFileLines(fname string) (int, error) {
+	rc, err := openLogFileReader(fname, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	// The compressed current log file is yet to be completed.
+	r := truncatedGzipReader{rc}
+
+	lines := 0
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		lines += countLines(buf[:n])
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// countLines returns the number of new lines in data.
+func countLines(data []byte) int {
+	return bytes.Count(data, []byte{'\n'})
+}
+
+// repairLogFile truncates the trailing partial line - not terminated by a
+// newline - of the log file fname, e.g. left behind by a crash in the middle
+// of a write. A missing log file needs no repair.
+func repairLogFile(fname string) error {
+	f, err := os.OpenFile(fname, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Scan backwards, a chunk at a time, for the last newline.
+	size := finfo.Size()
+	end := size
+	buf := make([]byte, 4096)
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+
+		chunk := buf[:end-start]
+		_, err = f.ReadAt(chunk, start)
+		if err != nil {
+			return err
+		}
+
+		idx := bytes.LastIndexByte(chunk, '\n')
+		if idx >= 0 {
+			end = start + int64(idx) + 1
+			break
+		}
+
+		end = start
+	}
+
+	if end == size {
+		return nil
+	}
+
+	if DEBUG != 0 {
+		fmt.Println("Truncating partial line of log file", fname, "from", size, "to", end, "bytes")
+	}
+
+	err = f.Truncate(end)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// lockLogFile takes the lock file of the log file fileName - named as
+// fileName, with the ".lock" extension instead of ".log" - guarding
+// against multiple LogStats objects - in the same or different processes -
+// writing to the same log file. The lock is released when the returned
+// file is closed.
+func lockLogFile(fileName string, fileMode, dirMode os.FileMode) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(fileName), dirMode)
+	if err != nil {
+		return nil, err
+	}
+
+	lockName := strings.TrimSuffix(fileName, ".log") + ".lock"
+	f, err := os.OpenFile(lockName, os.O_CREATE|os.O_RDWR, fileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		if err == ErrLogFileInUse {
+			return nil, fmt.Errorf("NewLogStats: %w: %v", err, fileName)
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func writeToFile(w io.Writer, bytes []byte) error {
+	n, err := w.Write(bytes)
 	if DEBUG != 0 {
 		fmt.Println(n, "bytes written to the file")
 	}
@@ -99,139 +325,432 @@ func writeToFile(f *os.File, bytes []byte) error {
 	return err
 }
 
-func rotate(fileName string, numFiles int, compress bool) (*os.File, int, error) {
-	// Assumption: fileName always has ".log" extention.
+// writeFile writes bytes to the log file f. Replaced by the tests, to fail
+// the writes.
+var writeFile = func(f *os.File, bytes []byte) (int, error) {
+	return f.Write(bytes)
+}
 
-	name := fileName[:len(fileName)-4]
-	var pattern string
-	if compress {
-		pattern = fmt.Sprintf("%s.log.*.gz", name)
-	} else {
-		pattern = fmt.Sprintf("%s.log*", name)
+// isTransientWriteError reports whether the write failed with an error
+// worth retrying, refer WithWriteRetry.
+func isTransientWriteError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EIO, syscall.EAGAIN, syscall.EINTR} {
+		if errors.Is(err, errno) {
+			return true
+		}
 	}
 
-	all, err := filepath.Glob(pattern)
+	return false
+}
+
+// getLogFileCompression returns the compression type of a log file, as
+// indicated by its suffix.
+func getLogFileCompression(fileName string) CompressionType {
+	for _, compression := range []CompressionType{CompressionGzip, CompressionZstd} {
+		if strings.HasSuffix(fileName, compression.Suffix()) {
+			return compression
+		}
+	}
+
+	return CompressionNone
+}
+
+func rotate(fileName string, numFiles int, compression CompressionType, cfg config) error {
+	// Assumption: fileName always has ".log" extention.
+
+	// All the rotated files - compressed or not, as the compression may
+	// have been toggled since they got rotated.
+	all, err := getRotatedLogFiles(fileName, cfg.fileNamer)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
 
-	sort.Strings(all)
-	l := len(all)
-	for i := l - 1; i >= 0; i-- {
-		var newFname string
+	if cfg.maxAge > 0 {
+		all, err = removeExpiredLogFiles(all, cfg.maxAge, cfg.now())
+		if err != nil {
+			return err
+		}
+	}
 
-		oldFname := all[i]
-		if i == l-1 {
-			num, err := getLogFileNumber(all[i])
-			if err != nil {
-				return nil, 0, err
+	// Shift the rotated files, preserving their compression suffix. The
+	// files are renumbered contiguously, so that the files removed due
+	// to their age do not leave any gaps.
+	for i := len(all) - 1; i >= 0; i-- {
+		oldFname := all[i].name
+
+		num := i + 2
+		if num >= numFiles {
+			if DEBUG != 0 {
+				fmt.Println("Removing oldfile", oldFname)
 			}
 
-			num = num + 1
-			if num >= numFiles {
-				continue
+			err = os.Remove(oldFname)
+			if err != nil {
+				return err
 			}
+			continue
+		}
 
-			newFname = getLogFileName(fileName, num, compress)
-		} else {
-			newFname = all[i+1]
+		newFname := cfg.fileNamer.RotatedFileName(fileName, num, all[i].ts, getLogFileCompression(oldFname))
+		if newFname == oldFname {
+			continue
 		}
 
 		if DEBUG != 0 {
 			fmt.Println("Renaming oldfile", oldFname, "newfile", newFname)
 		}
 
-		err := os.Rename(oldFname, newFname)
+		err = os.Rename(oldFname, newFname)
 		if err != nil {
-			return nil, 0, err
+			return err
 		}
 	}
 
-	if compress {
-		// compress filname.0.log to filename.1.log.gz
-		sourceFname := getLogFileName(fileName, 0, compress)
-		targetFname := getLogFileName(fileName, 1, compress)
-		err = compressFile(sourceFname, targetFname)
+	sourceFname := getLogFileName(fileName, 0, compression)
+	if cfg.compressActive {
+		// The current log file is already compressed.
+		sourceFname = getActiveLogFileName(fileName)
+		compression = CompressionGzip
+	}
+
+	if numFiles <= 1 {
+		// No rotated files are to be maintained.
+		err = os.Remove(sourceFname)
 		if err != nil {
-			return nil, 0, err
+			return err
+		}
+	} else if compression != CompressionNone && !cfg.compressActive {
+		// compress filname.log to filename.log.1.gz (or .zst)
+		targetFname, err := getRotationTarget(fileName, compression, cfg)
+		if err != nil {
+			return err
+		}
+
+		err = compressFile(sourceFname, targetFname, compression, cfg.compressionLevel, cfg.compressionDict, cfg.fileMode)
+		if err != nil {
+			return err
 		}
 
 		err = os.Remove(sourceFname)
 		if err != nil {
-			return nil, 0, err
+			return err
+		}
+	} else {
+		targetFname, err := getRotationTarget(fileName, compression, cfg)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(sourceFname, targetFname)
+		if err != nil {
+			return err
 		}
 	}
 
-	return openLogFile(fileName)
+	if cfg.maxTotalBytes > 0 {
+		err = removeExcessLogFiles(fileName, cfg.maxTotalBytes, cfg.fileNamer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func compressFile(sourceFname, targetFname string) error {
-	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
-	f, err := os.OpenFile(targetFname, flags, 0o644)
+// getRotationTarget returns the name of the log file fileName, once
+// rotated. The rotation time in the name is advanced until the name is
+// free, for the namers not giving a unique name to each rotation.
+func getRotationTarget(fileName string, compression CompressionType, cfg config) (string, error) {
+	ts := cfg.now()
+	for {
+		targetFname := cfg.fileNamer.RotatedFileName(fileName, 1, ts, compression)
+		_, err := os.Stat(targetFname)
+		if os.IsNotExist(err) {
+			return targetFname, nil
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		ts = ts.Add(time.Second)
+	}
+}
+
+// removeExcessLogFiles removes the oldest rotated log files until the total
+// size of the rotated log files is at most maxTotalBytes.
+func removeExcessLogFiles(fileName string, maxTotalBytes int64, namer FileNamer) error {
+	all, err := getRotatedLogFiles(fileName, namer)
 	if err != nil {
 		return err
 	}
 
-	writer := gzip.NewWriter(f)
+	sizes := make([]int64, len(all))
+	var total int64
+	for i, file := range all {
+		finfo, err := os.Stat(file.name)
+		if err != nil {
+			return err
+		}
 
-	var r *os.File
-	r, err = os.Open(sourceFname)
+		sizes[i] = finfo.Size()
+		total += sizes[i]
+	}
+
+	for i := len(all) - 1; i >= 0 && total > maxTotalBytes; i-- {
+		if DEBUG != 0 {
+			fmt.Println("Removing file", all[i].name, "to limit the total size to", maxTotalBytes)
+		}
+
+		err = os.Remove(all[i].name)
+		if err != nil {
+			return err
+		}
+
+		total -= sizes[i]
+	}
+
+	return nil
+}
+
+// removeExpiredLogFiles removes the log files last modified more than
+// maxAge before now, and returns the remaining ones.
+func removeExpiredLogFiles(files []rotatedLogFile, maxAge time.Duration, now time.Time) ([]rotatedLogFile, error) {
+	remaining := make([]rotatedLogFile, 0, len(files))
+	for _, file := range files {
+		fname := file.name
+		finfo, err := os.Stat(fname)
+		if err != nil {
+			return nil, err
+		}
+
+		if now.Sub(finfo.ModTime()) <= maxAge {
+			remaining = append(remaining, file)
+			continue
+		}
+
+		if DEBUG != 0 {
+			fmt.Println("Removing expired file", fname)
+		}
+
+		err = os.Remove(fname)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return remaining, nil
+}
+
+// compressRotatedLogFiles compresses the uncompressed rotated log files of
+// fileName with the compression of cfg, keeping their numbers, e.g. the
+// ones rotated while the compression was disabled. Each file is removed
+// once compressed. A compressed file left behind by an interruption, along
+// with its source, gets overwritten.
+func compressRotatedLogFiles(fileName string, cfg config) error {
+	if cfg.compression == CompressionNone {
+		return nil
+	}
+
+	files, err := getRotatedLogFiles(fileName, cfg.fileNamer)
 	if err != nil {
 		return err
 	}
 
-	var finfo os.FileInfo
-	finfo, err = r.Stat()
+	for _, file := range files {
+		if getLogFileCompression(file.name) != CompressionNone {
+			continue
+		}
+
+		targetFname := cfg.fileNamer.RotatedFileName(fileName, file.index, file.ts, cfg.compression)
+		err = compressFile(file.name, targetFname, cfg.compression, cfg.compressionLevel, cfg.compressionDict, cfg.fileMode)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(file.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compressFile(sourceFname, targetFname string, compression CompressionType, level int, dict []byte, fileMode os.FileMode) error {
+	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	f, err := os.OpenFile(targetFname, flags, fileMode)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	buf := make([]byte, finfo.Size())
-	_, err = r.Read(buf)
+	var writer io.WriteCloser
+	writer, err = newCompressWriter(f, compression, level, dict)
 	if err != nil {
 		return err
 	}
 
-	if DEBUG != 0 {
-		fmt.Println("compressFile: Read", len(buf), "bytes from the file:", sourceFname)
+	var r *os.File
+	r, err = os.Open(sourceFname)
+	if err != nil {
+		return err
 	}
+	defer r.Close()
 
-	_, err = writer.Write(buf)
+	var n int64
+	n, err = io.Copy(writer, r)
 	if err != nil {
 		return err
 	}
 
 	if DEBUG != 0 {
-		fmt.Println("compressFile: Written", len(buf), "bytes to the file:", targetFname)
+		fmt.Println("compressFile: Compressed", n, "bytes from the file:", sourceFname,
+			"to the file:", targetFname)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
 	}
 
-	err = r.Close()
+	// The source gets removed once compressed, so the compressed file
+	// must be on the disk by then.
+	err = f.Sync()
 	if err != nil {
 		return err
 	}
 
-	return writer.Close()
+	return f.Close()
 }
 
-// Input validation functions
-func validateInput(fileName string, numFiles int) (string, error) {
-	if numFiles > MAX_NUM_FILES {
-		return fileName, fmt.Errorf("NewLogStats: More than %v files not supported.", MAX_NUM_FILES)
+// newCompressWriter returns a writer which compresses the data written to w.
+// level and the preset dictionary dict, if any, are used only for gzip.
+func newCompressWriter(w io.Writer, compression CompressionType, level int, dict []byte) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		if dict != nil {
+			return newDictGzipWriter(w, level, dict)
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		return zstd.NewWriter(w)
 	}
 
-	if numFiles < 1 {
-		return fileName, fmt.Errorf("NewLogStats: Unsupported file count %v", numFiles)
+	return nil, fmt.Errorf("Unsupported compression type %v", compression)
+}
+
+// newDecompressReader returns a reader which decompresses the data read
+// from r. For CompressionNone, the data is read from r as-is. The gzip
+// streams compressed with a preset dictionary need dict, refer
+// WithCompressionDict.
+func newDecompressReader(r io.Reader, compression CompressionType, dict []byte) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		return newGzipReader(r, dict)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
 	}
 
-	if !strings.HasSuffix(fileName, ".log") {
-		fileName = fileName + ".log"
+	return nil, fmt.Errorf("Unsupported compression type %v", compression)
+}
+
+// logFileReader reads a log file, decompressed as per its suffix.
+type logFileReader struct {
+	io.ReadCloser
+	f *os.File
+}
+
+// Close closes both the decompressor and the log file.
+func (r *logFileReader) Close() error {
+	r.ReadCloser.Close()
+	return r.f.Close()
+}
+
+// openLogFileReader opens the log file fname - the current or a rotated
+// one - for streaming its decompressed contents, with the preset
+// dictionary dict, if any.
+func openLogFileReader(fname string, dict []byte) (io.ReadCloser, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
 	}
 
-	return fileName, nil
+	rc, err := newDecompressReader(f, getLogFileCompression(fname), dict)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &logFileReader{ReadCloser: rc, f: f}, nil
+}
+
+// readLogFile returns the full decompressed contents of the log file
+// fname, however large or compressible.
+func readLogFile(fname string) ([]byte, error) {
+	rc, err := openLogFileReader(fname, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// detectCompression detects the compression of the data buffered in r from
+// its magic bytes, without consuming them.
+func detectCompression(r *bufio.Reader) CompressionType {
+	// A short or failed peek is left for the actual reads to report.
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return CompressionGzip
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd
+	}
+
+	return CompressionNone
+}
+
+// validateTSFormat checks that tsFormat is a time layout, by formatting a
+// known time and parsing it back.
+func validateTSFormat(tsFormat string) error {
+	if strings.Contains(tsFormat, "\n") {
+		return fmt.Errorf("Invalid timestamp format %q, contains a new line", tsFormat)
+	}
+
+	known := time.Date(2021, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	formatted := known.Format(tsFormat)
+	if formatted == tsFormat {
+		return fmt.Errorf("Invalid timestamp format %q, no time elements in the layout", tsFormat)
+	}
+
+	parsed, err := time.Parse(tsFormat, formatted)
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp format %q, failed to parse %q with err %v",
+			tsFormat, formatted, err)
+	}
+
+	if parsed.Format(tsFormat) != formatted {
+		return fmt.Errorf("Invalid timestamp format %q, %q does not round trip",
+			tsFormat, formatted)
+	}
+
+	return nil
 }
 
 // Utility funtions needed for filtering
-func populateFilteredMap(prevMap, currMap, newMap map[string]interface{}) {
+
+// populateFilteredMap populates newMap with the stats of currMap, which
+// differ from prevMap. float64 stats differing by at most epsilon are
+// considered equal.
+func populateFilteredMap(prevMap, currMap, newMap map[string]interface{}, epsilon float64) {
 	for k, v := range currMap {
 		prev, ok := prevMap[k]
 		if !ok {
@@ -258,18 +777,38 @@ func populateFilteredMap(prevMap, currMap, newMap map[string]interface{}) {
 			}
 			newMap[k] = v
 			break
+		case float64:
+			if equalFloat64(v, prev, epsilon) {
+				continue
+			}
+			newMap[k] = v
+			break
 		case string:
 			if equalStrings(v, prev) {
 				continue
 			}
 			newMap[k] = v
 			break
+		case json.Number:
+			if equalNumbers(v, prev, epsilon) {
+				continue
+			}
+			newMap[k] = v
+			break
 		case Timestamp:
 			if equalTime(v, prev) {
 				continue
 			}
 			newMap[k] = v
 			break
+		case []interface{}:
+			// Arrays are deduplicated only if all their elements are
+			// unchanged, otherwise the entire array is written.
+			if equalSlices(val, prev, epsilon) {
+				continue
+			}
+			newMap[k] = v
+			break
 		case map[string]interface{}:
 			var currM, prevM map[string]interface{}
 			currM = val
@@ -282,7 +821,7 @@ func populateFilteredMap(prevMap, currMap, newMap map[string]interface{}) {
 
 			newM := make(map[string]interface{})
 			newMap[k] = newM
-			populateFilteredMap(prevM, currM, newM)
+			populateFilteredMap(prevM, currM, newM, epsilon)
 			if len(newM) == 0 {
 				delete(newMap, k)
 			}
@@ -291,9 +830,186 @@ func populateFilteredMap(prevMap, currMap, newMap map[string]interface{}) {
 			newMap[k] = v
 		}
 	}
+
+	// Keys removed since the previous stats are recorded explicitly, so
+	// that the reconstruction does not keep their stale values.
+	var removed []string
+	for k := range prevMap {
+		if _, ok := currMap[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	if len(removed) != 0 {
+		sort.Strings(removed)
+		newMap[REMOVED_KEYS] = removed
+	}
+}
+
+// withRemovedKeys returns the full stats statMap, along with the keys of
+// prevMap missing in statMap listed under REMOVED_KEYS - at every level of
+// nesting, as populateFilteredMap does - and whether there are any. As the
+// reconstruction merges the full stats into the previous stats as well,
+// the full stats written in place of the deduplicated stats, e.g. the
+// snapshots, need them for the removed keys to stay removed. statMap is
+// not modified.
+func withRemovedKeys(prevMap, statMap map[string]interface{}) (map[string]interface{}, bool) {
+	out := make(map[string]interface{}, len(statMap)+1)
+	var hasRemoved bool
+	for k, v := range statMap {
+		out[k] = v
+
+		currM, isMap := v.(map[string]interface{})
+		prevM, prevIsMap := prevMap[k].(map[string]interface{})
+		if isMap && prevIsMap {
+			var nestedRemoved bool
+			out[k], nestedRemoved = withRemovedKeys(prevM, currM)
+			hasRemoved = hasRemoved || nestedRemoved
+		}
+	}
+
+	var removed []string
+	for k := range prevMap {
+		if _, ok := statMap[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	if len(removed) != 0 {
+		sort.Strings(removed)
+		out[REMOVED_KEYS] = removed
+		hasRemoved = true
+	}
+
+	return out, hasRemoved
+}
+
+// nextBaseline returns the stats the next stats are to be deduplicated
+// against, once currMap is deduplicated against prevMap with epsilon: the
+// stats of currMap, except those deduplicated as equal within epsilon,
+// which keep their values of prevMap - the values last logged, as
+// reconstructed. So a float64 stat drifting by at most epsilon per write
+// gets logged once it differs from its logged value by more than epsilon.
+// The stats are copied, as by copyStatMap.
+func nextBaseline(prevMap, currMap map[string]interface{}, epsilon float64) map[string]interface{} {
+	out := make(map[string]interface{}, len(currMap))
+	for k, v := range currMap {
+		prev, ok := prevMap[k]
+		if !ok {
+			out[k] = copyStatValue(v)
+			continue
+		}
+
+		currM, isMap := v.(map[string]interface{})
+		prevM, prevIsMap := prev.(map[string]interface{})
+		if isMap && prevIsMap {
+			out[k] = nextBaseline(prevM, currM, epsilon)
+		} else if equalValues(v, prev, epsilon) {
+			out[k] = copyStatValue(prev)
+		} else {
+			out[k] = copyStatValue(v)
+		}
+	}
+	return out
+}
+
+// copyStatMap returns a deep copy of statMap, copying the nested maps and
+// arrays traversed by the deduplication. The other values are copied as
+// they are.
+func copyStatMap(statMap map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(statMap))
+	for k, v := range statMap {
+		out[k] = copyStatValue(v)
+	}
+	return out
+}
+
+func copyStatValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return copyStatMap(val)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, elem := range val {
+			out[i] = copyStatValue(elem)
+		}
+		return out
+	}
+
+	return v
+}
+
+// equalValues compares the values of the types supported for the
+// deduplication.
+func equalValues(v, prev interface{}, epsilon float64) bool {
+	switch val := v.(type) {
+	case int64:
+		return equalInt64(v, prev)
+	case uint64:
+		return equalUint64(v, prev)
+	case bool:
+		return equalBool(v, prev)
+	case float64:
+		return equalFloat64(v, prev, epsilon)
+	case string:
+		return equalStrings(v, prev)
+	case json.Number:
+		return equalNumbers(v, prev, epsilon)
+	case Timestamp:
+		return equalTime(v, prev)
+	case []interface{}:
+		return equalSlices(val, prev, epsilon)
+	case map[string]interface{}:
+		return equalMaps(val, prev, epsilon)
+	}
+
+	return false
+}
+
+func equalSlices(v []interface{}, prev interface{}, epsilon float64) bool {
+	prevslice, ok := prev.([]interface{})
+	if !ok {
+		return false
+	}
+
+	if len(v) != len(prevslice) {
+		return false
+	}
+
+	for i := range v {
+		if !equalValues(v[i], prevslice[i], epsilon) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalMaps(v map[string]interface{}, prev interface{}, epsilon float64) bool {
+	prevmap, ok := prev.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	if len(v) != len(prevmap) {
+		return false
+	}
+
+	for k, val := range v {
+		prevval, ok := prevmap[k]
+		if !ok || !equalValues(val, prevval, epsilon) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func equalInt64(v, prev interface{}) bool {
+	if _, ok := prev.(json.Number); ok {
+		return equalNumbers(v, prev, 0)
+	}
+
 	var vint, prevint int64
 	var ok bool
 
@@ -311,6 +1027,10 @@ func equalInt64(v, prev interface{}) bool {
 }
 
 func equalUint64(v, prev interface{}) bool {
+	if _, ok := prev.(json.Number); ok {
+		return equalNumbers(v, prev, 0)
+	}
+
 	var vint, prevint uint64
 	var ok bool
 
@@ -327,6 +1047,84 @@ func equalUint64(v, prev interface{}) bool {
 	return vint == prevint
 }
 
+func equalFloat64(v, prev interface{}, epsilon float64) bool {
+	if _, ok := prev.(json.Number); ok {
+		return equalNumbers(v, prev, epsilon)
+	}
+
+	var vfloat, prevfloat float64
+	var ok bool
+
+	vfloat, ok = v.(float64)
+	if !ok {
+		return false
+	}
+
+	prevfloat, ok = prev.(float64)
+	if !ok {
+		return false
+	}
+
+	return math.Abs(vfloat-prevfloat) <= epsilon
+}
+
+// equalNumbers compares the numbers v and prev, either of which can be a
+// json.Number - e.g. read back from a log file - and the other an int64,
+// a uint64 or a float64. The integers are compared exactly, the rest as
+// float64 with the tolerance epsilon.
+func equalNumbers(v, prev interface{}, epsilon float64) bool {
+	vnum, ok := toJSONNumber(v)
+	if !ok {
+		return false
+	}
+
+	prevnum, ok := toJSONNumber(prev)
+	if !ok {
+		return false
+	}
+
+	if vnum == prevnum {
+		return true
+	}
+
+	vint, verr := vnum.Int64()
+	prevint, preverr := prevnum.Int64()
+	if verr == nil && preverr == nil {
+		return vint == prevint
+	}
+
+	vuint, verr := strconv.ParseUint(string(vnum), 10, 64)
+	prevuint, preverr := strconv.ParseUint(string(prevnum), 10, 64)
+	if verr == nil && preverr == nil {
+		return vuint == prevuint
+	}
+
+	vfloat, verr := vnum.Float64()
+	prevfloat, preverr := prevnum.Float64()
+	if verr != nil || preverr != nil {
+		return false
+	}
+
+	return math.Abs(vfloat-prevfloat) <= epsilon
+}
+
+// toJSONNumber converts the numbers of the types supported for the
+// deduplication to json.Number.
+func toJSONNumber(v interface{}) (json.Number, bool) {
+	switch val := v.(type) {
+	case json.Number:
+		return val, true
+	case int64:
+		return json.Number(strconv.FormatInt(val, 10)), true
+	case uint64:
+		return json.Number(strconv.FormatUint(val, 10)), true
+	case float64:
+		return json.Number(strconv.FormatFloat(val, 'g', -1, 64)), true
+	}
+
+	return "", false
+}
+
 func equalBool(v, prev interface{}) bool {
 	var vbool, prevbool bool
 	var ok bool
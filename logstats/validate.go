@@ -0,0 +1,213 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// ValidateOpts configures ValidateStatFile.
+type ValidateOpts struct {
+	// TSFormat is the time layout of the timestamps, matching WithTSFormat.
+	// Empty means DEFAULT_TS_FORMAT.
+	TSFormat string
+
+	// Encoding of the stats, matching the Encoder of the LogStats object
+	// which wrote them. Nil means JSONEncoding.
+	Encoding Encoding
+
+	// PrefixFields is the number of fields between the timestamp and the
+	// stat type, matching WithLinePrefix.
+	PrefixFields int
+
+	// Monotonic checks that the timestamps never go back, i.e. that the
+	// stats were not written with WriteAt out of order.
+	Monotonic bool
+
+	// Reconstructable checks that the deduplicated stats can be
+	// reconstructed, i.e. that the keys listed as removed were present in
+	// the previous stats of their type.
+	Reconstructable bool
+}
+
+// ValidateStatFile checks the structural integrity of the log file read
+// from r - e.g. in the tests of the tools producing it - compressed or not:
+// each line must be "<timestamp> <type> <stats>", or a JSON Lines object,
+// with a valid timestamp and valid stats. Returns the malformed lines along
+// with the reasons, in the order of the lines, and the error reading r, if
+// any. A trailing line without a new line, e.g. left behind by a crash, is
+// reported as malformed.
+func ValidateStatFile(r io.Reader, opts ValidateOpts) ([]LineError, error) {
+	var reader = bufio.NewReader(r)
+	if compression := detectCompression(reader); compression != CompressionNone {
+		decompressor, err := newDecompressReader(reader, compression, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decompressor.Close()
+
+		if compression == CompressionGzip {
+			// The compressed current log file is yet to be completed.
+			decompressor = truncatedGzipReader{decompressor}
+		}
+
+		reader = bufio.NewReader(decompressor)
+	}
+
+	v := &statValidator{
+		opts:          opts,
+		keyToStatsMap: make(map[string]interface{}),
+	}
+	if v.opts.TSFormat == "" {
+		v.opts.TSFormat = DEFAULT_TS_FORMAT
+	}
+	if v.opts.Encoding == nil {
+		v.opts.Encoding = JSONEncoding{}
+	}
+
+	var lineErrs []LineError
+	for num := 1; ; num++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			return lineErrs, nil
+		}
+
+		if err != nil && err != io.EOF {
+			return lineErrs, err
+		}
+
+		var reason string
+		if err == io.EOF {
+			reason = "not terminated by a new line"
+		} else {
+			reason = v.validate(line[:len(line)-1])
+		}
+
+		if reason != "" {
+			lineErrs = append(lineErrs, LineError{Line: num, Reason: reason})
+		}
+
+		if err == io.EOF {
+			return lineErrs, nil
+		}
+	}
+}
+
+// statValidator validates the stat lines of a log file, in order.
+type statValidator struct {
+	opts          ValidateOpts
+	prevTS        time.Time
+	keyToStatsMap map[string]interface{}
+}
+
+// validate returns the reason the stat line is malformed, or "" if it is
+// well-formed.
+func (v *statValidator) validate(line []byte) string {
+	if !isJSONLine(line) && !isValidStatLine(line) {
+		return "not a stat line"
+	}
+
+	tsStr, statType, data, err := splitStatLine(line, v.opts.PrefixFields)
+	if err != nil {
+		return err.Error()
+	}
+
+	ts, err := time.Parse(v.opts.TSFormat, tsStr)
+	if err != nil {
+		return fmt.Sprintf("invalid timestamp - %v", err)
+	}
+
+	if v.opts.Monotonic && ts.Before(v.prevTS) {
+		return fmt.Sprintf("timestamp %v before the previous one %v", tsStr,
+			v.prevTS.Format(v.opts.TSFormat))
+	}
+	v.prevTS = ts
+
+	if bytes.HasPrefix(data, []byte("[")) {
+		// An array written by WriteValue, not a stat map.
+		if !json.Valid(data) {
+			return "invalid JSON array"
+		}
+		return ""
+	}
+
+	stat, err := v.opts.Encoding.Decode(data)
+	if err != nil {
+		return fmt.Sprintf("invalid stats - %v", err)
+	}
+
+	if !v.opts.Reconstructable {
+		return ""
+	}
+
+	var prev map[string]interface{}
+	if prevStat, ok := v.keyToStatsMap[statType]; ok {
+		prev = prevStat.(map[string]interface{})
+	}
+
+	reason := checkRemovedKeys(prev, stat)
+	if reason != "" {
+		return reason
+	}
+
+	reconstructStatMap(v.keyToStatsMap, statType, stat)
+	return ""
+}
+
+// checkRemovedKeys returns the reason the keys listed as removed in stat
+// cannot be dropped from the previous stats prev - nil if none - or ""
+// if they can. The nested maps are checked as well.
+func checkRemovedKeys(prev, stat map[string]interface{}) string {
+	if removed, ok := stat[REMOVED_KEYS]; ok {
+		keys, ok := removed.([]interface{})
+		if !ok {
+			return fmt.Sprintf("malformed %v %v", REMOVED_KEYS, removed)
+		}
+
+		for _, key := range keys {
+			k, ok := key.(string)
+			if !ok {
+				return fmt.Sprintf("malformed %v %v", REMOVED_KEYS, removed)
+			}
+
+			if _, ok := prev[k]; !ok {
+				return fmt.Sprintf("removed key %v missing in the previous stats", k)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(stat))
+	for k := range stat {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		nested, ok := stat[k].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		prevNested, _ := prev[k].(map[string]interface{})
+		reason := checkRemovedKeys(prevNested, nested)
+		if reason != "" {
+			return fmt.Sprintf("%v: %v", k, reason)
+		}
+	}
+
+	return ""
+}
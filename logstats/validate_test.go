@@ -0,0 +1,120 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateStatFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "logstats_validate")
+	if err != nil {
+		t.Fatalf("TestValidateStatFile failed with error %v", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	// A log file written by a deduplicating logger is valid.
+	fileName := filepath.Join(tmpDir, "validate.log")
+	statLogger, err := New(fileName, WithDedupe(true))
+	if err != nil {
+		t.Fatalf("TestValidateStatFile failed with error %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		stat := getSimpleStat(i % 3)
+		if i%4 == 0 {
+			delete(stat, "k3")
+		}
+
+		err = statLogger.Write("kStats", stat)
+		if err != nil {
+			t.Fatalf("TestValidateStatFile failed with error %v", err)
+		}
+	}
+
+	err = statLogger.WriteValue("vStats", []int{1, 2})
+	if err != nil {
+		t.Fatalf("TestValidateStatFile failed with error %v", err)
+	}
+
+	err = statLogger.Close()
+	if err != nil {
+		t.Fatalf("TestValidateStatFile failed with error %v", err)
+	}
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("TestValidateStatFile failed with error %v", err)
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(data)
+	zw.Close()
+
+	opts := ValidateOpts{Monotonic: true, Reconstructable: true}
+	for _, source := range [][]byte{data, compressed.Bytes()} {
+		lineErrs, err := ValidateStatFile(bytes.NewReader(source), opts)
+		if err != nil || len(lineErrs) != 0 {
+			t.Fatalf("TestValidateStatFile failed: unexpected errors %v %v", err, lineErrs)
+		}
+	}
+
+	// The malformed lines are reported, with their line numbers.
+	lines := []string{
+		`2024-01-31T23:59:59.000+00:00 kStats {"k1":10,"k2":{"k21":1}}`,
+		`malformed line`,
+		`2024-01-31T23:59:59 kStats {"k1":10}`,
+		`2024-01-31T23:59:59.000+00:00 kStats {"k1":`,
+		`2024-01-31T23:59:58.000+00:00 kStats {"k1":11}`,
+		`2024-01-31T23:59:59.000+00:00 kStats {"k2":{"__removed__":["k22"]}}`,
+		`2024-01-31T23:59:59.000+00:00 lStats {"__removed__":["k1"]}`,
+		`2024-01-31T23:59:59.000+00:00 kStats {"k1":12}`,
+	}
+	source := strings.Join(lines, "\n")
+
+	exp := map[int]string{
+		2: "not a stat line",
+		3: "invalid timestamp",
+		4: "invalid stats",
+		5: "before the previous one",
+		6: "k2: removed key k22 missing in the previous stats",
+		7: "removed key k1 missing in the previous stats",
+		8: "not terminated by a new line",
+	}
+
+	lineErrs, err := ValidateStatFile(strings.NewReader(source), opts)
+	if err != nil {
+		t.Fatalf("TestValidateStatFile failed with error %v", err)
+	}
+
+	if len(lineErrs) != len(exp) {
+		t.Fatalf("TestValidateStatFile failed: exp %v errors actual %v", len(exp), lineErrs)
+	}
+
+	for _, lineErr := range lineErrs {
+		if !strings.Contains(lineErr.Reason, exp[lineErr.Line]) {
+			t.Fatalf("TestValidateStatFile failed: exp %v actual %v", exp[lineErr.Line], lineErr)
+		}
+	}
+
+	// The optional checks are skipped by default.
+	lineErrs, err = ValidateStatFile(strings.NewReader(source), ValidateOpts{})
+	if err != nil || len(lineErrs) != len(exp)-3 {
+		t.Fatalf("TestValidateStatFile failed: unexpected errors %v %v", err, lineErrs)
+	}
+}
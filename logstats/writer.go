@@ -0,0 +1,48 @@
+/*
+Copyright 2020-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package logstats
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// statWriter is the io.Writer returned by AsWriter, writing each message
+// as a log message of type statType.
+type statWriter struct {
+	ls       LogStats
+	statType string
+}
+
+// Write writes the message p - e.g. a log line of a log.Logger - as a
+// single log message. The surrounding white space is trimmed. A JSON
+// object, e.g. from a slog.JSONHandler, is written as-is by WriteRaw, and
+// any other message as a JSON string by WriteValue. Empty messages are
+// dropped.
+func (w *statWriter) Write(p []byte) (int, error) {
+	msg := bytes.TrimSpace(p)
+	if len(msg) == 0 {
+		return len(p), nil
+	}
+
+	var err error
+	if msg[0] == '{' && json.Valid(msg) && bytes.IndexByte(msg, '\n') < 0 {
+		err = w.ls.WriteRaw(w.statType, msg)
+	} else {
+		err = w.ls.WriteValue(w.statType, string(msg))
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 
 	"github.com/couchbase/logstats/logstats"
@@ -12,6 +16,12 @@ import (
 
 func main() {
 	var sourceStatPath = flag.String("reconstruct-stat-file", "", "absolute/relative path to the source stat file")
+	var gzipOutput = flag.Bool("gzip-output", false, "gzip compress the reconstructed stat file")
+	var workers = flag.Int("workers", runtime.NumCPU(), "number of goroutines reconstructing the stats")
+	var compact = flag.Bool("compact", false, "deduplicate the reconstructed stats again")
+	var bufferSize = flag.Int("buffer-size", 10_000, "number of lines buffered at each stage of the reconstruction")
+	var types = flag.String("types", "", "comma separated stat types to reconstruct, leaving out the others")
+	var snapshotEvery = flag.Int("snapshot-every", 0, "with -compact, write the full stats of a type once every n stats of that type, 0 for only the first")
 	flag.Parse()
 	if sourceStatPath == nil || len(*sourceStatPath) == 0 {
 		panic("invalid value of parameter `file_path`. please retry with a valid value")
@@ -30,19 +40,102 @@ func main() {
 	defer sourceFile.Close()
 
 	var dir, fileName = filepath.Split(*sourceStatPath)
+	// compressed input is detected by ReconstructStatFile, only the
+	// suffix needs to be dropped here
+	for _, suffix := range []string{".gz", ".zst"} {
+		fileName, _ = strings.CutSuffix(fileName, suffix)
+	}
 	fileName, _ = strings.CutSuffix(fileName, filepath.Ext(fileName))
 	var outputPath = filepath.Join(dir, fileName+"_duped.log")
+	if *compact {
+		outputPath = filepath.Join(dir, fileName+"_compacted.log")
+	}
+	if *gzipOutput {
+		outputPath += ".gz"
+	}
 	var outputFile *os.File
-	outputFile, err = os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	outputFile, err = os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
 	if err != nil {
 		panic(fmt.Sprintf("Unable to create dest file at %v with err %v", outputPath, err))
 	}
 	defer outputFile.Close()
 
-	err = logstats.ReconstructStatFile(sourceFile, outputFile)
-	if err != nil {
+	var output io.Writer = outputFile
+	var gzipWriter *gzip.Writer
+	if *gzipOutput {
+		gzipWriter = gzip.NewWriter(outputFile)
+		output = gzipWriter
+	}
+
+	var progress = &progressWriter{w: output}
+	output = progress
+
+	var opts = logstats.ReconstructOptions{Workers: *workers, BufferSize: *bufferSize}
+	if len(*types) != 0 {
+		opts.Types = strings.Split(*types, ",")
+	}
+	if *compact {
+		opts.Compact = &logstats.CompactPolicy{SnapshotEvery: *snapshotEvery}
+	}
+
+	var reconstructErr *logstats.ReconstructError
+	err = logstats.ReconstructStatFileWithOptions(sourceFile, output, opts)
+	if errors.As(err, &reconstructErr) {
+		// the lines which could not be reconstructed are passed through
+		for _, lineErr := range reconstructErr.Errors {
+			fmt.Fprintf(os.Stderr, "failed to reconstruct %v\n", lineErr)
+		}
+	} else if err != nil {
 		panic(err)
 	}
 
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			panic(fmt.Sprintf("Unable to compress dest file at %v with err %v", outputPath, err))
+		}
+	}
+
+	fmt.Printf("total lines parsed - %v\n", progress.lines)
 	fmt.Printf("Stats file reconstructed and saved at %v\n", outputPath)
+	if reconstructErr != nil {
+		os.Exit(1)
+	}
+}
+
+// progressWriter counts the reconstructed lines written to w, printing the
+// progress every 10,000 lines over the previous progress line.
+type progressWriter struct {
+	w     io.Writer
+	lines int
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	n, err := p.w.Write(data)
+	for _, b := range data[:n] {
+		if b != '\n' {
+			continue
+		}
+
+		p.lines++
+		if p.lines%10_000 == 0 {
+			if p.lines != 10_000 {
+				// deletes previous line
+				fmt.Printf("\033[1A\033[K")
+			}
+			fmt.Printf("%v stat lines parsed\n", p.lines)
+		}
+	}
+
+	return n, err
+}
+
+// Sync syncs w, if it can be, for the reconstruction to sync the output
+// file periodically.
+func (p *progressWriter) Sync() error {
+	if syncer, ok := p.w.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+
+	return nil
 }